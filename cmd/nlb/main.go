@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -18,6 +19,7 @@ import (
 	"github.com/arunsoman/GhostPlane/pkg/ebpf"
 	"github.com/arunsoman/GhostPlane/pkg/proxy"
 	"github.com/arunsoman/GhostPlane/pkg/telemetry"
+	"github.com/arunsoman/GhostPlane/pkg/upgrade"
 )
 
 var (
@@ -87,9 +89,47 @@ func run(args []string, lookupEnv func(string) (string, bool), baseCtx context.C
 	if err != nil {
 		return fmt.Errorf("failed to create proxy: %v", err)
 	}
+	if err := p.SetForwarding(proxy.ForwardingConfig{
+		TrustedProxies: cfg.TrustedProxies,
+		HeaderPolicy:   cfg.ForwardedHeaders,
+		SetForwarded:   cfg.SetForwarded,
+	}); err != nil {
+		return fmt.Errorf("invalid forwarding config: %v", err)
+	}
+	if err := p.SetProxyProtocol(proxy.ProxyProtocolConfig{
+		Enabled:        cfg.ProxyProtocol,
+		TrustedSources: cfg.ProxyProtocolSources,
+	}); err != nil {
+		return fmt.Errorf("invalid proxy protocol config: %v", err)
+	}
+	if err := p.SetRequestID(proxy.RequestIDConfig{
+		Header: cfg.RequestIDHeader,
+		Format: cfg.RequestIDFormat,
+	}); err != nil {
+		return fmt.Errorf("invalid request id config: %v", err)
+	}
+	p.SetZone(cfg.Zone)
+	if err := p.SetTLS(proxy.TLSConfig{
+		CertFile:  cfg.TLSCertFile,
+		KeyFile:   cfg.TLSKeyFile,
+		HTTP3:     cfg.HTTP3,
+		HTTP3Addr: cfg.HTTP3Addr,
+	}); err != nil {
+		return fmt.Errorf("invalid tls config: %v", err)
+	}
+
+	// Listeners are inherited from the previous process after an upgrade
+	upgrader := upgrade.New()
+	if upgrader.Inherited() {
+		log.Println("🔁 Taking over listeners from the previous process")
+	}
+	p.SetPacketListener(func(network, addr string) (net.PacketConn, error) {
+		return upgrader.ListenPacket("http3", network, addr)
+	})
 
 	// Initialize eBPF Loader (if running as root/with required caps)
 	var loader *ebpf.Loader
+	handedOff := false
 	if os.Geteuid() == 0 {
 		log.Println("⚡ Initializing eBPF/XDP data plane on eth0")
 		loader = ebpf.NewLoader("eth0", []string{"10.0.1.10", "10.0.1.11"}, []uint16{80, 443})
@@ -97,7 +137,14 @@ func run(args []string, lookupEnv func(string) (string, bool), baseCtx context.C
 			log.Printf("⚠️  Failed to load eBPF (continuing without XDP): %v", err)
 			loader = nil // Fallback
 		} else {
-			defer loader.Close()
+			// After a handoff the successor owns the attached program
+			defer func() {
+				if handedOff {
+					loader.Release()
+				} else {
+					loader.Close()
+				}
+			}()
 		}
 	} else {
 		log.Println("ℹ️  Not running as root, skipping eBPF initialization")
@@ -109,17 +156,34 @@ func run(args []string, lookupEnv func(string) (string, bool), baseCtx context.C
 		log.Fatalf("failed to initialize API server: %v", err)
 	}
 
+	// L4 sockets are handed over too; restored proxies pick them up before Ready
+	apiServer.SetL4Listeners(func(network, addr string) (net.Listener, error) {
+		return upgrader.Listen("l4-"+network+"/"+addr, network, addr)
+	}, func(network, addr string) (net.PacketConn, error) {
+		return upgrader.ListenPacket("l4-"+network+"/"+addr, network, addr)
+	})
+
 	// Restore persisted routes
 	if err := apiServer.InitializeRoutes(); err != nil {
 		log.Printf("⚠️  Failed to restore routes: %v", err)
 	}
 
+	proxyLn, err := upgrader.Listen("proxy", "tcp", cfg.ProxyAddr)
+	if err != nil {
+		return fmt.Errorf("proxy failed: %v", err)
+	}
+	adminLn, err := upgrader.Listen("admin", "tcp", cfg.AdminAddr)
+	if err != nil {
+		proxyLn.Close()
+		return fmt.Errorf("API server failed: %v", err)
+	}
+
 	errCh := make(chan error, 2)
 
 	// Start proxy in background
 	go func() {
 		log.Printf("🚀 Starting L7 Proxy on %s", cfg.ProxyAddr)
-		if err := p.Start(cfg.ProxyAddr); err != nil && err != http.ErrServerClosed {
+		if err := p.Serve(proxyLn); err != nil && err != http.ErrServerClosed {
 			errCh <- fmt.Errorf("proxy failed: %v", err)
 		}
 	}()
@@ -127,16 +191,27 @@ func run(args []string, lookupEnv func(string) (string, bool), baseCtx context.C
 	// Initialize and start Management API with auth
 	go func() {
 		log.Printf("🌐 Starting Management API on %s", cfg.AdminAddr)
-		if err := apiServer.Start(cfg.AdminAddr); err != nil && err != http.ErrServerClosed {
+		if err := apiServer.Serve(adminLn); err != nil && err != http.ErrServerClosed {
 			errCh <- fmt.Errorf("API server failed: %v", err)
 		}
 	}()
 
-	// Wait for shutdown signal or error
-	select {
-	case <-ctx.Done():
-		log.Println("🛑 Shutting down gracefully...")
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	// Let a predecessor drain and exit now that we are serving
+	if err := upgrader.Ready(); err != nil {
+		log.Printf("⚠️  Failed to signal readiness to the previous process: %v", err)
+	}
+
+	// SIGUSR2 or SIGHUP re-executes the binary with our listeners
+	upgradeCh := make(chan os.Signal, 1)
+	signal.Notify(upgradeCh, syscall.SIGUSR2, syscall.SIGHUP)
+	defer signal.Stop(upgradeCh)
+
+	drainTimeout := time.Duration(cfg.DrainTimeoutMS) * time.Millisecond
+	if drainTimeout <= 0 {
+		drainTimeout = 10 * time.Second
+	}
+	drain := func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
 		defer cancel()
 
 		if err := p.Shutdown(shutdownCtx); err != nil {
@@ -145,9 +220,29 @@ func run(args []string, lookupEnv func(string) (string, bool), baseCtx context.C
 		if err := apiServer.Shutdown(shutdownCtx); err != nil {
 			log.Printf("API server shutdown error: %v", err)
 		}
-		return nil
-	case err := <-errCh:
-		return err
+	}
+
+	// Wait for shutdown signal, upgrade or error
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("🛑 Shutting down gracefully...")
+			drain()
+			return nil
+		case <-upgradeCh:
+			log.Println("🔁 Upgrading: starting a new process with our listeners")
+			child, err := upgrader.Upgrade()
+			if err != nil {
+				log.Printf("⚠️  Upgrade failed, continuing to serve: %v", err)
+				continue
+			}
+			log.Printf("✅ Process %d is serving, draining connections", child.Pid)
+			handedOff = true
+			drain()
+			return nil
+		case err := <-errCh:
+			return err
+		}
 	}
 }
 
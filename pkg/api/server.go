@@ -2,8 +2,10 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"sync" // Added for sync.Mutex
@@ -14,6 +16,7 @@ import (
 	"github.com/arunsoman/GhostPlane/pkg/config"
 	"github.com/arunsoman/GhostPlane/pkg/db"
 	"github.com/arunsoman/GhostPlane/pkg/ebpf"
+	"github.com/arunsoman/GhostPlane/pkg/l4"
 	"github.com/arunsoman/GhostPlane/pkg/proxy"
 	"github.com/arunsoman/GhostPlane/pkg/setup"
 	"github.com/arunsoman/GhostPlane/pkg/templates" // Added for templates
@@ -25,10 +28,12 @@ type Server struct {
 	authService *auth.AuthService
 	proxy       *proxy.Proxy
 	ebpfLoader  *ebpf.Loader
+	l4          *l4.Manager
 	templates   *templates.Repository // Added
 	renderer    *templates.Renderer   // Added
 	mu          sync.Mutex            // Added
 	store       *db.Store
+	pluginsMu   sync.Mutex // Serializes plugin changes with their persisted copy
 	// Stream channels
 	metricsTicker  *time.Ticker
 	DeploymentChan chan templates.Deployment // Added for SSE broadcasting
@@ -50,6 +55,7 @@ func NewServer(cfg *config.Config, authSvc *auth.AuthService, p *proxy.Proxy, el
 		authService:    authSvc,
 		proxy:          p,
 		ebpfLoader:     el,
+		l4:             l4.NewManager(),
 		templates:      repo,
 		renderer:       renderer,
 		store:          s,
@@ -59,6 +65,15 @@ func NewServer(cfg *config.Config, authSvc *auth.AuthService, p *proxy.Proxy, el
 
 // Start starts the API server
 func (s *Server) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve runs the API on an existing listener, such as one inherited across an upgrade
+func (s *Server) Serve(ln net.Listener) error {
 	mux := http.NewServeMux()
 
 	// Public endpoints (no auth required)
@@ -66,23 +81,35 @@ func (s *Server) Start(addr string) error {
 	mux.HandleFunc("/health", s.handleHealth)
 	mux.HandleFunc("/api/v1/setup/check", s.handleSetupCheck)
 	mux.HandleFunc("/api/v1/stream", s.handleStream) // SSE endpoint
+	mux.Handle("/metrics", s.metricsAuth(http.HandlerFunc(s.handlePrometheus)))
 
 	// Protected endpoints (auth required)
 	protectedMux := http.NewServeMux()
 	protectedMux.HandleFunc("/api/v1/config", s.handleConfig)
 	protectedMux.HandleFunc("/api/v1/metrics", s.handleMetrics)
 	protectedMux.HandleFunc("/api/v1/migrate", s.handleMigrate)
+	protectedMux.HandleFunc("/api/v1/ip-filters", s.handleIPFilters)
+	protectedMux.HandleFunc("/api/v1/backends/health", s.handleBackendHealth)
+	protectedMux.HandleFunc("/api/v1/backends/drain", s.handleBackendDrain)
+	protectedMux.HandleFunc("/api/v1/traffic-splits", s.handleTrafficSplits)
+	protectedMux.HandleFunc("/api/v1/concurrency", s.handleConcurrency)
+	protectedMux.HandleFunc("/api/v1/upstreams", s.handleUpstreams)
+	protectedMux.HandleFunc("/api/v1/filters", s.handleFilters)
+	protectedMux.HandleFunc("/api/v1/plugins", s.handlePlugins)
+	protectedMux.HandleFunc("/api/v1/l4", s.handleL4)
 	protectedMux.HandleFunc("/api/v1/ebpf/stats", s.handleEBPFStats)
 	protectedMux.HandleFunc("/api/v1/ebpf/config", s.handleEBPFConfig)
 	protectedMux.HandleFunc("/api/v1/change-password", s.authService.HandleChangePassword)
 	protectedMux.HandleFunc("/api/v1/setup/initialize", s.handleSetupInitialize)
 
 	// Template Gallery Routes
-	tmplHandler := templates.NewHandler(s.templates, s.renderer, templates.NewSimulator(), s.proxy, s.ebpfLoader, s.store, s.DeploymentChan)
+	tmplHandler := templates.NewHandler(s.templates, s.renderer, templates.NewSimulator(), s.proxy, s.ebpfLoader, s.l4, s.store, s.DeploymentChan)
 	fmt.Println("DEBUG: Registering Template Routes...")
 	protectedMux.HandleFunc("/api/v1/templates", tmplHandler.ListTemplates)
 	fmt.Println("DEBUG: Registering /api/v1/deployments/active")
 	protectedMux.HandleFunc("/api/v1/deployments/active", tmplHandler.GetActiveDeployment)
+	protectedMux.HandleFunc("/api/v1/rollouts", tmplHandler.HandleRollouts)
+	protectedMux.HandleFunc("/api/v1/blue-green", tmplHandler.HandleBlueGreen)
 	protectedMux.HandleFunc("/api/v1/templates/", func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, "/deploy") {
 			tmplHandler.DeployTemplate(w, r)
@@ -97,23 +124,32 @@ func (s *Server) Start(addr string) error {
 	mux.Handle("/api/v1/", s.authService.Middleware(protectedMux))
 
 	s.server = &http.Server{
-		Addr:         addr,
+		Addr:         ln.Addr().String(),
 		Handler:      mux,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 	}
 
-	return s.server.ListenAndServe()
+	return s.server.Serve(ln)
 }
 
-// Shutdown gracefully shuts down the API server
+// Shutdown gracefully shuts down the API server, letting L4 flows finish
 func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.l4.Shutdown(ctx); err != nil {
+		fmt.Printf("⚠️ L4 shutdown: %v\n", err)
+	}
 	if s.server != nil {
 		return s.server.Shutdown(ctx)
 	}
 	return nil
 }
 
+// SetL4Listeners overrides how user-space L4 proxies open their sockets, so
+// an upgrade can hand them to the next process
+func (s *Server) SetL4Listeners(listen func(network, addr string) (net.Listener, error), listenPacket func(network, addr string) (net.PacketConn, error)) {
+	s.l4.SetListeners(listen, listenPacket)
+}
+
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -166,10 +202,222 @@ func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"total_requests":     totalRequests,
 		"active_connections": activeConns,
+		"denied_requests":    atomic.LoadUint64(&s.proxy.DeniedRequests),
+		"shed_requests":      atomic.LoadUint64(&s.proxy.ShedRequests),
+		"dropped_logs":       atomic.LoadUint64(&s.proxy.DroppedLogs),
+		"protocols":          s.proxy.GetProtocolStats(),
 		"system_health":      "optimal",
 		"timestamp":          time.Now().Unix(),
 	})
 }
+
+// metricsAuth admits scrapers presenting the configured metrics token and
+// sends everyone else through the API's login check
+func (s *Server) metricsAuth(next http.Handler) http.Handler {
+	var token string
+	if s.config != nil {
+		token = s.config.MetricsToken
+	}
+	protected := s.authService.Middleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		protected.ServeHTTP(w, r)
+	})
+}
+
+// handlePrometheus serves proxy, user-space L4 and XDP metrics in the Prometheus text format
+func (s *Server) handlePrometheus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.proxy.WriteMetrics(w, func(m proxy.MetricsWriter) {
+		active := make(map[string]float64)
+		total := make(map[string]float64)
+		for _, st := range s.l4.Stats() {
+			listener := st.Protocol + "/" + st.Listen
+			active[listener] = float64(st.Active)
+			total[listener] = float64(st.Total)
+		}
+		m.Gauge("ghostplane_l4_active_flows", "Open connections (TCP) or sessions (UDP) per L4 listener.", "listener", active)
+		m.Counter("ghostplane_l4_flows_total", "Connections or sessions accepted per L4 listener.", "listener", total)
+
+		if s.ebpfLoader == nil {
+			return
+		}
+		stats, err := s.ebpfLoader.GetStats()
+		if err != nil {
+			return
+		}
+		m.Counter("ghostplane_xdp_processed_packets_total", "Packets seen by the XDP program.", "", map[string]float64{"": float64(stats.Processed)})
+		m.Counter("ghostplane_xdp_packets_total", "Packets by XDP verdict.", "action", map[string]float64{
+			"redirected": float64(stats.Redirected),
+			"dropped":    float64(stats.Dropped),
+			"passed":     float64(stats.Passed),
+			"aborted":    float64(stats.Aborted),
+		})
+	})
+}
+
+// handleBackendHealth reports the current state and transition history of every backend
+func (s *Server) handleBackendHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.proxy.GetBackendHealth())
+}
+
+// handleTrafficSplits reports per-split request, error and latency figures
+func (s *Server) handleTrafficSplits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.proxy.GetTrafficSplitStats())
+}
+
+// handleConcurrency reports the adaptive concurrency limit of each route
+func (s *Server) handleConcurrency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.proxy.GetConcurrencyStats())
+}
+
+// handleUpstreams reports connection pool utilisation per backend
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.proxy.GetUpstreamStats())
+}
+
+// handleL4 reports the user-space L4 proxies started for templates
+func (s *Server) handleL4(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.l4.Stats())
+}
+
+// handleFilters lists the filter names routes can place in their chain
+func (s *Server) handleFilters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proxy.RegisteredFilters())
+}
+
+// pluginUpload is a WASM plugin as uploaded and persisted; Module is base64 in JSON
+type pluginUpload struct {
+	Name   string             `json:"name"`
+	Module []byte             `json:"module"`
+	Limits proxy.PluginLimits `json:"limits,omitempty"`
+}
+
+// handlePlugins lists, loads (or hot-reloads) and removes WASM plugins
+func (s *Server) handlePlugins(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var req pluginUpload
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		s.pluginsMu.Lock()
+		defer s.pluginsMu.Unlock()
+		if err := s.proxy.LoadPlugin(req.Name, req.Module, req.Limits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.persistPlugins(func(plugins map[string]pluginUpload) { plugins[req.Name] = req })
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		s.pluginsMu.Lock()
+		defer s.pluginsMu.Unlock()
+		if err := s.proxy.RemovePlugin(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		s.persistPlugins(func(plugins map[string]pluginUpload) { delete(plugins, name) })
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(s.proxy.GetPlugins())
+}
+
+func (s *Server) loadPersistedPlugins() (map[string]pluginUpload, error) {
+	plugins := make(map[string]pluginUpload)
+	data, err := s.store.GetSetting("wasm_plugins")
+	if err != nil || data == "" {
+		return plugins, err
+	}
+	return plugins, json.Unmarshal([]byte(data), &plugins)
+}
+
+// persistPlugins applies update to the stored plugins. Caller must hold
+// pluginsMu, so concurrent changes don't overwrite each other.
+func (s *Server) persistPlugins(update func(map[string]pluginUpload)) {
+	if s.store == nil {
+		return
+	}
+	plugins, err := s.loadPersistedPlugins()
+	if err != nil {
+		fmt.Printf("⚠️ Failed to read persisted plugins: %v\n", err)
+		return
+	}
+	update(plugins)
+	data, _ := json.Marshal(plugins)
+	if err := s.store.SetSetting("wasm_plugins", string(data)); err != nil {
+		fmt.Printf("⚠️ Failed to persist plugins: %v\n", err)
+	}
+}
+
+// handleBackendDrain starts or stops draining a backend of a route
+func (s *Server) handleBackendDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Route   string `json:"route"`
+		Backend string `json:"backend"`
+		Drain   bool   `json:"drain"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := s.proxy.SetBackendDrain(req.Route, req.Backend, req.Drain); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"route": req.Route, "backend": req.Backend, "draining": req.Drain})
+}
+
 func (s *Server) handleSetupCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -237,6 +485,11 @@ func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
 			logData, _ := json.Marshal(log)
 			fmt.Fprintf(w, "event: log\ndata: %s\n\n", logData)
 			flusher.Flush()
+		case health := <-s.proxy.HealthChan:
+			// Stream backend health transition
+			data, _ := json.Marshal(health)
+			fmt.Fprintf(w, "event: health\ndata: %s\n\n", data)
+			flusher.Flush()
 		case <-metricsTicker.C:
 			// Stream aggregate metrics
 			totalRequests := atomic.LoadUint64(&s.proxy.TotalRequests)
@@ -260,6 +513,34 @@ func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
 
 // InitializeRoutes loads routes from store and applies them to proxy
 func (s *Server) InitializeRoutes() error {
+	if filter, err := s.store.GetSetting("global_ip_filter"); err == nil && filter != "" {
+		var cfg proxy.IPFilterConfig
+		if err := json.Unmarshal([]byte(filter), &cfg); err != nil {
+			return fmt.Errorf("failed to parse persisted ip filter: %v", err)
+		}
+		if err := s.proxy.SetGlobalIPFilter(&cfg); err != nil {
+			return err
+		}
+	}
+
+	// Plugins first so routes referencing them work from the first request
+	plugins, err := s.loadPersistedPlugins()
+	if err != nil {
+		return fmt.Errorf("failed to parse persisted plugins: %v", err)
+	}
+	for _, plugin := range plugins {
+		if err := s.proxy.LoadPlugin(plugin.Name, plugin.Module, plugin.Limits); err != nil {
+			return fmt.Errorf("failed to load plugin %s: %v", plugin.Name, err)
+		}
+	}
+
+	// User-space L4 proxies only run when XDP is unavailable, as on deploy
+	if s.ebpfLoader == nil {
+		if err := s.restoreL4Proxies(); err != nil {
+			return fmt.Errorf("failed to parse persisted L4 proxies: %v", err)
+		}
+	}
+
 	data, err := s.store.LoadRoutes()
 	if err != nil {
 		return err
@@ -276,6 +557,69 @@ func (s *Server) InitializeRoutes() error {
 	return s.proxy.UpdateRoutes(routes)
 }
 
+// restoreL4Proxies restarts the L4 proxies saved by template deployments. A
+// listener that cannot bind is reported without blocking the rest.
+func (s *Server) restoreL4Proxies() error {
+	data, err := s.store.GetSetting("l4_proxies")
+	if err != nil || data == "" {
+		return err
+	}
+	var configs []l4.Config
+	if err := json.Unmarshal([]byte(data), &configs); err != nil {
+		return err
+	}
+	for _, cfg := range configs {
+		if _, err := s.l4.Apply(cfg); err != nil {
+			fmt.Printf("⚠️ Failed to restore L4 %s proxy on port %d: %v\n", cfg.Protocol, cfg.ListenerPort, err)
+		}
+	}
+	return nil
+}
+
+// handleIPFilters reads or updates CIDR allow/deny lists. An empty route
+// targets the global filter; route filters are updated without a route reload.
+func (s *Server) handleIPFilters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Route string `json:"route"`
+			proxy.IPFilterConfig
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if req.Route == "" {
+			if err := s.proxy.SetGlobalIPFilter(&req.IPFilterConfig); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if s.store != nil {
+				data, _ := json.Marshal(req.IPFilterConfig)
+				if err := s.store.SetSetting("global_ip_filter", string(data)); err != nil {
+					fmt.Printf("⚠️ Failed to persist ip filter: %v\n", err)
+				}
+			}
+		} else {
+			if err := s.proxy.SetRouteIPFilter(req.Route, &req.IPFilterConfig); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if s.store != nil {
+				if err := s.store.SaveRoutes(s.proxy.GetRoutes()); err != nil {
+					fmt.Printf("⚠️ Failed to persist routes: %v\n", err)
+				}
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"filters": s.proxy.GetIPFilters(),
+	})
+}
+
 func (s *Server) handleMigrate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
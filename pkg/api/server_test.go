@@ -7,9 +7,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/arunsoman/GhostPlane/pkg/auth"
 	"github.com/arunsoman/GhostPlane/pkg/config"
 	"github.com/arunsoman/GhostPlane/pkg/db"
 	"github.com/arunsoman/GhostPlane/pkg/proxy"
@@ -43,6 +46,52 @@ func TestServer_Metrics(t *testing.T) {
 	}
 }
 
+func TestServer_Prometheus(t *testing.T) {
+	p, _ := proxy.New([]string{"http://localhost:8081"})
+	s, _ := NewServer(nil, nil, p, nil, nil, "../../templates")
+	w := httptest.NewRecorder()
+
+	s.handlePrometheus(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("Expected a text exposition, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{"# TYPE ghostplane_requests_total counter", "# TYPE ghostplane_l4_active_flows gauge"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Missing %q", want)
+		}
+	}
+	if strings.Contains(w.Body.String(), "ghostplane_xdp") {
+		t.Error("Expected no XDP metrics without a loader")
+	}
+}
+
+func TestServer_MetricsAuth(t *testing.T) {
+	p, _ := proxy.New([]string{})
+	authSvc, _ := auth.NewAuthService("secret", "admin", "password")
+	s, _ := NewServer(&config.Config{MetricsToken: "scrape"}, authSvc, p, nil, nil, "../../templates")
+	handler := s.metricsAuth(http.HandlerFunc(s.handlePrometheus))
+
+	scrape := func(authorization string) int {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := scrape(""); code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous scrapes to be refused, got %d", code)
+	}
+	if code := scrape("Bearer wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong token to be refused, got %d", code)
+	}
+	if code := scrape("Bearer scrape"); code != http.StatusOK {
+		t.Errorf("Expected the metrics token to be accepted, got %d", code)
+	}
+}
+
 func TestServer_Health(t *testing.T) {
 	s, _ := NewServer(nil, nil, nil, nil, nil, "../../templates")
 	req := httptest.NewRequest(http.MethodGet, "/health", nil)
@@ -113,3 +162,110 @@ func TestServer_Lifecycle(t *testing.T) {
 		t.Errorf("Shutdown failed: %v", err)
 	}
 }
+
+func TestServer_IPFilters(t *testing.T) {
+	p, _ := proxy.New([]string{})
+	p.UpdateRoutes([]proxy.ConfigRoute{{Path: "/admin", Targets: []string{"http://localhost:8081"}}})
+	s, _ := NewServer(nil, nil, p, nil, nil, "../../templates")
+
+	body, _ := json.Marshal(map[string]interface{}{"route": "/admin", "allow": []string{"10.0.0.0/8"}})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/ip-filters", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	s.handleIPFilters(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if routes := p.GetRoutes(); routes[0].IPFilter == nil || routes[0].IPFilter.Allow[0] != "10.0.0.0/8" {
+		t.Errorf("Expected route filter to be updated, got %+v", routes[0].IPFilter)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"deny": []string{"bogus"}})
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/ip-filters", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	s.handleIPFilters(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid CIDR, got %d", w.Code)
+	}
+}
+
+func TestServer_BackendDrain(t *testing.T) {
+	p, _ := proxy.New([]string{})
+	p.UpdateRoutes([]proxy.ConfigRoute{{Path: "/api", Targets: []string{"http://localhost:8081"}}})
+	s, _ := NewServer(nil, nil, p, nil, nil, "../../templates")
+
+	body, _ := json.Marshal(map[string]interface{}{"route": "/api", "backend": "http://localhost:8081", "drain": true})
+	w := httptest.NewRecorder()
+	s.handleBackendDrain(w, httptest.NewRequest(http.MethodPost, "/api/v1/backends/drain", bytes.NewBuffer(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if health := p.GetBackendHealth(); len(health) != 1 || !health[0].Draining {
+		t.Errorf("Expected backend to be draining, got %+v", health)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"route": "/api", "backend": "http://unknown:1", "drain": true})
+	w = httptest.NewRecorder()
+	s.handleBackendDrain(w, httptest.NewRequest(http.MethodPost, "/api/v1/backends/drain", bytes.NewBuffer(body)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown backend, got %d", w.Code)
+	}
+}
+
+func TestServer_Plugins(t *testing.T) {
+	p, _ := proxy.New([]string{})
+	s, _ := NewServer(nil, nil, p, nil, nil, "../../templates")
+
+	// Exports memory and an on_request that always continues
+	module := []byte("\x00asm\x01\x00\x00\x00" +
+		"\x01\x05\x01\x60\x00\x01\x7f" +
+		"\x03\x02\x01\x00" +
+		"\x05\x03\x01\x00\x01" +
+		"\x07\x17\x02\x06memory\x02\x00\x0aon_request\x00\x00" +
+		"\x0a\x06\x01\x04\x00\x41\x00\x0b")
+
+	body, _ := json.Marshal(map[string]interface{}{"name": "noop", "module": module, "limits": map[string]int{"timeout_ms": 20}})
+	w := httptest.NewRecorder()
+	s.handlePlugins(w, httptest.NewRequest(http.MethodPut, "/api/v1/plugins", bytes.NewBuffer(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var plugins []proxy.PluginInfo
+	json.NewDecoder(w.Body).Decode(&plugins)
+	if len(plugins) != 1 || plugins[0].Name != "noop" || plugins[0].Limits.TimeoutMS != 20 {
+		t.Errorf("Unexpected plugins %+v", plugins)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"name": "broken", "module": []byte("nope")})
+	w = httptest.NewRecorder()
+	s.handlePlugins(w, httptest.NewRequest(http.MethodPut, "/api/v1/plugins", bytes.NewBuffer(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid module, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.handlePlugins(w, httptest.NewRequest(http.MethodDelete, "/api/v1/plugins?name=noop", nil))
+	if w.Code != http.StatusOK || len(p.GetPlugins()) != 0 {
+		t.Errorf("Expected the plugin to be removed, got %d", w.Code)
+	}
+}
+
+func TestServer_RestoresL4Proxies(t *testing.T) {
+	store, err := db.NewStore(filepath.Join(t.TempDir(), "nlb.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	store.SetSetting("l4_proxies", `[{"protocol": "udp", "listen_addr": "127.0.0.1", "listener_port": 0, "targets": ["127.0.0.1:9"]}]`)
+
+	p, _ := proxy.New([]string{})
+	s, _ := NewServer(nil, nil, p, nil, store, "../../templates")
+	defer s.l4.Close()
+	if err := s.InitializeRoutes(); err != nil {
+		t.Fatalf("InitializeRoutes failed: %v", err)
+	}
+	if stats := s.l4.Stats(); len(stats) != 1 || stats[0].Protocol != "udp" {
+		t.Errorf("Expected the persisted L4 proxy to be running, got %+v", stats)
+	}
+}
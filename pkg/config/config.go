@@ -12,6 +12,32 @@ type Config struct {
 	Backends  []string `yaml:"backends" json:"backends"`
 	ProxyAddr string   `yaml:"proxy_addr" json:"proxy_addr"`
 	AdminAddr string   `yaml:"admin_addr" json:"admin_addr"`
+	// TrustedProxies lists CIDRs whose X-Forwarded-For / Forwarded headers are believed
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies,omitempty"`
+	// ForwardedHeaders is the upstream header policy: "append", "overwrite" or "preserve"
+	ForwardedHeaders string `yaml:"forwarded_headers" json:"forwarded_headers,omitempty"`
+	// SetForwarded also sends the RFC 7239 Forwarded header upstream
+	SetForwarded bool `yaml:"set_forwarded" json:"set_forwarded,omitempty"`
+	// ProxyProtocol accepts PROXY v1/v2 headers on the proxy listener from ProxyProtocolSources
+	ProxyProtocol        bool     `yaml:"proxy_protocol" json:"proxy_protocol,omitempty"`
+	ProxyProtocolSources []string `yaml:"proxy_protocol_sources" json:"proxy_protocol_sources,omitempty"`
+	// Zone is this proxy's locality; route backends labelled with it are preferred
+	Zone string `yaml:"zone" json:"zone,omitempty"`
+	// RequestIDHeader and RequestIDFormat ("uuid", "hex" or "trace") control request ID tagging
+	RequestIDHeader string `yaml:"request_id_header" json:"request_id_header,omitempty"`
+	RequestIDFormat string `yaml:"request_id_format" json:"request_id_format,omitempty"`
+	// TLSCertFile and TLSKeyFile serve the proxy over TLS (HTTP/1.1 and HTTP/2);
+	// HTTP3 adds a QUIC listener on HTTP3Addr, or the proxy port over UDP
+	TLSCertFile string `yaml:"tls_cert_file" json:"tls_cert_file,omitempty"`
+	TLSKeyFile  string `yaml:"tls_key_file" json:"tls_key_file,omitempty"`
+	HTTP3       bool   `yaml:"http3" json:"http3,omitempty"`
+	HTTP3Addr   string `yaml:"http3_addr" json:"http3_addr,omitempty"`
+	// DrainTimeoutMS bounds how long in-flight and upgraded connections may
+	// finish on shutdown or after handing the listeners to an upgraded process
+	DrainTimeoutMS int `yaml:"drain_timeout_ms" json:"drain_timeout_ms,omitempty"`
+	// MetricsToken lets scrapers read /metrics with "Authorization: Bearer <token>";
+	// without it /metrics needs a login like the rest of the API
+	MetricsToken string `yaml:"metrics_token" json:"-"`
 }
 
 func Load(path string) (*Config, error) {
@@ -34,5 +60,7 @@ func Default() *Config {
 		Backends:  []string{"http://localhost:8081", "http://localhost:8082"},
 		ProxyAddr: ":8080",
 		AdminAddr: ":8081",
+
+		DrainTimeoutMS: 10000,
 	}
 }
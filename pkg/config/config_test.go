@@ -9,6 +9,7 @@ func TestLoad(t *testing.T) {
 	content := `
 proxy_addr: ":8080"
 admin_addr: ":9090"
+set_forwarded: true
 backends:
   - "http://localhost:8081"
   - "http://localhost:8082"
@@ -37,6 +38,9 @@ backends:
 	if len(cfg.Backends) != 2 {
 		t.Errorf("Expected 2 backends, got %d", len(cfg.Backends))
 	}
+	if !cfg.SetForwarded {
+		t.Error("Expected set_forwarded to be read")
+	}
 }
 
 func TestLoad_NotFound(t *testing.T) {
@@ -3,10 +3,16 @@ package ebpf
 import (
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 
 	"github.com/cilium/ebpf/link"
 )
 
+// pinDir holds the pinned XDP links that keep the program attached while a
+// new process takes over during an upgrade
+const pinDir = "/sys/fs/bpf/ghostplane"
+
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang xdp ./programs/xdp_lb.c -- -O2 -g -Wall -Werror
 
 // Loader handles loading and attaching eBPF programs
@@ -54,6 +60,18 @@ func (l *Loader) Load() error {
 		return fmt.Errorf("getting interface %s: %w", l.iface, err)
 	}
 
+	// A predecessor left the program attached; swap ours in without detaching
+	pin := filepath.Join(pinDir, "xdp_"+l.iface)
+	if pinned, err := link.LoadPinnedLink(pin, nil); err == nil {
+		if err := pinned.Update(objs.XdpLoadBalancer); err != nil {
+			pinned.Close()
+			return fmt.Errorf("replacing pinned XDP program: %w", err)
+		}
+		l.link = pinned
+		fmt.Printf("✅ XDP program replaced in place on %s\n", l.iface)
+		return nil
+	}
+
 	link, err := link.AttachXDP(link.XDPOptions{
 		Program:   objs.XdpLoadBalancer,
 		Interface: iface.Index,
@@ -63,6 +81,14 @@ func (l *Loader) Load() error {
 	}
 	l.link = link
 
+	// Without a pin the program detaches when this process exits
+	if err := os.MkdirAll(pinDir, 0700); err == nil {
+		err = link.Pin(pin)
+	}
+	if err != nil {
+		fmt.Printf("⚠️  Could not pin XDP link, upgrades will briefly detach it: %v\n", err)
+	}
+
 	fmt.Printf("✅ XDP program attached to %s\n", l.iface)
 	return nil
 }
@@ -108,6 +134,19 @@ func (l *Loader) populateBackends() error {
 
 // Close detaches the XDP program and cleans up
 func (l *Loader) Close() error {
+	if l.link != nil {
+		l.link.Unpin()
+		l.link.Close()
+	}
+	if l.objs != nil {
+		l.objs.Close()
+	}
+	return nil
+}
+
+// Release drops this process's handles but leaves the XDP program attached
+// through its pin, for a successor to take over
+func (l *Loader) Release() error {
 	if l.link != nil {
 		l.link.Close()
 	}
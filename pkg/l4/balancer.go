@@ -0,0 +1,98 @@
+package l4
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// maglevTableSize is prime, as Maglev requires, and large enough that a
+// backend change moves roughly 1/n of flows
+const maglevTableSize = 65537
+
+// pool is an immutable snapshot of the healthy backends, swapped whenever health changes
+type pool struct {
+	backends  []*Backend
+	algorithm string
+	maglev    []int // Lookup table into backends, for the maglev algorithm
+}
+
+func newPool(backends []*Backend, algorithm string) *pool {
+	p := &pool{backends: backends, algorithm: algorithm}
+	if algorithm == Maglev {
+		names := make([]string, len(backends))
+		for i, b := range backends {
+			names[i] = b.Addr
+		}
+		p.maglev = buildMaglevTable(names, maglevTableSize)
+	}
+	return p
+}
+
+// balancer picks a backend for a flow identified by key (the client address)
+type balancer struct {
+	next atomic.Uint64
+}
+
+func (lb *balancer) pick(p *pool, key string) *Backend {
+	if len(p.backends) == 0 {
+		return nil
+	}
+	switch p.algorithm {
+	case LeastConnections:
+		best := p.backends[0]
+		for _, b := range p.backends[1:] {
+			if b.active.Load() < best.active.Load() {
+				best = b
+			}
+		}
+		return best
+	case Maglev:
+		return p.backends[p.maglev[hashKey(key, 0)%uint64(len(p.maglev))]]
+	default:
+		return p.backends[(lb.next.Add(1)-1)%uint64(len(p.backends))]
+	}
+}
+
+func hashKey(s string, seed byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{seed})
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// buildMaglevTable fills a lookup table from each backend's permutation of
+// slots, per the Maglev paper, so every backend owns an equal share and
+// removing one only remaps the flows it owned
+func buildMaglevTable(names []string, size int) []int {
+	n := len(names)
+	if n == 0 {
+		return nil
+	}
+	m := uint64(size)
+	offsets := make([]uint64, n)
+	skips := make([]uint64, n)
+	next := make([]uint64, n)
+	for i, name := range names {
+		offsets[i] = hashKey(name, 1) % m
+		skips[i] = hashKey(name, 2)%(m-1) + 1
+	}
+
+	table := make([]int, size)
+	for i := range table {
+		table[i] = -1
+	}
+	for filled := 0; ; {
+		for i := 0; i < n; i++ {
+			slot := (offsets[i] + next[i]*skips[i]) % m
+			for table[slot] >= 0 {
+				next[i]++
+				slot = (offsets[i] + next[i]*skips[i]) % m
+			}
+			table[slot] = i
+			next[i]++
+			if filled++; filled == size {
+				return table
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package l4 is a user-space TCP and UDP load balancer driven by a
+// template's l4_config. It serves L4 templates when the XDP data plane is
+// unavailable and doubles as a harness for testing them.
+package l4
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Balancing algorithms
+const (
+	RoundRobin       = "round_robin"
+	LeastConnections = "least_connections"
+	Maglev           = "maglev"
+)
+
+// Config mirrors a rendered l4_config block
+type Config struct {
+	Protocol         string   `json:"protocol"` // "tcp" or "udp"
+	ListenerPort     int      `json:"listener_port"`
+	ListenAddr       string   `json:"listen_addr,omitempty"`  // Host to bind, all interfaces by default
+	Targets          []string `json:"targets"`                // host:port
+	Algorithm        string   `json:"algorithm,omitempty"`    // "round_robin" (default), "least_connections" or "maglev"
+	HealthCheck      string   `json:"health_check,omitempty"` // "tcp_connect" or "none" (default)
+	HealthIntervalMS int      `json:"health_interval_ms,omitempty"`
+	IdleTimeoutMS    int      `json:"idle_timeout_ms,omitempty"` // Defaults to 5m for TCP and 30s for UDP
+	MaxSessions      int      `json:"max_sessions,omitempty"`    // UDP sessions tracked at once, defaults to 10000
+}
+
+// ParseConfig reads a template's l4_config map. Templates write the port as
+// a number or a string and the algorithm as "algorithm" or "algo".
+func ParseConfig(raw map[string]interface{}) (Config, error) {
+	normalized := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		normalized[k] = v
+	}
+	if algo, ok := normalized["algo"]; ok {
+		if _, set := normalized["algorithm"]; !set {
+			normalized["algorithm"] = algo
+		}
+		delete(normalized, "algo")
+	}
+	if port, ok := normalized["listener_port"].(string); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(port))
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid listener_port %q", port)
+		}
+		normalized["listener_port"] = n
+	}
+
+	data, err := json.Marshal(normalized)
+	if err != nil {
+		return Config{}, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("invalid l4_config: %w", err)
+	}
+	return cfg, cfg.validate()
+}
+
+func (c *Config) validate() error {
+	c.Protocol = strings.ToLower(c.Protocol)
+	if c.Protocol != "tcp" && c.Protocol != "udp" {
+		return fmt.Errorf("unknown protocol %q", c.Protocol)
+	}
+	if c.ListenerPort < 0 || c.ListenerPort > 65535 {
+		return fmt.Errorf("invalid listener_port %d", c.ListenerPort)
+	}
+	if len(c.Targets) == 0 {
+		return fmt.Errorf("at least one target is required")
+	}
+	for _, target := range c.Targets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return fmt.Errorf("invalid target %q: %w", target, err)
+		}
+	}
+	switch c.Algorithm {
+	case "":
+		c.Algorithm = RoundRobin
+	case RoundRobin, LeastConnections, Maglev:
+	default:
+		return fmt.Errorf("unknown algorithm %q", c.Algorithm)
+	}
+	if c.MaxSessions < 0 {
+		return fmt.Errorf("invalid max_sessions %d", c.MaxSessions)
+	}
+	switch c.HealthCheck {
+	case "", "none":
+		c.HealthCheck = "none"
+	case "tcp_connect":
+		if c.Protocol != "tcp" {
+			return fmt.Errorf("tcp_connect health checks need a tcp listener")
+		}
+	default:
+		return fmt.Errorf("unknown health_check %q", c.HealthCheck)
+	}
+	return nil
+}
+
+// sameListener reports whether c and o differ at most in targets and
+// algorithm, which a running proxy can take in place
+func (c Config) sameListener(o Config) bool {
+	c.Targets, c.Algorithm = nil, ""
+	o.Targets, o.Algorithm = nil, ""
+	return reflect.DeepEqual(c, o)
+}
+
+func (c Config) listenAddr() string {
+	return net.JoinHostPort(c.ListenAddr, strconv.Itoa(c.ListenerPort))
+}
+
+func (c Config) idleTimeout() time.Duration {
+	if c.IdleTimeoutMS > 0 {
+		return time.Duration(c.IdleTimeoutMS) * time.Millisecond
+	}
+	if c.Protocol == "udp" {
+		return 30 * time.Second
+	}
+	return 5 * time.Minute
+}
+
+func (c Config) maxSessions() int64 {
+	if c.MaxSessions > 0 {
+		return int64(c.MaxSessions)
+	}
+	return 10000
+}
+
+func (c Config) healthInterval() time.Duration {
+	if c.HealthIntervalMS > 0 {
+		return time.Duration(c.HealthIntervalMS) * time.Millisecond
+	}
+	return 5 * time.Second
+}
@@ -0,0 +1,164 @@
+package l4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Manager runs one proxy per protocol and listener port
+type Manager struct {
+	mu           sync.Mutex
+	proxies      map[string]*Proxy
+	listen       listenFunc // Guarded by mu
+	listenPacket listenPacketFunc
+}
+
+// NewManager returns an empty manager
+func NewManager() *Manager {
+	return &Manager{proxies: make(map[string]*Proxy)}
+}
+
+// SetListeners overrides how proxies open their sockets, e.g. to take over
+// ones inherited from the previous process during an upgrade
+func (m *Manager) SetListeners(listen func(network, addr string) (net.Listener, error), listenPacket func(network, addr string) (net.PacketConn, error)) {
+	m.mu.Lock()
+	m.listen, m.listenPacket = listen, listenPacket
+	m.mu.Unlock()
+}
+
+// newProxy is New with the manager's socket hooks
+func (m *Manager) newProxy(config Config) (*Proxy, error) {
+	p, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	p.listen, p.listenPacket = m.listen, m.listenPacket
+	return p, nil
+}
+
+func proxyKey(config Config) string {
+	return fmt.Sprintf("%s/%d", config.Protocol, config.ListenerPort)
+}
+
+// Apply starts a proxy for config, replacing any running on the same port.
+// A change of targets or algorithm is taken in place; anything else rebinds,
+// and the old proxy keeps serving if the new one cannot.
+func (m *Manager) Apply(config Config) (*Proxy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, err := m.newProxy(config)
+	if err != nil {
+		return nil, err
+	}
+	key := proxyKey(p.config)
+
+	old, ok := m.proxies[key]
+	if !ok {
+		if err := p.Start(); err != nil {
+			return nil, err
+		}
+		m.proxies[key] = p
+		return p, nil
+	}
+	if old.config.sameListener(p.config) {
+		old.reconfigure(p.config)
+		return old, nil
+	}
+
+	// Bind first where the addresses allow it; otherwise free the port and
+	// bring the old proxy back if the new one still cannot bind
+	if err := p.Start(); err != nil {
+		old.Close()
+		if err := p.Start(); err != nil {
+			if restored, rerr := m.newProxy(old.config); rerr == nil && restored.Start() == nil {
+				m.proxies[key] = restored
+			} else {
+				delete(m.proxies, key)
+			}
+			return nil, err
+		}
+	} else {
+		old.Close()
+	}
+	m.proxies[key] = p
+	return p, nil
+}
+
+// Remove stops the proxy on a protocol and port
+func (m *Manager) Remove(protocol string, port int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%d", protocol, port)
+	p, ok := m.proxies[key]
+	if !ok {
+		return fmt.Errorf("no %s proxy on port %d", protocol, port)
+	}
+	delete(m.proxies, key)
+	return p.Close()
+}
+
+// Stats reports every running proxy, ordered by listener
+func (m *Manager) Stats() []Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make([]Stats, 0, len(m.proxies))
+	for _, p := range m.proxies {
+		stats = append(stats, p.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Listen < stats[j].Listen })
+	return stats
+}
+
+// Configs returns the config of every running proxy, ordered by listener, so
+// callers can persist and restore them
+func (m *Manager) Configs() []Config {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	configs := make([]Config, 0, len(m.proxies))
+	for _, p := range m.proxies {
+		p.mu.Lock()
+		configs = append(configs, p.config)
+		p.mu.Unlock()
+	}
+	sort.Slice(configs, func(i, j int) bool { return proxyKey(configs[i]) < proxyKey(configs[j]) })
+	return configs
+}
+
+// Shutdown stops every proxy taking new flows and waits for open ones to
+// finish until ctx is done
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var wg sync.WaitGroup
+	errs := make([]error, 0, len(m.proxies))
+	var errMu sync.Mutex
+	for key, p := range m.proxies {
+		delete(m.proxies, key)
+		wg.Add(1)
+		go func(p *Proxy) {
+			defer wg.Done()
+			if err := p.Shutdown(ctx); err != nil {
+				errMu.Lock()
+				errs = append(errs, err)
+				errMu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Close stops all proxies
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, p := range m.proxies {
+		p.Close()
+		delete(m.proxies, key)
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package l4
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend is one target of an L4 proxy
+type Backend struct {
+	Addr     string
+	healthy  atomic.Bool
+	active   atomic.Int64 // Open TCP connections or live UDP sessions
+	total    atomic.Uint64
+	failures atomic.Uint64 // Failed dials
+}
+
+// BackendStats reports one backend
+type BackendStats struct {
+	Addr     string `json:"addr"`
+	Healthy  bool   `json:"healthy"`
+	Active   int64  `json:"active"`
+	Total    uint64 `json:"total"`
+	Failures uint64 `json:"failures"`
+}
+
+// Stats reports an L4 proxy's connections and traffic
+type Stats struct {
+	Protocol  string         `json:"protocol"`
+	Listen    string         `json:"listen"`
+	Algorithm string         `json:"algorithm"`
+	Active    int64          `json:"active"` // Connections (TCP) or sessions (UDP)
+	Total     uint64         `json:"total"`
+	Rejected  uint64         `json:"rejected"` // No healthy backend could take the flow, or max_sessions was reached
+	BytesIn   uint64         `json:"bytes_in"` // Client to backend
+	BytesOut  uint64         `json:"bytes_out"`
+	Backends  []BackendStats `json:"backends"`
+}
+
+// Proxy forwards TCP connections or UDP sessions on one port to its targets
+type Proxy struct {
+	mu       sync.Mutex // Guards backends and config's targets and algorithm; serializes pool rebuilds
+	config   Config
+	backends []*Backend
+	lb       balancer
+	pool     atomic.Pointer[pool]
+	idle     time.Duration
+
+	listener     net.Listener   // TCP
+	packetConn   net.PacketConn // UDP
+	sessions     sync.Map       // UDP client address -> *udpSession
+	conns        sync.Map       // Open TCP connections, closed on shutdown
+	listen       listenFunc     // nil uses net.Listen
+	listenPacket listenPacketFunc
+
+	active   atomic.Int64
+	total    atomic.Uint64
+	rejected atomic.Uint64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	done      chan struct{}
+	stopping  chan struct{} // Closed once the proxy stops taking new flows
+	stopOnce  sync.Once
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type (
+	listenFunc       func(network, addr string) (net.Listener, error)
+	listenPacketFunc func(network, addr string) (net.PacketConn, error)
+)
+
+// New validates config and prepares a proxy; Start binds it
+func New(config Config) (*Proxy, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		config:   config,
+		idle:     config.idleTimeout(),
+		done:     make(chan struct{}),
+		stopping: make(chan struct{}),
+	}
+	p.backends = newBackends(config.Targets, nil)
+	p.refreshPool()
+	return p, nil
+}
+
+// newBackends builds the backend list for targets, keeping the state of any
+// already in existing
+func newBackends(targets []string, existing []*Backend) []*Backend {
+	kept := make(map[string]*Backend, len(existing))
+	for _, b := range existing {
+		kept[b.Addr] = b
+	}
+	backends := make([]*Backend, 0, len(targets))
+	for _, target := range targets {
+		b, ok := kept[target]
+		if !ok {
+			b = &Backend{Addr: target}
+			b.healthy.Store(true) // Until a health check says otherwise
+		}
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+// reconfigure swaps targets and algorithm on a running proxy. Open flows
+// stay on their backend; unchanged targets keep their health and counters.
+func (p *Proxy) reconfigure(config Config) {
+	p.mu.Lock()
+	p.backends = newBackends(config.Targets, p.backends)
+	p.config.Targets = config.Targets
+	p.config.Algorithm = config.Algorithm
+	p.mu.Unlock()
+	p.refreshPool()
+	fmt.Printf("🔁 L4 %s proxy on %s now has %d targets (%s)\n", config.Protocol, p.Addr(), len(config.Targets), config.Algorithm)
+}
+
+// Start binds the listener and serves in the background
+func (p *Proxy) Start() error {
+	if p.config.Protocol == "udp" {
+		listenPacket := p.listenPacket
+		if listenPacket == nil {
+			listenPacket = net.ListenPacket
+		}
+		conn, err := listenPacket("udp", p.config.listenAddr())
+		if err != nil {
+			return err
+		}
+		p.packetConn = conn
+		p.wg.Add(1)
+		go p.serveUDP()
+	} else {
+		listen := p.listen
+		if listen == nil {
+			listen = net.Listen
+		}
+		ln, err := listen("tcp", p.config.listenAddr())
+		if err != nil {
+			return err
+		}
+		p.listener = ln
+		p.wg.Add(1)
+		go p.serveTCP()
+	}
+	if p.config.HealthCheck == "tcp_connect" {
+		p.wg.Add(1)
+		go p.healthLoop()
+	}
+	fmt.Printf("🔌 L4 %s proxy listening on %s (%s, %d targets)\n", p.config.Protocol, p.Addr(), p.config.Algorithm, len(p.backends))
+	return nil
+}
+
+// Addr is the bound listener address
+func (p *Proxy) Addr() net.Addr {
+	if p.packetConn != nil {
+		return p.packetConn.LocalAddr()
+	}
+	if p.listener != nil {
+		return p.listener.Addr()
+	}
+	return nil
+}
+
+// Shutdown stops taking new flows and waits until open connections and
+// sessions finish or ctx is done, then closes the proxy. After an upgrade the
+// successor keeps serving the shared socket meanwhile.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.stopAccepting()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for p.active.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			n := p.active.Load()
+			p.Close()
+			return fmt.Errorf("%d L4 flows still open: %w", n, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return p.Close()
+}
+
+// stopAccepting ends the accept or read loop; open flows carry on. A UDP
+// socket stays open so sessions can still send replies.
+func (p *Proxy) stopAccepting() {
+	p.stopOnce.Do(func() {
+		close(p.stopping)
+		if p.listener != nil {
+			p.listener.Close()
+		}
+		if p.packetConn != nil {
+			p.packetConn.SetReadDeadline(time.Now())
+		}
+	})
+}
+
+// Close stops the listener and ends every connection and session
+func (p *Proxy) Close() error {
+	p.closeOnce.Do(func() {
+		p.stopAccepting()
+		close(p.done)
+		if p.listener != nil {
+			p.listener.Close()
+		}
+		if p.packetConn != nil {
+			p.packetConn.Close()
+		}
+		p.conns.Range(func(key, _ interface{}) bool {
+			key.(net.Conn).Close()
+			return true
+		})
+		p.sessions.Range(func(_, value interface{}) bool {
+			value.(*udpSession).upstream.Close()
+			return true
+		})
+	})
+	p.wg.Wait()
+	return nil
+}
+
+// Stats reports current connection and backend figures
+func (p *Proxy) Stats() Stats {
+	p.mu.Lock()
+	backends := p.backends
+	algorithm := p.config.Algorithm
+	p.mu.Unlock()
+
+	s := Stats{
+		Protocol:  p.config.Protocol,
+		Algorithm: algorithm,
+		Active:    p.active.Load(),
+		Total:     p.total.Load(),
+		Rejected:  p.rejected.Load(),
+		BytesIn:   p.bytesIn.Load(),
+		BytesOut:  p.bytesOut.Load(),
+	}
+	if addr := p.Addr(); addr != nil {
+		s.Listen = addr.String()
+	}
+	for _, b := range backends {
+		s.Backends = append(s.Backends, BackendStats{
+			Addr:     b.Addr,
+			Healthy:  b.healthy.Load(),
+			Active:   b.active.Load(),
+			Total:    b.total.Load(),
+			Failures: b.failures.Load(),
+		})
+	}
+	return s
+}
+
+func (p *Proxy) refreshPool() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var healthy []*Backend
+	for _, b := range p.backends {
+		if b.healthy.Load() {
+			healthy = append(healthy, b)
+		}
+	}
+	p.pool.Store(newPool(healthy, p.config.Algorithm))
+}
+
+// pick chooses a backend for a flow, skipping any in exclude (already failed)
+func (p *Proxy) pick(key string, exclude map[*Backend]bool) *Backend {
+	pool := p.pool.Load()
+	if len(exclude) > 0 {
+		var remaining []*Backend
+		for _, b := range pool.backends {
+			if !exclude[b] {
+				remaining = append(remaining, b)
+			}
+		}
+		pool = newPool(remaining, pool.algorithm)
+	}
+	return p.lb.pick(pool, key)
+}
+
+// setHealthy records a probe result and reports whether the state changed
+func (p *Proxy) setHealthy(b *Backend, healthy bool) bool {
+	if b.healthy.Swap(healthy) == healthy {
+		return false
+	}
+	state := "DOWN"
+	if healthy {
+		state = "UP"
+	}
+	fmt.Printf("🩺 L4 backend %s is %s\n", b.Addr, state)
+	return true
+}
+
+func (p *Proxy) healthLoop() {
+	defer p.wg.Done()
+	interval := p.config.healthInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.checkHealth(interval)
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Proxy) checkHealth(interval time.Duration) {
+	timeout := interval / 2
+	if timeout > 2*time.Second {
+		timeout = 2 * time.Second
+	}
+	p.mu.Lock()
+	backends := p.backends
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var changed atomic.Bool
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", b.Addr, timeout)
+			if err == nil {
+				conn.Close()
+			}
+			if p.setHealthy(b, err == nil) {
+				changed.Store(true)
+			}
+		}(b)
+	}
+	wg.Wait()
+	// One rebuild per round, after every probe has landed
+	if changed.Load() {
+		p.refreshPool()
+	}
+}
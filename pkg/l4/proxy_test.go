@@ -0,0 +1,400 @@
+package l4
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arunsoman/GhostPlane/pkg/upgrade"
+)
+
+// tcpEcho answers each line with its own name and the line
+func tcpEcho(t *testing.T, name string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fmt.Fprintf(conn, "%s:%s\n", name, scanner.Text())
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func startProxy(t *testing.T, config Config) *Proxy {
+	config.ListenAddr = "127.0.0.1"
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg string) string {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprintf(conn, "%s\n", msg)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return strings.TrimSpace(line)
+}
+
+func TestProxy_TCP(t *testing.T) {
+	a, b := tcpEcho(t, "a"), tcpEcho(t, "b")
+	defer a.Close()
+	defer b.Close()
+	// A refused target is skipped in favour of the others
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+
+	p := startProxy(t, Config{Protocol: "tcp", Targets: []string{dead.Addr().String(), a.Addr().String(), b.Addr().String()}})
+
+	seen := map[string]bool{}
+	for i := 0; i < 6; i++ {
+		conn, err := net.Dial("tcp", p.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		reply := roundTrip(t, conn, "ping")
+		conn.Close()
+		seen[strings.SplitN(reply, ":", 2)[0]] = true
+		if !strings.HasSuffix(reply, ":ping") {
+			t.Fatalf("Unexpected reply %q", reply)
+		}
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Errorf("Expected round robin across live targets, got %v", seen)
+	}
+
+	stats := p.Stats()
+	if stats.Total != 6 || stats.BytesIn == 0 || stats.BytesOut == 0 || stats.Backends[0].Failures == 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestProxy_TCPHealthAndLeastConnections(t *testing.T) {
+	a, b := tcpEcho(t, "a"), tcpEcho(t, "b")
+	defer a.Close()
+
+	p := startProxy(t, Config{
+		Protocol:         "tcp",
+		Targets:          []string{a.Addr().String(), b.Addr().String()},
+		Algorithm:        LeastConnections,
+		HealthCheck:      "tcp_connect",
+		HealthIntervalMS: 20,
+		IdleTimeoutMS:    100,
+	})
+
+	// Hold a connection open; the next one goes to the other, idle backend
+	held, _ := net.Dial("tcp", p.Addr().String())
+	first := roundTrip(t, held, "x")[:1]
+	next, _ := net.Dial("tcp", p.Addr().String())
+	if second := roundTrip(t, next, "x")[:1]; second == first {
+		t.Errorf("Expected least connections to avoid %s", first)
+	}
+	next.Close()
+
+	// The idle timeout closes the held connection
+	held.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := held.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+	held.Close()
+
+	b.Close()
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().Backends[1].Healthy && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.Stats().Backends[1].Healthy {
+		t.Fatal("Expected the closed backend to be marked down")
+	}
+	for i := 0; i < 3; i++ {
+		conn, _ := net.Dial("tcp", p.Addr().String())
+		if reply := roundTrip(t, conn, "x"); reply != "a:x" {
+			t.Errorf("Expected only the healthy backend, got %q", reply)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxy_UDP(t *testing.T) {
+	backend, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	p := startProxy(t, Config{Protocol: "udp", Targets: []string{backend.LocalAddr().String()}, Algorithm: Maglev, IdleTimeoutMS: 100})
+
+	client, _ := net.Dial("udp", p.Addr().String())
+	defer client.Close()
+	buf := make([]byte, 1500)
+	for _, msg := range []string{"one", "two"} {
+		client.Write([]byte(msg))
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != "echo:"+msg {
+			t.Fatalf("Expected echo of %s, got %q (%v)", msg, buf[:n], err)
+		}
+	}
+	if stats := p.Stats(); stats.Total != 1 || stats.Active != 1 {
+		t.Errorf("Expected one session for one client, got %+v", stats)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().Active != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.Stats().Active != 0 {
+		t.Error("Expected the idle session to expire")
+	}
+}
+
+func TestProxy_UDPMaxSessions(t *testing.T) {
+	backend, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer backend.Close()
+
+	p := startProxy(t, Config{Protocol: "udp", Targets: []string{backend.LocalAddr().String()}, MaxSessions: 1})
+
+	for i := 0; i < 2; i++ {
+		client, _ := net.Dial("udp", p.Addr().String())
+		defer client.Close()
+		client.Write([]byte("hi"))
+	}
+	deadline := time.Now().Add(time.Second)
+	for p.Stats().Total < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := p.Stats(); stats.Active != 1 || stats.Rejected != 1 {
+		t.Errorf("Expected the second flow to be rejected at max_sessions, got %+v", stats)
+	}
+}
+
+func TestMaglevTable(t *testing.T) {
+	names := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"}
+	const size = 1031
+	full := buildMaglevTable(names, size)
+
+	counts := make([]int, len(names))
+	for _, i := range full {
+		counts[i]++
+	}
+	for i, c := range counts {
+		if c < size/len(names)-2 || c > size/len(names)+2 {
+			t.Errorf("Backend %d owns %d slots, expected an even share", i, c)
+		}
+	}
+
+	// Dropping the last backend only moves the slots it owned
+	reduced := buildMaglevTable(names[:3], size)
+	moved := 0
+	for slot := range full {
+		if full[slot] != 3 && reduced[slot] != full[slot] {
+			moved++
+		}
+	}
+	if moved > size/10 {
+		t.Errorf("Expected minimal disruption, %d of %d slots moved", moved, size)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	// As the udp-streaming template renders it
+	cfg, err := ParseConfig(map[string]interface{}{
+		"protocol":      "udp",
+		"listener_port": "5060",
+		"targets":       []interface{}{"10.0.0.1:5060"},
+		"algo":          "maglev",
+	})
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	if cfg.ListenerPort != 5060 || cfg.Algorithm != Maglev || cfg.HealthCheck != "none" {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+
+	for name, raw := range map[string]map[string]interface{}{
+		"protocol":  {"protocol": "sctp", "targets": []interface{}{"a:1"}},
+		"targets":   {"protocol": "tcp"},
+		"algorithm": {"protocol": "tcp", "targets": []interface{}{"a:1"}, "algorithm": "random"},
+		"health":    {"protocol": "udp", "targets": []interface{}{"a:1"}, "health_check": "tcp_connect"},
+	} {
+		if _, err := ParseConfig(raw); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestManager_Apply(t *testing.T) {
+	a, b := tcpEcho(t, "a"), tcpEcho(t, "b")
+	defer a.Close()
+	defer b.Close()
+	free, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	m := NewManager()
+	defer m.Close()
+	config := Config{Protocol: "tcp", ListenAddr: "127.0.0.1", ListenerPort: port, Targets: []string{a.Addr().String()}}
+	first, err := m.Apply(config)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	open, _ := net.Dial("tcp", first.Addr().String())
+	defer open.Close()
+	if reply := roundTrip(t, open, "ping"); reply != "a:ping" {
+		t.Fatalf("Unexpected reply %q", reply)
+	}
+
+	// New targets are taken in place: same listener, open flows untouched
+	config.Targets = []string{b.Addr().String()}
+	config.Algorithm = LeastConnections
+	second, err := m.Apply(config)
+	if err != nil || second != first {
+		t.Fatalf("Expected an in-place update, got %v", err)
+	}
+	conn, _ := net.Dial("tcp", first.Addr().String())
+	defer conn.Close()
+	if reply := roundTrip(t, conn, "ping"); reply != "b:ping" {
+		t.Errorf("Expected the new target, got %q", reply)
+	}
+	if reply := roundTrip(t, open, "again"); reply != "a:again" {
+		t.Errorf("Expected the open flow to keep its backend, got %q", reply)
+	}
+	if configs := m.Configs(); len(configs) != 1 || configs[0].Algorithm != LeastConnections {
+		t.Errorf("Unexpected configs %+v", configs)
+	}
+
+	// Other changes rebind the port
+	config.IdleTimeoutMS = 1000
+	third, err := m.Apply(config)
+	if err != nil || third == first {
+		t.Fatalf("Expected a new proxy, got %v", err)
+	}
+	if s := m.Stats(); len(s) != 1 || s[0].Listen != first.Addr().String() {
+		t.Errorf("Expected one proxy on the same port, got %+v", s)
+	}
+}
+
+// TestHelperL4Successor is the process started by TestManager_Upgrade, not a test itself
+func TestHelperL4Successor(t *testing.T) {
+	if os.Getenv("GHOSTPLANE_TEST_L4_SUCCESSOR") != "1" {
+		t.Skip("helper process")
+	}
+	u := upgrade.New()
+	m := NewManager()
+	m.SetListeners(func(network, addr string) (net.Listener, error) {
+		return u.Listen("l4-"+network+"/"+addr, network, addr)
+	}, nil)
+	port, _ := strconv.Atoi(os.Getenv("GHOSTPLANE_TEST_L4_PORT"))
+	if _, err := m.Apply(Config{Protocol: "tcp", ListenAddr: "127.0.0.1", ListenerPort: port, Targets: []string{os.Getenv("GHOSTPLANE_TEST_L4_TARGET")}}); err != nil {
+		os.Exit(3)
+	}
+	u.Ready()
+	time.Sleep(10 * time.Second)
+	os.Exit(0)
+}
+
+func TestManager_Upgrade(t *testing.T) {
+	a, b := tcpEcho(t, "a"), tcpEcho(t, "b")
+	defer a.Close()
+	defer b.Close()
+	free, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	u := upgrade.New()
+	m := NewManager()
+	m.SetListeners(func(network, addr string) (net.Listener, error) {
+		return u.Listen("l4-"+network+"/"+addr, network, addr)
+	}, nil)
+	p, err := m.Apply(Config{Protocol: "tcp", ListenAddr: "127.0.0.1", ListenerPort: port, Targets: []string{a.Addr().String()}})
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	// A listener closed before the upgrade is left behind rather than failing it
+	m.Apply(Config{Protocol: "tcp", ListenAddr: "127.0.0.1", Targets: []string{a.Addr().String()}})
+	m.Remove("tcp", 0)
+
+	open, _ := net.Dial("tcp", p.Addr().String())
+	defer open.Close()
+	if reply := roundTrip(t, open, "ping"); reply != "a:ping" {
+		t.Fatalf("Unexpected reply %q", reply)
+	}
+
+	t.Setenv("GHOSTPLANE_TEST_L4_SUCCESSOR", "1")
+	t.Setenv("GHOSTPLANE_TEST_L4_PORT", strconv.Itoa(port))
+	t.Setenv("GHOSTPLANE_TEST_L4_TARGET", b.Addr().String())
+	u.Path, u.Args = os.Args[0], []string{os.Args[0], "-test.run=^TestHelperL4Successor$"}
+	u.ReadyTimeout = 10 * time.Second
+	proc, err := u.Upgrade()
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	defer proc.Kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- m.Shutdown(ctx) }()
+
+	// New connections reach the successor on the same socket
+	deadline := time.Now().Add(3 * time.Second)
+	reply := ""
+	for time.Now().Before(deadline) && reply != "b:ping" {
+		conn, err := net.Dial("tcp", p.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed during the handoff: %v", err)
+		}
+		reply = roundTrip(t, conn, "ping")
+		conn.Close()
+	}
+	if reply != "b:ping" {
+		t.Errorf("Expected the successor to serve new connections, got %q", reply)
+	}
+
+	// The flow opened before the upgrade keeps going until it is done
+	if reply := roundTrip(t, open, "again"); reply != "a:again" {
+		t.Errorf("Expected the open flow to survive the upgrade, got %q", reply)
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("Expected shutdown to wait for the open flow")
+	default:
+	}
+	open.Close()
+	if err := <-shutdown; err != nil {
+		t.Errorf("Expected a clean drain, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package l4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var bufferPool = sync.Pool{New: func() interface{} { b := make([]byte, 32*1024); return &b }}
+
+func (p *Proxy) serveTCP() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.stopping:
+				return
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		p.wg.Add(1)
+		go p.handleTCP(conn)
+	}
+}
+
+// handleTCP dials a backend, trying the others if it refuses, and splices
+// the two connections until both sides finish or the flow goes idle
+func (p *Proxy) handleTCP(client net.Conn) {
+	defer p.wg.Done()
+	defer client.Close()
+	p.total.Add(1)
+
+	var upstream net.Conn
+	var backend *Backend
+	failed := make(map[*Backend]bool)
+	for {
+		backend = p.pick(client.RemoteAddr().String(), failed)
+		if backend == nil {
+			p.rejected.Add(1)
+			return
+		}
+		conn, err := net.DialTimeout("tcp", backend.Addr, 5*time.Second)
+		if err == nil {
+			upstream = conn
+			break
+		}
+		backend.failures.Add(1)
+		failed[backend] = true
+	}
+	defer upstream.Close()
+
+	p.conns.Store(client, struct{}{})
+	p.conns.Store(upstream, struct{}{})
+	defer p.conns.Delete(client)
+	defer p.conns.Delete(upstream)
+
+	p.active.Add(1)
+	backend.active.Add(1)
+	backend.total.Add(1)
+	defer p.active.Add(-1)
+	defer backend.active.Add(-1)
+
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.pipe(upstream, client, &last, &p.bytesIn)
+	}()
+	p.pipe(client, upstream, &last, &p.bytesOut)
+	wg.Wait()
+}
+
+// pipe copies src to dst. Reads time out on the idle deadline, which only
+// ends the flow when neither direction has moved data for that long.
+func (p *Proxy) pipe(dst, src net.Conn, last *atomic.Int64, counter *atomic.Uint64) {
+	bufp := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufp)
+	buf := *bufp
+
+	for {
+		src.SetReadDeadline(time.Now().Add(p.idle))
+		n, err := src.Read(buf)
+		if n > 0 {
+			last.Store(time.Now().UnixNano())
+			counter.Add(uint64(n))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				src.Close()
+				return
+			}
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, last.Load())) < p.idle {
+				continue // The other direction is still active
+			}
+			if err == io.EOF {
+				// Half-close so the peer sees the end of this direction
+				if tc, ok := dst.(*net.TCPConn); ok {
+					tc.CloseWrite()
+					return
+				}
+			}
+			dst.Close()
+			src.Close()
+			return
+		}
+	}
+}
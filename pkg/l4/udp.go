@@ -0,0 +1,118 @@
+package l4
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// udpSession tracks one client flow: datagrams from the client go out on a
+// connected socket to its backend, and replies come back the same way
+type udpSession struct {
+	client   net.Addr
+	backend  *Backend
+	upstream net.Conn
+	last     atomic.Int64
+}
+
+func (p *Proxy) serveUDP() {
+	defer p.wg.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := p.packetConn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-p.stopping:
+				return
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		session := p.session(client)
+		if session == nil {
+			continue
+		}
+		session.last.Store(time.Now().UnixNano())
+		if _, err := session.upstream.Write(buf[:n]); err == nil {
+			p.bytesIn.Add(uint64(n))
+		}
+	}
+}
+
+// session finds or opens the client's session; nil when no backend can take
+// it or the session table is full
+func (p *Proxy) session(client net.Addr) *udpSession {
+	key := client.String()
+	if s, ok := p.sessions.Load(key); ok {
+		return s.(*udpSession)
+	}
+
+	p.total.Add(1)
+	// Every session holds a socket and a goroutine, so spoofed sources must not grow them unbounded
+	if p.active.Load() >= p.config.maxSessions() {
+		p.rejected.Add(1)
+		return nil
+	}
+	failed := make(map[*Backend]bool)
+	for {
+		backend := p.pick(key, failed)
+		if backend == nil {
+			p.rejected.Add(1)
+			return nil
+		}
+		conn, err := net.Dial("udp", backend.Addr)
+		if err != nil {
+			backend.failures.Add(1)
+			failed[backend] = true
+			continue
+		}
+
+		s := &udpSession{client: client, backend: backend, upstream: conn}
+		s.last.Store(time.Now().UnixNano())
+		p.sessions.Store(key, s)
+		p.active.Add(1)
+		backend.active.Add(1)
+		backend.total.Add(1)
+		p.wg.Add(1)
+		go p.relayReplies(key, s)
+		return s
+	}
+}
+
+// relayReplies returns backend datagrams to the client until the session
+// has been idle in both directions for the idle timeout
+func (p *Proxy) relayReplies(key string, s *udpSession) {
+	defer p.wg.Done()
+	defer func() {
+		s.upstream.Close()
+		p.sessions.Delete(key)
+		p.active.Add(-1)
+		s.backend.active.Add(-1)
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		s.upstream.SetReadDeadline(time.Unix(0, s.last.Load()).Add(p.idle))
+		n, err := s.upstream.Read(buf)
+		if n > 0 {
+			s.last.Store(time.Now().UnixNano())
+			if _, werr := p.packetConn.WriteTo(buf[:n], s.client); werr == nil {
+				p.bytesOut.Add(uint64(n))
+			}
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, s.last.Load())) < p.idle {
+				continue // The client sent more since the deadline was set
+			}
+			// Idle, closed on shutdown, or the backend is unreachable (ICMP refused)
+			return
+		}
+	}
+}
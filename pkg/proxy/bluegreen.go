@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// BlueGreenConfig keeps two colours of a service registered and health-checked,
+// with one of them receiving all of the route's traffic
+type BlueGreenConfig struct {
+	Blue         []string `json:"blue"`
+	Green        []string `json:"green"`
+	Active       string   `json:"active"`                  // "blue" (default) or "green"
+	DrainSeconds int      `json:"drain_seconds,omitempty"` // How long the old colour's backends stay draining after a switch
+}
+
+// BlueGreenStatus reports a route's colours after or between switches
+type BlueGreenStatus struct {
+	Route         string    `json:"route"`
+	Active        string    `json:"active"`
+	Previous      string    `json:"previous,omitempty"`
+	SwitchedAt    time.Time `json:"switched_at,omitempty"`
+	Draining      bool      `json:"draining"`
+	DrainInFlight int64     `json:"drain_in_flight"` // Requests still running on the old colour
+	BlueHealthy   int       `json:"blue_healthy_percent"`
+	GreenHealthy  int       `json:"green_healthy_percent"`
+}
+
+// blueGreenState is swapped as a whole on every switch
+type blueGreenState struct {
+	active     string
+	previous   string
+	switchedAt time.Time
+	drained    []*backendHealth // Backends of the previous colour this switch set draining
+}
+
+// endDrain clears the draining flag the switch set, leaving manual drains alone
+func (st *blueGreenState) endDrain() {
+	for _, h := range st.drained {
+		h.draining.Store(false)
+	}
+}
+
+// blueGreen is the compiled form of BlueGreenConfig
+type blueGreen struct {
+	config *BlueGreenConfig
+	blue   *Pool
+	green  *Pool
+	drain  time.Duration
+	state  atomic.Pointer[blueGreenState]
+}
+
+func newBlueGreen(cfg *BlueGreenConfig, opts poolOptions) (*blueGreen, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if len(cfg.Blue) == 0 || len(cfg.Green) == 0 {
+		return nil, fmt.Errorf("both blue and green targets are required")
+	}
+	active := cfg.Active
+	if active == "" {
+		active = "blue"
+	}
+	if active != "blue" && active != "green" {
+		return nil, fmt.Errorf("active must be blue or green, got %q", cfg.Active)
+	}
+	blue, err := createBackendPoolWithOptions(cfg.Blue, opts)
+	if err != nil {
+		return nil, err
+	}
+	green, err := createBackendPoolWithOptions(cfg.Green, opts)
+	if err != nil {
+		return nil, err
+	}
+	bg := &blueGreen{config: cfg, blue: blue, green: green, drain: time.Duration(cfg.DrainSeconds) * time.Second}
+	bg.state.Store(&blueGreenState{active: active})
+	return bg, nil
+}
+
+func (bg *blueGreen) pool(color string) *Pool {
+	if color == "green" {
+		return bg.green
+	}
+	return bg.blue
+}
+
+func (bg *blueGreen) activePool() *Pool {
+	return bg.pool(bg.state.Load().active)
+}
+
+// carryState keeps the active colour of the previous generation of the route
+// when its config is reloaded unchanged. Otherwise the old switch's drain ends.
+func (bg *blueGreen) carryState(prev *blueGreen) {
+	if prev == nil {
+		return
+	}
+	if prev.state.Load().active != bg.state.Load().active {
+		prev.state.Load().endDrain()
+		return
+	}
+	bg.state.Store(prev.state.Load())
+}
+
+// startDrain sets the backends of color draining, so nothing picks them while
+// their in-flight requests finish, and returns those it changed
+func (bg *blueGreen) startDrain(color string) []*backendHealth {
+	if bg.drain <= 0 {
+		return nil
+	}
+	var drained []*backendHealth
+	for _, b := range bg.pool(color).backends() {
+		if b.health.draining.CompareAndSwap(false, true) {
+			drained = append(drained, b.health)
+		}
+	}
+	return drained
+}
+
+func (bg *blueGreen) currentConfig() *BlueGreenConfig {
+	if bg == nil {
+		return nil
+	}
+	cfg := *bg.config
+	cfg.Active = bg.state.Load().active
+	return &cfg
+}
+
+func (bg *blueGreen) status(routePath string) BlueGreenStatus {
+	st := bg.state.Load()
+	s := BlueGreenStatus{
+		Route:        routePath,
+		Active:       st.active,
+		Previous:     st.previous,
+		SwitchedAt:   st.switchedAt,
+		BlueHealthy:  bg.blue.healthyPercent(),
+		GreenHealthy: bg.green.healthyPercent(),
+	}
+	if st.previous != "" && time.Since(st.switchedAt) < bg.drain {
+		s.Draining = true
+		for _, b := range bg.pool(st.previous).backends() {
+			s.DrainInFlight += b.health.inflight.Load()
+		}
+	}
+	return s
+}
+
+// BlueGreenPool returns the targets of one colour of a route, e.g. for verifying
+// the idle colour before switching to it
+func (p *Proxy) BlueGreenPool(routePath, color string) ([]string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	bg, err := p.findBlueGreen(routePath)
+	if err != nil {
+		return nil, err
+	}
+	if color != "blue" && color != "green" {
+		return nil, fmt.Errorf("color must be blue or green, got %q", color)
+	}
+	var targets []string
+	for _, b := range bg.pool(color).backends() {
+		targets = append(targets, b.URL.String())
+	}
+	return targets, nil
+}
+
+// SwitchBlueGreen atomically sends a route's traffic to the given colour, or to
+// the other colour when color is empty. Requests already running on the old
+// colour finish where they are while its backends drain for drain_seconds.
+// Switching back is an instant rollback and ends the drain.
+func (p *Proxy) SwitchBlueGreen(routePath, color string) (BlueGreenStatus, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	bg, err := p.findBlueGreen(routePath)
+	if err != nil {
+		return BlueGreenStatus{}, err
+	}
+	current := bg.state.Load()
+	if color == "" {
+		color = "green"
+		if current.active == "green" {
+			color = "blue"
+		}
+	}
+	if color != "blue" && color != "green" {
+		return BlueGreenStatus{}, fmt.Errorf("color must be blue or green, got %q", color)
+	}
+	if color != current.active {
+		current.endDrain()
+		next := &blueGreenState{active: color, previous: current.active, switchedAt: time.Now()}
+		next.drained = bg.startDrain(current.active)
+		bg.state.Store(next)
+		if len(next.drained) > 0 {
+			time.AfterFunc(bg.drain, func() { p.endBlueGreenDrain(routePath, next) })
+		}
+	}
+	return bg.status(routePath), nil
+}
+
+// endBlueGreenDrain ends the drain of a switch unless the route has switched
+// or been reconfigured since, which ends or takes over the drain itself
+func (p *Proxy) endBlueGreenDrain(routePath string, st *blueGreenState) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if bg, err := p.findBlueGreen(routePath); err == nil && bg.state.Load() == st {
+		st.endDrain()
+	}
+}
+
+// GetBlueGreen reports every blue/green route
+func (p *Proxy) GetBlueGreen() []BlueGreenStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var out []BlueGreenStatus
+	for _, r := range p.routes {
+		if r.blueGreen != nil {
+			out = append(out, r.blueGreen.status(r.Path))
+		}
+	}
+	return out
+}
+
+// findBlueGreen must be called with p.mu held
+func (p *Proxy) findBlueGreen(routePath string) (*blueGreen, error) {
+	for _, r := range p.routes {
+		if r.Path != routePath {
+			continue
+		}
+		if r.blueGreen == nil {
+			return nil, fmt.Errorf("route %s is not a blue/green route", routePath)
+		}
+		return r.blueGreen, nil
+	}
+	return nil, fmt.Errorf("route %s not found", routePath)
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxy_BlueGreenSwitch(t *testing.T) {
+	blue := newSplitBackend("blue", http.StatusOK)
+	defer blue.Close()
+	green := newSplitBackend("green", http.StatusOK)
+	defer green.Close()
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:      "/app",
+		BlueGreen: &BlueGreenConfig{Blue: []string{blue.URL}, Green: []string{green.URL}, DrainSeconds: 60},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	serve := func() string {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/app", nil))
+		return w.Body.String()
+	}
+	if got := serve(); got != "blue" {
+		t.Fatalf("Expected blue by default, got %q", got)
+	}
+
+	// Both colours are registered for health checks
+	if n := len(p.GetBackendHealth()); n != 2 {
+		t.Errorf("Expected both colours in backend health, got %d", n)
+	}
+
+	status, err := p.SwitchBlueGreen("/app", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if status.Active != "green" || status.Previous != "blue" || !status.Draining {
+		t.Errorf("Unexpected status after switch %+v", status)
+	}
+	if got := serve(); got != "green" {
+		t.Errorf("Expected green after switch, got %q", got)
+	}
+
+	// The active colour survives a reload of the same config
+	p.UpdateRoutes(p.GetRoutes())
+	if got := serve(); got != "green" {
+		t.Errorf("Expected green after reload, got %q", got)
+	}
+	if s := p.GetBlueGreen()[0]; s.Previous != "blue" {
+		t.Errorf("Expected switch history to survive reload, got %+v", s)
+	}
+
+	// Rollback
+	if _, err := p.SwitchBlueGreen("/app", "blue"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := serve(); got != "blue" {
+		t.Errorf("Expected blue after rollback, got %q", got)
+	}
+
+	if _, err := p.SwitchBlueGreen("/app", "red"); err == nil {
+		t.Error("Expected error for unknown colour")
+	}
+	if _, err := p.SwitchBlueGreen("/other", ""); err == nil {
+		t.Error("Expected error for unknown route")
+	}
+	if err := p.UpdateRoutes([]ConfigRoute{{Path: "/app", BlueGreen: &BlueGreenConfig{Blue: []string{blue.URL}}}}); err == nil {
+		t.Error("Expected error when a colour has no targets")
+	}
+}
+
+func TestProxy_BlueGreenDrain(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	blue := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("blue"))
+	}))
+	defer blue.Close()
+	green := newSplitBackend("green", http.StatusOK)
+	defer green.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:      "/app",
+		BlueGreen: &BlueGreenConfig{Blue: []string{blue.URL}, Green: []string{green.URL}, DrainSeconds: 1},
+	}})
+	draining := func(target string) bool {
+		for _, s := range p.GetBackendHealth() {
+			if s.Backend == target {
+				return s.Draining
+			}
+		}
+		return false
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/app", nil))
+		done <- w
+	}()
+	<-started
+
+	status, _ := p.SwitchBlueGreen("/app", "green")
+	if !status.Draining || status.DrainInFlight != 1 {
+		t.Errorf("Expected the request on blue to be draining, got %+v", status)
+	}
+	if !draining(blue.URL) || draining(green.URL) {
+		t.Error("Expected only the blue backend to be draining")
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/app", nil))
+	if w.Body.String() != "green" {
+		t.Errorf("Expected new requests on green, got %q", w.Body.String())
+	}
+
+	// The request that started on blue finishes there
+	close(release)
+	if w := <-done; w.Code != http.StatusOK || w.Body.String() != "blue" {
+		t.Errorf("Expected the in-flight request to complete on blue, got %d %q", w.Code, w.Body.String())
+	}
+
+	// Rolling back ends blue's drain and drains green instead
+	p.SwitchBlueGreen("/app", "blue")
+	if draining(blue.URL) || !draining(green.URL) {
+		t.Error("Expected the rollback to move the drain to green")
+	}
+
+	// The drain ends after drain_seconds
+	deadline := time.Now().Add(3 * time.Second)
+	for draining(green.URL) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if draining(green.URL) {
+		t.Error("Expected the drain to end after drain_seconds")
+	}
+}
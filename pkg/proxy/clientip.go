@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strings"
+)
+
+// Forwarded header policies
+const (
+	ForwardAppend    = "append"    // Extend headers received from trusted proxies with this hop
+	ForwardOverwrite = "overwrite" // Replace incoming headers with the resolved client only
+	ForwardPreserve  = "preserve"  // Pass incoming headers through untouched
+)
+
+// ForwardingConfig controls how the real client address is resolved and
+// which X-Forwarded-* / Forwarded headers are sent upstream.
+type ForwardingConfig struct {
+	TrustedProxies []string `json:"trusted_proxies,omitempty"` // CIDRs whose forwarding headers are believed
+	HeaderPolicy   string   `json:"header_policy,omitempty"`   // "append" (default), "overwrite" or "preserve"
+	SetForwarded   bool     `json:"set_forwarded,omitempty"`   // Also emit the RFC 7239 Forwarded header
+}
+
+// forwardingPolicy is the compiled form of a ForwardingConfig
+type forwardingPolicy struct {
+	trusted      ipSet
+	headerPolicy string
+	setForwarded bool
+}
+
+func newForwardingPolicy(config ForwardingConfig) (*forwardingPolicy, error) {
+	fp := &forwardingPolicy{headerPolicy: strings.ToLower(config.HeaderPolicy), setForwarded: config.SetForwarded}
+	switch fp.headerPolicy {
+	case "":
+		fp.headerPolicy = ForwardAppend
+	case ForwardAppend, ForwardOverwrite, ForwardPreserve:
+	default:
+		return nil, fmt.Errorf("unknown header policy %q", config.HeaderPolicy)
+	}
+	for _, entry := range config.TrustedProxies {
+		if err := fp.trusted.add(entry); err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+	}
+	return fp, nil
+}
+
+func (fp *forwardingPolicy) isTrusted(addr netip.Addr) bool {
+	return addr.IsValid() && fp.trusted.size > 0 && fp.trusted.contains(addr)
+}
+
+// clientInfo is the per-request result of client address resolution
+type clientInfo struct {
+	IP          netip.Addr // Resolved client address
+	Port        uint16     // Client source port, known only when the client is the peer
+	Peer        netip.Addr // Address of the directly connected peer
+	Proto       string
+	Host        string
+	trustedPeer bool
+	policy      *forwardingPolicy
+}
+
+type clientInfoKey struct{}
+
+// requestClientIP extracts the directly connected peer address of a request
+func requestClientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// ClientIPFromContext returns the client address resolved by the proxy for the request carrying ctx
+func ClientIPFromContext(ctx context.Context) (netip.Addr, bool) {
+	info, ok := ctx.Value(clientInfoKey{}).(*clientInfo)
+	if !ok || !info.IP.IsValid() {
+		return netip.Addr{}, false
+	}
+	return info.IP, true
+}
+
+// resolve determines the client address of a request. Forwarding headers are
+// only considered when the peer is trusted; the chain is walked from the
+// right and the first untrusted hop is the client.
+func (fp *forwardingPolicy) resolve(r *http.Request) *clientInfo {
+	peer := requestClientIP(r)
+	info := &clientInfo{IP: peer, Peer: peer, Host: r.Host, Proto: "http", policy: fp}
+	if r.TLS != nil {
+		info.Proto = "https"
+	}
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		info.Port = ap.Port()
+	}
+	if !fp.isTrusted(peer) {
+		return info
+	}
+	info.trustedPeer = true
+
+	chain, proto, host := forwardedChain(r.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !chain[i].IsValid() {
+			break
+		}
+		info.IP, info.Port = chain[i], 0
+		if !fp.isTrusted(chain[i]) {
+			break
+		}
+	}
+	if proto != "" {
+		info.Proto = strings.ToLower(proto)
+	}
+	if host != "" {
+		info.Host = host
+	}
+	return info
+}
+
+// forwardedChain extracts the hop list plus the original proto and host,
+// preferring RFC 7239 Forwarded over the X-Forwarded-* family.
+func forwardedChain(h http.Header) (chain []netip.Addr, proto, host string) {
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, element := range splitForwarded(strings.Join(values, ",")) {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				value = strings.Trim(value, `"`)
+				switch strings.ToLower(key) {
+				case "for":
+					chain = append(chain, parseNodeAddr(value))
+				case "proto":
+					if proto == "" {
+						proto = value
+					}
+				case "host":
+					if host == "" {
+						host = value
+					}
+				}
+			}
+		}
+		return chain, proto, host
+	}
+
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				chain = append(chain, parseNodeAddr(hop))
+			}
+		}
+	}
+	proto = strings.TrimSpace(strings.Split(h.Get("X-Forwarded-Proto"), ",")[0])
+	host = strings.TrimSpace(strings.Split(h.Get("X-Forwarded-Host"), ",")[0])
+	return chain, proto, host
+}
+
+// splitForwarded splits a Forwarded header on commas outside quoted strings
+func splitForwarded(s string) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNodeAddr parses an address as it appears in forwarding headers:
+// "1.2.3.4", "1.2.3.4:80", "[2001:db8::1]:80" or "2001:db8::1".
+// Obfuscated identifiers and "unknown" yield an invalid address.
+func parseNodeAddr(node string) netip.Addr {
+	node = strings.TrimSpace(node)
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr().Unmap()
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	addr, err := netip.ParseAddr(node)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// formatForwardedNode quotes IPv6 addresses as RFC 7239 requires
+func formatForwardedNode(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return "unknown"
+	}
+	if addr.Is6() {
+		return `"[` + addr.String() + `]"`
+	}
+	return addr.String()
+}
+
+// setForwardingHeaders writes the upstream X-Forwarded-* / Forwarded headers
+// according to the policy attached to the inbound request.
+func setForwardingHeaders(pr *httputil.ProxyRequest) {
+	info, ok := pr.In.Context().Value(clientInfoKey{}).(*clientInfo)
+	if !ok {
+		info = defaultForwardingPolicy.resolve(pr.In)
+	}
+	in, out := pr.In.Header, pr.Out.Header
+	peer := ""
+	if info.Peer.IsValid() {
+		peer = info.Peer.String()
+	}
+
+	switch info.policy.headerPolicy {
+	case ForwardPreserve:
+		for _, k := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"} {
+			if v, ok := in[k]; ok {
+				out[k] = v
+			}
+		}
+		return
+	case ForwardOverwrite:
+		if info.IP.IsValid() {
+			out.Set("X-Forwarded-For", info.IP.String())
+		}
+		out.Set("X-Forwarded-Host", info.Host)
+		out.Set("X-Forwarded-Proto", info.Proto)
+		if info.policy.setForwarded {
+			out.Set("Forwarded", fmt.Sprintf("for=%s;host=%q;proto=%s", formatForwardedNode(info.IP), info.Host, info.Proto))
+		}
+		return
+	}
+
+	// Append: keep what trusted proxies told us and add the directly connected peer
+	xff := peer
+	if prior := strings.Join(in.Values("X-Forwarded-For"), ", "); info.trustedPeer && prior != "" {
+		xff = prior + ", " + peer
+	}
+	if xff != "" {
+		out.Set("X-Forwarded-For", xff)
+	}
+	out.Set("X-Forwarded-Host", info.Host)
+	out.Set("X-Forwarded-Proto", info.Proto)
+	if info.policy.setForwarded {
+		element := fmt.Sprintf("for=%s;host=%q;proto=%s", formatForwardedNode(info.Peer), pr.In.Host, info.Proto)
+		if prior := strings.Join(in.Values("Forwarded"), ", "); info.trustedPeer && prior != "" {
+			element = prior + ", " + element
+		}
+		out.Set("Forwarded", element)
+	}
+}
+
+var defaultForwardingPolicy, _ = newForwardingPolicy(ForwardingConfig{})
+
+// SetForwarding configures trusted proxies and the forwarding header policy
+func (p *Proxy) SetForwarding(config ForwardingConfig) error {
+	fp, err := newForwardingPolicy(config)
+	if err != nil {
+		return err
+	}
+	p.forwarding.Store(fp)
+	return nil
+}
+
+// resolveClient resolves the client address and attaches it to the request context
+func (p *Proxy) resolveClient(r *http.Request) (*http.Request, *clientInfo) {
+	fp := p.forwarding.Load()
+	if fp == nil {
+		fp = defaultForwardingPolicy
+	}
+	info := fp.resolve(r)
+	return r.WithContext(context.WithValue(r.Context(), clientInfoKey{}, info)), info
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestForwardingPolicy_Resolve(t *testing.T) {
+	fp, err := newForwardingPolicy(ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8", "fd00::/8"}})
+	if err != nil {
+		t.Fatalf("Failed to build policy: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		remote   string
+		headers  map[string]string
+		expected string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.9:4000", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "203.0.113.9"},
+		{"trusted peer uses XFF", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"skips trusted hops from the right", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.7, 10.0.0.5"}, "198.51.100.7"},
+		{"all hops trusted", "10.0.0.2:4000", map[string]string{"X-Forwarded-For": "10.1.1.1"}, "10.1.1.1"},
+		{"forwarded with ipv6", "[fd00::1]:4000", map[string]string{"Forwarded": `for="[2001:db8::7]:1234";proto=https, for=10.0.0.9`}, "2001:db8::7"},
+		{"forwarded unknown stops walk", "10.0.0.2:4000", map[string]string{"Forwarded": "for=198.51.100.1, for=unknown"}, "10.0.0.2"},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		if got := fp.resolve(req).IP.String(); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, got)
+		}
+	}
+
+	if _, err := newForwardingPolicy(ForwardingConfig{HeaderPolicy: "mangle"}); err == nil {
+		t.Error("Expected error for unknown header policy")
+	}
+}
+
+func TestProxy_ForwardingHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{backend.URL})
+
+	send := func(remote string, headers map[string]string) {
+		req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		req.RemoteAddr = remote
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Untrusted peer: spoofed XFF is discarded
+	send("203.0.113.9:4000", map[string]string{"X-Forwarded-For": "1.1.1.1"})
+	if xff := got.Get("X-Forwarded-For"); xff != "203.0.113.9" {
+		t.Errorf("Expected spoofed XFF to be replaced, got %q", xff)
+	}
+	if got.Get("X-Forwarded-Host") != "app.example.com" || got.Get("X-Forwarded-Proto") != "http" {
+		t.Errorf("Unexpected forwarded host/proto: %q %q", got.Get("X-Forwarded-Host"), got.Get("X-Forwarded-Proto"))
+	}
+
+	// Trusted peer: chain is appended
+	p.SetForwarding(ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8"}, SetForwarded: true})
+	send("10.0.0.2:4000", map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "https"})
+	if xff := got.Get("X-Forwarded-For"); xff != "198.51.100.7, 10.0.0.2" {
+		t.Errorf("Expected appended XFF, got %q", xff)
+	}
+	if got.Get("X-Forwarded-Proto") != "https" {
+		t.Errorf("Expected trusted proto to be kept, got %q", got.Get("X-Forwarded-Proto"))
+	}
+	if fwd := got.Get("Forwarded"); fwd != `for=10.0.0.2;host="app.example.com";proto=https` {
+		t.Errorf("Unexpected Forwarded header %q", fwd)
+	}
+
+	// Overwrite: only the resolved client is sent
+	p.SetForwarding(ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8"}, HeaderPolicy: ForwardOverwrite})
+	send("10.0.0.2:4000", map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.7"})
+	if xff := got.Get("X-Forwarded-For"); xff != "198.51.100.7" {
+		t.Errorf("Expected overwritten XFF, got %q", xff)
+	}
+
+	// Preserve: headers pass through untouched
+	p.SetForwarding(ForwardingConfig{HeaderPolicy: ForwardPreserve})
+	send("203.0.113.9:4000", map[string]string{"X-Forwarded-For": "1.1.1.1"})
+	if xff := got.Get("X-Forwarded-For"); xff != "1.1.1.1" {
+		t.Errorf("Expected preserved XFF, got %q", xff)
+	}
+}
+
+func TestProxy_ResolvedClientIPInLogsAndAffinity(t *testing.T) {
+	backend1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("b1")) }))
+	defer backend1.Close()
+	backend2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("b2")) }))
+	defer backend2.Close()
+
+	p, _ := New([]string{})
+	p.SetForwarding(ForwardingConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+	p.UpdateRoutes([]ConfigRoute{
+		{Path: "/sticky", Targets: []string{backend1.URL, backend2.URL}, Affinity: &AffinityConfig{Type: "client_ip"}},
+	})
+
+	// Same client behind different load balancer nodes must stick to one backend
+	first := ""
+	for i, peer := range []string{"10.0.0.2:1000", "10.0.0.3:2000", "10.0.0.4:3000"} {
+		req := httptest.NewRequest(http.MethodGet, "/sticky", nil)
+		req.RemoteAddr = peer
+		req.Header.Set("X-Forwarded-For", "2001:db8::42")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		if i == 0 {
+			first = w.Body.String()
+		} else if w.Body.String() != first {
+			t.Errorf("Expected affinity to %s, got %s", first, w.Body.String())
+		}
+
+		entry := <-p.LogChan
+		if entry.ClientIP != "2001:db8::42" {
+			t.Errorf("Expected resolved client IP in access log, got %q", entry.ClientIP)
+		}
+	}
+}
+
+func TestProxy_RateLimitPerClient(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{
+		{Path: "/limited", Targets: []string{backend.URL}, RateLimit: &RateLimitConfig{RequestsPerSecond: 0.001, Burst: 1, Key: "client_ip"}},
+	})
+
+	do := func(remote string) int {
+		req := httptest.NewRequest(http.MethodGet, "/limited", nil)
+		req.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := do("198.51.100.1:1"); code != http.StatusOK {
+		t.Errorf("Expected first request to pass, got %d", code)
+	}
+	if code := do("198.51.100.1:2"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected second request from same client to be limited, got %d", code)
+	}
+	if code := do("198.51.100.2:1"); code != http.StatusOK {
+		t.Errorf("Expected other client to have its own bucket, got %d", code)
+	}
+}
+
+func TestProxy_RateLimitBucketBounds(t *testing.T) {
+	p, _ := New([]string{})
+	config := &RateLimitConfig{RequestsPerSecond: 1000, Burst: 1}
+
+	for i := 0; i < maxRateLimitBuckets+10; i++ {
+		p.isRateAllowed(fmt.Sprintf("/r|%d", i), config)
+	}
+	if n := len(p.rateLimitBuckets); n > maxRateLimitBuckets {
+		t.Errorf("Expected at most %d buckets, got %d", maxRateLimitBuckets, n)
+	}
+
+	// Buckets that have refilled are pruned once the sweep interval passes
+	p.rateLimitMu.Lock()
+	p.sweepRateLimitBuckets(time.Now().Add(time.Second))
+	n := len(p.rateLimitBuckets)
+	p.rateLimitMu.Unlock()
+	if n != 0 {
+		t.Errorf("Expected refilled buckets to be swept, %d left", n)
+	}
+}
+
+func TestProxy_RateLimitFullMapKeepsClientsLimited(t *testing.T) {
+	p, _ := New([]string{})
+	config := &RateLimitConfig{RequestsPerSecond: 0.01, Burst: 1}
+
+	if !p.isRateAllowed("/r|victim", config) {
+		t.Fatal("Expected first request to pass")
+	}
+	// Flood with new keys until the map is full and beyond
+	for i := 0; i < maxRateLimitBuckets+10; i++ {
+		p.isRateAllowed(fmt.Sprintf("/r|%d", i), config)
+	}
+	if n := len(p.rateLimitBuckets); n > maxRateLimitBuckets {
+		t.Errorf("Expected at most %d buckets, got %d", maxRateLimitBuckets, n)
+	}
+	if p.isRateAllowed("/r|victim", config) {
+		t.Error("Expected the flood not to reset an existing client's limit")
+	}
+	if p.isRateAllowed("/r|new", config) {
+		t.Error("Expected new keys to be refused while every bucket is still limiting")
+	}
+
+	// Once the oldest bucket has refilled it makes room for a new key
+	p.rateLimitMu.Lock()
+	p.rateLimitBuckets["/r|victim"].last = time.Now().Add(-time.Hour)
+	p.rateLimitLRU.MoveToBack(p.rateLimitBuckets["/r|victim"].elem)
+	p.rateLimitMu.Unlock()
+	if !p.isRateAllowed("/r|new", config) {
+		t.Error("Expected a refilled bucket to be evicted for a new key")
+	}
+	if _, ok := p.rateLimitBuckets["/r|victim"]; ok {
+		t.Error("Expected the refilled bucket to be the one evicted")
+	}
+}
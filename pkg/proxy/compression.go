@@ -0,0 +1,394 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionConfig enables response compression for a route
+type CompressionConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Algorithms []string `json:"algorithms,omitempty"` // Server preference order; defaults to br, zstd, gzip
+	MimeTypes  []string `json:"mime_types,omitempty"` // Exact types or "type/*"; defaults to common text formats
+	MinSize    int      `json:"min_size,omitempty"`   // Bytes; smaller responses are sent as-is. Defaults to 1024
+}
+
+var (
+	defaultCompressionAlgorithms = []string{"br", "zstd", "gzip"}
+	defaultCompressibleTypes     = []string{
+		"text/*",
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"application/xhtml+xml",
+		"image/svg+xml",
+	}
+)
+
+const defaultCompressionMinSize = 1024
+
+// encoder is the API shared by the gzip, brotli and zstd writers
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Encoders are expensive to allocate, so each algorithm keeps a pool
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() any { return gzip.NewWriter(nil) }},
+	"br":   {New: func() any { return brotli.NewWriterLevel(nil, brotli.DefaultCompression) }},
+	"zstd": {New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return w
+	}},
+}
+
+// compressionPolicy is the compiled form of a CompressionConfig
+type compressionPolicy struct {
+	algorithms []string
+	types      map[string]bool
+	prefixes   []string // From "type/*" entries, including the slash
+	minSize    int
+}
+
+// newCompressionPolicy compiles a compression config. A nil or disabled config yields a nil policy.
+func newCompressionPolicy(config *CompressionConfig) (*compressionPolicy, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	if config.MinSize < 0 {
+		return nil, fmt.Errorf("min_size must not be negative")
+	}
+
+	c := &compressionPolicy{
+		algorithms: defaultCompressionAlgorithms,
+		types:      make(map[string]bool),
+		minSize:    defaultCompressionMinSize,
+	}
+	if config.MinSize > 0 {
+		c.minSize = config.MinSize
+	}
+	if len(config.Algorithms) > 0 {
+		c.algorithms = nil
+		for _, a := range config.Algorithms {
+			a = strings.ToLower(strings.TrimSpace(a))
+			if encoderPools[a] == nil {
+				return nil, fmt.Errorf("unsupported compression algorithm %q", a)
+			}
+			c.algorithms = append(c.algorithms, a)
+		}
+	}
+
+	types := config.MimeTypes
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			c.prefixes = append(c.prefixes, prefix+"/")
+			continue
+		}
+		if !strings.Contains(t, "/") {
+			return nil, fmt.Errorf("invalid mime type %q", t)
+		}
+		c.types[t] = true
+	}
+	return c, nil
+}
+
+// compressible reports whether a response with these headers may be
+// compressed, ignoring its size
+func (c *compressionPolicy) compressible(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if isStreaming(h) {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if c.types[mediaType] {
+		return true
+	}
+	for _, p := range c.prefixes {
+		if strings.HasPrefix(mediaType, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStreaming detects responses that must reach the client as soon as each chunk is written
+func isStreaming(h http.Header) bool {
+	ct := strings.ToLower(h.Get("Content-Type"))
+	return strings.HasPrefix(ct, "text/event-stream") ||
+		strings.HasPrefix(ct, "application/grpc") ||
+		strings.EqualFold(h.Get("X-Accel-Buffering"), "no")
+}
+
+// negotiateEncoding picks the configured algorithm the client weights
+// highest, breaking ties by server preference. Empty means identity.
+func negotiateEncoding(acceptEncoding string, algorithms []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		weights[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, a := range algorithms {
+		q, ok := weights[a]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = a, q
+		}
+	}
+	return best
+}
+
+// wrap returns the writer an attempt should proxy into and a finish func
+// that must run once the attempt returns. A nil policy passes w through.
+func (c *compressionPolicy) wrap(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if c == nil {
+		return w, func() {}
+	}
+	cw := &compressWriter{
+		ResponseWriter: w,
+		policy:         c,
+		encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding"), c.algorithms),
+		head:           r.Method == http.MethodHead,
+	}
+	return cw, cw.close
+}
+
+// compressWriter holds the status line back until it knows whether the
+// body will be compressed. Responses without a Content-Length are buffered
+// up to the minimum size before deciding.
+type compressWriter struct {
+	http.ResponseWriter
+	policy      *compressionPolicy
+	encoding    string // Negotiated for this request, empty when the client accepts none
+	head        bool
+	status      int
+	wroteHeader bool // Status recorded, possibly not yet sent
+	decided     bool // Status sent; enc is set when compressing
+	buf         bytes.Buffer
+	enc         encoder
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if code < 200 {
+		// Informational responses (including upgrades) go straight through
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+
+	h := w.Header()
+	if w.encoding == "" || w.head || code == http.StatusNoContent || code == http.StatusNotModified ||
+		code == http.StatusPartialContent || !w.policy.compressible(h) {
+		w.passthrough()
+		return
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil && n < w.policy.minSize {
+			w.passthrough()
+		} else {
+			w.startCompression()
+		}
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	if w.decided {
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf.Write(b)
+	if w.buf.Len() >= w.policy.minSize {
+		w.startCompression()
+	}
+	return len(b), nil
+}
+
+// Flush pushes compressed output through. A response still being sized
+// stays buffered: the reverse proxy flushes after every chunk of an
+// unknown-length body, and true streams are never held back.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		return
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) passthrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
+
+func (w *compressWriter) startCompression() {
+	setEncodedHeaders(w.Header(), w.encoding)
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.enc = encoderPools[w.encoding].Get().(encoder)
+	w.enc.Reset(w.ResponseWriter)
+	if w.buf.Len() > 0 {
+		w.enc.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
+
+func (w *compressWriter) close() {
+	if w.wroteHeader && !w.decided {
+		w.passthrough()
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		encoderPools[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+// setEncodedHeaders describes a body that is now encoded: its length is no
+// longer known, caches must key on Accept-Encoding and a strong validator
+// no longer matches the bytes sent.
+func setEncodedHeaders(h http.Header, encoding string) {
+	h.Set("Content-Encoding", encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	if !varyIncludes(h, "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+func varyIncludes(h http.Header, name string) bool {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressForCache encodes an identity body with the preferred algorithm so
+// the cache always holds the compressed form. The returned headers are a copy.
+func (c *compressionPolicy) compressForCache(body []byte, headers http.Header) ([]byte, http.Header) {
+	if c == nil || len(body) < c.minSize || !c.compressible(headers) {
+		return body, headers
+	}
+	encoding := c.algorithms[0]
+	var buf bytes.Buffer
+	enc := encoderPools[encoding].Get().(encoder)
+	enc.Reset(&buf)
+	_, err := enc.Write(body)
+	if closeErr := enc.Close(); err == nil {
+		err = closeErr
+	}
+	encoderPools[encoding].Put(enc)
+	if err != nil {
+		return body, headers
+	}
+
+	headers = headers.Clone()
+	setEncodedHeaders(headers, encoding)
+	return buf.Bytes(), headers
+}
+
+// cachedForClient adapts a cache entry to the request's Accept-Encoding,
+// decoding a compressed body for clients that cannot accept it. It fails
+// when the stored encoding is one the proxy cannot decode.
+func cachedForClient(r *http.Request, entry cacheEntry) (cacheEntry, error) {
+	encoding := entry.headers.Get("Content-Encoding")
+	if encoding == "" || negotiateEncoding(r.Header.Get("Accept-Encoding"), []string{encoding}) != "" {
+		return entry, nil
+	}
+	body, err := decodeBody(encoding, entry.response)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	headers := entry.headers.Clone()
+	headers.Del("Content-Encoding")
+	headers.Set("Content-Length", strconv.Itoa(len(body)))
+	return cacheEntry{response: body, headers: headers, expiration: entry.expiration}, nil
+}
+
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	case "br":
+		return io.ReadAll(brotli.NewReader(bytes.NewReader(body)))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
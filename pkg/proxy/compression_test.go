@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	algorithms := []string{"br", "zstd", "gzip"}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"*", "br"},
+		{"*;q=0.1, zstd;q=0.8", "zstd"},
+		{"identity", ""},
+		{"deflate", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept, algorithms); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestNewCompressionPolicy(t *testing.T) {
+	if c, err := newCompressionPolicy(&CompressionConfig{Enabled: false}); c != nil || err != nil {
+		t.Errorf("Expected a disabled config to compile to nil, got %v, %v", c, err)
+	}
+	if _, err := newCompressionPolicy(&CompressionConfig{Enabled: true, Algorithms: []string{"deflate"}}); err == nil {
+		t.Error("Expected unsupported algorithm to be rejected")
+	}
+	if _, err := newCompressionPolicy(&CompressionConfig{Enabled: true, MimeTypes: []string{"json"}}); err == nil {
+		t.Error("Expected malformed mime type to be rejected")
+	}
+
+	c, err := newCompressionPolicy(&CompressionConfig{Enabled: true, MimeTypes: []string{"text/*", "application/json"}})
+	if err != nil {
+		t.Fatalf("newCompressionPolicy failed: %v", err)
+	}
+	h := http.Header{}
+	for ct, want := range map[string]bool{
+		"text/html; charset=utf-8": true,
+		"application/json":         true,
+		"image/png":                false,
+		"text/event-stream":        false,
+	} {
+		h.Set("Content-Type", ct)
+		if got := c.compressible(h); got != want {
+			t.Errorf("compressible(%q) = %v, want %v", ct, got, want)
+		}
+	}
+	h.Set("Content-Type", "text/plain")
+	h.Set("Cache-Control", "public, no-transform")
+	if c.compressible(h) {
+		t.Error("Expected no-transform responses to be left alone")
+	}
+}
+
+func decode(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("gzip: %v", err)
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("zstd: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return string(body)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", encoding, err)
+	}
+	return string(out)
+}
+
+func TestProxy_Compression(t *testing.T) {
+	large := strings.Repeat("compressible text ", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			io.WriteString(w, large)
+		case "/chunked":
+			w.Header().Set("Content-Type", "application/json")
+			for i := 0; i < 100; i++ {
+				io.WriteString(w, `{"item":"value"},`)
+				w.(http.Flusher).Flush()
+			}
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "tiny")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, large)
+		case "/encoded":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			io.WriteString(gz, large)
+			gz.Close()
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: "+large+"\n\n")
+		}
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:        "/*",
+		Targets:     []string{backend.URL},
+		Compression: &CompressionConfig{Enabled: true},
+	}})
+	if err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, enc := range []string{"gzip", "br", "zstd"} {
+		w := get("/large", enc)
+		if got := w.Header().Get("Content-Encoding"); got != enc {
+			t.Fatalf("Expected %s encoding, got %q", enc, got)
+		}
+		if decode(t, enc, w.Body.Bytes()) != large {
+			t.Errorf("%s body did not round-trip", enc)
+		}
+		if w.Body.Len() >= len(large) {
+			t.Errorf("Expected %s body to shrink, got %d bytes", enc, w.Body.Len())
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" || w.Header().Get("ETag") != `W/"v1"` {
+			t.Errorf("Unexpected headers for %s: %v", enc, w.Header())
+		}
+		if w.Header().Get("Content-Length") != "" {
+			t.Error("Expected Content-Length to be dropped from a compressed response")
+		}
+	}
+
+	w := get("/chunked", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || !strings.HasPrefix(decode(t, "gzip", w.Body.Bytes()), `{"item"`) {
+		t.Errorf("Expected a flushed unknown-length body to be compressed, got %v", w.Header())
+	}
+
+	for _, tt := range []struct {
+		path, accept, want string
+	}{
+		{"/large", "identity", ""},       // client accepts nothing we offer
+		{"/small", "gzip, br", ""},       // below min_size
+		{"/image", "gzip, br", ""},       // not a compressible type
+		{"/events", "gzip, br", ""},      // streaming
+		{"/encoded", "gzip, br", "gzip"}, // already encoded upstream, passed through untouched
+	} {
+		w := get(tt.path, tt.accept)
+		if got := w.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("%s: expected Content-Encoding %q, got %q", tt.path, tt.want, got)
+		}
+		if body := decode(t, tt.want, w.Body.Bytes()); !strings.Contains(body, "tiny") && !strings.Contains(body, large) {
+			t.Errorf("%s: unexpected body %.40q", tt.path, body)
+		}
+	}
+}
+
+func TestProxy_CompressedCache(t *testing.T) {
+	large := strings.Repeat("cached asset ", 200)
+	var hits int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/javascript")
+		io.WriteString(w, large)
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:        "/static/*",
+		Targets:     []string{backend.URL},
+		Cache:       &CacheConfig{Enabled: true, TTL: 60},
+		Compression: &CompressionConfig{Enabled: true, Algorithms: []string{"gzip"}},
+	}})
+	if err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/static/app.js", nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w
+	}
+
+	// The first client accepts nothing, but the entry is still stored compressed
+	if w := get(""); w.Header().Get("X-GP-Cache") != "MISS" || w.Body.String() != large {
+		t.Fatalf("Expected an identity MISS, got %v", w.Header())
+	}
+	entry, ok := p.getCachedResponse("/static/app.js")
+	if !ok || entry.headers.Get("Content-Encoding") != "gzip" || decode(t, "gzip", entry.response) != large {
+		t.Fatalf("Expected a gzip cache entry, got %v", entry.headers)
+	}
+
+	w := get("gzip")
+	if w.Header().Get("X-GP-Cache") != "HIT" || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a compressed HIT, got %v", w.Header())
+	}
+	if decode(t, "gzip", w.Body.Bytes()) != large {
+		t.Error("Compressed HIT did not round-trip")
+	}
+
+	w = get("br")
+	if w.Header().Get("X-GP-Cache") != "HIT" || w.Header().Get("Content-Encoding") != "" || w.Body.String() != large {
+		t.Errorf("Expected a decoded HIT for a client without gzip, got %v", w.Header())
+	}
+	if hits != 1 {
+		t.Errorf("Expected a single origin fetch, got %d", hits)
+	}
+}
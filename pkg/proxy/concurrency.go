@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConcurrencyConfig adaptively limits the requests a route has in flight to its
+// backends. Requests over the limit wait in a bounded queue; lower classes are
+// shed first once it fills.
+type ConcurrencyConfig struct {
+	Algorithm       string  `json:"algorithm,omitempty"`         // "aimd" (default) or "gradient"
+	InitialLimit    int     `json:"initial_limit,omitempty"`     // Defaults to 20
+	MinLimit        int     `json:"min_limit,omitempty"`         // Defaults to 1
+	MaxLimit        int     `json:"max_limit,omitempty"`         // Defaults to 1000
+	LatencyTargetMS int     `json:"latency_target_ms,omitempty"` // AIMD backs off above this latency; 0 only backs off on errors
+	BackoffRatio    float64 `json:"backoff_ratio,omitempty"`     // AIMD decrease factor, defaults to 0.9
+	MaxQueue        int     `json:"max_queue,omitempty"`         // Defaults to 100
+	QueueTimeoutMS  int     `json:"queue_timeout_ms,omitempty"`  // Defaults to 200
+	ClassHeader     string  `json:"class_header,omitempty"`      // Request header naming the class
+	DefaultClass    string  `json:"default_class,omitempty"`     // "critical", "high", "normal" (default) or "low"
+	RetryAfter      int     `json:"retry_after,omitempty"`       // Seconds advertised to shed clients, defaults to 1
+}
+
+// ConcurrencyStats reports a route's limiter
+type ConcurrencyStats struct {
+	Route    string `json:"route"`
+	Limit    int    `json:"limit"`
+	InFlight int    `json:"in_flight"`
+	Queued   int    `json:"queued"`
+	Shed     uint64 `json:"shed"`
+}
+
+// Request classes in order of importance
+const (
+	classCritical = iota
+	classHigh
+	classNormal
+	classLow
+	numClasses
+)
+
+// classQueueShare is the part of the queue each class may fill, so lower
+// classes are shed while higher ones can still wait
+var classQueueShare = [numClasses]float64{1, 0.75, 0.5, 0.25}
+
+func parseClass(s string) (int, bool) {
+	switch strings.ToLower(s) {
+	case "critical":
+		return classCritical, true
+	case "high":
+		return classHigh, true
+	case "", "normal":
+		return classNormal, true
+	case "low":
+		return classLow, true
+	}
+	return 0, false
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// concurrencyLimiter is an adaptive limit with a priority wait queue
+type concurrencyLimiter struct {
+	config       *ConcurrencyConfig
+	defaultClass int
+	minLimit     float64
+	maxLimit     float64
+	maxQueue     int
+	queueTimeout time.Duration
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	queued   int
+	waiters  [numClasses]*list.List
+	minRTT   time.Duration
+	samples  int
+	shed     uint64
+}
+
+func newConcurrencyLimiter(cfg *ConcurrencyConfig) (*concurrencyLimiter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	switch cfg.Algorithm {
+	case "", "aimd", "gradient":
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", cfg.Algorithm)
+	}
+	class, ok := parseClass(cfg.DefaultClass)
+	if !ok {
+		return nil, fmt.Errorf("unknown class %q", cfg.DefaultClass)
+	}
+	if cfg.BackoffRatio < 0 || cfg.BackoffRatio >= 1 {
+		return nil, fmt.Errorf("backoff_ratio must be between 0 and 1")
+	}
+
+	l := &concurrencyLimiter{
+		config:       cfg,
+		defaultClass: class,
+		minLimit:     float64(max(cfg.MinLimit, 1)),
+		maxLimit:     1000,
+		maxQueue:     100,
+		queueTimeout: 200 * time.Millisecond,
+		limit:        20,
+	}
+	if cfg.MaxLimit > 0 {
+		l.maxLimit = float64(cfg.MaxLimit)
+	}
+	if cfg.MaxQueue > 0 {
+		l.maxQueue = cfg.MaxQueue
+	}
+	if cfg.QueueTimeoutMS > 0 {
+		l.queueTimeout = time.Duration(cfg.QueueTimeoutMS) * time.Millisecond
+	}
+	if cfg.InitialLimit > 0 {
+		l.limit = float64(cfg.InitialLimit)
+	}
+	if l.minLimit > l.maxLimit {
+		return nil, fmt.Errorf("min_limit exceeds max_limit")
+	}
+	l.limit = math.Min(math.Max(l.limit, l.minLimit), l.maxLimit)
+	for i := range l.waiters {
+		l.waiters[i] = list.New()
+	}
+	return l, nil
+}
+
+// classOf assigns a request its class from the configured header or the route default
+func (l *concurrencyLimiter) classOf(r *http.Request) int {
+	if v := r.Header.Get(l.config.ClassHeader); l.config.ClassHeader != "" && v != "" {
+		if c, ok := parseClass(v); ok {
+			return c
+		}
+	}
+	return l.defaultClass
+}
+
+// acquire admits a request, waiting in the queue if the limit is reached.
+// It returns false when the request should be shed.
+func (l *concurrencyLimiter) acquire(ctx context.Context, class int) bool {
+	l.mu.Lock()
+	if l.inflight < int(l.limit) && l.queued == 0 {
+		l.inflight++
+		l.mu.Unlock()
+		return true
+	}
+	if float64(l.queued) >= float64(l.maxQueue)*classQueueShare[class] {
+		l.shed++
+		l.mu.Unlock()
+		return false
+	}
+	w := &waiter{ready: make(chan struct{})}
+	elem := l.waiters[class].PushBack(w)
+	l.queued++
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.granted {
+		// Granted while timing out; keep the slot
+		return true
+	}
+	l.waiters[class].Remove(elem)
+	l.queued--
+	l.shed++
+	return false
+}
+
+// release frees a slot, adapts the limit to the observed latency and outcome,
+// and hands freed capacity to the most important waiters
+func (l *concurrencyLimiter) release(rtt time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+	if l.config.Algorithm == "gradient" {
+		l.adaptGradient(rtt, failed)
+	} else {
+		l.adaptAIMD(rtt, failed)
+	}
+
+	for l.inflight < int(l.limit) && l.queued > 0 {
+		for _, q := range l.waiters {
+			if front := q.Front(); front != nil {
+				w := q.Remove(front).(*waiter)
+				w.granted = true
+				close(w.ready)
+				l.queued--
+				l.inflight++
+				break
+			}
+		}
+	}
+}
+
+// adaptAIMD grows the limit by about one per round trip and cuts it on errors or slow responses
+func (l *concurrencyLimiter) adaptAIMD(rtt time.Duration, failed bool) {
+	target := time.Duration(l.config.LatencyTargetMS) * time.Millisecond
+	if failed || (target > 0 && rtt > target) {
+		ratio := l.config.BackoffRatio
+		if ratio == 0 {
+			ratio = 0.9
+		}
+		l.limit = math.Max(l.limit*ratio, l.minLimit)
+		return
+	}
+	l.limit = math.Min(l.limit+1/l.limit, l.maxLimit)
+}
+
+// adaptGradient scales the limit by how far latency has drifted above the
+// best seen, leaving headroom for a small queue
+func (l *concurrencyLimiter) adaptGradient(rtt time.Duration, failed bool) {
+	// Forget the baseline now and then so a permanently slower backend is not punished forever
+	l.samples++
+	if l.minRTT == 0 || rtt < l.minRTT || l.samples > 1000 {
+		l.minRTT, l.samples = max(rtt, time.Microsecond), 0
+	}
+	gradient := math.Max(0.5, math.Min(1, float64(l.minRTT)/float64(max(rtt, time.Microsecond))))
+	if failed {
+		gradient = 0.5
+	}
+	next := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = math.Min(math.Max(l.limit*0.8+next*0.2, l.minLimit), l.maxLimit)
+}
+
+func (l *concurrencyLimiter) stats(routePath string) ConcurrencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ConcurrencyStats{Route: routePath, Limit: int(l.limit), InFlight: l.inflight, Queued: l.queued, Shed: l.shed}
+}
+
+func (l *concurrencyLimiter) retryAfter() string {
+	return fmt.Sprintf("%d", max(l.config.RetryAfter, 1))
+}
+
+// reuseLimiter keeps a route's learned limit across reloads that leave its
+// config unchanged. Must be called with p.mu held.
+func (p *Proxy) reuseLimiter(routePath string, l *concurrencyLimiter) *concurrencyLimiter {
+	for _, old := range p.routes {
+		if old.Path == routePath && old.limiter != nil && reflect.DeepEqual(old.limiter.config, l.config) {
+			return old.limiter
+		}
+	}
+	return l
+}
+
+// GetConcurrencyStats reports the limiter of every route that has one
+func (p *Proxy) GetConcurrencyStats() []ConcurrencyStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var out []ConcurrencyStats
+	for _, r := range p.routes {
+		if r.limiter != nil {
+			out = append(out, r.limiter.stats(r.Path))
+		}
+	}
+	return out
+}
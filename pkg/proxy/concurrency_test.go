@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter_PriorityQueue(t *testing.T) {
+	l, err := newConcurrencyLimiter(&ConcurrencyConfig{InitialLimit: 2, MaxLimit: 2, MaxQueue: 2, QueueTimeoutMS: 2000})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ctx := context.Background()
+
+	if !l.acquire(ctx, classNormal) || !l.acquire(ctx, classNormal) {
+		t.Fatal("Expected requests under the limit to be admitted")
+	}
+
+	var order []int
+	done := make(chan int, 2)
+	wait := func(class int) {
+		if l.acquire(ctx, class) {
+			done <- class
+		}
+	}
+	go wait(classLow)
+	waitQueued(t, l, 1)
+
+	// Low and normal may only fill part of the queue
+	if l.acquire(ctx, classLow) || l.acquire(ctx, classNormal) {
+		t.Fatal("Expected lower classes to be shed once their queue share is used")
+	}
+	go wait(classHigh)
+	waitQueued(t, l, 2)
+	if l.acquire(ctx, classCritical) {
+		t.Fatal("Expected shedding when the queue is full")
+	}
+
+	l.release(time.Millisecond, false)
+	order = append(order, <-done)
+	l.release(time.Millisecond, false)
+	order = append(order, <-done)
+	if order[0] != classHigh || order[1] != classLow {
+		t.Errorf("Expected high before low, got %v", order)
+	}
+	if s := l.stats("/"); s.Shed != 3 || s.InFlight != 2 || s.Queued != 0 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+}
+
+func waitQueued(t *testing.T, l *concurrencyLimiter, n int) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if l.stats("").Queued == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d queued requests", n)
+}
+
+func TestConcurrencyLimiter_Adapts(t *testing.T) {
+	aimd, _ := newConcurrencyLimiter(&ConcurrencyConfig{InitialLimit: 10, MinLimit: 2, LatencyTargetMS: 100})
+	aimd.inflight = 100
+	for i := 0; i < 50; i++ {
+		aimd.release(500*time.Millisecond, false)
+	}
+	if got := aimd.stats("").Limit; got != 2 {
+		t.Errorf("Expected AIMD to back off to the minimum on slow responses, got %d", got)
+	}
+	for i := 0; i < 50; i++ {
+		aimd.release(10*time.Millisecond, false)
+	}
+	if got := aimd.stats("").Limit; got <= 2 {
+		t.Errorf("Expected AIMD to grow on fast responses, got %d", got)
+	}
+
+	gradient, _ := newConcurrencyLimiter(&ConcurrencyConfig{Algorithm: "gradient", InitialLimit: 100})
+	gradient.inflight = 100
+	gradient.release(10*time.Millisecond, false)
+	for i := 0; i < 50; i++ {
+		gradient.release(100*time.Millisecond, false)
+	}
+	if got := gradient.stats("").Limit; got >= 50 {
+		t.Errorf("Expected gradient limit to drop as latency rises, got %d", got)
+	}
+
+	if _, err := newConcurrencyLimiter(&ConcurrencyConfig{Algorithm: "vegas"}); err == nil {
+		t.Error("Expected error for unknown algorithm")
+	}
+	if _, err := newConcurrencyLimiter(&ConcurrencyConfig{DefaultClass: "urgent"}); err == nil {
+		t.Error("Expected error for unknown class")
+	}
+}
+
+func TestProxy_ConcurrencyShedding(t *testing.T) {
+	release := make(chan struct{})
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:        "/api",
+		Targets:     []string{backend.URL},
+		Concurrency: &ConcurrencyConfig{InitialLimit: 1, MaxLimit: 1, MaxQueue: 4, QueueTimeoutMS: 50, RetryAfter: 3},
+	}})
+
+	first := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api", nil))
+		first <- w.Code
+	}()
+	for hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("Expected 503 with Retry-After while saturated, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if atomic.LoadUint64(&p.ShedRequests) != 1 {
+		t.Errorf("Expected 1 shed request, got %d", p.ShedRequests)
+	}
+
+	close(release)
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("Expected admitted request to succeed, got %d", code)
+	}
+	if s := p.GetConcurrencyStats()[0]; s.InFlight != 0 {
+		t.Errorf("Expected slot to be released, got %+v", s)
+	}
+}
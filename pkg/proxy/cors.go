@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig defines the cross-origin resource sharing policy for a route
+type CORSConfig struct {
+	AllowOrigins      []string `json:"allow_origins,omitempty"`       // Exact origins, or "*" for any
+	AllowOriginsRegex []string `json:"allow_origins_regex,omitempty"` // e.g. "^https://.*\\.example\\.com$"
+	AllowMethods      []string `json:"allow_methods,omitempty"`       // Defaults to GET, HEAD, POST
+	AllowHeaders      []string `json:"allow_headers,omitempty"`       // "*" reflects the requested headers
+	ExposeHeaders     []string `json:"expose_headers,omitempty"`
+	AllowCredentials  bool     `json:"allow_credentials,omitempty"`
+	MaxAge            int      `json:"max_age,omitempty"` // Preflight cache lifetime in seconds
+}
+
+// corsPolicy is the compiled form of a CORSConfig
+type corsPolicy struct {
+	anyOrigin      bool
+	origins        map[string]bool
+	originPatterns []*regexp.Regexp
+	methods        map[string]bool
+	allowMethods   string
+	anyHeader      bool
+	headers        map[string]bool
+	allowHeaders   string
+	exposeHeaders  string
+	credentials    bool
+	maxAge         string
+}
+
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// newCORSPolicy compiles a CORS config. A nil config yields a nil policy.
+func newCORSPolicy(config *CORSConfig) (*corsPolicy, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	c := &corsPolicy{
+		origins:     make(map[string]bool),
+		methods:     make(map[string]bool),
+		headers:     make(map[string]bool),
+		credentials: config.AllowCredentials,
+	}
+
+	for _, o := range config.AllowOrigins {
+		if o == "*" {
+			// Reflecting every origin with credentials lets any site read authenticated responses
+			if config.AllowCredentials {
+				return nil, fmt.Errorf("allow_origins \"*\" cannot be combined with allow_credentials; list the origins")
+			}
+			c.anyOrigin = true
+			continue
+		}
+		c.origins[strings.ToLower(o)] = true
+	}
+	for _, expr := range config.AllowOriginsRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin regex %q: %w", expr, err)
+		}
+		c.originPatterns = append(c.originPatterns, re)
+	}
+
+	methods := config.AllowMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	var allowed []string
+	for _, m := range methods {
+		m = strings.ToUpper(m)
+		c.methods[m] = true
+		allowed = append(allowed, m)
+	}
+	c.allowMethods = strings.Join(allowed, ", ")
+
+	var headers []string
+	for _, h := range config.AllowHeaders {
+		if h == "*" {
+			c.anyHeader = true
+			continue
+		}
+		canonical := http.CanonicalHeaderKey(h)
+		c.headers[canonical] = true
+		headers = append(headers, canonical)
+	}
+	c.allowHeaders = strings.Join(headers, ", ")
+	c.exposeHeaders = strings.Join(config.ExposeHeaders, ", ")
+
+	if config.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(config.MaxAge)
+	}
+	return c, nil
+}
+
+// isPreflight reports whether the request is a CORS preflight
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (c *corsPolicy) allowOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if c.anyOrigin || c.origins[strings.ToLower(origin)] {
+		return true
+	}
+	for _, re := range c.originPatterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowRequestHeaders validates Access-Control-Request-Headers and returns the value to send back
+func (c *corsPolicy) allowRequestHeaders(requested string) (string, bool) {
+	if requested == "" {
+		return c.allowHeaders, true
+	}
+	if c.anyHeader {
+		return requested, true
+	}
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !c.headers[http.CanonicalHeaderKey(h)] {
+			return "", false
+		}
+	}
+	return c.allowHeaders, true
+}
+
+// setOrigin writes the Allow-Origin/Credentials pair. A wildcard origin list
+// never carries credentials, so it is sent as is; matched origins are echoed.
+func (c *corsPolicy) setOrigin(h http.Header, origin string) {
+	if c.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// handlePreflight answers an OPTIONS preflight directly and returns the status written
+func (c *corsPolicy) handlePreflight(w http.ResponseWriter, r *http.Request) int {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	allowedHeaders, headersOK := c.allowRequestHeaders(r.Header.Get("Access-Control-Request-Headers"))
+	if !c.allowOrigin(origin) || !c.methods[method] || !headersOK {
+		w.WriteHeader(http.StatusForbidden)
+		return http.StatusForbidden
+	}
+
+	c.setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", c.allowMethods)
+	if allowedHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", allowedHeaders)
+	}
+	if c.maxAge != "" {
+		h.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent
+}
+
+// applyResponse adds CORS headers to an actual (non-preflight) response,
+// replacing any CORS headers the upstream may have sent.
+func (c *corsPolicy) applyResponse(h http.Header, origin string) {
+	if !c.allowOrigin(origin) {
+		return
+	}
+	h.Del("Access-Control-Allow-Origin")
+	h.Del("Access-Control-Allow-Credentials")
+	c.setOrigin(h, origin)
+	if c.exposeHeaders != "" {
+		h.Set("Access-Control-Expose-Headers", c.exposeHeaders)
+	}
+}
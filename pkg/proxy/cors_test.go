@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxy_CORSPreflight(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{
+		{
+			Path:    "/api/*",
+			Methods: []string{"GET", "PUT", "DELETE"},
+			Targets: []string{backend.URL},
+			Auth:    &AuthConfig{Type: "api_key", Keys: map[string]string{"secret": "test"}},
+			CORS: &CORSConfig{
+				AllowOrigins:      []string{"https://app.example.com"},
+				AllowOriginsRegex: []string{`^https://[a-z0-9]+\.preview\.example\.com$`},
+				AllowMethods:      []string{"GET", "PUT"},
+				AllowHeaders:      []string{"Content-Type", "X-API-Key"},
+				AllowCredentials:  true,
+				MaxAge:            600,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/api/items", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w
+	}
+
+	w := preflight("https://app.example.com", "PUT", "content-type, x-api-key")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for allowed preflight, got %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Expected origin to be echoed, got %q", got)
+	}
+	if w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("Expected Allow-Credentials header")
+	}
+	if w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("Expected Max-Age 600, got %q", w.Header().Get("Access-Control-Max-Age"))
+	}
+
+	if w := preflight("https://pr42.preview.example.com", "GET", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected regex origin to be allowed, got %d", w.Code)
+	}
+	if w := preflight("https://evil.example.org", "GET", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for unknown origin, got %d", w.Code)
+	}
+	if w := preflight("https://app.example.com", "DELETE", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for disallowed method, got %d", w.Code)
+	}
+	if w := preflight("https://app.example.com", "GET", "X-Other"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for disallowed header, got %d", w.Code)
+	}
+
+	if atomic.LoadInt32(&hits) != 0 {
+		t.Errorf("Preflights must not reach the backend, got %d hits", hits)
+	}
+}
+
+func TestProxy_CORSActualRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("X-Total-Count", "3")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{
+		{
+			Path:    "/api/*",
+			Targets: []string{backend.URL},
+			CORS: &CORSConfig{
+				AllowOrigins:     []string{"https://app.example.com"},
+				ExposeHeaders:    []string{"X-Total-Count"},
+				AllowCredentials: true,
+			},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if got := w.Result().Header.Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://app.example.com" {
+		t.Errorf("Expected a single echoed origin with credentials, got %v", got)
+	}
+	if w.Header().Get("Access-Control-Expose-Headers") != "X-Total-Count" {
+		t.Error("Expected Expose-Headers to be set")
+	}
+}
+
+func TestProxy_CORSWildcardCredentials(t *testing.T) {
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{
+		{Path: "/api", Targets: []string{"http://localhost:1"}, CORS: &CORSConfig{AllowOrigins: []string{"*"}, AllowCredentials: true}},
+	})
+	if err == nil {
+		t.Error("Expected error for wildcard origin with credentials")
+	}
+
+	p.UpdateRoutes([]ConfigRoute{
+		{Path: "/api", Targets: []string{"http://localhost:1"}, CORS: &CORSConfig{AllowOrigins: []string{"*"}}},
+	})
+	req := httptest.NewRequest(http.MethodOptions, "/api", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Expected a literal wildcard without credentials, got %q", got)
+	}
+}
+
+func TestProxy_CORSInvalidRegex(t *testing.T) {
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{
+		{Path: "/api", Targets: []string{"http://localhost:1"}, CORS: &CORSConfig{AllowOriginsRegex: []string{"("}}},
+	})
+	if err == nil {
+		t.Error("Expected error for invalid origin regex")
+	}
+}
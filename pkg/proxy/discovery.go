@@ -0,0 +1,593 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DiscoveryConfig fills a route's pool from a provider instead of its static
+// targets, which only serve until the first lookup succeeds
+type DiscoveryConfig struct {
+	Type string `json:"type"` // "dns", "file" or "http"
+	// Name is the host to resolve, or the SRV service name such as _http._tcp.api.internal
+	Name       string `json:"name,omitempty"`
+	RecordType string `json:"record_type,omitempty"` // "A", "AAAA", "SRV", or both address types by default
+	Port       int    `json:"port,omitempty"`        // Target port for A/AAAA records
+	Scheme     string `json:"scheme,omitempty"`      // Target scheme, "http" by default
+	Server     string `json:"server,omitempty"`      // Resolver host:port, the first nameserver in /etc/resolv.conf by default
+	// Path is a JSON or YAML target list, re-read when it changes
+	Path string `json:"path,omitempty"`
+	// URL returns a JSON target list
+	URL string `json:"url,omitempty"`
+	// RefreshMS is the file and http poll interval and the retry interval after
+	// a failed lookup; DNS answers are otherwise refreshed when their TTL expires
+	RefreshMS int `json:"refresh_ms,omitempty"`
+}
+
+// DiscoveredTarget is one pool member reported by a provider. File and http
+// lists hold these objects or bare URLs, either top-level or under "targets".
+type DiscoveredTarget struct {
+	URL      string `json:"url" yaml:"url"`
+	Weight   int    `json:"weight,omitempty" yaml:"weight"`
+	Locality string `json:"locality,omitempty" yaml:"locality"`
+}
+
+// DNS answers are never refreshed more often than this, whatever their TTL
+var minDNSRefresh = time.Second
+
+// maxDNSRefresh caps the wait on records with long TTLs
+const maxDNSRefresh = time.Hour
+
+// errUnchanged reports that a watched source has not changed since the last read
+var errUnchanged = errors.New("unchanged")
+
+// discoverer looks up a pool's members
+type discoverer interface {
+	// discover returns the current targets and how long to wait before asking again
+	discover(ctx context.Context) ([]DiscoveredTarget, time.Duration, error)
+}
+
+func newDiscoverer(cfg *DiscoveryConfig) (discoverer, error) {
+	refresh := time.Duration(cfg.RefreshMS) * time.Millisecond
+	if cfg.RefreshMS < 0 {
+		return nil, fmt.Errorf("refresh_ms must not be negative")
+	}
+	if refresh == 0 {
+		refresh = 5 * time.Second
+	}
+	switch cfg.Type {
+	case "dns":
+		return newDNSDiscoverer(cfg, refresh)
+	case "file":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("file discovery needs a path")
+		}
+		return &fileDiscoverer{path: cfg.Path, refresh: refresh}, nil
+	case "http":
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("http discovery needs an http(s) url, got %q", cfg.URL)
+		}
+		return &httpDiscoverer{url: cfg.URL, refresh: refresh, client: &http.Client{Timeout: 5 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery type %q", cfg.Type)
+	}
+}
+
+// parseTargetList reads a JSON or YAML target list, which must not be empty
+func parseTargetList(data []byte) ([]DiscoveredTarget, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if m, ok := doc.(map[string]interface{}); ok {
+		doc = m["targets"]
+	}
+	items, ok := doc.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of targets")
+	}
+
+	targets := make([]DiscoveredTarget, 0, len(items))
+	for _, item := range items {
+		var t DiscoveredTarget
+		switch v := item.(type) {
+		case string:
+			t.URL = v
+		case map[string]interface{}:
+			raw, _ := yaml.Marshal(v)
+			if err := yaml.Unmarshal(raw, &t); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected target %v", item)
+		}
+		if _, err := url.Parse(t.URL); err != nil || t.URL == "" {
+			return nil, fmt.Errorf("invalid target url %q", t.URL)
+		}
+		if t.Weight < 0 {
+			return nil, fmt.Errorf("negative weight for %s", t.URL)
+		}
+		targets = append(targets, t)
+	}
+	// Like an empty DNS answer, an empty list is more likely a bad write than a real drain
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("empty target list")
+	}
+	return targets, nil
+}
+
+// fileDiscoverer re-reads a target list whenever its modification time or size changes
+type fileDiscoverer struct {
+	path    string
+	refresh time.Duration
+	modTime time.Time
+	size    int64
+}
+
+func (d *fileDiscoverer) discover(ctx context.Context) ([]DiscoveredTarget, time.Duration, error) {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return nil, d.refresh, err
+	}
+	if info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+		return nil, d.refresh, errUnchanged
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return nil, d.refresh, err
+	}
+	targets, err := parseTargetList(data)
+	if err != nil {
+		return nil, d.refresh, fmt.Errorf("parsing %s: %w", d.path, err)
+	}
+	d.modTime, d.size = info.ModTime(), info.Size()
+	return targets, d.refresh, nil
+}
+
+// httpDiscoverer polls an endpoint that returns the target list
+type httpDiscoverer struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+}
+
+func (d *httpDiscoverer) discover(ctx context.Context) ([]DiscoveredTarget, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, d.refresh, err
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, d.refresh, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, d.refresh, fmt.Errorf("%s returned %s", d.url, res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, d.refresh, err
+	}
+	targets, err := parseTargetList(data)
+	return targets, d.refresh, err
+}
+
+// dnsDiscoverer resolves A/AAAA or SRV records directly against a nameserver,
+// since the system resolver does not expose TTLs
+type dnsDiscoverer struct {
+	name    dnsmessage.Name
+	types   []dnsmessage.Type
+	port    int
+	scheme  string
+	server  string
+	refresh time.Duration
+}
+
+func newDNSDiscoverer(cfg *DiscoveryConfig, refresh time.Duration) (*dnsDiscoverer, error) {
+	fqdn := cfg.Name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil || cfg.Name == "" {
+		return nil, fmt.Errorf("invalid dns name %q", cfg.Name)
+	}
+	d := &dnsDiscoverer{name: name, port: cfg.Port, scheme: cfg.Scheme, server: cfg.Server, refresh: refresh}
+	switch strings.ToUpper(cfg.RecordType) {
+	case "":
+		d.types = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	case "A":
+		d.types = []dnsmessage.Type{dnsmessage.TypeA}
+	case "AAAA":
+		d.types = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	case "SRV":
+		d.types = []dnsmessage.Type{dnsmessage.TypeSRV}
+	default:
+		return nil, fmt.Errorf("unknown record_type %q", cfg.RecordType)
+	}
+	if d.types[0] != dnsmessage.TypeSRV && (d.port <= 0 || d.port > 65535) {
+		return nil, fmt.Errorf("address records need a port")
+	}
+	if d.scheme == "" {
+		d.scheme = "http"
+	}
+	if d.server == "" {
+		d.server = systemNameserver()
+	} else if _, _, err := net.SplitHostPort(d.server); err != nil {
+		d.server = net.JoinHostPort(d.server, "53")
+	}
+	return d, nil
+}
+
+// systemNameserver returns the first nameserver in /etc/resolv.conf
+func systemNameserver() string {
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+func (d *dnsDiscoverer) discover(ctx context.Context) ([]DiscoveredTarget, time.Duration, error) {
+	var targets []DiscoveredTarget
+	ttl := maxDNSRefresh
+	observe := func(h dnsmessage.ResourceHeader) {
+		ttl = min(ttl, time.Duration(h.TTL)*time.Second)
+	}
+
+	if d.types[0] == dnsmessage.TypeSRV {
+		answers, additional, err := d.query(ctx, d.name, dnsmessage.TypeSRV)
+		if err != nil {
+			return nil, d.refresh, err
+		}
+		// Only the most preferred priority is used; the rest are fallbacks
+		var best []*dnsmessage.SRVResource
+		for _, rr := range answers {
+			srv, ok := rr.Body.(*dnsmessage.SRVResource)
+			if !ok {
+				continue
+			}
+			observe(rr.Header)
+			if len(best) > 0 && srv.Priority > best[0].Priority {
+				continue
+			}
+			if len(best) > 0 && srv.Priority < best[0].Priority {
+				best = nil
+			}
+			best = append(best, srv)
+		}
+		for _, srv := range best {
+			ips, err := d.addresses(ctx, srv.Target, additional, observe)
+			if err != nil {
+				return nil, d.refresh, err
+			}
+			for _, ip := range ips {
+				targets = append(targets, DiscoveredTarget{
+					URL:    d.scheme + "://" + net.JoinHostPort(ip, strconv.Itoa(int(srv.Port))),
+					Weight: max(int(srv.Weight), 1),
+				})
+			}
+		}
+	} else {
+		ips, err := d.addresses(ctx, d.name, nil, observe)
+		if err != nil {
+			return nil, d.refresh, err
+		}
+		for _, ip := range ips {
+			targets = append(targets, DiscoveredTarget{URL: d.scheme + "://" + net.JoinHostPort(ip, strconv.Itoa(d.port))})
+		}
+	}
+
+	// An empty answer is treated as a failure so a bad zone does not empty the pool
+	if len(targets) == 0 {
+		return nil, d.refresh, fmt.Errorf("no records for %s", d.name)
+	}
+	return targets, max(ttl, minDNSRefresh), nil
+}
+
+// addresses resolves name with the configured address types, using glue
+// records from an SRV answer when present
+func (d *dnsDiscoverer) addresses(ctx context.Context, name dnsmessage.Name, glue []dnsmessage.Resource, observe func(dnsmessage.ResourceHeader)) ([]string, error) {
+	types := d.types
+	if types[0] == dnsmessage.TypeSRV {
+		types = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	}
+	collect := func(records []dnsmessage.Resource) []string {
+		var ips []string
+		for _, rr := range records {
+			if !strings.EqualFold(rr.Header.Name.String(), name.String()) {
+				continue
+			}
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				observe(rr.Header)
+				ips = append(ips, net.IP(body.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				observe(rr.Header)
+				ips = append(ips, net.IP(body.AAAA[:]).String())
+			}
+		}
+		return ips
+	}
+	if ips := collect(glue); len(ips) > 0 {
+		return ips, nil
+	}
+
+	var ips []string
+	for _, t := range types {
+		answers, _, err := d.query(ctx, name, t)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, collect(answers)...)
+	}
+	return ips, nil
+}
+
+// query sends a single question over UDP, retrying over TCP when the answer is truncated
+func (d *dnsDiscoverer) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]dnsmessage.Resource, []dnsmessage.Resource, error) {
+	id := uint16(rand.Uint32())
+	question := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var dialer net.Dialer
+
+	var reply dnsmessage.Message
+	for _, network := range []string{"udp", "tcp"} {
+		conn, err := dialer.DialContext(ctx, network, d.server)
+		if err != nil {
+			return nil, nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		data, err := exchange(conn, network, packed)
+		conn.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("querying %s: %w", d.server, err)
+		}
+		if err := reply.Unpack(data); err != nil {
+			return nil, nil, err
+		}
+		if reply.ID != id || !reply.Response || !answersQuestion(reply, question) {
+			return nil, nil, fmt.Errorf("dns reply from %s does not match the query", d.server)
+		}
+		if !reply.Truncated {
+			break
+		}
+	}
+
+	switch reply.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil, fmt.Errorf("%s does not exist", name)
+	default:
+		return nil, nil, fmt.Errorf("resolving %s: %s", name, reply.RCode)
+	}
+	return reply.Answers, reply.Additionals, nil
+}
+
+// answersQuestion reports whether a reply echoes the single question asked;
+// names compare case-insensitively
+func answersQuestion(reply dnsmessage.Message, q dnsmessage.Question) bool {
+	if len(reply.Questions) != 1 {
+		return false
+	}
+	got := reply.Questions[0]
+	return got.Type == q.Type && got.Class == q.Class && strings.EqualFold(got.Name.String(), q.Name.String())
+}
+
+// exchange writes a packed query and reads the reply, length-prefixed over TCP
+func exchange(conn net.Conn, network string, packed []byte) ([]byte, error) {
+	if network == "udp" {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	if _, err := conn.Write(append(framed, packed...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err := io.ReadFull(conn, buf)
+	return buf, err
+}
+
+// restartDiscovery stops the providers of the previous routes and starts one
+// per route with discovery. Must be called with p.mu held.
+func (p *Proxy) restartDiscovery() {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+
+	for _, cancel := range p.discoveryCancels {
+		cancel()
+	}
+	p.discoveryCancels = nil
+
+	for _, r := range p.routes {
+		if r.discovery == nil || r.Pool == nil {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		p.discoveryCancels = append(p.discoveryCancels, cancel)
+		go p.runDiscovery(ctx, r.Path, r.Pool, r.discovery)
+	}
+}
+
+func (p *Proxy) runDiscovery(ctx context.Context, routePath string, pool *Pool, d discoverer) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			targets, wait, err := d.discover(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			switch {
+			case errors.Is(err, errUnchanged):
+			case err != nil:
+				// Keep the members we have until the provider recovers
+				fmt.Printf("⚠️ Discovery for %s failed: %v\n", routePath, err)
+			default:
+				if err := p.applyDiscovered(routePath, pool, targets); err != nil {
+					fmt.Printf("⚠️ Discovery for %s returned bad targets: %v\n", routePath, err)
+				}
+			}
+			timer.Reset(wait)
+		}
+	}
+}
+
+// applyDiscovered swaps pool's membership for targets. Targets already in
+// the pool keep their backend, and with it their health state and
+// connections; removed ones drain like targets dropped by a reload.
+func (p *Proxy) applyDiscovered(routePath string, pool *Pool, targets []DiscoveredTarget) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var route *Route
+	for i := range p.routes {
+		if p.routes[i].Pool == pool {
+			route = &p.routes[i]
+		}
+	}
+	if route == nil {
+		return nil // Replaced by a reload
+	}
+	if discoveredEqual(pool.discovered, targets) {
+		return nil
+	}
+
+	next, err := discoveredBackends(targets, pool.backends(), pool.opts)
+	if err != nil {
+		return err
+	}
+
+	// New members pick up any state their target still has, then join the registry
+	current := make(map[*Backend]bool)
+	for _, b := range pool.backends() {
+		current[b] = true
+	}
+	kept := make(map[string]bool)
+	for _, b := range next {
+		key := healthKey(routePath, b.URL.String())
+		kept[key] = true
+		if current[b] {
+			continue
+		}
+		if h, ok := p.healthStates[key]; ok {
+			b.health = h
+		} else if h, ok := p.removedBackends[key]; ok {
+			h.draining.Store(false)
+			b.health = h
+			delete(p.removedBackends, key)
+		}
+		p.healthStates[key] = b.health
+	}
+
+	pool.members.Store(&next)
+	pool.discovered = targets
+
+	// Drain removed targets unless another pool of the route still uses them
+	for _, other := range route.pools() {
+		for _, b := range other.backends() {
+			kept[healthKey(routePath, b.URL.String())] = true
+		}
+	}
+	for b := range current {
+		key := healthKey(routePath, b.URL.String())
+		if kept[key] {
+			continue
+		}
+		b.health.draining.Store(true)
+		p.removedBackends[key] = b.health
+		delete(p.healthStates, key)
+	}
+	fmt.Printf("🔄 Discovery updated %s: %d targets\n", routePath, len(next))
+	return nil
+}
+
+// discoveredBackends builds the members for targets, reusing unchanged backends from current
+func discoveredBackends(targets []DiscoveredTarget, current []*Backend, opts poolOptions) ([]*Backend, error) {
+	existing := make(map[string]*Backend, len(current))
+	for _, b := range current {
+		existing[b.URL.String()] = b
+	}
+	seen := make(map[string]bool, len(targets))
+	next := make([]*Backend, 0, len(targets))
+	for _, t := range targets {
+		b, err := newBackend(t.URL, t.Weight, t.Locality, opts)
+		if err != nil {
+			return nil, err
+		}
+		key := b.URL.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if old, ok := existing[key]; ok {
+			if old.Weight == b.Weight && old.Locality == b.Locality {
+				b = old
+			} else {
+				// Weights are read without locks, so a change needs a new backend
+				b.Proxy, b.health = old.Proxy, old.health
+			}
+		}
+		next = append(next, b)
+	}
+	return next, nil
+}
+
+func discoveredEqual(a, b []DiscoveredTarget) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers from a mutable record set over UDP
+type fakeDNS struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	records map[string][]dnsmessage.Resource // "name|type"
+	spoof   bool                             // Answer with a different question
+}
+
+func startFakeDNS(t *testing.T) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	d := &fakeDNS{conn: conn, records: make(map[string][]dnsmessage.Resource)}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil || len(query.Questions) != 1 {
+				continue
+			}
+			q := query.Questions[0]
+			d.mu.Lock()
+			answers := d.records[q.Name.String()+"|"+q.Type.String()]
+			if d.spoof {
+				query.Questions[0].Name = dnsmessage.MustNewName("other.test.")
+			}
+			d.mu.Unlock()
+			reply := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+				Questions: query.Questions,
+				Answers:   answers,
+			}
+			packed, _ := reply.Pack()
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return d
+}
+
+func (d *fakeDNS) set(name string, qtype dnsmessage.Type, records ...dnsmessage.Resource) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.records[name+"|"+qtype.String()] = records
+}
+
+func aRecord(name string, ttl uint32, ip string) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: a},
+	}
+}
+
+func srvRecord(name string, ttl uint32, target string, port, weight uint16) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port, Weight: weight},
+	}
+}
+
+func namedBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+	}))
+}
+
+func routeTargets(p *Proxy) []string {
+	targets := p.GetRoutes()[0].Targets
+	sort.Strings(targets)
+	return targets
+}
+
+func waitForTargets(t *testing.T, p *Proxy, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if fmt.Sprint(routeTargets(p)) == fmt.Sprint(want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected targets %v, got %v", want, routeTargets(p))
+}
+
+func portOf(t *testing.T, s *httptest.Server) uint16 {
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("Bad port %q", port)
+	}
+	return uint16(n)
+}
+
+func TestDiscovery_DNSSRV(t *testing.T) {
+	a, b, c := namedBackend("a"), namedBackend("b"), namedBackend("c")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	dns := startFakeDNS(t)
+	dns.set("_http._tcp.api.test.", dnsmessage.TypeSRV,
+		srvRecord("_http._tcp.api.test.", 1, "a.test.", portOf(t, a), 10),
+		srvRecord("_http._tcp.api.test.", 1, "b.test.", portOf(t, b), 10))
+	for _, host := range []string{"a.test.", "b.test.", "c.test."} {
+		dns.set(host, dnsmessage.TypeA, aRecord(host, 60, "127.0.0.1"))
+	}
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:      "/*",
+		Discovery: &DiscoveryConfig{Type: "dns", Name: "_http._tcp.api.test", RecordType: "SRV", Server: dns.conn.LocalAddr().String()},
+	}})
+	if err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+	waitForTargets(t, p, a.URL, b.URL)
+
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		seen[rec.Body.String()] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Errorf("Expected both discovered backends to serve, got %v", seen)
+	}
+
+	// Health state survives a membership change that keeps the target
+	p.mu.RLock()
+	for _, backend := range p.routes[0].Pool.backends() {
+		if backend.URL.String() == a.URL {
+			p.setBackendHealth("/*", backend, false, "down")
+		}
+	}
+	p.mu.RUnlock()
+
+	// Once the 1s TTL expires, the changed record set is picked up in place
+	dns.set("_http._tcp.api.test.", dnsmessage.TypeSRV,
+		srvRecord("_http._tcp.api.test.", 1, "a.test.", portOf(t, a), 10),
+		srvRecord("_http._tcp.api.test.", 1, "c.test.", portOf(t, c), 10))
+	waitForTargets(t, p, a.URL, c.URL)
+	for _, s := range p.GetBackendHealth() {
+		if s.Backend == a.URL && s.Healthy {
+			t.Error("Expected the kept target to stay unhealthy across discovery updates")
+		}
+		if s.Backend == b.URL && !s.Removed {
+			t.Error("Expected the dropped target to be reported only while draining")
+		}
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "c" {
+		t.Errorf("Expected the healthy new member to serve, got %q", rec.Body.String())
+	}
+}
+
+func TestDiscovery_DNSFailureKeepsMembers(t *testing.T) {
+	dns := startFakeDNS(t)
+	dns.set("api.test.", dnsmessage.TypeA, aRecord("api.test.", 1, "10.0.0.1"))
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:      "/*",
+		Discovery: &DiscoveryConfig{Type: "dns", Name: "api.test", RecordType: "A", Port: 8080, Server: dns.conn.LocalAddr().String(), RefreshMS: 20},
+	}})
+	waitForTargets(t, p, "http://10.0.0.1:8080")
+
+	// An empty answer leaves the pool as it was
+	dns.set("api.test.", dnsmessage.TypeA)
+	time.Sleep(1500 * time.Millisecond)
+	if got := routeTargets(p); len(got) != 1 {
+		t.Errorf("Expected the last members to be kept, got %v", got)
+	}
+}
+
+func TestDiscovery_DNSRejectsMismatchedReply(t *testing.T) {
+	dns := startFakeDNS(t)
+	dns.set("api.test.", dnsmessage.TypeA, aRecord("api.test.", 60, "10.0.0.1"))
+	d := &dnsDiscoverer{server: dns.conn.LocalAddr().String()}
+	name := dnsmessage.MustNewName("API.test.")
+
+	if _, _, err := d.query(context.Background(), name, dnsmessage.TypeA); err != nil {
+		t.Fatalf("Expected a case-insensitive question match, got %v", err)
+	}
+	dns.mu.Lock()
+	dns.spoof = true
+	dns.mu.Unlock()
+	if _, _, err := d.query(context.Background(), name, dnsmessage.TypeA); err == nil {
+		t.Error("Expected a reply for another question to be rejected")
+	}
+}
+
+func TestDiscovery_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	os.WriteFile(path, []byte(`[{"url": "http://10.0.0.1:80", "weight": 5}, "http://10.0.0.2:80"]`), 0644)
+
+	p, _ := New([]string{})
+	if err := p.UpdateRoutes([]ConfigRoute{{
+		Path:      "/*",
+		Targets:   []string{"http://10.0.0.9:80"},
+		Discovery: &DiscoveryConfig{Type: "file", Path: path, RefreshMS: 20},
+	}}); err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+	waitForTargets(t, p, "http://10.0.0.1:80", "http://10.0.0.2:80")
+	if w := p.GetRoutes()[0].Weights["http://10.0.0.1:80"]; w != 5 {
+		t.Errorf("Expected the listed weight, got %d", w)
+	}
+
+	// YAML with a targets key works too; removed targets drain
+	os.WriteFile(path, []byte("targets:\n  - url: http://10.0.0.2:80\n  - url: http://10.0.0.3:80\n    locality: eu-1\n"), 0644)
+	waitForTargets(t, p, "http://10.0.0.2:80", "http://10.0.0.3:80")
+
+	// An emptied or truncated file keeps the last members
+	os.WriteFile(path, []byte("[]"), 0644)
+	time.Sleep(100 * time.Millisecond)
+	os.WriteFile(path, nil, 0644)
+	time.Sleep(100 * time.Millisecond)
+	if got := routeTargets(p); len(got) != 2 {
+		t.Errorf("Expected an empty list to keep the last members, got %v", got)
+	}
+	os.WriteFile(path, []byte("targets:\n  - url: http://10.0.0.2:80\n  - url: http://10.0.0.3:80\n"), 0644)
+
+	// A reload with the same discovery starts from the discovered members
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:      "/*",
+		Targets:   []string{"http://10.0.0.9:80"},
+		Discovery: &DiscoveryConfig{Type: "file", Path: path, RefreshMS: 20},
+	}})
+	if got := routeTargets(p); fmt.Sprint(got) != "[http://10.0.0.2:80 http://10.0.0.3:80]" {
+		t.Errorf("Expected discovered members to survive the reload, got %v", got)
+	}
+}
+
+func TestDiscovery_HTTP(t *testing.T) {
+	var mu sync.Mutex
+	list := `{"targets": ["http://10.0.0.1:80"]}`
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, list)
+	}))
+	defer endpoint.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{Path: "/*", Discovery: &DiscoveryConfig{Type: "http", URL: endpoint.URL, RefreshMS: 20}}})
+	waitForTargets(t, p, "http://10.0.0.1:80")
+
+	mu.Lock()
+	list = `["http://10.0.0.1:80", "http://10.0.0.2:80"]`
+	mu.Unlock()
+	waitForTargets(t, p, "http://10.0.0.1:80", "http://10.0.0.2:80")
+
+	mu.Lock()
+	list = `{"targets": []}`
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	if got := routeTargets(p); len(got) != 2 {
+		t.Errorf("Expected an empty list to keep the last members, got %v", got)
+	}
+}
+
+func TestDiscovery_InvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]DiscoveryConfig{
+		"type":        {Type: "consul"},
+		"dns port":    {Type: "dns", Name: "api.test"},
+		"record type": {Type: "dns", Name: "api.test", RecordType: "MX", Port: 80},
+		"file":        {Type: "file"},
+		"http":        {Type: "http", URL: "ftp://example.com"},
+	} {
+		p, _ := New([]string{})
+		if err := p.UpdateRoutes([]ConfigRoute{{Path: "/*", Discovery: &cfg}}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
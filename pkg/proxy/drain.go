@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// minSlowStartFactor is the share of its weight a backend gets the moment it recovers
+const minSlowStartFactor = 0.1
+
+// slowStartFactor scales a backend's weight while it warms up after recovering.
+// Backends that have never been down start at full weight.
+func (b *Backend) slowStartFactor(window time.Duration, now time.Time) float64 {
+	if window <= 0 {
+		return 1
+	}
+	recovered := b.health.recoveredAt.Load()
+	if recovered == 0 {
+		return 1
+	}
+	elapsed := now.Sub(time.Unix(0, recovered))
+	if elapsed >= window {
+		return 1
+	}
+	return max(float64(elapsed)/float64(window), minSlowStartFactor)
+}
+
+// IsDraining reports whether the backend is refusing new requests
+func (b *Backend) IsDraining() bool {
+	return b.health.draining.Load()
+}
+
+// pickRamped chooses a backend by weight scaled by slow-start, or returns nil
+// when no candidate is warming up and the normal algorithm applies
+func (p *Pool) pickRamped(candidates []*Backend, weighted bool) *Backend {
+	if p.slowStart <= 0 {
+		return nil
+	}
+	now := time.Now()
+	weights := make([]float64, len(candidates))
+	ramping := false
+	total := 0.0
+	for i, b := range candidates {
+		weight := 100.0
+		if weighted && b.Weight > 0 {
+			weight = float64(b.Weight)
+		}
+		factor := b.slowStartFactor(p.slowStart, now)
+		if factor < 1 {
+			ramping = true
+		}
+		weights[i] = weight * factor
+		total += weights[i]
+	}
+	if !ramping {
+		return nil
+	}
+
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return candidates[i]
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1]
+}
+
+// SetBackendDrain stops (or resumes) new requests to a backend of a route while
+// in-flight requests complete. An empty route addresses the default pool.
+func (p *Proxy) SetBackendDrain(routePath, target string, drain bool) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	h, ok := p.healthStates[healthKey(routePath, target)]
+	if !ok {
+		return fmt.Errorf("backend %s not found on route %q", target, routePath)
+	}
+	h.draining.Store(drain)
+	return nil
+}
+
+// drainRemoved marks the state of targets dropped by a reload as draining and
+// keeps it reported until their in-flight requests finish. Must be called with p.mu held.
+func (p *Proxy) drainRemoved(states map[string]*backendHealth) {
+	for key, h := range p.healthStates {
+		if _, kept := states[key]; kept {
+			continue
+		}
+		h.draining.Store(true)
+		p.removedBackends[key] = h
+	}
+	for key, h := range p.removedBackends {
+		if _, back := states[key]; back || h.inflight.Load() == 0 {
+			delete(p.removedBackends, key)
+		}
+	}
+}
+
+func splitHealthKey(key string) (string, string) {
+	routePath, target, _ := strings.Cut(key, "|")
+	return routePath, target
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxy_BackendDrain(t *testing.T) {
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{Path: "/api", Targets: []string{"http://10.0.0.1:80", "http://10.0.0.2:80"}}})
+	pool := p.routes[0].Pool
+
+	if err := p.SetBackendDrain("/api", "http://10.0.0.1:80", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if b := pool.GetNext(); b.URL.String() != "http://10.0.0.2:80" {
+			t.Fatalf("Draining backend should not receive new requests, got %s", b.URL)
+		}
+	}
+
+	// Drain survives a reload of the same targets
+	p.UpdateRoutes(p.GetRoutes())
+	if !p.routes[0].Pool.backends()[0].IsDraining() {
+		t.Error("Drain mode should be kept across reloads")
+	}
+
+	p.SetBackendDrain("/api", "http://10.0.0.2:80", true)
+	if b := p.routes[0].Pool.GetNext(); b != nil {
+		t.Errorf("Expected no backend when all are draining, got %s", b.URL)
+	}
+
+	if err := p.SetBackendDrain("/api", "http://10.0.0.9:80", true); err == nil {
+		t.Error("Expected error for unknown backend")
+	}
+}
+
+func TestProxy_RemovedTargetDrains(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer slow.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{Path: "/api", Targets: []string{slow.URL}}})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api", nil))
+		done <- w
+	}()
+	<-started
+
+	p.UpdateRoutes([]ConfigRoute{{Path: "/api", Targets: []string{"http://10.0.0.2:80"}}})
+
+	var removed *BackendHealthStatus
+	for _, s := range p.GetBackendHealth() {
+		if s.Backend == slow.URL {
+			removed = &s
+		}
+	}
+	if removed == nil || !removed.Removed || !removed.Draining || removed.InFlight != 1 {
+		t.Fatalf("Expected removed target to be reported as draining, got %+v", removed)
+	}
+
+	close(release)
+	w := <-done
+	if w.Code != http.StatusOK || w.Body.String() != "done" {
+		t.Errorf("In-flight request should complete, got %d %q", w.Code, w.Body.String())
+	}
+	for _, s := range p.GetBackendHealth() {
+		if s.Backend == slow.URL {
+			t.Error("Removed target should disappear once drained")
+		}
+	}
+}
+
+func TestPool_SlowStart(t *testing.T) {
+	pool, _ := createBackendPoolWithOptions(
+		[]string{"http://10.0.0.1:80", "http://10.0.0.2:80"},
+		poolOptions{slowStart: time.Minute},
+	)
+	recovered := pool.backends()[0]
+	recovered.health.set(false, "down")
+	recovered.health.set(true, "up")
+
+	if f := recovered.slowStartFactor(time.Minute, time.Now()); f != minSlowStartFactor {
+		t.Errorf("Expected minimum factor right after recovery, got %f", f)
+	}
+	if f := recovered.slowStartFactor(time.Minute, time.Now().Add(30*time.Second)); f < 0.45 || f > 0.55 {
+		t.Errorf("Expected roughly half weight mid-window, got %f", f)
+	}
+	if f := pool.backends()[1].slowStartFactor(time.Minute, time.Now()); f != 1 {
+		t.Errorf("Never-failed backend should have full weight, got %f", f)
+	}
+
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		if pool.GetNext() == recovered {
+			hits++
+		}
+	}
+	if hits > 250 {
+		t.Errorf("Warming backend got %d of 1000 requests, expected a reduced share", hits)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"fmt"
+)
+
+// FailoverConfig adds ordered priority tiers behind a route's Targets, which
+// form the primary tier. Traffic moves to the next tier when the healthy share
+// of the current one drops below MinHealthyPercent.
+type FailoverConfig struct {
+	Tiers             []FailoverTier `json:"tiers"`
+	MinHealthyPercent int            `json:"min_healthy_percent,omitempty"` // 0 fails over only when no backend is healthy
+}
+
+// FailoverTier is one secondary pool, e.g. a standby region
+type FailoverTier struct {
+	Name     string         `json:"name,omitempty"`
+	Targets  []string       `json:"targets"`
+	Weights  map[string]int `json:"weights,omitempty"`
+	Locality string         `json:"locality,omitempty"` // Zone label for every target in the tier
+}
+
+// healthyPercent is the share of the pool able to take new requests
+func (p *Pool) healthyPercent() int {
+	backends := p.backends()
+	if len(backends) == 0 {
+		return 0
+	}
+	healthy := 0
+	for _, b := range backends {
+		if b.IsAlive() && !b.IsDraining() {
+			healthy++
+		}
+	}
+	return healthy * 100 / len(backends)
+}
+
+// hasCapacity reports whether the pool meets a failover threshold
+func (p *Pool) hasCapacity(minHealthyPercent int) bool {
+	pct := p.healthyPercent()
+	if minHealthyPercent <= 0 {
+		return pct > 0
+	}
+	return pct >= minHealthyPercent
+}
+
+// activePool picks the first priority tier with enough healthy capacity. When
+// every tier is below the threshold the healthiest one is used. Blue/green
+// routes always use their active colour.
+func (r *Route) activePool() *Pool {
+	if r.blueGreen != nil {
+		return r.blueGreen.activePool()
+	}
+	if len(r.failoverPools) == 0 {
+		return r.Pool
+	}
+	minHealthy := r.Failover.MinHealthyPercent
+
+	if r.Pool.hasCapacity(minHealthy) {
+		return r.Pool
+	}
+	best, bestPct := r.Pool, r.Pool.healthyPercent()
+	for _, pool := range r.failoverPools {
+		if pool.hasCapacity(minHealthy) {
+			return pool
+		}
+		if pct := pool.healthyPercent(); pct > bestPct {
+			best, bestPct = pool, pct
+		}
+	}
+	return best
+}
+
+// localCandidates narrows candidates to backends in the proxy's zone when any are available
+func (p *Pool) localCandidates(candidates []*Backend) []*Backend {
+	if p.zone == nil {
+		return candidates
+	}
+	zone := p.zone.Load()
+	if zone == nil || *zone == "" {
+		return candidates
+	}
+	var local []*Backend
+	for _, b := range candidates {
+		if b.Locality == *zone {
+			local = append(local, b)
+		}
+	}
+	if len(local) == 0 {
+		return candidates
+	}
+	return local
+}
+
+// SetZone sets the proxy's own locality; backends labelled with it are preferred
+func (p *Proxy) SetZone(zone string) {
+	p.zone.Store(&zone)
+}
+
+// buildFailoverPools creates one pool per tier sharing the route's pool options
+func buildFailoverPools(cfg *FailoverConfig, opts poolOptions) ([]*Pool, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	pools := make([]*Pool, 0, len(cfg.Tiers))
+	for i, tier := range cfg.Tiers {
+		if len(tier.Targets) == 0 {
+			return nil, fmt.Errorf("tier %d has no targets", i)
+		}
+		tierOpts := opts
+		tierOpts.weights = tier.Weights
+		if tier.Locality != "" {
+			tierOpts.localities = make(map[string]string, len(tier.Targets))
+			for _, t := range tier.Targets {
+				tierOpts.localities[t] = tier.Locality
+			}
+		}
+		pool, err := createBackendPoolWithOptions(tier.Targets, tierOpts)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+	if cfg.MinHealthyPercent < 0 || cfg.MinHealthyPercent > 100 {
+		return nil, fmt.Errorf("min_healthy_percent must be between 0 and 100")
+	}
+	return pools, nil
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoute_FailoverTiers(t *testing.T) {
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/*",
+		Targets: []string{"http://10.0.0.1:80", "http://10.0.0.2:80"},
+		Failover: &FailoverConfig{
+			MinHealthyPercent: 50,
+			Tiers: []FailoverTier{
+				{Name: "secondary", Targets: []string{"http://10.1.0.1:80"}},
+				{Name: "tertiary", Targets: []string{"http://10.2.0.1:80"}},
+			},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	route := &p.routes[0]
+
+	if route.activePool() != route.Pool {
+		t.Fatal("Expected primary tier while fully healthy")
+	}
+
+	// 50% healthy still meets the threshold
+	p.setBackendHealth("/*", route.Pool.backends()[0], false, "down")
+	if route.activePool() != route.Pool {
+		t.Fatal("Expected primary tier at the threshold")
+	}
+
+	p.setBackendHealth("/*", route.Pool.backends()[1], false, "down")
+	if got := route.activePool(); got != route.failoverPools[0] {
+		t.Fatal("Expected failover to the secondary tier")
+	}
+
+	p.setBackendHealth("/*", route.failoverPools[0].backends()[0], false, "down")
+	if got := route.activePool(); got != route.failoverPools[1] {
+		t.Fatal("Expected failover to the tertiary tier")
+	}
+
+	// Recovery of the primary takes traffic back
+	p.setBackendHealth("/*", route.Pool.backends()[0], true, "up")
+	if route.activePool() != route.Pool {
+		t.Error("Expected traffic back on the primary tier after recovery")
+	}
+
+	if routes := p.GetRoutes(); routes[0].Failover == nil || len(routes[0].Failover.Tiers) != 2 {
+		t.Errorf("Expected failover config to round-trip, got %+v", routes[0].Failover)
+	}
+}
+
+func TestRoute_FailoverServesSecondary(t *testing.T) {
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secondary"))
+	}))
+	defer secondary.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:     "/app",
+		Targets:  []string{"http://10.0.0.1:80"},
+		Failover: &FailoverConfig{Tiers: []FailoverTier{{Targets: []string{secondary.URL}}}},
+	}})
+	p.setBackendHealth("/app", p.routes[0].Pool.backends()[0], false, "down")
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/app", nil))
+	if w.Body.String() != "secondary" {
+		t.Errorf("Expected secondary tier to answer, got %d %q", w.Code, w.Body.String())
+	}
+
+	if err := p.UpdateRoutes([]ConfigRoute{{
+		Path:     "/app",
+		Targets:  []string{"http://10.0.0.1:80"},
+		Failover: &FailoverConfig{Tiers: []FailoverTier{{Name: "empty"}}},
+	}}); err == nil {
+		t.Error("Expected error for a tier without targets")
+	}
+}
+
+func TestPool_LocalityPreference(t *testing.T) {
+	p, _ := New([]string{})
+	p.SetZone("us-east-1a")
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/api",
+		Targets: []string{"http://10.0.0.1:80", "http://10.0.0.2:80", "http://10.0.0.3:80"},
+		Localities: map[string]string{
+			"http://10.0.0.1:80": "us-east-1b",
+			"http://10.0.0.2:80": "us-east-1a",
+			"http://10.0.0.3:80": "us-east-1c",
+		},
+	}})
+	pool := p.routes[0].Pool
+
+	for i := 0; i < 6; i++ {
+		if b := pool.GetNext(); b.URL.String() != "http://10.0.0.2:80" {
+			t.Fatalf("Expected local backend to be preferred, got %s", b.URL)
+		}
+	}
+
+	// Without a healthy local backend, other zones are used
+	p.setBackendHealth("/api", pool.backends()[1], false, "down")
+	if b := pool.GetNext(); b.Locality == "us-east-1a" {
+		t.Errorf("Expected a remote backend once the local one is down, got %s", b.URL)
+	}
+
+	// Zone changes apply without a reload
+	p.SetZone("us-east-1c")
+	if b := pool.GetNext(); b.URL.String() != "http://10.0.0.3:80" {
+		t.Errorf("Expected backend in the new zone, got %s", b.URL)
+	}
+}
@@ -0,0 +1,506 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Filter is one stage of a route's request pipeline. Filters run in chain
+// order before a backend is chosen.
+type Filter interface {
+	// Name identifies the filter in route configs
+	Name() string
+	// OnRequest returns false to end the request; the filter must have
+	// written the response (see FilterContext.Reject).
+	OnRequest(fc *FilterContext) bool
+}
+
+// ResponseFilter is a Filter that also acts once the response is complete.
+// OnResponse runs in reverse chain order, only for filters whose OnRequest
+// let the request through.
+type ResponseFilter interface {
+	Filter
+	OnResponse(fc *FilterContext)
+}
+
+// FilterFactory builds a filter for a compiled route from its JSON config
+type FilterFactory func(route *Route, config json.RawMessage) (Filter, error)
+
+// FilterConfig places a filter in a route's chain
+type FilterConfig struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config,omitempty"` // Passed to the filter's factory; built-ins read their route fields instead
+}
+
+var (
+	filterMu       sync.RWMutex
+	filterRegistry = map[string]FilterFactory{}
+)
+
+// builtinFilters is the default chain order. Built-ins that a route does not
+// configure are left out of its chain.
+var builtinFilters = []string{
+	"ip_filter", "cors", "auth", "rate_limit", "circuit_breaker",
+	"limits", "headers", "cache", "concurrency", "compression",
+}
+
+// RegisterFilter makes a filter available to route configs by name. It
+// panics if the name is already taken, like database/sql.Register.
+func RegisterFilter(name string, factory FilterFactory) {
+	filterMu.Lock()
+	defer filterMu.Unlock()
+	if _, dup := filterRegistry[name]; dup {
+		panic("proxy: RegisterFilter called twice for " + name)
+	}
+	filterRegistry[name] = factory
+}
+
+// RegisteredFilters returns the names of all registered filters, sorted
+func RegisteredFilters() []string {
+	filterMu.RLock()
+	defer filterMu.RUnlock()
+	names := make([]string, 0, len(filterRegistry))
+	for name := range filterRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterFilter("ip_filter", newIPFilterFilter)
+	RegisterFilter("cors", newCORSFilter)
+	RegisterFilter("auth", newAuthFilter)
+	RegisterFilter("rate_limit", newRateLimitFilter)
+	RegisterFilter("circuit_breaker", newCircuitBreakerFilter)
+	RegisterFilter("limits", newLimitsFilter)
+	RegisterFilter("headers", newHeadersFilter)
+	RegisterFilter("cache", newCacheFilter)
+	RegisterFilter("concurrency", newConcurrencyFilter)
+	RegisterFilter("compression", newCompressionFilter)
+}
+
+// buildFilterChain returns the listed filters in order, followed by any
+// configured built-ins the list leaves out, so naming one filter never
+// silently disables another
+func buildFilterChain(route *Route, configs []FilterConfig) ([]Filter, error) {
+	filterMu.RLock()
+	defer filterMu.RUnlock()
+
+	var chain []Filter
+	listed := make(map[string]bool)
+	add := func(name string, config json.RawMessage) error {
+		factory, ok := filterRegistry[name]
+		if !ok {
+			return fmt.Errorf("unknown filter %q", name)
+		}
+		f, err := factory(route, config)
+		if err != nil {
+			return fmt.Errorf("filter %s: %w", name, err)
+		}
+		if f != nil {
+			chain = append(chain, f)
+		}
+		return nil
+	}
+
+	for _, fc := range configs {
+		// Built-ins act on the route's own settings, so listing one twice is a mistake;
+		// configurable filters such as wasm may repeat
+		if listed[fc.Name] && isBuiltinFilter(fc.Name) {
+			return nil, fmt.Errorf("filter %q listed twice", fc.Name)
+		}
+		listed[fc.Name] = true
+		if err := add(fc.Name, fc.Config); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range builtinFilters {
+		if !listed[name] {
+			if err := add(name, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return chain, nil
+}
+
+func isBuiltinFilter(name string) bool {
+	for _, b := range builtinFilters {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterContext carries one request through a route's filter chain
+type FilterContext struct {
+	Request   *http.Request
+	Response  http.ResponseWriter // Records the status; see BeforeHeader for editing headers
+	Route     *Route
+	ClientIP  netip.Addr
+	RequestID string
+
+	proxy       *Proxy
+	sw          *statusResponseWriter
+	client      *clientInfo
+	backend     *Backend
+	values      map[any]any
+	passed      []Filter
+	onAttempt   []func(r *http.Request)
+	wrappers    []func(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func())
+	attemptDone []func(status int)
+}
+
+// Status is the response status, or 200 before one is written
+func (fc *FilterContext) Status() int {
+	return fc.sw.status
+}
+
+// Backend is the chosen backend; nil during OnRequest
+func (fc *FilterContext) Backend() *Backend {
+	return fc.backend
+}
+
+// Set stores per-request state for a later phase
+func (fc *FilterContext) Set(key, value any) {
+	if fc.values == nil {
+		fc.values = make(map[any]any)
+	}
+	fc.values[key] = value
+}
+
+// Get returns state stored with Set
+func (fc *FilterContext) Get(key any) any {
+	return fc.values[key]
+}
+
+// Reject writes an error response and returns false for OnRequest to return
+func (fc *FilterContext) Reject(status int, message string) bool {
+	fc.sw.status = status
+	http.Error(fc.sw, message, status)
+	return false
+}
+
+// BeforeHeader runs fn right before the status line is written, after the
+// upstream has set its headers
+func (fc *FilterContext) BeforeHeader(fn func(h http.Header, status int)) {
+	fc.sw.beforeHeader = append(fc.sw.beforeHeader, fn)
+}
+
+// OnAttempt edits the upstream request of each attempt; its headers are a
+// fresh copy every time
+func (fc *FilterContext) OnAttempt(fn func(r *http.Request)) {
+	fc.onAttempt = append(fc.onAttempt, fn)
+}
+
+// WrapAttempt wraps the writer each attempt proxies into. finish runs when
+// the attempt returns.
+func (fc *FilterContext) WrapAttempt(fn func(w http.ResponseWriter, r *http.Request) (w2 http.ResponseWriter, finish func())) {
+	fc.wrappers = append(fc.wrappers, fn)
+}
+
+// runRequest runs the chain and reports whether the request should proceed
+func (fc *FilterContext) runRequest(chain []Filter) bool {
+	for _, f := range chain {
+		if !f.OnRequest(fc) {
+			return false
+		}
+		fc.passed = append(fc.passed, f)
+	}
+	return true
+}
+
+// runResponse unwinds the filters that let the request through
+func (fc *FilterContext) runResponse() {
+	for i := len(fc.passed) - 1; i >= 0; i-- {
+		if rf, ok := fc.passed[i].(ResponseFilter); ok {
+			rf.OnResponse(fc)
+		}
+	}
+}
+
+// prepareAttempt applies per-attempt edits and wrappers. The returned finish
+// func must run once the attempt returns.
+func (fc *FilterContext) prepareAttempt(req *http.Request, orig *http.Request) (http.ResponseWriter, func()) {
+	if len(fc.onAttempt) > 0 {
+		req.Header = orig.Header.Clone()
+		for _, fn := range fc.onAttempt {
+			fn(req)
+		}
+	}
+	var w http.ResponseWriter = fc.sw
+	var finishers []func()
+	for _, wrap := range fc.wrappers {
+		var finish func()
+		w, finish = wrap(w, orig)
+		finishers = append(finishers, finish)
+	}
+	return w, func() {
+		for i := len(finishers) - 1; i >= 0; i-- {
+			finishers[i]()
+		}
+	}
+}
+
+// Built-in filters. Each factory returns nil when the route doesn't use the feature.
+
+type ipFilterFilter struct{ route *Route }
+
+func newIPFilterFilter(route *Route, _ json.RawMessage) (Filter, error) {
+	if route.ipFilter == nil {
+		return nil, nil
+	}
+	return ipFilterFilter{route}, nil
+}
+
+func (ipFilterFilter) Name() string { return "ip_filter" }
+
+func (f ipFilterFilter) OnRequest(fc *FilterContext) bool {
+	if !f.route.ipFilter.allow(fc.ClientIP) {
+		atomic.AddUint64(&fc.proxy.DeniedRequests, 1)
+		return fc.Reject(http.StatusForbidden, "Forbidden")
+	}
+	return true
+}
+
+// corsFilter answers preflights itself; they never reach auth or the backend
+type corsFilter struct{ policy *corsPolicy }
+
+func newCORSFilter(route *Route, _ json.RawMessage) (Filter, error) {
+	if route.cors == nil {
+		return nil, nil
+	}
+	return corsFilter{route.cors}, nil
+}
+
+func (corsFilter) Name() string { return "cors" }
+
+func (f corsFilter) OnRequest(fc *FilterContext) bool {
+	if isPreflight(fc.Request) {
+		fc.sw.status = f.policy.handlePreflight(fc.sw, fc.Request)
+		return false
+	}
+	if origin := fc.Request.Header.Get("Origin"); origin != "" {
+		fc.BeforeHeader(func(h http.Header, _ int) {
+			f.policy.applyResponse(h, origin)
+		})
+	}
+	return true
+}
+
+type authFilter struct{ route *Route }
+
+func newAuthFilter(route *Route, _ json.RawMessage) (Filter, error) {
+	if route.Auth == nil || route.Auth.Type == "none" {
+		return nil, nil
+	}
+	return authFilter{route}, nil
+}
+
+func (authFilter) Name() string { return "auth" }
+
+func (f authFilter) OnRequest(fc *FilterContext) bool {
+	if !f.route.Authenticate(fc.Request) {
+		return fc.Reject(http.StatusUnauthorized, "Unauthorized")
+	}
+	return true
+}
+
+type rateLimitFilter struct {
+	path   string
+	config *RateLimitConfig
+}
+
+func newRateLimitFilter(route *Route, _ json.RawMessage) (Filter, error) {
+	if route.RateLimit == nil {
+		return nil, nil
+	}
+	return rateLimitFilter{route.Path, route.RateLimit}, nil
+}
+
+func (rateLimitFilter) Name() string { return "rate_limit" }
+
+func (f rateLimitFilter) OnRequest(fc *FilterContext) bool {
+	key := f.path
+	if f.config.Key == "client_ip" && fc.ClientIP.IsValid() {
+		key += "|" + fc.ClientIP.String()
+	}
+	if !fc.proxy.isRateAllowed(key, f.config) {
+		fc.proxy.metrics.rateLimited.counter(f.path).inc()
+		return fc.Reject(http.StatusTooManyRequests, "Rate limit exceeded")
+	}
+	return true
+}
+
+// circuitBreakerFilter rejects while open and records every attempt's outcome
+type circuitBreakerFilter struct {
+	path   string
+	config *CircuitBreakerConfig
+}
+
+func newCircuitBreakerFilter(route *Route, _ json.RawMessage) (Filter, error) {
+	if route.CircuitBreaker == nil {
+		return nil, nil
+	}
+	return circuitBreakerFilter{route.Path, route.CircuitBreaker}, nil
+}
+
+func (circuitBreakerFilter) Name() string { return "circuit_breaker" }
+
+func (f circuitBreakerFilter) OnRequest(fc *FilterContext) bool {
+	if !fc.proxy.isCircuitClosed(f.path, f.config) {
+		fc.proxy.metrics.circuitRejected.counter(f.path).inc()
+		return fc.Reject(http.StatusServiceUnavailable, "Circuit breaker tripped")
+	}
+	p := fc.proxy
+	fc.attemptDone = append(fc.attemptDone, func(status int) {
+		if status < 500 {
+			p.recordSuccess(f.path, f.config)
+		} else {
+			p.recordFailure(f.path, f.config)
+		}
+	})
+	return true
+}
+
+// limitsFilter enforces size limits and buffers, before any backend is involved
+type limitsFilter struct{ config *LimitsConfig }
+
+func newLimitsFilter(route *Route, _ json.RawMessage) (Filter, error) {
+	if route.Limits == nil {
+		return nil, nil
+	}
+	return limitsFilter{route.Limits}, nil
+}
+
+func (limitsFilter) Name() string { return "limits" }
+
+func (f limitsFilter) OnRequest(fc *FilterContext) bool {
+	if status := applyLimits(fc.sw, fc.Request, f.config); status != 0 {
+		return fc.Reject(status, http.StatusText(status))
+	}
+	return true
+}
+
+// headersFilter edits responses as the status line is written and requests
+// per attempt, once the backend is known
+type headersFilter struct{ policy *headerPolicy }
+
+func newHeadersFilter(route *Route, _ json.RawMessage) (Filter, error) {
+	if route.headers == nil {
+		return nil, nil
+	}
+	return headersFilter{route.headers}, nil
+}
+
+func (headersFilter) Name() string { return "headers" }
+
+func (f headersFilter) OnRequest(fc *FilterContext) bool {
+	vars := &headerVars{req: fc.Request, client: fc.client, route: fc.Route, requestID: fc.RequestID}
+	fc.BeforeHeader(func(h http.Header, status int) {
+		vars.status = status
+		f.policy.applyResponse(h, vars)
+	})
+	fc.OnAttempt(func(r *http.Request) {
+		vars.backend = fc.backend
+		f.policy.applyRequest(r, vars)
+	})
+	return true
+}
+
+// cacheFilter serves hits and stores complete 200 responses. Entries are
+// stored compressed; clients that can't accept the stored encoding get it decoded.
+type cacheFilter struct{ route *Route }
+
+func newCacheFilter(route *Route, _ json.RawMessage) (Filter, error) {
+	if route.Cache == nil || !route.Cache.Enabled {
+		return nil, nil
+	}
+	return cacheFilter{route}, nil
+}
+
+func (cacheFilter) Name() string { return "cache" }
+
+func (f cacheFilter) OnRequest(fc *FilterContext) bool {
+	sw := fc.sw
+	if entry, ok := fc.proxy.getCachedResponse(fc.Request.URL.String()); ok {
+		if entry, err := cachedForClient(fc.Request, entry); err == nil {
+			for k, v := range entry.headers {
+				sw.Header()[k] = v
+			}
+			sw.Header().Set("X-GP-Cache", "HIT")
+			fc.proxy.metrics.cache.counter(f.route.Path, "hit").inc()
+			sw.Write(entry.response)
+			return false
+		}
+	}
+	sw.Header().Set("X-GP-Cache", "MISS")
+	fc.proxy.metrics.cache.counter(f.route.Path, "miss").inc()
+	sw.capture = true
+	sw.captureMax = f.route.Cache.MaxSizeBytes
+	if sw.captureMax == 0 {
+		sw.captureMax = defaultMaxCacheableBytes
+	}
+	return true
+}
+
+func (f cacheFilter) OnResponse(fc *FilterContext) {
+	sw := fc.sw
+	if sw.capture && sw.status == http.StatusOK {
+		body, headers := f.route.compression.compressForCache(sw.body.Bytes(), sw.cacheHeader)
+		fc.proxy.setCachedResponse(fc.Request.URL.String(), body, headers, f.route.Cache.TTL)
+	}
+}
+
+// concurrencyFilter sheds requests over the adaptive limit with a fast 503
+type concurrencyFilter struct{ limiter *concurrencyLimiter }
+
+type concurrencyAdmittedKey struct{}
+
+func newConcurrencyFilter(route *Route, _ json.RawMessage) (Filter, error) {
+	if route.limiter == nil {
+		return nil, nil
+	}
+	return concurrencyFilter{route.limiter}, nil
+}
+
+func (concurrencyFilter) Name() string { return "concurrency" }
+
+func (f concurrencyFilter) OnRequest(fc *FilterContext) bool {
+	if !f.limiter.acquire(fc.Request.Context(), f.limiter.classOf(fc.Request)) {
+		atomic.AddUint64(&fc.proxy.ShedRequests, 1)
+		fc.sw.Header().Set("Retry-After", f.limiter.retryAfter())
+		return fc.Reject(http.StatusServiceUnavailable, "Service overloaded")
+	}
+	fc.Set(concurrencyAdmittedKey{}, time.Now())
+	return true
+}
+
+func (f concurrencyFilter) OnResponse(fc *FilterContext) {
+	admitted := fc.Get(concurrencyAdmittedKey{}).(time.Time)
+	f.limiter.release(time.Since(admitted), fc.Status() >= 500)
+}
+
+type compressionFilter struct{ policy *compressionPolicy }
+
+func newCompressionFilter(route *Route, _ json.RawMessage) (Filter, error) {
+	if route.compression == nil {
+		return nil, nil
+	}
+	return compressionFilter{route.compression}, nil
+}
+
+func (compressionFilter) Name() string { return "compression" }
+
+func (f compressionFilter) OnRequest(fc *FilterContext) bool {
+	fc.WrapAttempt(f.policy.wrap)
+	return true
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tagFilter records its phases and can block requests carrying its block header
+type tagFilter struct {
+	tag   string
+	trace *[]string
+}
+
+func (f tagFilter) Name() string { return "tag" }
+
+func (f tagFilter) OnRequest(fc *FilterContext) bool {
+	*f.trace = append(*f.trace, "request:"+f.tag)
+	if fc.Request.Header.Get("X-Block") == f.tag {
+		return fc.Reject(http.StatusTeapot, "blocked by "+f.tag)
+	}
+	fc.OnAttempt(func(r *http.Request) {
+		r.Header.Add("X-Tags", f.tag)
+	})
+	fc.BeforeHeader(func(h http.Header, status int) {
+		h.Add("X-Seen", f.tag)
+	})
+	return true
+}
+
+func (f tagFilter) OnResponse(fc *FilterContext) {
+	*f.trace = append(*f.trace, "response:"+f.tag)
+}
+
+func TestProxy_FilterChain(t *testing.T) {
+	var trace []string
+	RegisterFilter("test_tag", func(route *Route, config json.RawMessage) (Filter, error) {
+		var cfg struct {
+			Tag string `json:"tag"`
+		}
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return nil, err
+		}
+		return tagFilter{tag: cfg.Tag, trace: &trace}, nil
+	})
+	defer func() {
+		filterMu.Lock()
+		delete(filterRegistry, "test_tag")
+		filterMu.Unlock()
+	}()
+
+	var upstream http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/",
+		Targets: []string{backend.URL},
+		Auth:    &AuthConfig{Type: "api_key", Keys: map[string]string{"k": "test"}},
+		Filters: []FilterConfig{
+			{Name: "test_tag", Config: json.RawMessage(`{"tag":"first"}`)},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+
+	send := func(block string) *httptest.ResponseRecorder {
+		trace = nil
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-API-Key", "k")
+		if block != "" {
+			req.Header.Set("X-Block", block)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if upstream.Get("X-Tags") != "first" || w.Header().Get("X-Seen") != "first" {
+		t.Errorf("Expected request and header phases to run, got upstream %v, response %v", upstream, w.Header())
+	}
+	if strings.Join(trace, ",") != "request:first,response:first" {
+		t.Errorf("Unexpected phases %v", trace)
+	}
+
+	// The listed filter runs ahead of auth, which still applies though unlisted
+	if w := send("first"); w.Code != http.StatusTeapot {
+		t.Errorf("Expected the custom filter to reject, got %d", w.Code)
+	}
+	if len(trace) != 1 {
+		t.Errorf("Expected no response phase for a rejecting filter, got %v", trace)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected unlisted auth to still run, got %d", w.Code)
+	}
+
+	// Reordered: auth first, so unauthenticated requests never reach the custom filter
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/",
+		Targets: []string{backend.URL},
+		Auth:    &AuthConfig{Type: "api_key", Keys: map[string]string{"k": "test"}},
+		Filters: []FilterConfig{
+			{Name: "auth"},
+			{Name: "test_tag", Config: json.RawMessage(`{"tag":"second"}`)},
+		},
+	}})
+	trace = nil
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized || len(trace) != 0 {
+		t.Errorf("Expected auth to reject before the custom filter ran, got %d, %v", w.Code, trace)
+	}
+	if routes := p.GetRoutes(); len(routes[0].Filters) != 2 || routes[0].Filters[1].Name != "test_tag" {
+		t.Errorf("Expected GetRoutes to report the filter list, got %+v", routes[0].Filters)
+	}
+}
+
+func TestBuildFilterChain(t *testing.T) {
+	p, _ := New([]string{})
+	cases := map[string][]FilterConfig{
+		"unknown":   {{Name: "does_not_exist"}},
+		"duplicate": {{Name: "auth"}, {Name: "auth"}},
+	}
+	for name, filters := range cases {
+		if err := p.UpdateRoutes([]ConfigRoute{{Path: "/", Targets: []string{"http://127.0.0.1:1"}, Filters: filters}}); err == nil {
+			t.Errorf("%s: expected UpdateRoutes to fail", name)
+		}
+	}
+
+	route := &Route{
+		Path:      "/",
+		RateLimit: &RateLimitConfig{RequestsPerSecond: 1, Burst: 1},
+		Cache:     &CacheConfig{Enabled: true},
+	}
+	route.ipFilter, _ = newIPFilter(nil)
+	chain, err := buildFilterChain(route, nil)
+	if err != nil {
+		t.Fatalf("buildFilterChain failed: %v", err)
+	}
+	var names []string
+	for _, f := range chain {
+		names = append(names, f.Name())
+	}
+	// Only configured built-ins, in default order
+	if strings.Join(names, ",") != "ip_filter,rate_limit,cache" {
+		t.Errorf("Unexpected default chain %v", names)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a taken name to panic")
+		}
+	}()
+	RegisterFilter("auth", newAuthFilter)
+}
@@ -0,0 +1,496 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// HeaderRule adjusts response headers only when the status matches
+type HeaderRule struct {
+	Status []string          `json:"status"` // Exact codes ("404") or classes ("5xx")
+	Set    map[string]string `json:"set,omitempty"`
+	Append map[string]string `json:"append,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// CookieRewriteConfig rewrites Set-Cookie headers from upstreams, like
+// nginx's proxy_cookie_domain, proxy_cookie_path and proxy_cookie_flags
+type CookieRewriteConfig struct {
+	Domain   map[string]string `json:"domain,omitempty"` // Upstream domain ("*" for any) to public domain; "" drops the attribute
+	Path     map[string]string `json:"path,omitempty"`   // Upstream path prefix to public prefix
+	Secure   bool              `json:"secure,omitempty"`
+	HTTPOnly bool              `json:"http_only,omitempty"`
+	SameSite string            `json:"same_site,omitempty"` // "Strict", "Lax" or "None"
+}
+
+// Variables available in header values as ${name}
+var headerVariables = map[string]bool{
+	"client_ip": true, "request_id": true, "route": true, "method": true,
+	"host": true, "scheme": true, "path": true, "request_uri": true,
+	"backend_url": true, "status": true,
+	"tls_version": true, "tls_cipher": true, "tls_server_name": true, "tls_client_subject": true,
+}
+
+// Variable families keyed by name: ${header.X-Name}, ${path.id}, ${jwt.sub}
+var headerVariablePrefixes = []string{"header.", "path.", "jwt."}
+
+// headerTemplate is a header value whose ${variable} references are resolved per request
+type headerTemplate []headerPart
+
+type headerPart struct {
+	text     string
+	variable string // Set for variable references, text is empty
+}
+
+func compileHeaderTemplate(s string) (headerTemplate, error) {
+	var t headerTemplate
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated variable in %q", s)
+		}
+		name := s[i+2 : i+end]
+		if !isHeaderVariable(name) {
+			return nil, fmt.Errorf("unknown variable ${%s}", name)
+		}
+		if i > 0 {
+			t = append(t, headerPart{text: s[:i]})
+		}
+		t = append(t, headerPart{variable: name})
+		s = s[i+end+1:]
+	}
+	if s != "" {
+		t = append(t, headerPart{text: s})
+	}
+	return t, nil
+}
+
+func isHeaderVariable(name string) bool {
+	if headerVariables[name] {
+		return true
+	}
+	for _, prefix := range headerVariablePrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t headerTemplate) uses(prefix string) bool {
+	for _, part := range t {
+		if strings.HasPrefix(part.variable, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t headerTemplate) expand(v *headerVars) string {
+	if len(t) == 1 && t[0].variable == "" {
+		return t[0].text
+	}
+	var b strings.Builder
+	for _, part := range t {
+		if part.variable != "" {
+			b.WriteString(v.lookup(part.variable))
+		} else {
+			b.WriteString(part.text)
+		}
+	}
+	return b.String()
+}
+
+// headerVars resolves variables for one request. The backend and status are
+// filled in as the request progresses.
+type headerVars struct {
+	req       *http.Request
+	client    *clientInfo
+	route     *Route
+	requestID string
+	backend   *Backend
+	status    int
+	claims    jwt.MapClaims
+	parsed    bool
+}
+
+func (v *headerVars) lookup(name string) string {
+	r := v.req
+	switch name {
+	case "client_ip":
+		if v.client != nil && v.client.IP.IsValid() {
+			return v.client.IP.String()
+		}
+		return ""
+	case "request_id":
+		return v.requestID
+	case "route":
+		return v.route.Path
+	case "method":
+		return r.Method
+	case "host":
+		if v.client != nil && v.client.Host != "" {
+			return v.client.Host
+		}
+		return r.Host
+	case "scheme":
+		if v.client != nil && v.client.Proto != "" {
+			return v.client.Proto
+		}
+		if r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	case "path":
+		return r.URL.Path
+	case "request_uri":
+		return r.URL.RequestURI()
+	case "backend_url":
+		if v.backend != nil {
+			return v.backend.URL.String()
+		}
+		return ""
+	case "status":
+		if v.status == 0 {
+			return ""
+		}
+		return strconv.Itoa(v.status)
+	case "tls_version":
+		if r.TLS != nil {
+			return tls.VersionName(r.TLS.Version)
+		}
+		return ""
+	case "tls_cipher":
+		if r.TLS != nil {
+			return tls.CipherSuiteName(r.TLS.CipherSuite)
+		}
+		return ""
+	case "tls_server_name":
+		if r.TLS != nil {
+			return r.TLS.ServerName
+		}
+		return ""
+	case "tls_client_subject":
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			return r.TLS.PeerCertificates[0].Subject.String()
+		}
+		return ""
+	}
+
+	switch {
+	case strings.HasPrefix(name, "header."):
+		return r.Header.Get(strings.TrimPrefix(name, "header."))
+	case strings.HasPrefix(name, "path."):
+		return pathParam(v.route.Path, r.URL.Path, strings.TrimPrefix(name, "path."))
+	case strings.HasPrefix(name, "jwt."):
+		if !v.parsed {
+			v.parsed = true
+			v.claims, _ = verifyJWT(r, v.route.Auth)
+		}
+		if claim, ok := v.claims[strings.TrimPrefix(name, "jwt.")]; ok {
+			return fmt.Sprint(claim)
+		}
+	}
+	return ""
+}
+
+// pathParam returns the request segment at the position of "{name}" in the route path
+func pathParam(routePath, reqPath, name string) string {
+	want := "{" + name + "}"
+	segments := strings.Split(routePath, "/")
+	values := strings.Split(reqPath, "/")
+	for i, seg := range segments {
+		if seg == want && i < len(values) {
+			return values[i]
+		}
+	}
+	return ""
+}
+
+// routeGlob turns "{name}" path segments into "*" for matching
+func routeGlob(p string) string {
+	if !strings.Contains(p, "{") {
+		return ""
+	}
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			segments[i] = "*"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+type compiledHeader struct {
+	name  string
+	value headerTemplate
+}
+
+type compiledRule struct {
+	status []string
+	set    []compiledHeader
+	append []compiledHeader
+	remove []string
+}
+
+type cookieRewrite struct {
+	domains  map[string]headerTemplate // Lowercased, without a leading dot
+	paths    []compiledHeader          // name is the upstream prefix
+	secure   bool
+	httpOnly bool
+	sameSite string
+}
+
+// headerPolicy is the compiled form of a HeadersConfig
+type headerPolicy struct {
+	setRequest     []compiledHeader
+	appendRequest  []compiledHeader
+	removeRequest  []string
+	setResponse    []compiledHeader
+	appendResponse []compiledHeader
+	removeResponse []string
+	rules          []compiledRule
+	cookies        *cookieRewrite
+	location       []locationRewrite
+}
+
+// locationRewrite replaces an upstream prefix of the Location header; both sides are templates
+type locationRewrite struct {
+	from, to headerTemplate
+}
+
+// newHeaderPolicy compiles a headers config. A nil config yields a nil policy.
+func newHeaderPolicy(config *HeadersConfig, auth *AuthConfig) (*headerPolicy, error) {
+	if config == nil {
+		return nil, nil
+	}
+	h := &headerPolicy{removeRequest: config.RemoveRequest, removeResponse: config.RemoveResponse}
+	var err error
+	var all []headerTemplate
+	compile := func(m map[string]string) []compiledHeader {
+		names := make([]string, 0, len(m))
+		for k := range m {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		var out []compiledHeader
+		for _, k := range names {
+			t, cerr := compileHeaderTemplate(m[k])
+			if cerr != nil && err == nil {
+				err = fmt.Errorf("header %s: %w", k, cerr)
+			}
+			all = append(all, t)
+			out = append(out, compiledHeader{name: k, value: t})
+		}
+		return out
+	}
+
+	h.setRequest = compile(config.AddRequest)
+	h.appendRequest = compile(config.AppendRequest)
+	h.setResponse = compile(config.AddResponse)
+	h.appendResponse = compile(config.AppendResponse)
+	for _, rule := range config.ResponseRules {
+		if len(rule.Status) == 0 {
+			return nil, fmt.Errorf("response rule needs at least one status")
+		}
+		for _, s := range rule.Status {
+			if !validStatusPattern(s) {
+				return nil, fmt.Errorf("invalid status %q in response rule", s)
+			}
+		}
+		h.rules = append(h.rules, compiledRule{
+			status: rule.Status,
+			set:    compile(rule.Set),
+			append: compile(rule.Append),
+			remove: rule.Remove,
+		})
+	}
+
+	if c := config.RewriteCookies; c != nil {
+		h.cookies = &cookieRewrite{domains: make(map[string]headerTemplate), secure: c.Secure, httpOnly: c.HTTPOnly}
+		switch strings.ToLower(c.SameSite) {
+		case "":
+		case "strict", "lax", "none":
+			h.cookies.sameSite = strings.ToUpper(c.SameSite[:1]) + strings.ToLower(c.SameSite[1:])
+		default:
+			return nil, fmt.Errorf("invalid same_site %q", c.SameSite)
+		}
+		for _, d := range compile(c.Domain) {
+			h.cookies.domains[strings.TrimPrefix(strings.ToLower(d.name), ".")] = d.value
+		}
+		h.cookies.paths = compile(c.Path)
+	}
+
+	for _, rw := range compile(config.RewriteLocation) {
+		from, cerr := compileHeaderTemplate(rw.name)
+		if cerr != nil && err == nil {
+			err = fmt.Errorf("location prefix %s: %w", rw.name, cerr)
+		}
+		all = append(all, from)
+		h.location = append(h.location, locationRewrite{from: from, to: rw.value})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range all {
+		if t.uses("jwt.") && (auth == nil || auth.Type != "jwt") {
+			return nil, fmt.Errorf("jwt variables require auth type jwt")
+		}
+	}
+	return h, nil
+}
+
+func validStatusPattern(s string) bool {
+	if len(s) == 3 && s[0] >= '1' && s[0] <= '5' && strings.EqualFold(s[1:], "xx") {
+		return true
+	}
+	code, err := strconv.Atoi(s)
+	return err == nil && code >= 100 && code <= 599
+}
+
+func statusMatches(patterns []string, status int) bool {
+	code := strconv.Itoa(status)
+	for _, p := range patterns {
+		if p == code || (strings.EqualFold(p[1:], "xx") && p[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func setHeaders(h http.Header, headers []compiledHeader, v *headerVars) {
+	for _, ch := range headers {
+		h.Set(ch.name, ch.value.expand(v))
+	}
+}
+
+func appendHeaders(h http.Header, headers []compiledHeader, v *headerVars) {
+	for _, ch := range headers {
+		h.Add(ch.name, ch.value.expand(v))
+	}
+}
+
+// applyRequest sets the upstream request's headers for one attempt
+func (p *headerPolicy) applyRequest(r *http.Request, v *headerVars) {
+	setHeaders(r.Header, p.setRequest, v)
+	appendHeaders(r.Header, p.appendRequest, v)
+	for _, k := range p.removeRequest {
+		r.Header.Del(k)
+	}
+}
+
+// applyResponse runs as the status line is written, after the upstream has set its headers
+func (p *headerPolicy) applyResponse(h http.Header, v *headerVars) {
+	if p.cookies != nil {
+		if cookies := h.Values("Set-Cookie"); len(cookies) > 0 {
+			rewritten := make([]string, len(cookies))
+			for i, c := range cookies {
+				rewritten[i] = p.cookies.rewrite(c, v)
+			}
+			h["Set-Cookie"] = rewritten
+		}
+	}
+	if loc := h.Get("Location"); loc != "" {
+		for _, rw := range p.location {
+			if prefix := rw.from.expand(v); prefix != "" && strings.HasPrefix(loc, prefix) {
+				h.Set("Location", rw.to.expand(v)+loc[len(prefix):])
+				break
+			}
+		}
+	}
+
+	setHeaders(h, p.setResponse, v)
+	appendHeaders(h, p.appendResponse, v)
+	for _, k := range p.removeResponse {
+		h.Del(k)
+	}
+	for _, rule := range p.rules {
+		if statusMatches(rule.status, v.status) {
+			setHeaders(h, rule.set, v)
+			appendHeaders(h, rule.append, v)
+			for _, k := range rule.remove {
+				h.Del(k)
+			}
+		}
+	}
+}
+
+// rewrite edits a Set-Cookie value attribute by attribute so anything it
+// does not know about passes through unchanged
+func (c *cookieRewrite) rewrite(cookie string, v *headerVars) string {
+	parts := strings.Split(cookie, ";")
+	out := parts[:1]
+	var secure, httpOnly bool
+	for _, attr := range parts[1:] {
+		key, val, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		switch strings.ToLower(key) {
+		case "domain":
+			repl, ok := c.domains[strings.TrimPrefix(strings.ToLower(val), ".")]
+			if !ok {
+				repl, ok = c.domains["*"]
+			}
+			if ok {
+				if d := repl.expand(v); d != "" {
+					out = append(out, " Domain="+d)
+				}
+				continue
+			}
+		case "path":
+			for _, p := range c.paths {
+				if strings.HasPrefix(val, p.name) {
+					attr = " Path=" + p.value.expand(v) + val[len(p.name):]
+					break
+				}
+			}
+		case "secure":
+			secure = true
+		case "httponly":
+			httpOnly = true
+		case "samesite":
+			if c.sameSite != "" {
+				continue
+			}
+		}
+		out = append(out, attr)
+	}
+	if c.secure && !secure {
+		out = append(out, " Secure")
+	}
+	if c.httpOnly && !httpOnly {
+		out = append(out, " HttpOnly")
+	}
+	if c.sameSite != "" {
+		out = append(out, " SameSite="+c.sameSite)
+	}
+	return strings.Join(out, ";")
+}
+
+// verifyJWT validates the request's bearer token against the route's HMAC secret
+func verifyJWT(r *http.Request, auth *AuthConfig) (jwt.MapClaims, bool) {
+	if auth == nil || auth.Secret == "" {
+		return nil, false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, false
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(auth.Secret), nil
+	}, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}))
+	if err != nil {
+		return nil, false
+	}
+	return claims, true
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestCompileHeaderTemplate(t *testing.T) {
+	for _, bad := range []string{"${nope}", "${client_ip", "${jwt.}"} {
+		if _, err := compileHeaderTemplate(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+
+	tmpl, err := compileHeaderTemplate("for=${client_ip}; route=${route}; id=${path.id}")
+	if err != nil {
+		t.Fatalf("compileHeaderTemplate failed: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/users/42/profile", nil)
+	vars := &headerVars{req: req, client: &clientInfo{IP: netip.MustParseAddr("203.0.113.7")}, route: &Route{Path: "/users/{id}/*"}}
+	if got := tmpl.expand(vars); got != "for=203.0.113.7; route=/users/{id}/*; id=42" {
+		t.Errorf("Unexpected expansion %q", got)
+	}
+}
+
+func TestProxy_DynamicHeaders(t *testing.T) {
+	var upstream http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+		w.Header().Set("Location", "http://"+r.Host+"/login?next=/users")
+		w.Header().Add("Set-Cookie", "session=abc; Domain=internal.local; Path=/app/users; SameSite=None")
+		w.Header().Add("Set-Cookie", "theme=dark")
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer backend.Close()
+
+	secret := "s3cret"
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice", "tenant": "acme"}).SignedString([]byte(secret))
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/users/{id}",
+		Targets: []string{backend.URL},
+		Auth:    &AuthConfig{Type: "jwt", Secret: secret},
+		Headers: &HeadersConfig{
+			AddRequest:    map[string]string{"X-User": "${jwt.sub}", "X-User-ID": "${path.id}", "X-Backend": "${backend_url}"},
+			AppendRequest: map[string]string{"X-Trace": "proxy"},
+			AddResponse:   map[string]string{"X-Served-By": "${route} via ${backend_url}"},
+			ResponseRules: []HeaderRule{
+				{Status: []string{"5xx"}, Set: map[string]string{"Retry-After": "5"}},
+				{Status: []string{"302"}, Append: map[string]string{"Cache-Control": "no-store"}},
+			},
+			RewriteCookies: &CookieRewriteConfig{
+				Domain:   map[string]string{"internal.local": "${host}"},
+				Path:     map[string]string{"/app": ""},
+				Secure:   true,
+				SameSite: "Lax",
+			},
+			RewriteLocation: map[string]string{"${backend_url}": "${scheme}://${host}"},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+
+	send := func(target string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Host = "www.example.com"
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Trace", "client")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	res := send("/users/42")
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("Expected 302, got %d", res.StatusCode)
+	}
+	if upstream.Get("X-User") != "alice" || upstream.Get("X-User-ID") != "42" || upstream.Get("X-Backend") != backend.URL {
+		t.Errorf("Unexpected upstream headers: %v", upstream)
+	}
+	if got := upstream.Values("X-Trace"); len(got) != 2 || got[0] != "client" || got[1] != "proxy" {
+		t.Errorf("Expected X-Trace to be appended, got %v", got)
+	}
+
+	// Response headers must be on the wire, not added after the status line was sent
+	if got := res.Header.Get("X-Served-By"); got != "/users/{id} via "+backend.URL {
+		t.Errorf("Unexpected X-Served-By %q", got)
+	}
+	if got := res.Header.Get("Location"); got != "http://www.example.com/login?next=/users" {
+		t.Errorf("Expected Location to be rewritten, got %q", got)
+	}
+	cookies := res.Header.Values("Set-Cookie")
+	if len(cookies) != 2 || cookies[0] != "session=abc; Domain=www.example.com; Path=/users; Secure; SameSite=Lax" {
+		t.Errorf("Unexpected cookies %q", cookies)
+	}
+	if cookies[1] != "theme=dark; Secure; SameSite=Lax" {
+		t.Errorf("Expected flags on cookies without attributes, got %q", cookies[1])
+	}
+	if res.Header.Get("Cache-Control") != "no-store" || res.Header.Get("Retry-After") != "" {
+		t.Errorf("Expected only the 302 rule to apply, got %v", res.Header)
+	}
+
+	if res := send("/users/42?fail=1"); res.Header.Get("Retry-After") != "5" || res.Header.Get("Cache-Control") != "" {
+		t.Errorf("Expected only the 5xx rule to apply, got %v", res.Header)
+	}
+}
+
+func TestNewHeaderPolicy_Validation(t *testing.T) {
+	cases := []*HeadersConfig{
+		{AddRequest: map[string]string{"X-User": "${jwt.sub}"}}, // jwt variables need jwt auth
+		{AddResponse: map[string]string{"X": "${unknown}"}},
+		{ResponseRules: []HeaderRule{{Status: []string{"6xx"}}}},
+		{ResponseRules: []HeaderRule{{Set: map[string]string{"X": "y"}}}},
+		{RewriteCookies: &CookieRewriteConfig{SameSite: "sometimes"}},
+	}
+	for i, c := range cases {
+		if _, err := newHeaderPolicy(c, nil); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+	if _, err := newHeaderPolicy(&HeadersConfig{AddRequest: map[string]string{"X-User": "${jwt.sub}"}}, &AuthConfig{Type: "jwt", Secret: "k"}); err != nil {
+		t.Errorf("Expected jwt variables with jwt auth to compile, got %v", err)
+	}
+}
+
+func TestRoute_JWTAuth(t *testing.T) {
+	p, _ := New([]string{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	p.UpdateRoutes([]ConfigRoute{{Path: "/", Targets: []string{backend.URL}, Auth: &AuthConfig{Type: "jwt", Secret: "right"}}})
+
+	for secret, want := range map[string]int{"right": http.StatusOK, "wrong": http.StatusUnauthorized} {
+		token, _ := jwt.New(jwt.SigningMethodHS256).SignedString([]byte(secret))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("token signed with %q: expected %d, got %d", secret, want, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected requests without a token to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,453 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Health check types
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+	HealthCheckGRPC = "grpc"
+)
+
+// maxHealthBody caps how much of a probe response is read for body matching
+const maxHealthBody = 64 * 1024
+
+// statusRange is an inclusive range of acceptable HTTP status codes
+type statusRange struct {
+	min, max int
+}
+
+// healthProber is the compiled form of a HealthCheckConfig
+type healthProber struct {
+	kind         string
+	path         string
+	method       string
+	headers      map[string]string
+	statuses     []statusRange
+	bodyContains string
+	bodyRegex    *regexp.Regexp
+	grpcService  string
+	timeout      time.Duration
+	client       *http.Client
+}
+
+func newHealthProber(config *HealthCheckConfig) (*healthProber, error) {
+	hp := &healthProber{
+		kind:         strings.ToLower(config.Type),
+		path:         config.Path,
+		method:       strings.ToUpper(config.Method),
+		headers:      config.Headers,
+		bodyContains: config.BodyContains,
+		grpcService:  config.GRPCService,
+		timeout:      time.Duration(config.Timeout) * time.Second,
+	}
+	if hp.kind == "" {
+		hp.kind = HealthCheckHTTP
+	}
+	if hp.method == "" {
+		hp.method = http.MethodGet
+	}
+	if hp.timeout <= 0 {
+		hp.timeout = 2 * time.Second
+	}
+
+	switch hp.kind {
+	case HealthCheckHTTP:
+		hp.client = &http.Client{
+			Timeout: hp.timeout,
+			// Redirects are reported as-is so they can be matched by expected_status
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+	case HealthCheckGRPC:
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		hp.client = &http.Client{Timeout: hp.timeout, Transport: transport}
+	case HealthCheckTCP:
+	default:
+		return nil, fmt.Errorf("unknown health check type %q", config.Type)
+	}
+
+	expected := config.ExpectedStatus
+	if len(expected) == 0 {
+		expected = []string{"200-399"}
+	}
+	for _, s := range expected {
+		r, err := parseStatusRange(s)
+		if err != nil {
+			return nil, err
+		}
+		hp.statuses = append(hp.statuses, r)
+	}
+
+	if config.BodyRegex != "" {
+		re, err := regexp.Compile(config.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body_regex: %w", err)
+		}
+		hp.bodyRegex = re
+	}
+	return hp, nil
+}
+
+// parseStatusRange accepts "200", "200-299" or "2xx"
+func parseStatusRange(s string) (statusRange, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] >= '1' && s[0] <= '5' {
+		base := int(s[0]-'0') * 100
+		return statusRange{base, base + 99}, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	min, err := strconv.Atoi(lo)
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid expected status %q", s)
+	}
+	max := min
+	if isRange {
+		if max, err = strconv.Atoi(hi); err != nil || max < min {
+			return statusRange{}, fmt.Errorf("invalid expected status %q", s)
+		}
+	}
+	return statusRange{min, max}, nil
+}
+
+func (hp *healthProber) statusOK(code int) bool {
+	for _, r := range hp.statuses {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// probe runs a single check against target. A nil error means healthy;
+// otherwise the error describes why the check failed.
+func (hp *healthProber) probe(ctx context.Context, target *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, hp.timeout)
+	defer cancel()
+
+	switch hp.kind {
+	case HealthCheckTCP:
+		return hp.probeTCP(ctx, target)
+	case HealthCheckGRPC:
+		return hp.probeGRPC(ctx, target)
+	default:
+		return hp.probeHTTP(ctx, target)
+	}
+}
+
+// checkURL resolves the configured path against the backend URL
+func (hp *healthProber) checkURL(target *url.URL) url.URL {
+	checkURL := *target
+	if hp.path != "" {
+		if strings.HasPrefix(hp.path, "http") {
+			if u, err := url.Parse(hp.path); err == nil {
+				checkURL = *u
+			}
+		} else {
+			path, query, _ := strings.Cut(hp.path, "?")
+			checkURL.Path = path
+			checkURL.RawQuery = query
+		}
+	}
+	return checkURL
+}
+
+func (hp *healthProber) probeHTTP(ctx context.Context, target *url.URL) error {
+	checkURL := hp.checkURL(target)
+	req, err := http.NewRequestWithContext(ctx, hp.method, checkURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range hp.headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", "GhostPlane-HealthCheck")
+
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !hp.statusOK(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if hp.bodyContains == "" && hp.bodyRegex == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	if hp.bodyContains != "" && !bytes.Contains(body, []byte(hp.bodyContains)) {
+		return fmt.Errorf("body does not contain %q", hp.bodyContains)
+	}
+	if hp.bodyRegex != nil && !hp.bodyRegex.Match(body) {
+		return fmt.Errorf("body does not match %q", hp.bodyRegex.String())
+	}
+	return nil
+}
+
+func (hp *healthProber) probeTCP(ctx context.Context, target *url.URL) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", hostPort(target))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeGRPC calls grpc.health.v1.Health/Check over HTTP/2 (h2c for http:// targets)
+func (hp *healthProber) probeGRPC(ctx context.Context, target *url.URL) error {
+	// HealthCheckRequest { string service = 1; }
+	var msg []byte
+	if hp.grpcService != "" {
+		msg = append([]byte{0x0a}, binary.AppendUvarint(nil, uint64(len(hp.grpcService)))...)
+		msg = append(msg, hp.grpcService...)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	checkURL := url.URL{Scheme: target.Scheme, Host: target.Host, Path: "/grpc.health.v1.Health/Check"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, checkURL.String(), bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return fmt.Errorf("reading grpc response: %w", err)
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status") // Trailers-only response
+	}
+	if status != "0" {
+		return fmt.Errorf("grpc status %s: %s", status, resp.Trailer.Get("Grpc-Message"))
+	}
+	if len(body) < 5 {
+		return errors.New("empty grpc health response")
+	}
+
+	// HealthCheckResponse { ServingStatus status = 1; } with SERVING = 1
+	payload := body[5:]
+	for len(payload) > 0 {
+		tag, n := binary.Uvarint(payload)
+		if n <= 0 {
+			break
+		}
+		payload = payload[n:]
+		if tag&7 != 0 {
+			break // Only varint fields are expected here
+		}
+		value, n := binary.Uvarint(payload)
+		if n <= 0 {
+			break
+		}
+		payload = payload[n:]
+		if tag>>3 == 1 {
+			if value == 1 {
+				return nil
+			}
+			return fmt.Errorf("grpc serving status %d", value)
+		}
+	}
+	return errors.New("grpc serving status missing")
+}
+
+// hostPort returns host:port for a backend URL, filling in the scheme's default port
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// jittered spreads probes of many proxies/routes so they don't fire in lockstep
+func jittered(interval time.Duration, percent int) time.Duration {
+	if percent <= 0 {
+		return interval
+	}
+	spread := int64(interval) * int64(percent) / 100
+	if spread <= 0 {
+		return interval
+	}
+	return interval - time.Duration(spread) + time.Duration(rand.Int64N(2*spread+1))
+}
+
+// healthCounter tracks consecutive probe results for rise/fall thresholds
+type healthCounter struct {
+	successes int
+	failures  int
+}
+
+// observe records a probe result and reports the backend's new liveness,
+// changing it only once the relevant threshold is reached
+func (c *healthCounter) observe(alive, healthy bool, rise, fall int) bool {
+	if healthy {
+		c.successes++
+		c.failures = 0
+		if !alive && c.successes >= rise {
+			return true
+		}
+	} else {
+		c.failures++
+		c.successes = 0
+		if alive && c.failures >= fall {
+			return false
+		}
+	}
+	return alive
+}
+
+func (p *Proxy) restartHealthChecks() {
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+
+	// Stop existing checks
+	for _, cancel := range p.healthCancels {
+		cancel()
+	}
+	p.healthCancels = nil
+
+	// Start new checks for each route that has health check config
+	for _, r := range p.routes {
+		if r.HealthCheck == nil {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		p.healthCancels = append(p.healthCancels, cancel)
+		go p.runRouteHealthCheck(ctx, r)
+	}
+
+	// Also handle default pool if any
+	if p.defaultPool != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.healthCancels = append(p.healthCancels, cancel)
+		go p.runDefaultHealthCheck(ctx)
+	}
+}
+
+func (p *Proxy) runRouteHealthCheck(ctx context.Context, r Route) {
+	config := r.HealthCheck
+	interval := time.Duration(config.Interval) * time.Second
+	if interval < 1*time.Second {
+		interval = 10 * time.Second
+	}
+	jitter := config.JitterPercent
+	if jitter == 0 {
+		jitter = 10
+	}
+	rise := max(config.HealthyThreshold, 1)
+	fall := max(config.UnhealthyThreshold, 1)
+
+	timer := time.NewTimer(jittered(interval, jitter))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			// Re-read each round so members added by discovery are probed too
+			var backends []*Backend
+			for _, pool := range r.pools() {
+				backends = append(backends, pool.backends()...)
+			}
+			for _, b := range backends {
+				err := r.healthProber.probe(ctx, b.URL)
+				if ctx.Err() != nil {
+					return
+				}
+				reason := "active check passed"
+				if err != nil {
+					reason = "active check failed: " + err.Error()
+				}
+				if alive, changed := b.health.observe(err == nil, rise, fall, reason); changed {
+					p.publishHealthEvent(r.Path, b, alive, reason)
+				}
+			}
+			timer.Reset(jittered(interval, jitter))
+		}
+	}
+}
+
+// defaultPoolProber keeps the legacy behaviour for the default pool:
+// a HEAD request where anything below 500 counts as healthy
+var defaultPoolProber, _ = newHealthProber(&HealthCheckConfig{
+	Method:         http.MethodHead,
+	Timeout:        2,
+	ExpectedStatus: []string{"200-499"},
+})
+
+func (p *Proxy) runDefaultHealthCheck(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.mu.RLock()
+			pool := p.defaultPool
+			p.mu.RUnlock()
+
+			if pool == nil {
+				return
+			}
+
+			for _, b := range pool.backends() {
+				err := defaultPoolProber.probe(ctx, b.URL)
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					p.setBackendHealth("", b, false, "active check failed: "+err.Error())
+				} else {
+					p.setBackendHealth("", b, true, "active check passed")
+				}
+			}
+		}
+	}
+}
+
+func (p *Proxy) startHealthCheckWorker() {
+	p.restartHealthChecks()
+}
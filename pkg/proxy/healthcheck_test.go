@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	cases := map[string]statusRange{
+		"200":     {200, 200},
+		"200-299": {200, 299},
+		"3xx":     {300, 399},
+	}
+	for in, expected := range cases {
+		got, err := parseStatusRange(in)
+		if err != nil || got != expected {
+			t.Errorf("parseStatusRange(%q) = %v, %v; expected %v", in, got, err, expected)
+		}
+	}
+	for _, bad := range []string{"abc", "300-200", "9xx"} {
+		if _, err := parseStatusRange(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestHealthProber_HTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Header.Get("X-Probe") != "yes" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"status":"ok","db":"up"}`))
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	cases := []struct {
+		name    string
+		config  HealthCheckConfig
+		healthy bool
+	}{
+		{"matching expectations", HealthCheckConfig{Path: "/healthz", Headers: map[string]string{"X-Probe": "yes"}, BodyContains: `"db":"up"`}, true},
+		{"body regex", HealthCheckConfig{Path: "/healthz", Headers: map[string]string{"X-Probe": "yes"}, BodyRegex: `"status":\s*"ok"`}, true},
+		{"404 is unhealthy by default", HealthCheckConfig{Path: "/healthz"}, false},
+		{"404 accepted explicitly", HealthCheckConfig{Path: "/healthz", ExpectedStatus: []string{"200", "404"}}, true},
+		{"body mismatch", HealthCheckConfig{Path: "/healthz", Headers: map[string]string{"X-Probe": "yes"}, BodyContains: "degraded"}, false},
+	}
+	for _, tc := range cases {
+		hp, err := newHealthProber(&tc.config)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		err = hp.probe(context.Background(), target)
+		if (err == nil) != tc.healthy {
+			t.Errorf("%s: expected healthy=%v, got err=%v", tc.name, tc.healthy, err)
+		}
+	}
+
+	if _, err := newHealthProber(&HealthCheckConfig{Type: "icmp"}); err == nil {
+		t.Error("Expected error for unknown check type")
+	}
+}
+
+func TestHealthProber_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+
+	hp, _ := newHealthProber(&HealthCheckConfig{Type: HealthCheckTCP, Timeout: 1})
+	if err := hp.probe(context.Background(), &url.URL{Scheme: "http", Host: addr}); err != nil {
+		t.Errorf("Expected open port to be healthy, got %v", err)
+	}
+	ln.Close()
+	if err := hp.probe(context.Background(), &url.URL{Scheme: "http", Host: addr}); err == nil {
+		t.Error("Expected closed port to be unhealthy")
+	}
+}
+
+func TestHealthProber_GRPC(t *testing.T) {
+	serving := uint64(1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/grpc.health.v1.Health/Check" || r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		msg := binary.AppendUvarint([]byte{0x08}, serving)
+		frame := make([]byte, 5)
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		w.Write(append(frame, msg...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+
+	hp, _ := newHealthProber(&HealthCheckConfig{Type: HealthCheckGRPC, GRPCService: "orders"})
+	if err := hp.probe(context.Background(), target); err != nil {
+		t.Errorf("Expected SERVING backend to be healthy, got %v", err)
+	}
+	serving = 2 // NOT_SERVING
+	if err := hp.probe(context.Background(), target); err == nil {
+		t.Error("Expected NOT_SERVING backend to be unhealthy")
+	}
+}
+
+func TestHealthCounter_Thresholds(t *testing.T) {
+	c := &healthCounter{}
+	alive := true
+
+	// Two failures with fall=3 keep the backend up
+	alive = c.observe(alive, false, 2, 3)
+	alive = c.observe(alive, false, 2, 3)
+	if !alive {
+		t.Fatal("Backend should stay up before the unhealthy threshold")
+	}
+	alive = c.observe(alive, false, 2, 3)
+	if alive {
+		t.Fatal("Backend should be down after 3 consecutive failures")
+	}
+
+	// A single success with rise=2 is not enough
+	alive = c.observe(alive, true, 2, 3)
+	if alive {
+		t.Fatal("Backend should stay down before the healthy threshold")
+	}
+	alive = c.observe(alive, true, 2, 3)
+	if !alive {
+		t.Fatal("Backend should be up after 2 consecutive successes")
+	}
+}
+
+func TestJittered(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jittered(10*time.Second, 10)
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("Jittered interval out of range: %v", d)
+		}
+	}
+}
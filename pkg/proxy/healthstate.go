@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxHealthHistory bounds the number of transitions kept per backend
+const maxHealthHistory = 20
+
+// HealthTransition records a single change of a backend's health
+type HealthTransition struct {
+	Time    time.Time `json:"time"`
+	Healthy bool      `json:"healthy"`
+	Reason  string    `json:"reason"`
+}
+
+// HealthEvent is published on HealthChan whenever a backend changes state
+type HealthEvent struct {
+	Route   string    `json:"route"`
+	Backend string    `json:"backend"`
+	Healthy bool      `json:"healthy"`
+	Reason  string    `json:"reason"`
+	Time    time.Time `json:"time"`
+}
+
+// BackendHealthStatus is a snapshot of a backend's health for the API
+type BackendHealthStatus struct {
+	Route    string             `json:"route"`
+	Backend  string             `json:"backend"`
+	Healthy  bool               `json:"healthy"`
+	Draining bool               `json:"draining"`
+	InFlight int64              `json:"in_flight"`
+	Removed  bool               `json:"removed,omitempty"` // Dropped by a reload, still finishing requests
+	History  []HealthTransition `json:"history"`
+}
+
+// backendHealth is the shared, concurrency-safe health state of a backend.
+// It is keyed by route and target so it survives route reloads.
+type backendHealth struct {
+	alive       atomic.Bool
+	recoveredAt atomic.Int64 // UnixNano of the last return to healthy, for slow-start
+	draining    atomic.Bool
+	inflight    atomic.Int64
+	mu          sync.Mutex
+	counter     healthCounter
+	passive     passiveWindow
+	history     []HealthTransition
+}
+
+func newBackendHealth() *backendHealth {
+	h := &backendHealth{}
+	h.alive.Store(true)
+	return h
+}
+
+// observe feeds an active probe result through the rise/fall thresholds and
+// reports whether the backend changed state
+func (h *backendHealth) observe(healthy bool, rise, fall int, reason string) (bool, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	alive := h.alive.Load()
+	next := h.counter.observe(alive, healthy, rise, fall)
+	if next == alive {
+		return alive, false
+	}
+	h.transitionLocked(next, reason)
+	return next, true
+}
+
+// set forces a state, reporting whether it changed
+func (h *backendHealth) set(healthy bool, reason string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.alive.Load() == healthy {
+		return false
+	}
+	h.counter = healthCounter{}
+	h.transitionLocked(healthy, reason)
+	return true
+}
+
+func (h *backendHealth) transitionLocked(healthy bool, reason string) {
+	h.alive.Store(healthy)
+	if healthy {
+		h.recoveredAt.Store(time.Now().UnixNano())
+	}
+	// Traffic seen before a transition says nothing about the new state
+	h.passive.reset()
+	h.history = append(h.history, HealthTransition{Time: time.Now(), Healthy: healthy, Reason: reason})
+	if len(h.history) > maxHealthHistory {
+		h.history = h.history[len(h.history)-maxHealthHistory:]
+	}
+}
+
+func (h *backendHealth) snapshot() []HealthTransition {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HealthTransition(nil), h.history...)
+}
+
+func (h *backendHealth) status(routePath, target string) BackendHealthStatus {
+	return BackendHealthStatus{
+		Route:    routePath,
+		Backend:  target,
+		Healthy:  h.alive.Load(),
+		Draining: h.draining.Load(),
+		InFlight: h.inflight.Load(),
+		History:  h.snapshot(),
+	}
+}
+
+func healthKey(routePath, target string) string {
+	return routePath + "|" + target
+}
+
+// adoptHealthState points every backend of pool at the registered state for
+// its target, keeping state from before a reload. Must be called with p.mu held.
+func (p *Proxy) adoptHealthState(routePath string, pool *Pool, states map[string]*backendHealth) {
+	if pool == nil {
+		return
+	}
+	for _, b := range pool.backends() {
+		key := healthKey(routePath, b.URL.String())
+		if h, ok := states[key]; ok {
+			b.health = h
+			continue
+		}
+		if h, ok := p.healthStates[key]; ok {
+			b.health = h
+		} else if h, ok := p.removedBackends[key]; ok {
+			// Re-added before it finished draining
+			h.draining.Store(false)
+			b.health = h
+		}
+		states[key] = b.health
+	}
+}
+
+// setBackendHealth records a probe or traffic verdict and publishes an event on change
+func (p *Proxy) setBackendHealth(routePath string, b *Backend, healthy bool, reason string) {
+	if b.health.set(healthy, reason) {
+		p.publishHealthEvent(routePath, b, healthy, reason)
+	}
+}
+
+func (p *Proxy) publishHealthEvent(routePath string, b *Backend, healthy bool, reason string) {
+	if p.HealthChan == nil {
+		return
+	}
+	select {
+	case p.HealthChan <- HealthEvent{Route: routePath, Backend: b.URL.String(), Healthy: healthy, Reason: reason, Time: time.Now()}:
+	default:
+		// No consumer keeping up, drop the event
+	}
+}
+
+// GetBackendHealth returns the health and transition history of every routed backend
+func (p *Proxy) GetBackendHealth() []BackendHealthStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var statuses []BackendHealthStatus
+	seen := make(map[*backendHealth]bool)
+	add := func(routePath string, pool *Pool) {
+		if pool == nil {
+			return
+		}
+		for _, b := range pool.backends() {
+			if seen[b.health] {
+				continue
+			}
+			seen[b.health] = true
+			statuses = append(statuses, b.health.status(routePath, b.URL.String()))
+		}
+	}
+	add("", p.defaultPool)
+	for _, r := range p.routes {
+		for _, pool := range r.pools() {
+			add(r.Path, pool)
+		}
+	}
+	for key, h := range p.removedBackends {
+		if h.inflight.Load() == 0 {
+			continue
+		}
+		status := h.status(splitHealthKey(key))
+		status.Removed = true
+		statuses = append(statuses, status)
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Route < statuses[j].Route })
+	return statuses
+}
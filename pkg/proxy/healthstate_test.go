@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestProxy_HealthStatePreservedAcrossReload(t *testing.T) {
+	p, _ := New([]string{})
+	routes := []ConfigRoute{{Path: "/api", Targets: []string{"http://10.0.0.1:80", "http://10.0.0.2:80"}}}
+	p.UpdateRoutes(routes)
+
+	down := p.routes[0].Pool.backends()[0]
+	p.setBackendHealth("/api", down, false, "active check failed: connection refused")
+
+	event := <-p.HealthChan
+	if event.Route != "/api" || event.Backend != "http://10.0.0.1:80" || event.Healthy {
+		t.Errorf("Unexpected health event %+v", event)
+	}
+
+	// Reload with one unchanged target, one new target
+	routes[0].Targets = []string{"http://10.0.0.1:80", "http://10.0.0.3:80"}
+	p.UpdateRoutes(routes)
+
+	for _, b := range p.routes[0].Pool.backends() {
+		switch b.URL.String() {
+		case "http://10.0.0.1:80":
+			if b.IsAlive() {
+				t.Error("Unchanged target should keep its unhealthy state")
+			}
+		case "http://10.0.0.3:80":
+			if !b.IsAlive() {
+				t.Error("New target should start healthy")
+			}
+		}
+	}
+
+	statuses := p.GetBackendHealth()
+	if len(statuses) != 2 {
+		t.Fatalf("Expected 2 backends, got %d", len(statuses))
+	}
+	for _, s := range statuses {
+		if s.Backend == "http://10.0.0.1:80" {
+			if len(s.History) != 1 || s.History[0].Reason != "active check failed: connection refused" {
+				t.Errorf("Expected transition history to survive reload, got %+v", s.History)
+			}
+		}
+	}
+
+	// Setting the same state again is not a transition
+	p.setBackendHealth("/api", p.routes[0].Pool.backends()[0], false, "still down")
+	select {
+	case e := <-p.HealthChan:
+		t.Errorf("Unexpected event for unchanged state: %+v", e)
+	default:
+	}
+}
+
+func TestProxy_HealthStateConcurrentAccess(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{Path: "/api", Targets: []string{backend.URL}}})
+	b := p.routes[0].Pool.backends()[0]
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			p.setBackendHealth("/api", b, i%2 == 0, "flap")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+		}
+	}()
+	wg.Wait()
+
+	if n := len(p.GetBackendHealth()[0].History); n > maxHealthHistory {
+		t.Errorf("History should be bounded, got %d entries", n)
+	}
+}
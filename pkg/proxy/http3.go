@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// TLSConfig terminates TLS on the proxy listener. HTTP/1.1 and HTTP/2 are
+// negotiated over TCP; HTTP/3 optionally runs over QUIC with the same
+// certificate and route table, and is advertised with Alt-Svc.
+type TLSConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	HTTP3        bool   `json:"http3,omitempty"`
+	HTTP3Addr    string `json:"http3_addr,omitempty"`      // UDP address, defaults to the TCP listener's
+	AltSvcMaxAge int    `json:"alt_svc_max_age,omitempty"` // Seconds clients may remember HTTP/3, defaults to 86400
+}
+
+// protocolStats counts requests by downstream protocol
+type protocolStats struct {
+	http1 atomic.Uint64
+	http2 atomic.Uint64
+	http3 atomic.Uint64
+}
+
+func (s *protocolStats) observe(r *http.Request) {
+	switch r.ProtoMajor {
+	case 3:
+		s.http3.Add(1)
+	case 2:
+		s.http2.Add(1)
+	default:
+		s.http1.Add(1)
+	}
+}
+
+// SetTLS enables TLS for listeners started afterwards. Calling it again
+// swaps the certificate on running listeners.
+func (p *Proxy) SetTLS(config TLSConfig) error {
+	if config.CertFile == "" && config.KeyFile == "" {
+		if config.HTTP3 {
+			return fmt.Errorf("http3 requires a certificate")
+		}
+		p.listenerMu.Lock()
+		p.tls = TLSConfig{}
+		p.listenerMu.Unlock()
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	if config.HTTP3Addr != "" {
+		if _, err := net.ResolveUDPAddr("udp", config.HTTP3Addr); err != nil {
+			return fmt.Errorf("invalid http3 address: %w", err)
+		}
+	}
+	if config.AltSvcMaxAge <= 0 {
+		config.AltSvcMaxAge = 86400
+	}
+
+	p.listenerMu.Lock()
+	p.tls = config
+	p.listenerMu.Unlock()
+	p.certificate.Store(&cert)
+	return nil
+}
+
+// serverTLSConfig hands out the current certificate so reloads apply to new handshakes
+func (p *Proxy) serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.certificate.Load(), nil
+		},
+	}
+}
+
+// startHTTP3 listens for QUIC next to the TCP listener at tcpAddr and
+// returns the Alt-Svc value advertising it
+func (p *Proxy) startHTTP3(config TLSConfig, tcpAddr net.Addr, handler http.Handler) (string, error) {
+	addr := config.HTTP3Addr
+	if addr == "" {
+		addr = tcpAddr.String()
+	}
+	p.listenerMu.Lock()
+	listen := p.listenPacket
+	p.listenerMu.Unlock()
+	if listen == nil {
+		listen = net.ListenPacket
+	}
+	conn, err := listen("udp", addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to listen for http3: %w", err)
+	}
+
+	server := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(p.serverTLSConfig()),
+	}
+	p.listenerMu.Lock()
+	p.http3Server = server
+	p.listenerMu.Unlock()
+
+	go func() {
+		if err := server.Serve(conn); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("⚠️ HTTP/3 listener stopped: %v\n", err)
+		}
+	}()
+	fmt.Printf("🚀 HTTP/3 listening on udp %s\n", conn.LocalAddr())
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	return fmt.Sprintf(`h3=":%d"; ma=%d`, port, config.AltSvcMaxAge), nil
+}
+
+// advertiseHTTP3 adds Alt-Svc to TCP responses so clients can upgrade
+func advertiseHTTP3(next http.Handler, altSvc string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxy) shutdownHTTP3(ctx context.Context) error {
+	p.listenerMu.Lock()
+	server := p.http3Server
+	p.http3Server = nil
+	p.listenerMu.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// SetPacketListener overrides how the HTTP/3 socket is opened, e.g. to take
+// over one inherited from the previous process during an upgrade
+func (p *Proxy) SetPacketListener(listen func(network, addr string) (net.PacketConn, error)) {
+	p.listenerMu.Lock()
+	p.listenPacket = listen
+	p.listenerMu.Unlock()
+}
+
+// GetProtocolStats reports requests served per downstream protocol
+func (p *Proxy) GetProtocolStats() map[string]uint64 {
+	return map[string]uint64{
+		"http/1.1": p.protocols.http1.Load(),
+		"h2":       p.protocols.http2.Load(),
+		"h3":       p.protocols.http3.Load(),
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and returns its paths
+func writeTestCert(t *testing.T) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ghostplane-test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestProxy_HTTP3(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{Path: "/app", Targets: []string{backend.URL}}})
+	if err := p.SetTLS(TLSConfig{HTTP3: true}); err == nil {
+		t.Error("Expected HTTP/3 without a certificate to be rejected")
+	}
+	certFile, keyFile := writeTestCert(t)
+	if err := p.SetTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile, HTTP3: true, HTTP3Addr: "127.0.0.1:0"}); err != nil {
+		t.Fatalf("SetTLS failed: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go p.Serve(ln)
+	defer p.Shutdown(context.Background())
+
+	clientTLS := &tls.Config{InsecureSkipVerify: true}
+	h2 := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS, ForceAttemptHTTP2: true}}
+	res, err := h2.Get("https://" + ln.Addr().String() + "/app")
+	if err != nil {
+		t.Fatalf("TLS request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Errorf("Expected h2 over TLS, got %s", res.Proto)
+	}
+	altSvc := regexp.MustCompile(`^h3=":(\d+)"; ma=86400$`).FindStringSubmatch(res.Header.Get("Alt-Svc"))
+	if altSvc == nil {
+		t.Fatalf("Expected an HTTP/3 Alt-Svc advertisement, got %q", res.Header.Get("Alt-Svc"))
+	}
+
+	h3 := &http.Client{Transport: &http3.Transport{TLSClientConfig: clientTLS}}
+	defer h3.Transport.(*http3.Transport).Close()
+	res, err = h3.Get("https://127.0.0.1:" + altSvc[1] + "/app")
+	if err != nil {
+		t.Fatalf("HTTP/3 request failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ProtoMajor != 3 || string(body) != "hello" {
+		t.Errorf("Expected the route over HTTP/3, got %s %q", res.Proto, body)
+	}
+	if res.Header.Get("Alt-Svc") != "" {
+		t.Error("Expected no Alt-Svc on HTTP/3 responses")
+	}
+
+	if stats := p.GetProtocolStats(); stats["h2"] != 1 || stats["h3"] != 1 || stats["http/1.1"] != 0 {
+		t.Errorf("Unexpected protocol stats %v", stats)
+	}
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// IPFilterConfig defines CIDR based access control. Deny entries always win;
+// when Allow is non-empty only matching clients are let through.
+type IPFilterConfig struct {
+	Allow []string `json:"allow,omitempty"` // CIDRs or bare IPs, e.g. "10.0.0.0/8"
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// IPFilterStatus reports the current lists and deny counter of a filter
+type IPFilterStatus struct {
+	Route  string          `json:"route,omitempty"` // Empty for the global filter
+	Config *IPFilterConfig `json:"config,omitempty"`
+	Denied uint64          `json:"denied"`
+}
+
+// prefixTrie is a binary trie over address bits used for longest-prefix lookups
+type prefixTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+}
+
+func (t *prefixTrie) insert(prefix netip.Prefix) {
+	addr := prefix.Addr().AsSlice()
+	node := &t.root
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := addr[i/8] >> (7 - uint(i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+}
+
+// contains reports whether any inserted prefix covers addr
+func (t *prefixTrie) contains(addr netip.Addr) bool {
+	bytes := addr.AsSlice()
+	node := &t.root
+	for i := 0; i < len(bytes)*8; i++ {
+		if node.terminal {
+			return true
+		}
+		node = node.children[bytes[i/8]>>(7-uint(i%8))&1]
+		if node == nil {
+			return false
+		}
+	}
+	return node.terminal
+}
+
+// ipSet holds separate tries for IPv4 and IPv6 prefixes
+type ipSet struct {
+	v4, v6 prefixTrie
+	size   int
+}
+
+func (s *ipSet) add(entry string) error {
+	entry = strings.TrimSpace(entry)
+	var prefix netip.Prefix
+	if strings.Contains(entry, "/") {
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return err
+		}
+		prefix = p.Masked()
+	} else {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return err
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	addr := prefix.Addr()
+	if addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+		addr = prefix.Addr()
+	}
+	if addr.Is4() {
+		s.v4.insert(prefix)
+	} else {
+		s.v6.insert(prefix)
+	}
+	s.size++
+	return nil
+}
+
+func (s *ipSet) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return s.v4.contains(addr)
+	}
+	return s.v6.contains(addr)
+}
+
+// ipAccessList is an immutable compiled IPFilterConfig
+type ipAccessList struct {
+	config *IPFilterConfig
+	allow  ipSet
+	deny   ipSet
+}
+
+func newIPAccessList(config *IPFilterConfig) (*ipAccessList, error) {
+	l := &ipAccessList{config: config}
+	if config == nil {
+		return l, nil
+	}
+	for _, entry := range config.Allow {
+		if err := l.allow.add(entry); err != nil {
+			return nil, fmt.Errorf("invalid allow entry %q: %w", entry, err)
+		}
+	}
+	for _, entry := range config.Deny {
+		if err := l.deny.add(entry); err != nil {
+			return nil, fmt.Errorf("invalid deny entry %q: %w", entry, err)
+		}
+	}
+	return l, nil
+}
+
+func (l *ipAccessList) permits(addr netip.Addr) bool {
+	if l.deny.size > 0 && l.deny.contains(addr) {
+		return false
+	}
+	if l.allow.size > 0 {
+		return l.allow.contains(addr)
+	}
+	return true
+}
+
+// ipFilter holds an access list that can be swapped at runtime without
+// rebuilding the routing table. The deny counter survives list updates.
+type ipFilter struct {
+	list   atomic.Pointer[ipAccessList]
+	denied atomic.Uint64
+}
+
+func newIPFilter(config *IPFilterConfig) (*ipFilter, error) {
+	f := &ipFilter{}
+	if err := f.update(config); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *ipFilter) update(config *IPFilterConfig) error {
+	list, err := newIPAccessList(config)
+	if err != nil {
+		return err
+	}
+	f.list.Store(list)
+	return nil
+}
+
+// allow checks addr against the current list, counting denials.
+// Requests whose client address cannot be determined are denied only when an allowlist is set.
+func (f *ipFilter) allow(addr netip.Addr) bool {
+	list := f.list.Load()
+	if list.allow.size == 0 && list.deny.size == 0 {
+		return true
+	}
+	if !addr.IsValid() {
+		if list.allow.size == 0 {
+			return true
+		}
+	} else if list.permits(addr) {
+		return true
+	}
+	f.denied.Add(1)
+	return false
+}
+
+func (f *ipFilter) status(route string) IPFilterStatus {
+	return IPFilterStatus{
+		Route:  route,
+		Config: f.list.Load().config,
+		Denied: f.denied.Load(),
+	}
+}
+
+// SetGlobalIPFilter replaces the filter applied to every request before routing
+func (p *Proxy) SetGlobalIPFilter(config *IPFilterConfig) error {
+	if err := p.globalIPFilter.update(config); err != nil {
+		return fmt.Errorf("invalid global ip filter: %w", err)
+	}
+	return nil
+}
+
+// SetRouteIPFilter replaces the filter of every route with the given path
+// in place, without reloading the routing table.
+func (p *Proxy) SetRouteIPFilter(routePath string, config *IPFilterConfig) error {
+	list, err := newIPAccessList(config)
+	if err != nil {
+		return fmt.Errorf("invalid ip filter for route %s: %w", routePath, err)
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	found := false
+	for _, r := range p.routes {
+		if r.Path == routePath {
+			r.ipFilter.list.Store(list)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("route %s not found", routePath)
+	}
+	return nil
+}
+
+// GetIPFilters returns the global filter followed by every route filter
+func (p *Proxy) GetIPFilters() []IPFilterStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	statuses := []IPFilterStatus{p.globalIPFilter.status("")}
+	for _, r := range p.routes {
+		statuses = append(statuses, r.ipFilter.status(r.Path))
+	}
+	return statuses
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestIPAccessList(t *testing.T) {
+	list, err := newIPAccessList(&IPFilterConfig{
+		Allow: []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile list: %v", err)
+	}
+
+	cases := map[string]bool{
+		"10.2.3.4":        true,
+		"10.1.2.3":        false, // deny wins over the broader allow
+		"192.168.1.10":    true,
+		"192.168.1.11":    false,
+		"::ffff:10.2.3.4": true,
+		"2001:db8:1::1":   true,
+		"2001:db9::1":     false,
+		"172.16.0.1":      false,
+	}
+	for ip, expected := range cases {
+		if got := list.permits(netip.MustParseAddr(ip)); got != expected {
+			t.Errorf("permits(%s) = %v, expected %v", ip, got, expected)
+		}
+	}
+
+	if _, err := newIPAccessList(&IPFilterConfig{Deny: []string{"not-an-ip"}}); err == nil {
+		t.Error("Expected error for invalid entry")
+	}
+}
+
+func TestProxy_IPFilter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{
+		{Path: "/admin", Targets: []string{backend.URL}, IPFilter: &IPFilterConfig{Allow: []string{"10.0.0.0/8"}}},
+		{Path: "/public", Targets: []string{backend.URL}},
+	})
+
+	do := func(path, remote string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := do("/admin", "10.1.1.1:5000"); code != http.StatusOK {
+		t.Errorf("Expected allowlisted client to pass, got %d", code)
+	}
+	if code := do("/admin", "203.0.113.7:5000"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for client outside allowlist, got %d", code)
+	}
+	if code := do("/public", "203.0.113.7:5000"); code != http.StatusOK {
+		t.Errorf("Expected unfiltered route to pass, got %d", code)
+	}
+
+	// Update the route filter in place
+	if err := p.SetRouteIPFilter("/admin", &IPFilterConfig{Allow: []string{"203.0.113.0/24"}}); err != nil {
+		t.Fatalf("SetRouteIPFilter failed: %v", err)
+	}
+	if code := do("/admin", "203.0.113.7:5000"); code != http.StatusOK {
+		t.Errorf("Expected updated allowlist to apply, got %d", code)
+	}
+	if err := p.SetRouteIPFilter("/missing", nil); err == nil {
+		t.Error("Expected error for unknown route")
+	}
+
+	// Global deny applies before routing
+	if err := p.SetGlobalIPFilter(&IPFilterConfig{Deny: []string{"203.0.113.7/32"}}); err != nil {
+		t.Fatalf("SetGlobalIPFilter failed: %v", err)
+	}
+	if code := do("/public", "203.0.113.7:5000"); code != http.StatusForbidden {
+		t.Errorf("Expected global deny, got %d", code)
+	}
+	if code := do("/public", "[2001:db8::1]:5000"); code != http.StatusOK {
+		t.Errorf("Expected IPv6 client to pass, got %d", code)
+	}
+
+	statuses := p.GetIPFilters()
+	if statuses[0].Denied != 1 {
+		t.Errorf("Expected 1 global denial, got %d", statuses[0].Denied)
+	}
+	if statuses[1].Route != "/admin" || statuses[1].Denied != 1 {
+		t.Errorf("Expected 1 denial on /admin, got %+v", statuses[1])
+	}
+	if p.DeniedRequests != 2 {
+		t.Errorf("Expected 2 total denials, got %d", p.DeniedRequests)
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// LimitsConfig bounds what a client may send on a route
+type LimitsConfig struct {
+	MaxRequestBodyBytes int64 `json:"max_request_body_bytes,omitempty"` // Larger bodies get 413
+	MaxHeaderBytes      int   `json:"max_header_bytes,omitempty"`       // Larger request heads get 431
+	// BufferRequests reads the whole body before a backend is picked, so slow
+	// uploads tie up a proxy goroutine instead of a backend connection.
+	// Buffered bodies are replayed on retries.
+	BufferRequests  bool `json:"buffer_requests,omitempty"`
+	BufferTimeoutMS int  `json:"buffer_timeout_ms,omitempty"` // Upload deadline while buffering; 408 when exceeded
+}
+
+const (
+	// defaultMaxBufferedBody bounds buffering when no body limit is set
+	defaultMaxBufferedBody = 10 << 20
+	// defaultMaxCacheableBytes bounds cache capture when the cache config has no max_size_bytes
+	defaultMaxCacheableBytes = 10 << 20
+)
+
+func validateLimits(config *LimitsConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.MaxRequestBodyBytes < 0 || config.MaxHeaderBytes < 0 || config.BufferTimeoutMS < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// requestHeadSize approximates the bytes the client sent for the request line and headers
+func requestHeadSize(r *http.Request) int {
+	size := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			size += len(k) + len(v) + 4
+		}
+	}
+	return size
+}
+
+// applyLimits enforces a route's size limits and, when configured, buffers
+// the request body. It returns the status to reject the request with, or 0.
+func applyLimits(w http.ResponseWriter, r *http.Request, config *LimitsConfig) int {
+	if config.MaxHeaderBytes > 0 && requestHeadSize(r) > config.MaxHeaderBytes {
+		return http.StatusRequestHeaderFieldsTooLarge
+	}
+
+	max := config.MaxRequestBodyBytes
+	if max == 0 && config.BufferRequests {
+		max = defaultMaxBufferedBody
+	}
+	if max == 0 || r.Body == nil || r.Body == http.NoBody {
+		return 0
+	}
+	if r.ContentLength > max {
+		return http.StatusRequestEntityTooLarge
+	}
+	// Bodies of unknown length are cut off mid-stream; the upstream error is reported as 413
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+
+	if !config.BufferRequests {
+		return 0
+	}
+	if config.BufferTimeoutMS > 0 {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Now().Add(time.Duration(config.BufferTimeoutMS) * time.Millisecond))
+		defer rc.SetReadDeadline(time.Time{})
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			return http.StatusRequestEntityTooLarge
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			return http.StatusRequestTimeout
+		default:
+			return http.StatusBadRequest
+		}
+	}
+
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return 0
+}
+
+// isRequestTooLarge reports whether a proxy error came from a body exceeding its limit
+func isRequestTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxy_RequestLimits(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/upload",
+		Targets: []string{backend.URL},
+		Limits:  &LimitsConfig{MaxRequestBodyBytes: 16, MaxHeaderBytes: 256},
+	}})
+	if err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+
+	send := func(body string, length int64, header string) int {
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+		req.ContentLength = length
+		if header != "" {
+			req.Header.Set("X-Padding", header)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := send("small", 5, ""); code != http.StatusOK {
+		t.Errorf("Expected 200 within limits, got %d", code)
+	}
+	if code := send(strings.Repeat("x", 32), 32, ""); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a declared oversized body, got %d", code)
+	}
+	if code := send("small", 5, strings.Repeat("h", 300)); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected 431 for oversized headers, got %d", code)
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("Expected rejected requests to never reach the backend, got %d hits", got)
+	}
+
+	// Without a Content-Length the body is cut off mid-stream
+	if code := send(strings.Repeat("x", 64*1024), -1, ""); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an oversized chunked body, got %d", code)
+	}
+
+	if err := p.UpdateRoutes([]ConfigRoute{{Path: "/", Targets: []string{backend.URL}, Limits: &LimitsConfig{MaxHeaderBytes: -1}}}); err == nil {
+		t.Error("Expected negative limits to be rejected")
+	}
+}
+
+func TestProxy_RequestBuffering(t *testing.T) {
+	var attempts int32
+	var lengths []int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lengths = append(lengths, r.ContentLength)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:       "/upload",
+		Targets:    []string{backend.URL},
+		Limits:     &LimitsConfig{MaxRequestBodyBytes: 1024, BufferRequests: true},
+		Resilience: &ResilienceConfig{MaxRetries: 1},
+	}})
+	if err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("payload"))
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if atomic.LoadInt32(&attempts) != 2 {
+		t.Fatalf("Expected the request to be retried, got %d attempts", attempts)
+	}
+	// The buffered body is sent with a known length, and again in full on the retry
+	if lengths[0] != 7 || lengths[1] != 7 {
+		t.Errorf("Expected buffered Content-Length 7 on both attempts, got %v", lengths)
+	}
+	if !strings.HasSuffix(w.Body.String(), "payload") {
+		t.Errorf("Expected the retried attempt to carry the body, got %q", w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 2048)))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 while buffering an oversized body, got %d", w.Code)
+	}
+}
+
+func TestProxy_MaxCacheableSize(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path == "/large" {
+			io.WriteString(w, strings.Repeat("x", 4096))
+			return
+		}
+		io.WriteString(w, "small")
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/*",
+		Targets: []string{backend.URL},
+		Cache:   &CacheConfig{Enabled: true, TTL: 60, MaxSizeBytes: 1024},
+	}})
+	if err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, path := range []string{"/large", "/small"} {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected 200 for %s, got %d", path, w.Code)
+			}
+		}
+	}
+
+	if _, ok := p.getCachedResponse("/large"); ok {
+		t.Error("Expected a response over max_size_bytes not to be cached")
+	}
+	if _, ok := p.getCachedResponse("/small"); !ok {
+		t.Error("Expected a small response to be cached")
+	}
+	// Two fetches of /large, one of /small
+	if got := atomic.LoadInt32(&hits); got != 3 {
+		t.Errorf("Expected 3 origin hits, got %d", got)
+	}
+}
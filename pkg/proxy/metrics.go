@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxMetricSeries bounds the label combinations kept per metric. Routes and
+// backends come from configuration, but discovery churn or stray methods
+// could otherwise grow the set forever; combinations past the limit are
+// folded into one series labelled "other".
+const maxMetricSeries = 2000
+
+// overflowLabel replaces every label value of series past maxMetricSeries
+const overflowLabel = "other"
+
+// latencyBuckets are the histogram upper bounds, in seconds
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// knownMethods keeps the method label to a fixed set
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+	http.MethodConnect: true, http.MethodTrace: true,
+}
+
+// metricSeries is one label combination: a counter, or a histogram when it has buckets
+type metricSeries struct {
+	values  []string
+	count   atomic.Uint64
+	sum     atomic.Uint64 // float64 bits
+	buckets []atomic.Uint64
+}
+
+func (s *metricSeries) inc() {
+	s.count.Add(1)
+}
+
+func (s *metricSeries) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			s.buckets[i].Add(1)
+			break
+		}
+	}
+	for {
+		old := s.sum.Load()
+		if s.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			break
+		}
+	}
+	s.count.Add(1)
+}
+
+// metricVec is a counter or histogram family keyed by label values; the zero value is ready to use
+type metricVec struct {
+	mu     sync.RWMutex
+	series map[string]*metricSeries
+}
+
+func (v *metricVec) with(histogram bool, values ...string) *metricSeries {
+	key := strings.Join(values, "\x00")
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+	if v.series == nil {
+		v.series = make(map[string]*metricSeries)
+	}
+	if len(v.series) >= maxMetricSeries {
+		values = make([]string, len(values))
+		for i := range values {
+			values[i] = overflowLabel
+		}
+		key = strings.Join(values, "\x00")
+		if s, ok := v.series[key]; ok {
+			return s
+		}
+	}
+	s = &metricSeries{values: values}
+	if histogram {
+		s.buckets = make([]atomic.Uint64, len(latencyBuckets))
+	}
+	v.series[key] = s
+	return s
+}
+
+func (v *metricVec) counter(values ...string) *metricSeries {
+	return v.with(false, values...)
+}
+
+func (v *metricVec) histogram(values ...string) *metricSeries {
+	return v.with(true, values...)
+}
+
+// sorted returns the series in label order, for stable output
+func (v *metricVec) sorted() []*metricSeries {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	out := make([]*metricSeries, 0, len(v.series))
+	for _, s := range v.series {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].values, "\x00") < strings.Join(out[j].values, "\x00")
+	})
+	return out
+}
+
+// proxyMetrics holds the request-path metrics that are not derived from
+// existing state at scrape time
+type proxyMetrics struct {
+	requests        metricVec // route, method, code_class, backend
+	duration        metricVec // route, backend
+	connect         metricVec // route, backend
+	ttfb            metricVec // route, backend
+	ejections       metricVec // route, backend
+	cache           metricVec // route, result
+	rateLimited     metricVec // route
+	circuitRejected metricVec // route
+	circuitTrips    metricVec // route
+}
+
+func methodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+func codeClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// routeLabel names the route a request was matched to, "default" otherwise
+func routeLabel(r *Route) string {
+	if r == nil {
+		return "default"
+	}
+	return r.Path
+}
+
+func backendLabel(b *Backend) string {
+	if b == nil {
+		return "none"
+	}
+	return b.URL.String()
+}
+
+func (m *proxyMetrics) observeRequest(route, method string, status int, backend string, elapsed time.Duration) {
+	m.requests.counter(route, methodLabel(method), codeClass(status), backend).inc()
+	m.duration.histogram(route, backend).observe(elapsed)
+}
+
+// traceUpstream times new connections and the first response byte of an attempt
+func (m *proxyMetrics) traceUpstream(start time.Time, route, backend string) *httptrace.ClientTrace {
+	// Dials for several addresses may race, so the first start wins
+	var connectStart atomic.Int64
+	return &httptrace.ClientTrace{
+		ConnectStart: func(_, _ string) {
+			connectStart.CompareAndSwap(0, time.Now().UnixNano())
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if started := connectStart.Load(); err == nil && started != 0 {
+				m.connect.histogram(route, backend).observe(time.Since(time.Unix(0, started)))
+			}
+		},
+		GotFirstResponseByte: func() {
+			m.ttfb.histogram(route, backend).observe(time.Since(start))
+		},
+	}
+}
+
+// promWriter renders the Prometheus text exposition format
+type promWriter struct {
+	w io.Writer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (pw promWriter) header(name, kind, help string) {
+	fmt.Fprintf(pw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample of an already declared family
+func (pw promWriter) sample(name string, names, values []string, v float64) {
+	fmt.Fprintf(pw.w, "%s%s %s\n", name, formatLabels(names, values), formatFloat(v))
+}
+
+// single writes a family with one unlabelled sample
+func (pw promWriter) single(name, kind, help string, v float64) {
+	pw.header(name, kind, help)
+	pw.sample(name, nil, nil, v)
+}
+
+func (pw promWriter) counters(name, help string, labels []string, vec *metricVec) {
+	pw.header(name, "counter", help)
+	for _, s := range vec.sorted() {
+		pw.sample(name, labels, s.values, float64(s.count.Load()))
+	}
+}
+
+func (pw promWriter) histograms(name, help string, labels []string, vec *metricVec) {
+	pw.header(name, "histogram", help)
+	withLE := append(append([]string(nil), labels...), "le")
+	for _, s := range vec.sorted() {
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += s.buckets[i].Load()
+			pw.sample(name+"_bucket", withLE, append(append([]string(nil), s.values...), formatFloat(bound)), float64(cumulative))
+		}
+		// Buckets are counted first, so a concurrent observation may be missing from count
+		count := max(s.count.Load(), cumulative)
+		pw.sample(name+"_bucket", withLE, append(append([]string(nil), s.values...), "+Inf"), float64(count))
+		pw.sample(name+"_sum", labels, s.values, math.Float64frombits(s.sum.Load()))
+		pw.sample(name+"_count", labels, s.values, float64(count))
+	}
+}
+
+// MetricsWriter renders extra metric families after the proxy's own, such as
+// data-plane counters the proxy does not know about
+type MetricsWriter struct {
+	pw promWriter
+}
+
+// Counter writes a counter family with one sample per entry of values, keyed by label's value
+func (m MetricsWriter) Counter(name, help, label string, values map[string]float64) {
+	m.family(name, "counter", help, label, values)
+}
+
+// Gauge writes a gauge family with one sample per entry of values, keyed by label's value
+func (m MetricsWriter) Gauge(name, help, label string, values map[string]float64) {
+	m.family(name, "gauge", help, label, values)
+}
+
+func (m MetricsWriter) family(name, kind, help, label string, values map[string]float64) {
+	m.pw.header(name, kind, help)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if label == "" {
+			m.pw.sample(name, nil, nil, values[k])
+		} else {
+			m.pw.sample(name, []string{label}, []string{k}, values[k])
+		}
+	}
+}
+
+// WriteMetrics renders the proxy's metrics in the Prometheus text format.
+// extra, if set, appends further families.
+func (p *Proxy) WriteMetrics(w io.Writer, extra func(MetricsWriter)) {
+	pw := promWriter{w}
+	m := &p.metrics
+	routeBackend := []string{"route", "backend"}
+
+	pw.single("ghostplane_requests_total", "counter", "Requests received by the L7 proxy.", float64(atomic.LoadUint64(&p.TotalRequests)))
+	pw.single("ghostplane_active_connections", "gauge", "Requests currently being served, including upgraded connections.", float64(atomic.LoadInt32(&p.ActiveConnections)))
+	pw.single("ghostplane_denied_requests_total", "counter", "Requests refused by the global IP filter.", float64(atomic.LoadUint64(&p.DeniedRequests)))
+	pw.single("ghostplane_shed_requests_total", "counter", "Requests shed by adaptive concurrency limits.", float64(atomic.LoadUint64(&p.ShedRequests)))
+	pw.single("ghostplane_dropped_access_logs_total", "counter", "Access log entries dropped because no consumer kept up.", float64(atomic.LoadUint64(&p.DroppedLogs)))
+
+	pw.header("ghostplane_protocol_requests_total", "counter", "Requests by downstream protocol.")
+	protocols := p.GetProtocolStats()
+	for _, proto := range []string{"http/1.1", "h2", "h3"} {
+		pw.sample("ghostplane_protocol_requests_total", []string{"protocol"}, []string{proto}, float64(protocols[proto]))
+	}
+
+	pw.counters("ghostplane_http_requests_total", "Completed requests by route, method, status class and backend.",
+		[]string{"route", "method", "code_class", "backend"}, &m.requests)
+	pw.histograms("ghostplane_http_request_duration_seconds", "Time to serve a request, retries included.", routeBackend, &m.duration)
+	pw.histograms("ghostplane_upstream_connect_duration_seconds", "Time to open a new connection to a backend.", routeBackend, &m.connect)
+	pw.histograms("ghostplane_upstream_ttfb_seconds", "Time from sending an attempt to its first response byte.", routeBackend, &m.ttfb)
+
+	health := p.GetBackendHealth()
+	sort.SliceStable(health, func(i, j int) bool {
+		if health[i].Route != health[j].Route {
+			return health[i].Route < health[j].Route
+		}
+		return health[i].Backend < health[j].Backend
+	})
+	gauges := []struct {
+		name, help string
+		value      func(BackendHealthStatus) float64
+	}{
+		{"ghostplane_backend_up", "Whether the backend is healthy.", func(s BackendHealthStatus) float64 { return boolMetric(s.Healthy) }},
+		{"ghostplane_backend_draining", "Whether the backend is draining.", func(s BackendHealthStatus) float64 { return boolMetric(s.Draining) }},
+		{"ghostplane_backend_in_flight", "Requests currently proxied to the backend.", func(s BackendHealthStatus) float64 { return float64(s.InFlight) }},
+	}
+	for _, g := range gauges {
+		pw.header(g.name, "gauge", g.help)
+		for i, s := range health {
+			if i >= maxMetricSeries {
+				break
+			}
+			pw.sample(g.name, routeBackend, []string{routeLabelOf(s.Route), s.Backend}, g.value(s))
+		}
+	}
+	pw.counters("ghostplane_backend_ejections_total", "Backends taken out of rotation by passive health checks.", routeBackend, &m.ejections)
+
+	p.cacheMu.Lock()
+	entries := len(p.cacheStore)
+	p.cacheMu.Unlock()
+	pw.single("ghostplane_cache_entries", "gauge", "Responses held in the cache.", float64(entries))
+	pw.counters("ghostplane_cache_requests_total", "Cache lookups by result.", []string{"route", "result"}, &m.cache)
+	pw.counters("ghostplane_rate_limited_total", "Requests rejected by rate limits.", []string{"route"}, &m.rateLimited)
+	pw.counters("ghostplane_circuit_breaker_rejections_total", "Requests rejected by an open circuit breaker.", []string{"route"}, &m.circuitRejected)
+	pw.counters("ghostplane_circuit_breaker_trips_total", "Times a circuit breaker opened.", []string{"route"}, &m.circuitTrips)
+
+	pw.header("ghostplane_circuit_breaker_state", "gauge", "Circuit breaker state: 0 closed, 1 half-open, 2 open.")
+	p.cbMu.Lock()
+	states := make(map[string]float64, len(p.circuitStates))
+	for path, st := range p.circuitStates {
+		states[path] = map[string]float64{"closed": 0, "half-open": 1, "open": 2}[st.status]
+	}
+	p.cbMu.Unlock()
+	paths := make([]string, 0, len(states))
+	for path := range states {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		pw.sample("ghostplane_circuit_breaker_state", []string{"route"}, []string{path}, states[path])
+	}
+
+	if extra != nil {
+		extra(MetricsWriter{pw})
+	}
+}
+
+// routeLabelOf maps the health registry's route key onto the route label
+func routeLabelOf(path string) string {
+	if path == "" {
+		return "default"
+	}
+	return path
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(p *Proxy) string {
+	var out strings.Builder
+	p.WriteMetrics(&out, nil)
+	return out.String()
+}
+
+func TestProxy_Metrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{
+		{Path: "/api/*", Targets: []string{backend.URL}},
+		{Path: "/limited", Targets: []string{backend.URL}, RateLimit: &RateLimitConfig{RequestsPerSecond: 0.001, Burst: 1}},
+	})
+	p.LogChan = make(chan AccessLog, 5) // Nobody reads it, so the sixth entry is dropped
+	for _, path := range []string{"/api/a", "/api/b", "/api/fail", "/limited", "/limited"} {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/api/pot", nil))
+
+	out := scrape(p)
+	for _, want := range []string{
+		fmt.Sprintf(`ghostplane_http_requests_total{route="/api/*",method="GET",code_class="2xx",backend=%q} 2`, backend.URL),
+		fmt.Sprintf(`ghostplane_http_requests_total{route="/api/*",method="GET",code_class="5xx",backend=%q} 1`, backend.URL),
+		fmt.Sprintf(`ghostplane_http_requests_total{route="/api/*",method="OTHER",code_class="2xx",backend=%q} 1`, backend.URL),
+		`ghostplane_http_requests_total{route="/limited",method="GET",code_class="4xx",backend="none"} 1`,
+		fmt.Sprintf(`ghostplane_http_request_duration_seconds_count{route="/api/*",backend=%q} 4`, backend.URL),
+		fmt.Sprintf(`ghostplane_http_request_duration_seconds_bucket{route="/api/*",backend=%q,le="+Inf"} 4`, backend.URL),
+		fmt.Sprintf(`ghostplane_upstream_ttfb_seconds_count{route="/api/*",backend=%q} 4`, backend.URL),
+		fmt.Sprintf(`ghostplane_upstream_connect_duration_seconds_count{route="/api/*",backend=%q}`, backend.URL),
+		fmt.Sprintf(`ghostplane_backend_up{route="/api/*",backend=%q} 1`, backend.URL),
+		`ghostplane_rate_limited_total{route="/limited"} 1`,
+		`ghostplane_requests_total 6`,
+		`ghostplane_dropped_access_logs_total 1`,
+		"# TYPE ghostplane_upstream_ttfb_seconds histogram",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Missing %s", want)
+		}
+	}
+}
+
+func TestMetricVec_BoundedCardinality(t *testing.T) {
+	var vec metricVec
+	for i := 0; i < maxMetricSeries+50; i++ {
+		vec.counter("/r", fmt.Sprintf("http://10.0.%d.%d:80", i/256, i%256)).inc()
+	}
+	series := vec.sorted()
+	if len(series) != maxMetricSeries+1 {
+		t.Fatalf("Expected %d series, got %d", maxMetricSeries+1, len(series))
+	}
+	overflow := vec.counter("/r", "http://10.1.0.0:80")
+	if overflow.values[1] != overflowLabel || overflow.count.Load() != 50 {
+		t.Errorf("Expected later combinations folded into %q, got %v with %d", overflowLabel, overflow.values, overflow.count.Load())
+	}
+
+	var out strings.Builder
+	promWriter{&out}.counters("test_total", "Test.", []string{"route", "backend"}, &metricVec{series: map[string]*metricSeries{
+		"x": {values: []string{`a"b\c`, "line\nbreak"}},
+	}})
+	if !strings.Contains(out.String(), `test_total{route="a\"b\\c",backend="line\nbreak"} 0`) {
+		t.Errorf("Expected escaped label values, got %s", out.String())
+	}
+}
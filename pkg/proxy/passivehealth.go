@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// PassiveHealthConfig marks backends unhealthy from live traffic results.
+// Passive checks only take backends out of rotation; recovery is confirmed
+// by the route's active checks reaching the healthy threshold.
+type PassiveHealthConfig struct {
+	Window              int `json:"window,omitempty"`               // Sliding window in seconds, defaults to 30
+	MinRequests         int `json:"min_requests,omitempty"`         // Requests in window before the 5xx rate is judged, defaults to 10
+	ErrorRatePercent    int `json:"error_rate_percent,omitempty"`   // 5xx share that marks a backend down, defaults to 50
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"` // Connect errors or timeouts in a row that mark a backend down, defaults to 3
+}
+
+// passiveBuckets is the resolution of the sliding window
+const passiveBuckets = 10
+
+type passiveBucket struct {
+	slot   int64
+	total  int
+	errors int
+}
+
+// passiveWindow counts requests and 5xx responses over a bucketed sliding window
+type passiveWindow struct {
+	buckets     [passiveBuckets]passiveBucket
+	consecutive int
+}
+
+func (w *passiveWindow) reset() {
+	*w = passiveWindow{}
+}
+
+// record adds one outcome and returns the totals inside the window
+func (w *passiveWindow) record(now time.Time, window time.Duration, serverError bool) (int, int) {
+	width := window / passiveBuckets
+	if width <= 0 {
+		width = time.Second
+	}
+	slot := now.UnixNano() / int64(width)
+
+	b := &w.buckets[slot%passiveBuckets]
+	if b.slot != slot {
+		*b = passiveBucket{slot: slot}
+	}
+	b.total++
+	if serverError {
+		b.errors++
+	}
+
+	var total, errs int
+	for _, b := range w.buckets {
+		if slot-b.slot < passiveBuckets {
+			total += b.total
+			errs += b.errors
+		}
+	}
+	return total, errs
+}
+
+// recordTraffic feeds a live request outcome into the passive window and takes
+// the backend down when a threshold is crossed, returning the reason if so
+func (h *backendHealth) recordTraffic(cfg *PassiveHealthConfig, failed, serverError bool, now time.Time) (string, bool) {
+	window := time.Duration(cfg.Window) * time.Second
+	if window <= 0 {
+		window = 30 * time.Second
+	}
+	minRequests := cfg.MinRequests
+	if minRequests <= 0 {
+		minRequests = 10
+	}
+	errorRate := cfg.ErrorRatePercent
+	if errorRate <= 0 {
+		errorRate = 50
+	}
+	consecutive := cfg.ConsecutiveFailures
+	if consecutive <= 0 {
+		consecutive = 3
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.alive.Load() {
+		return "", false
+	}
+
+	total, errs := h.passive.record(now, window, failed || serverError)
+	if failed {
+		h.passive.consecutive++
+	} else {
+		h.passive.consecutive = 0
+	}
+
+	var reason string
+	switch {
+	case failed && h.passive.consecutive >= consecutive:
+		reason = fmt.Sprintf("passive check: %d consecutive connection failures", h.passive.consecutive)
+	case total >= minRequests && errs*100 >= errorRate*total:
+		reason = fmt.Sprintf("passive check: %d of %d requests failed in %s", errs, total, window)
+	default:
+		return "", false
+	}
+
+	h.counter = healthCounter{}
+	h.transitionLocked(false, reason)
+	return reason, true
+}
+
+// proxyAttemptKey carries a *proxyAttempt through the reverse proxy so the
+// transport error of an attempt can be told apart from a backend 5xx
+type proxyAttemptKey struct{}
+
+type proxyAttempt struct {
+	err error
+}
+
+// proxyErrorHandler records the transport error for passive health checks and
+// answers 502 like the reverse proxy's default handler
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if a, ok := r.Context().Value(proxyAttemptKey{}).(*proxyAttempt); ok {
+		a.err = err
+	}
+	if isRequestTooLarge(err) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	log.Printf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// isTimeout reports whether a transport error was a timeout rather than a refusal
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// observeTraffic applies a proxied attempt's outcome to the backend's passive
+// health. Cancellations by the client say nothing about the backend.
+func (p *Proxy) observeTraffic(route *Route, b *Backend, clientCtx context.Context, status int, err error) {
+	if route.HealthCheck == nil || route.HealthCheck.Passive == nil {
+		return
+	}
+	if err != nil && (clientCtx.Err() != nil || isRequestTooLarge(err)) {
+		return
+	}
+	if reason, changed := b.health.recordTraffic(route.HealthCheck.Passive, err != nil, status >= 500, time.Now()); changed {
+		if err != nil {
+			kind := "connection error"
+			if isTimeout(err) {
+				kind = "timeout"
+			}
+			reason += " (last: " + kind + ")"
+		}
+		p.metrics.ejections.counter(route.Path, b.URL.String()).inc()
+		p.publishHealthEvent(route.Path, b, false, reason)
+	}
+}
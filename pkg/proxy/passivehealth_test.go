@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxy_PassiveHealthServerErrors(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/api",
+		Targets: []string{backend.URL},
+		HealthCheck: &HealthCheckConfig{
+			Interval: 3600,
+			Passive:  &PassiveHealthConfig{MinRequests: 4, ErrorRatePercent: 50},
+		},
+	}})
+	b := p.routes[0].Pool.backends()[0]
+
+	for i := 0; i < 3; i++ {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+	}
+	if !b.IsAlive() {
+		t.Fatal("Backend should stay up below min_requests")
+	}
+
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+	if b.IsAlive() {
+		t.Fatal("Backend should be marked down once the 5xx rate is exceeded")
+	}
+
+	event := <-p.HealthChan
+	if event.Healthy || event.Backend != backend.URL {
+		t.Errorf("Unexpected health event %+v", event)
+	}
+}
+
+func TestProxy_PassiveHealthConnectionFailures(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	target := backend.URL
+	backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/api",
+		Targets: []string{target},
+		HealthCheck: &HealthCheckConfig{
+			Interval: 3600,
+			Passive:  &PassiveHealthConfig{ConsecutiveFailures: 2, MinRequests: 100},
+		},
+	}})
+	b := p.routes[0].Pool.backends()[0]
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for refused connection, got %d", w.Code)
+	}
+	if !b.IsAlive() {
+		t.Fatal("Backend should stay up after a single failure")
+	}
+
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+	if b.IsAlive() {
+		t.Fatal("Backend should be marked down after consecutive connection failures")
+	}
+}
+
+func TestBackendHealth_PassiveRecoveryNeedsActiveChecks(t *testing.T) {
+	h := newBackendHealth()
+	cfg := &PassiveHealthConfig{ConsecutiveFailures: 1}
+
+	if _, down := h.recordTraffic(cfg, true, false, time.Now()); !down {
+		t.Fatal("Expected a connection failure to take the backend down")
+	}
+
+	// Traffic successes alone never bring a backend back
+	if _, changed := h.recordTraffic(cfg, false, false, time.Now()); changed || h.alive.Load() {
+		t.Fatal("Passive results must not restore a backend")
+	}
+
+	if _, changed := h.observe(true, 2, 1, "active check passed"); changed {
+		t.Error("One active pass should not meet a rise threshold of 2")
+	}
+	if alive, changed := h.observe(true, 2, 1, "active check passed"); !changed || !alive {
+		t.Error("Backend should recover after the rise threshold of active passes")
+	}
+}
+
+func TestPassiveWindow_Expires(t *testing.T) {
+	var w passiveWindow
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		w.record(now, 10*time.Second, true)
+	}
+	total, errs := w.record(now.Add(11*time.Second), 10*time.Second, false)
+	if total != 1 || errs != 0 {
+		t.Errorf("Expected old outcomes to leave the window, got total=%d errors=%d", total, errs)
+	}
+}
@@ -2,18 +2,25 @@ package proxy
 
 import (
 	"bytes"
+	"container/list"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"path"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
@@ -26,15 +33,34 @@ type AccessLog struct {
 	DurationMs int64     `json:"duration_ms"`
 	Backend    string    `json:"backend"`
 	ClientIP   string    `json:"client_ip"`
+	Split      string    `json:"split,omitempty"` // Traffic split that served the request
+	RequestID  string    `json:"request_id,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"` // Downstream protocol, e.g. HTTP/2.0
 }
 
 // statusResponseWriter is a wrapper for http.ResponseWriter to capture status code and body
 type statusResponseWriter struct {
 	http.ResponseWriter
-	header  http.Header
-	status  int
-	body    bytes.Buffer
-	capture bool
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	capture     bool
+	captureMax  int64 // Capture is abandoned once the body grows past this
+	wroteHeader bool
+	// beforeHeader runs once, right before the status line is written,
+	// so response headers can be adjusted after the upstream has set its own.
+	beforeHeader []func(h http.Header, status int)
+	// cacheHeader snapshots the headers before beforeHeader runs, so cached
+	// entries don't carry per-request additions
+	cacheHeader http.Header
+	// replaced is an error a beforeHeader hook sent in place of the upstream
+	// response; the upstream body is then dropped
+	replaced *errorResponse
+}
+
+type errorResponse struct {
+	status int
+	msg    string
 }
 
 func (w *statusResponseWriter) Header() http.Header {
@@ -42,29 +68,92 @@ func (w *statusResponseWriter) Header() http.Header {
 }
 
 func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced != nil {
+		return len(b), nil
+	}
 	if w.capture {
-		w.body.Write(b)
+		if w.captureMax > 0 && int64(w.body.Len()+len(b)) > w.captureMax {
+			w.capture = false
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
 	}
 	return w.ResponseWriter.Write(b)
 }
 
 func (w *statusResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.capture {
+			w.cacheHeader = w.header.Clone()
+		}
+		for _, fn := range w.beforeHeader {
+			fn(w.header, statusCode)
+		}
+		if res := w.replaced; res != nil {
+			w.capture = false
+			for k := range w.header {
+				delete(w.header, k)
+			}
+			w.status = res.status
+			http.Error(w.ResponseWriter, res.msg, res.status)
+			return
+		}
+	}
+	if w.replaced != nil {
+		return
+	}
 	w.status = statusCode
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
+// replaceResponse sends an error instead of the upstream response. Only a
+// beforeHeader hook may call it, before anything has been written.
+func (w *statusResponseWriter) replaceResponse(status int, msg string) {
+	w.replaced = &errorResponse{status: status, msg: msg}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // Backend represents a single target server
 type Backend struct {
 	URL    *url.URL
-	Alive  bool
 	Proxy  *httputil.ReverseProxy
 	Weight int // Added for weighted LB
+	// Locality is the backend's zone label, preferred when it matches the proxy's zone
+	Locality string
+	health   *backendHealth
+}
+
+// IsAlive reports the backend's current health; safe for concurrent use
+func (b *Backend) IsAlive() bool {
+	return b.health.alive.Load()
 }
 
 // Pool represents a group of backends
 type Pool struct {
-	backends []*Backend
-	current  uint64
+	members   atomic.Pointer[[]*Backend] // Swapped whole when discovery changes the membership
+	current   uint64
+	slowStart time.Duration           // Ramp-up window for recovered backends
+	zone      *atomic.Pointer[string] // The proxy's zone, shared so SetZone applies without a reload
+	opts      poolOptions             // Builds the members that discovery adds
+	// discovered is the target list last applied by discovery; guarded by the proxy's mu
+	discovered []DiscoveredTarget
+}
+
+// backends returns the pool's current members; the slice must not be modified
+func (p *Pool) backends() []*Backend {
+	if members := p.members.Load(); members != nil {
+		return *members
+	}
+	return nil
 }
 
 // Route represents a routing rule
@@ -87,16 +176,46 @@ type Route struct {
 	Auth           *AuthConfig
 	Cache          *CacheConfig
 	Headers        *HeadersConfig
+	CORS           *CORSConfig
+	ProxyProtocol  string
+	SlowStart      int
+	Failover       *FailoverConfig
+	Localities     map[string]string
+	TrafficSplit   *TrafficSplitConfig
+	BlueGreen      *BlueGreenConfig
+	Concurrency    *ConcurrencyConfig
+	Upstream       *UpstreamConfig
+	Compression    *CompressionConfig
+	Limits         *LimitsConfig
+	Filters        []FilterConfig
+	Discovery      *DiscoveryConfig
+	filters        []Filter // Compiled chain, run in order for every matched request
+	transport      *upstreamTransport
+	compression    *compressionPolicy
+	failoverPools  []*Pool
+	trafficSplit   *trafficSplit
+	blueGreen      *blueGreen
+	limiter        *concurrencyLimiter
+	cors           *corsPolicy
+	headers        *headerPolicy
+	ipFilter       *ipFilter
+	glob           string // Path with "{param}" segments as "*", empty when there are none
+	healthProber   *healthProber
+	discovery      discoverer
 	cancel         context.CancelFunc
 }
 
 // Matches checks if a request matches this route
 func (r *Route) Matches(req *http.Request) bool {
-	// 1. Method match
+	// 1. Method match (a CORS preflight is matched on the method it asks about)
+	method := req.Method
+	if r.cors != nil && isPreflight(req) {
+		method = strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))
+	}
 	if len(r.Methods) > 0 {
 		matchedMethod := false
 		for _, m := range r.Methods {
-			if m == req.Method {
+			if m == method {
 				matchedMethod = true
 				break
 			}
@@ -107,7 +226,11 @@ func (r *Route) Matches(req *http.Request) bool {
 	}
 
 	// 2. Path match (Glob)
-	matchedPath, _ := path.Match(r.Path, req.URL.Path)
+	pattern := r.Path
+	if r.glob != "" {
+		pattern = r.glob
+	}
+	matchedPath, _ := path.Match(pattern, req.URL.Path)
 	if matchedPath {
 		return true
 	}
@@ -127,6 +250,26 @@ func (r *Route) Matches(req *http.Request) bool {
 	return false
 }
 
+// pools returns every backend pool the route can send traffic to
+func (r *Route) pools() []*Pool {
+	pools := []*Pool{r.Pool}
+	if r.CanaryPool != nil {
+		pools = append(pools, r.CanaryPool)
+	}
+	pools = append(pools, r.failoverPools...)
+	if r.blueGreen != nil {
+		pools = append(pools, r.blueGreen.blue, r.blueGreen.green)
+	}
+	if r.trafficSplit != nil {
+		for _, t := range r.trafficSplit.targets {
+			if t.pool != nil {
+				pools = append(pools, t.pool)
+			}
+		}
+	}
+	return pools
+}
+
 // Authenticate checks if a request has valid credentials
 func (r *Route) Authenticate(req *http.Request) bool {
 	if r.Auth == nil || r.Auth.Type == "none" {
@@ -156,6 +299,9 @@ func (r *Route) Authenticate(req *http.Request) bool {
 		if expectedPass, ok := r.Auth.Keys[user]; ok && expectedPass == pass {
 			return true
 		}
+	case "jwt":
+		_, ok := verifyJWT(req, r.Auth)
+		return ok
 	}
 
 	return false
@@ -219,27 +365,42 @@ func (c *Condition) Match(req *http.Request) bool {
 
 // GetNextWithAlgorithm returns the next available backend using the specified algorithm and respecting affinity
 func (p *Pool) GetNextWithAlgorithm(algo string, affinity *AffinityConfig, req *http.Request) *Backend {
-	n := uint64(len(p.backends))
+	backends := p.backends()
+	n := uint64(len(backends))
 	if n == 0 {
 		return nil
 	}
 
 	aliveBackends := make([]*Backend, 0)
-	for _, b := range p.backends {
-		if b.Alive {
+	for _, b := range backends {
+		if b.IsAlive() && !b.IsDraining() {
 			aliveBackends = append(aliveBackends, b)
 		}
 	}
 
+	// With nothing healthy, fall back to any backend that is not draining
 	if len(aliveBackends) == 0 {
-		aliveBackends = p.backends
+		for _, b := range backends {
+			if !b.IsDraining() {
+				aliveBackends = append(aliveBackends, b)
+			}
+		}
+		if len(aliveBackends) == 0 {
+			return nil
+		}
 	}
 
+	aliveBackends = p.localCandidates(aliveBackends)
+
 	// Session Affinity
 	if affinity != nil && affinity.Type != "none" {
 		var key string
 		if affinity.Type == "client_ip" {
-			key = strings.Split(req.RemoteAddr, ":")[0]
+			if ip, ok := ClientIPFromContext(req.Context()); ok {
+				key = ip.String()
+			} else if ip := requestClientIP(req); ip.IsValid() {
+				key = ip.String()
+			}
 		} else if affinity.Type == "cookie" && affinity.CookieName != "" {
 			if c, err := req.Cookie(affinity.CookieName); err == nil {
 				key = c.Value
@@ -256,6 +417,11 @@ func (p *Pool) GetNextWithAlgorithm(algo string, affinity *AffinityConfig, req *
 		}
 	}
 
+	// Recovered backends warming up get a reduced share whatever the algorithm
+	if b := p.pickRamped(aliveBackends, strings.ToLower(algo) == "weighted"); b != nil {
+		return b
+	}
+
 	// Algorithms
 	switch strings.ToLower(algo) {
 	case "random":
@@ -306,21 +472,47 @@ type Proxy struct {
 	mu                sync.RWMutex
 	TotalRequests     uint64
 	ActiveConnections int32
+	DeniedRequests    uint64
+	ShedRequests      uint64
+	DroppedLogs       uint64 // Access log entries dropped because LogChan was full
 	LogChan           chan AccessLog
+	HealthChan        chan HealthEvent
 	healthCancels     []context.CancelFunc
+	discoveryCancels  []context.CancelFunc // Guarded by healthMu
 	healthMu          sync.Mutex
+	healthStates      map[string]*backendHealth // Guarded by mu
+	removedBackends   map[string]*backendHealth // Targets dropped by a reload that are still draining; guarded by mu
 	// Sprint 3 State
 	rateLimitMu      sync.Mutex
 	rateLimitBuckets map[string]*tokenBucket
+	rateLimitLRU     *list.List // Bucket keys, most recently used first; guarded by rateLimitMu
+	rateLimitSwept   time.Time  // Guarded by rateLimitMu
 	cbMu             sync.Mutex
 	circuitStates    map[string]*cbState
 	cacheMu          sync.Mutex
 	cacheStore       map[string]cacheEntry
+	globalIPFilter   *ipFilter
+	forwarding       atomic.Pointer[forwardingPolicy]
+	requestID        atomic.Pointer[requestIDPolicy]
+	listenerMu       sync.Mutex
+	proxyProtocol    ProxyProtocolConfig
+	zone             atomic.Pointer[string]
+	splitStats       splitStatsRegistry
+	plugins          pluginManager
+	tls              TLSConfig // Guarded by listenerMu
+	certificate      atomic.Pointer[tls.Certificate]
+	http3Server      *http3.Server                                      // Guarded by listenerMu
+	listenPacket     func(network, addr string) (net.PacketConn, error) // Guarded by listenerMu
+	protocols        protocolStats
+	metrics          proxyMetrics
 }
 
 type tokenBucket struct {
 	tokens float64
 	last   time.Time
+	rate   float64 // Refill rate and capacity the bucket was last used with
+	burst  float64
+	elem   *list.Element // Position in rateLimitLRU
 }
 
 type cbState struct {
@@ -342,12 +534,19 @@ func New(defaultBackends []string) (*Proxy, error) {
 		return nil, err
 	}
 
+	globalFilter, _ := newIPFilter(nil)
+
 	return &Proxy{
 		defaultPool:      pool,
 		LogChan:          make(chan AccessLog, 1000),
+		HealthChan:       make(chan HealthEvent, 100),
+		healthStates:     make(map[string]*backendHealth),
+		removedBackends:  make(map[string]*backendHealth),
 		rateLimitBuckets: make(map[string]*tokenBucket),
+		rateLimitLRU:     list.New(),
 		circuitStates:    make(map[string]*cbState),
 		cacheStore:       make(map[string]cacheEntry),
+		globalIPFilter:   globalFilter,
 	}, nil
 }
 
@@ -370,6 +569,20 @@ type ConfigRoute struct {
 	Auth           *AuthConfig           `json:"auth,omitempty"`
 	Cache          *CacheConfig          `json:"cache,omitempty"`
 	Headers        *HeadersConfig        `json:"headers,omitempty"`
+	CORS           *CORSConfig           `json:"cors,omitempty"`
+	IPFilter       *IPFilterConfig       `json:"ip_filter,omitempty"`
+	ProxyProtocol  string                `json:"proxy_protocol,omitempty"` // Send PROXY "v1" or "v2" headers to targets
+	SlowStart      int                   `json:"slow_start,omitempty"`     // Seconds to ramp a recovered backend up to its full weight
+	Failover       *FailoverConfig       `json:"failover,omitempty"`
+	Localities     map[string]string     `json:"localities,omitempty"` // Target URL to zone label
+	TrafficSplit   *TrafficSplitConfig   `json:"traffic_split,omitempty"`
+	BlueGreen      *BlueGreenConfig      `json:"blue_green,omitempty"`
+	Concurrency    *ConcurrencyConfig    `json:"concurrency,omitempty"`
+	Upstream       *UpstreamConfig       `json:"upstream,omitempty"`
+	Compression    *CompressionConfig    `json:"compression,omitempty"`
+	Limits         *LimitsConfig         `json:"limits,omitempty"`
+	Filters        []FilterConfig        `json:"filters,omitempty"` // Chain order; configured built-ins not listed follow in default order
+	Discovery      *DiscoveryConfig      `json:"discovery,omitempty"`
 }
 
 type CanaryConfig struct {
@@ -397,23 +610,33 @@ type CircuitBreakerConfig struct {
 type RateLimitConfig struct {
 	RequestsPerSecond float64 `json:"requests_per_second"`
 	Burst             int     `json:"burst"`
+	Key               string  `json:"key,omitempty"` // "route" (default, shared bucket) or "client_ip"
 }
 
 type AuthConfig struct {
-	Type string            `json:"type"` // "none", "api_key", "basic"
-	Keys map[string]string `json:"keys,omitempty"`
+	Type   string            `json:"type"` // "none", "api_key", "basic", "jwt"
+	Keys   map[string]string `json:"keys,omitempty"`
+	Secret string            `json:"secret,omitempty"` // HMAC key for "jwt" bearer tokens
 }
 
 type CacheConfig struct {
-	Enabled bool `json:"enabled"`
-	TTL     int  `json:"ttl_seconds"`
+	Enabled      bool  `json:"enabled"`
+	TTL          int   `json:"ttl_seconds"`
+	MaxSizeBytes int64 `json:"max_size_bytes,omitempty"` // Larger responses are not cached; defaults to 10 MiB
 }
 
+// HeadersConfig edits request and response headers. Values may reference
+// variables such as ${client_ip}, ${backend_url}, ${path.id} or ${jwt.sub}.
 type HeadersConfig struct {
-	AddRequest     map[string]string `json:"add_request,omitempty"`
-	RemoveRequest  []string          `json:"remove_request,omitempty"`
-	AddResponse    map[string]string `json:"add_response,omitempty"`
-	RemoveResponse []string          `json:"remove_response,omitempty"`
+	AddRequest      map[string]string    `json:"add_request,omitempty"`
+	AppendRequest   map[string]string    `json:"append_request,omitempty"` // Added alongside existing values
+	RemoveRequest   []string             `json:"remove_request,omitempty"`
+	AddResponse     map[string]string    `json:"add_response,omitempty"`
+	AppendResponse  map[string]string    `json:"append_response,omitempty"`
+	RemoveResponse  []string             `json:"remove_response,omitempty"`
+	ResponseRules   []HeaderRule         `json:"response_rules,omitempty"`
+	RewriteCookies  *CookieRewriteConfig `json:"rewrite_cookies,omitempty"`
+	RewriteLocation map[string]string    `json:"rewrite_location,omitempty"` // Upstream prefix to public prefix, e.g. "${backend_url}": "${scheme}://${host}"
 }
 
 // RoutingRule defines advanced matching conditions
@@ -432,11 +655,21 @@ type Condition struct {
 
 // HealthCheckConfig defines per-route health check settings
 type HealthCheckConfig struct {
-	Path               string `json:"path"`
-	Interval           int    `json:"interval"`
-	Timeout            int    `json:"timeout"`
-	HealthyThreshold   int    `json:"healthy_threshold"`
-	UnhealthyThreshold int    `json:"unhealthy_threshold"`
+	Type               string            `json:"type,omitempty"` // "http" (default), "tcp", "grpc"
+	Path               string            `json:"path"`
+	Method             string            `json:"method,omitempty"` // HTTP method, defaults to GET
+	Headers            map[string]string `json:"headers,omitempty"`
+	ExpectedStatus     []string          `json:"expected_status,omitempty"` // e.g. "200", "200-299", "3xx"; defaults to 200-399
+	BodyContains       string            `json:"body_contains,omitempty"`
+	BodyRegex          string            `json:"body_regex,omitempty"`
+	GRPCService        string            `json:"grpc_service,omitempty"` // Service name for grpc.health.v1
+	Interval           int               `json:"interval"`
+	Timeout            int               `json:"timeout"`
+	JitterPercent      int               `json:"jitter_percent,omitempty"` // Interval spread, defaults to 10
+	HealthyThreshold   int               `json:"healthy_threshold"`
+	UnhealthyThreshold int               `json:"unhealthy_threshold"`
+	// Passive marks backends down from live traffic; active checks confirm recovery
+	Passive *PassiveHealthConfig `json:"passive,omitempty"`
 }
 
 // RouteSource identifies the origin of a route
@@ -453,17 +686,107 @@ func (p *Proxy) UpdateRoutes(configRoutes []ConfigRoute) error {
 
 	var newRoutes []Route
 	for _, cr := range configRoutes {
-		pool, err := createBackendPoolWithWeights(cr.Targets, cr.Weights)
+		opts := poolOptions{
+			weights:    cr.Weights,
+			slowStart:  time.Duration(cr.SlowStart) * time.Second,
+			localities: cr.Localities,
+			zone:       &p.zone,
+		}
+		// Routes without upstream tuning share http.DefaultTransport, so a
+		// reload does not throw away their warm connections
+		var transport *upstreamTransport
+		if cr.Upstream != nil || cr.ProxyProtocol != "" {
+			t, err := newUpstreamTransport(cr.Upstream, cr.ProxyProtocol)
+			if err != nil {
+				return fmt.Errorf("invalid upstream for route %s: %w", cr.Path, err)
+			}
+			transport, opts.transport = t, t
+		}
+		pool, err := createBackendPoolWithOptions(cr.Targets, opts)
 		if err != nil {
 			return err
 		}
+		var provider discoverer
+		if cr.Discovery != nil {
+			if provider, err = newDiscoverer(cr.Discovery); err != nil {
+				return fmt.Errorf("invalid discovery for route %s: %w", cr.Path, err)
+			}
+			// Start from what the last lookup found rather than the bootstrap targets
+			for _, old := range p.routes {
+				if old.Path == cr.Path && reflect.DeepEqual(old.Discovery, cr.Discovery) && old.Pool != nil && old.Pool.discovered != nil {
+					members, err := discoveredBackends(old.Pool.discovered, nil, opts)
+					if err != nil {
+						return err
+					}
+					pool.members.Store(&members)
+					pool.discovered = old.Pool.discovered
+				}
+			}
+		}
 		var canaryPool *Pool
 		if cr.Canary != nil && len(cr.Canary.Targets) > 0 {
-			canaryPool, err = createBackendPool(cr.Canary.Targets)
+			canaryPool, err = createBackendPoolWithOptions(cr.Canary.Targets, poolOptions{transport: opts.transport, slowStart: opts.slowStart, localities: opts.localities, zone: opts.zone})
 			if err != nil {
 				return err
 			}
 		}
+		failoverPools, err := buildFailoverPools(cr.Failover, opts)
+		if err != nil {
+			return fmt.Errorf("invalid failover for route %s: %w", cr.Path, err)
+		}
+		split, err := newTrafficSplit(cr.TrafficSplit, opts)
+		if err != nil {
+			return fmt.Errorf("invalid traffic_split for route %s: %w", cr.Path, err)
+		}
+		bg, err := newBlueGreen(cr.BlueGreen, opts)
+		if err != nil {
+			return fmt.Errorf("invalid blue_green for route %s: %w", cr.Path, err)
+		}
+		for _, old := range p.routes {
+			if old.Path != cr.Path {
+				continue
+			}
+			if bg != nil {
+				bg.carryState(old.blueGreen)
+			} else if old.blueGreen != nil {
+				old.blueGreen.state.Load().endDrain()
+			}
+			if split != nil {
+				split.carryState(old.trafficSplit)
+			}
+		}
+		limiter, err := newConcurrencyLimiter(cr.Concurrency)
+		if err != nil {
+			return fmt.Errorf("invalid concurrency for route %s: %w", cr.Path, err)
+		}
+		if limiter != nil {
+			limiter = p.reuseLimiter(cr.Path, limiter)
+		}
+		compression, err := newCompressionPolicy(cr.Compression)
+		if err != nil {
+			return fmt.Errorf("invalid compression for route %s: %w", cr.Path, err)
+		}
+		if err := validateLimits(cr.Limits); err != nil {
+			return fmt.Errorf("invalid limits for route %s: %w", cr.Path, err)
+		}
+		headers, err := newHeaderPolicy(cr.Headers, cr.Auth)
+		if err != nil {
+			return fmt.Errorf("invalid headers for route %s: %w", cr.Path, err)
+		}
+		cors, err := newCORSPolicy(cr.CORS)
+		if err != nil {
+			return fmt.Errorf("invalid cors config for route %s: %w", cr.Path, err)
+		}
+		filter, err := newIPFilter(cr.IPFilter)
+		if err != nil {
+			return fmt.Errorf("invalid ip filter for route %s: %w", cr.Path, err)
+		}
+		var prober *healthProber
+		if cr.HealthCheck != nil {
+			if prober, err = newHealthProber(cr.HealthCheck); err != nil {
+				return fmt.Errorf("invalid health check for route %s: %w", cr.Path, err)
+			}
+		}
 
 		newRoutes = append(newRoutes, Route{
 			Path:           cr.Path,
@@ -483,6 +806,31 @@ func (p *Proxy) UpdateRoutes(configRoutes []ConfigRoute) error {
 			Auth:           cr.Auth,
 			Cache:          cr.Cache,
 			Headers:        cr.Headers,
+			CORS:           cr.CORS,
+			ProxyProtocol:  cr.ProxyProtocol,
+			SlowStart:      cr.SlowStart,
+			Failover:       cr.Failover,
+			Localities:     cr.Localities,
+			TrafficSplit:   cr.TrafficSplit,
+			failoverPools:  failoverPools,
+			trafficSplit:   split,
+			BlueGreen:      cr.BlueGreen,
+			blueGreen:      bg,
+			Concurrency:    cr.Concurrency,
+			limiter:        limiter,
+			Upstream:       cr.Upstream,
+			transport:      transport,
+			Compression:    cr.Compression,
+			compression:    compression,
+			Limits:         cr.Limits,
+			Filters:        cr.Filters,
+			Discovery:      cr.Discovery,
+			discovery:      provider,
+			cors:           cors,
+			headers:        headers,
+			ipFilter:       filter,
+			glob:           routeGlob(cr.Path),
+			healthProber:   prober,
 		})
 	}
 
@@ -491,112 +839,42 @@ func (p *Proxy) UpdateRoutes(configRoutes []ConfigRoute) error {
 		return newRoutes[i].Priority < newRoutes[j].Priority
 	})
 
-	p.routes = newRoutes
-	fmt.Printf("🔄 Updated L7 Routes: %d rules active\n", len(newRoutes))
-
-	// Restart health checks
-	p.restartHealthChecks()
-	return nil
-}
-
-func (p *Proxy) restartHealthChecks() {
-	p.healthMu.Lock()
-	defer p.healthMu.Unlock()
-
-	// Stop existing checks
-	for _, cancel := range p.healthCancels {
-		cancel()
-	}
-	p.healthCancels = nil
-
-	// Start new checks for each route that has health check config
-	for _, r := range p.routes {
-		if r.HealthCheck == nil {
-			continue
+	// Filters hold their compiled route, so chains are built once the slice is final
+	for i := range newRoutes {
+		chain, err := buildFilterChain(&newRoutes[i], newRoutes[i].Filters)
+		if err != nil {
+			return fmt.Errorf("invalid filters for route %s: %w", newRoutes[i].Path, err)
 		}
-
-		ctx, cancel := context.WithCancel(context.Background())
-		p.healthCancels = append(p.healthCancels, cancel)
-		go p.runRouteHealthCheck(ctx, r)
-	}
-
-	// Also handle default pool if any
-	if p.defaultPool != nil {
-		ctx, cancel := context.WithCancel(context.Background())
-		p.healthCancels = append(p.healthCancels, cancel)
-		go p.runDefaultHealthCheck(ctx)
+		newRoutes[i].filters = chain
 	}
-}
-
-func (p *Proxy) runRouteHealthCheck(ctx context.Context, r Route) {
-	config := r.HealthCheck
-	interval := time.Duration(config.Interval) * time.Second
-	if interval < 1*time.Second {
-		interval = 10 * time.Second
-	}
-
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			for _, b := range r.Pool.backends {
-				// Use the route-specific health check path if it's an absolute URL or just a path
-				checkURL := *b.URL
-				if config.Path != "" {
-					if strings.HasPrefix(config.Path, "http") {
-						u, err := url.Parse(config.Path)
-						if err == nil {
-							checkURL = *u
-						}
-					} else {
-						checkURL.Path = config.Path
-					}
-				}
 
-				alive := checkBackend(&checkURL, config.Timeout)
-				if alive != b.Alive {
-					b.Alive = alive
-					status := "UP"
-					if !alive {
-						status = "DOWN"
-					}
-					fmt.Printf("🩺 Health Check (%s): %s is %s\n", r.Path, b.URL.String(), status)
-				}
-			}
+	// Carry health state over for targets that survive the reload
+	states := make(map[string]*backendHealth)
+	p.adoptHealthState("", p.defaultPool, states)
+	for _, r := range newRoutes {
+		for _, pool := range r.pools() {
+			p.adoptHealthState(r.Path, pool, states)
 		}
 	}
-}
-
-func (p *Proxy) runDefaultHealthCheck(ctx context.Context) {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	p.drainRemoved(states)
+	p.healthStates = states
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			p.mu.RLock()
-			pool := p.defaultPool
-			p.mu.RUnlock()
-
-			if pool == nil {
-				return
-			}
+	p.splitStats.attach(newRoutes)
+	oldRoutes := p.routes
+	p.routes = newRoutes
 
-			for _, b := range pool.backends {
-				alive := checkBackend(b.URL, 2)
-				if alive != b.Alive {
-					b.Alive = alive
-					fmt.Printf("🩺 Default Health Check: %s is %v\n", b.URL.String(), alive)
-				}
-			}
+	// Requests already running keep their connections; idle ones of the old pools are dropped
+	for _, r := range oldRoutes {
+		if r.transport != nil {
+			r.transport.CloseIdleConnections()
 		}
 	}
+	fmt.Printf("🔄 Updated L7 Routes: %d rules active\n", len(newRoutes))
+
+	// Restart health checks and discovery
+	p.restartHealthChecks()
+	p.restartDiscovery()
+	return nil
 }
 
 // GetRoutes returns the current active routes
@@ -608,7 +886,7 @@ func (p *Proxy) GetRoutes() []ConfigRoute {
 	for _, r := range p.routes {
 		var targets []string
 		if r.Pool != nil {
-			for _, b := range r.Pool.backends {
+			for _, b := range r.Pool.backends() {
 				targets = append(targets, b.URL.String())
 			}
 		}
@@ -630,6 +908,20 @@ func (p *Proxy) GetRoutes() []ConfigRoute {
 			Auth:           r.Auth,
 			Cache:          r.Cache,
 			Headers:        r.Headers,
+			CORS:           r.CORS,
+			IPFilter:       r.ipFilter.list.Load().config,
+			ProxyProtocol:  r.ProxyProtocol,
+			SlowStart:      r.SlowStart,
+			Failover:       r.Failover,
+			Localities:     r.Localities,
+			TrafficSplit:   r.trafficSplit.currentConfig(),
+			BlueGreen:      r.blueGreen.currentConfig(),
+			Concurrency:    r.Concurrency,
+			Upstream:       r.Upstream,
+			Compression:    r.Compression,
+			Limits:         r.Limits,
+			Filters:        r.Filters,
+			Discovery:      r.Discovery,
 		})
 	}
 	return current
@@ -640,67 +932,77 @@ func getWeightsFromPool(p *Pool) map[string]int {
 		return nil
 	}
 	weights := make(map[string]int)
-	for _, b := range p.backends {
+	for _, b := range p.backends() {
 		weights[b.URL.String()] = b.Weight
 	}
 	return weights
 }
 
+// poolOptions carries per-route settings applied to every backend of a pool
+type poolOptions struct {
+	weights    map[string]int
+	transport  http.RoundTripper // nil uses http.DefaultTransport
+	slowStart  time.Duration
+	localities map[string]string
+	zone       *atomic.Pointer[string]
+}
+
 func createBackendPool(urls []string) (*Pool, error) {
-	return createBackendPoolWithWeights(urls, nil)
+	return createBackendPoolWithOptions(urls, poolOptions{})
 }
 
-func createBackendPoolWithWeights(urls []string, weights map[string]int) (*Pool, error) {
+func createBackendPoolWithOptions(urls []string, opts poolOptions) (*Pool, error) {
 	var backends []*Backend
 	for _, b := range urls {
-		target, err := url.Parse(b)
+		backend, err := newBackend(b, 0, "", opts)
 		if err != nil {
-			return nil, fmt.Errorf("invalid backend URL %s: %w", b, err)
-		}
-
-		rp := httputil.NewSingleHostReverseProxy(target)
-
-		// Custom Director to ensure headers are set correctly
-		originalDirector := rp.Director
-		rp.Director = func(req *http.Request) {
-			originalDirector(req)
-			req.Header.Set("X-Forwarded-Host", req.Host)
-			req.Header.Set("X-Proxy-By", "NLB-Plus")
-		}
-
-		weight := 100
-		if weights != nil {
-			if w, ok := weights[b]; ok {
-				weight = w
-			}
+			return nil, err
 		}
-
-		backends = append(backends, &Backend{
-			URL:    target,
-			Alive:  true,
-			Proxy:  rp,
-			Weight: weight,
-		})
+		backends = append(backends, backend)
 	}
-	return &Pool{backends: backends}, nil
+	pool := &Pool{slowStart: opts.slowStart, zone: opts.zone, opts: opts}
+	pool.members.Store(&backends)
+	return pool, nil
 }
 
-func (p *Proxy) applyRequestHeaders(r *http.Request, config *HeadersConfig) {
-	for k, v := range config.AddRequest {
-		r.Header.Set(k, v)
+// newBackend builds a backend for target; a zero weight or empty locality
+// falls back to the pool's configured one
+func newBackend(raw string, weight int, locality string, opts poolOptions) (*Backend, error) {
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL %s: %w", raw, err)
 	}
-	for _, k := range config.RemoveRequest {
-		r.Header.Del(k)
+
+	// Rewrite (rather than Director) so forwarding headers are fully
+	// controlled by the proxy's policy instead of being appended blindly
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = pr.In.Host
+			setForwardingHeaders(pr)
+			pr.Out.Header.Set("X-Proxy-By", "NLB-Plus")
+		},
+		Transport:    opts.transport,
+		ErrorHandler: proxyErrorHandler,
 	}
-}
 
-func (p *Proxy) applyResponseHeaders(w http.ResponseWriter, config *HeadersConfig) {
-	for k, v := range config.AddResponse {
-		w.Header().Set(k, v)
+	if weight == 0 {
+		weight = 100
+		if w, ok := opts.weights[raw]; ok {
+			weight = w
+		}
 	}
-	for _, k := range config.RemoveResponse {
-		w.Header().Del(k)
+	if locality == "" {
+		locality = opts.localities[raw]
 	}
+
+	return &Backend{
+		URL:      target,
+		Proxy:    rp,
+		Weight:   weight,
+		Locality: locality,
+		health:   newBackendHealth(),
+	}, nil
 }
 
 func (p *Proxy) getCachedResponse(url string) (cacheEntry, bool) {
@@ -733,6 +1035,22 @@ func (p *Proxy) setCachedResponse(url string, body []byte, headers http.Header,
 
 // Start starts the proxy server
 func (p *Proxy) Start(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return p.Serve(ln)
+}
+
+// Serve runs the proxy on an existing listener
+func (p *Proxy) Serve(ln net.Listener) error {
+	wrapped, err := p.wrapListener(ln)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	ln = wrapped
+
 	mux := http.NewServeMux()
 
 	// Health check endpoint
@@ -742,22 +1060,43 @@ func (p *Proxy) Start(addr string) error {
 	})
 
 	mux.Handle("/", p)
+	handler := otelhttp.NewHandler(mux, "Proxy")
+
+	p.listenerMu.Lock()
+	tlsConfig := p.tls
+	p.listenerMu.Unlock()
 
 	p.server = &http.Server{
-		Addr:    addr,
-		Handler: otelhttp.NewHandler(mux, "Proxy"),
+		Addr:    ln.Addr().String(),
+		Handler: handler,
+	}
+	if tlsConfig.CertFile != "" {
+		p.server.TLSConfig = p.serverTLSConfig()
+		if tlsConfig.HTTP3 {
+			altSvc, err := p.startHTTP3(tlsConfig, ln.Addr(), handler)
+			if err != nil {
+				ln.Close()
+				return err
+			}
+			p.server.Handler = advertiseHTTP3(handler, altSvc)
+		}
 	}
 
 	// Start health check worker
 	go p.startHealthCheckWorker()
 
-	fmt.Printf("🚀 L7 Proxy started on %s\n", addr)
-	return p.server.ListenAndServe()
+	fmt.Printf("🚀 L7 Proxy started on %s\n", ln.Addr())
+	if tlsConfig.CertFile != "" {
+		// Certificates come from TLSConfig; h2 is negotiated alongside HTTP/1.1
+		return p.server.ServeTLS(ln, "", "")
+	}
+	return p.server.Serve(ln)
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	atomic.AddUint64(&p.TotalRequests, 1)
+	p.protocols.observe(r)
 	atomic.AddInt32(&p.ActiveConnections, 1)
 	defer atomic.AddInt32(&p.ActiveConnections, -1)
 
@@ -770,65 +1109,98 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	var matchedBackend *Backend
 	var activeRoute *Route
+	var split *splitTarget
+	var fc *FilterContext
+
+	// Resolve the real client once; everything below uses this address
+	r, client := p.resolveClient(r)
+	clientIP := client.IP
+
+	// Tag the request so proxy, backend and trace logs can be joined
+	idPolicy := p.requestID.Load()
+	if idPolicy == nil {
+		idPolicy = defaultRequestIDPolicy
+	}
+	requestID := idPolicy.resolve(r)
+	sw.beforeHeader = append(sw.beforeHeader, func(h http.Header, _ int) {
+		h.Set(idPolicy.header, requestID)
+	})
+
+	// Logging (deferred so rejected requests are recorded too)
+	defer func() {
+		entry := AccessLog{
+			Timestamp:  start,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     sw.status,
+			DurationMs: time.Since(start).Milliseconds(),
+			RequestID:  requestID,
+			Protocol:   r.Proto,
+		}
+		if clientIP.IsValid() {
+			entry.ClientIP = clientIP.String()
+		}
+		if matchedBackend != nil {
+			entry.Backend = matchedBackend.URL.String()
+		}
+		if split != nil {
+			entry.Split = split.name
+			split.stats.record(sw.status, time.Since(start))
+		}
+		p.metrics.observeRequest(routeLabel(activeRoute), r.Method, sw.status, backendLabel(matchedBackend), time.Since(start))
+		select {
+		case p.LogChan <- entry:
+		default:
+			// No consumer keeping up, drop the entry rather than block the request
+			atomic.AddUint64(&p.DroppedLogs, 1)
+		}
+	}()
+
+	// 0. Global IP access control
+	if p.globalIPFilter != nil && !p.globalIPFilter.allow(clientIP) {
+		atomic.AddUint64(&p.DeniedRequests, 1)
+		sw.status = http.StatusForbidden
+		http.Error(sw, "Forbidden", sw.status)
+		return
+	}
 
 	// 1. Match Route
 	for _, route := range routes {
 		if route.Matches(r) {
 			activeRoute = &route
 
-			// A. Auth
-			if !route.Authenticate(r) {
-				sw.status = http.StatusUnauthorized
-				http.Error(sw, "Unauthorized", sw.status)
-				return
+			// 2. Filter chain (access control, auth, limits, caching...); response
+			// phases unwind once the request is done, however it ended
+			fc = &FilterContext{
+				Request:   r,
+				Response:  sw,
+				Route:     activeRoute,
+				ClientIP:  clientIP,
+				RequestID: requestID,
+				proxy:     p,
+				sw:        sw,
+				client:    client,
 			}
-
-			// B. Rate Limit
-			if route.RateLimit != nil {
-				if !p.isRateAllowed(route.Path, route.RateLimit) {
-					sw.status = http.StatusTooManyRequests
-					http.Error(sw, "Rate limit exceeded", sw.status)
-					return
-				}
-			}
-
-			// C. Circuit Breaker
-			if route.CircuitBreaker != nil {
-				if !p.isCircuitClosed(route.Path, route.CircuitBreaker) {
-					sw.status = http.StatusServiceUnavailable
-					http.Error(sw, "Circuit breaker tripped", sw.status)
-					return
-				}
-			}
-
-			// D. Headers (Request)
-			if route.Headers != nil {
-				p.applyRequestHeaders(r, route.Headers)
+			defer fc.runResponse()
+			if !fc.runRequest(route.filters) {
+				return
 			}
 
-			// E. Caching (Read)
-			if route.Cache != nil && route.Cache.Enabled {
-				if entry, ok := p.getCachedResponse(r.URL.String()); ok {
-					for k, v := range entry.headers {
-						sw.Header()[k] = v
-					}
-					sw.Header().Set("X-GP-Cache", "HIT")
-					sw.Write(entry.response)
-					return
+			// 3. Pick the pool and backend
+			pool := route.activePool()
+			if route.trafficSplit != nil {
+				split = route.trafficSplit.choose(r)
+				if split.pool != nil {
+					pool = split.pool
 				}
-				sw.Header().Set("X-GP-Cache", "MISS")
-				sw.capture = true
-			}
-
-			pool := route.Pool
-			if route.Canary != nil && route.CanaryPool != nil {
-				roll := time.Now().UnixNano() % 100
-				if roll < int64(route.Canary.Weight) {
+			} else if route.Canary != nil && route.CanaryPool != nil {
+				if rand.IntN(100) < route.Canary.Weight {
 					pool = route.CanaryPool
 				}
 			}
 
 			matchedBackend = pool.GetNextWithAlgorithm(route.Algorithm, route.Affinity, r)
+			fc.backend = matchedBackend
 			break
 		}
 	}
@@ -849,20 +1221,34 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		for i := 0; i <= maxRetries; i++ {
 			ctx, cancel := context.WithTimeout(r.Context(), timeout)
-			reqWithCtx := r.WithContext(ctx)
+			ctx = httptrace.WithClientTrace(ctx, p.metrics.traceUpstream(time.Now(), routeLabel(activeRoute), backendLabel(matchedBackend)))
+			attempt := &proxyAttempt{}
+			reqWithCtx := r.WithContext(context.WithValue(ctx, proxyAttemptKey{}, attempt))
+			if i > 0 && r.GetBody != nil {
+				// Buffered bodies can be sent again
+				reqWithCtx.Body, _ = r.GetBody()
+			}
 
-			matchedBackend.Proxy.ServeHTTP(sw, reqWithCtx)
+			var out http.ResponseWriter = sw
+			finish := func() {}
+			if fc != nil {
+				out, finish = fc.prepareAttempt(reqWithCtx, r)
+			}
+			p.forward(matchedBackend, out, reqWithCtx)
+			finish()
 			cancel()
 
-			if sw.status < 500 {
-				if activeRoute != nil && activeRoute.CircuitBreaker != nil {
-					p.recordSuccess(activeRoute.Path, activeRoute.CircuitBreaker)
+			if activeRoute != nil {
+				p.observeTraffic(activeRoute, matchedBackend, r.Context(), sw.status, attempt.err)
+			}
+			if fc != nil {
+				for _, done := range fc.attemptDone {
+					done(sw.status)
 				}
-				break
 			}
 
-			if activeRoute != nil && activeRoute.CircuitBreaker != nil {
-				p.recordFailure(activeRoute.Path, activeRoute.CircuitBreaker)
+			if sw.status < 500 {
+				break
 			}
 
 			if i < maxRetries {
@@ -873,69 +1259,56 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		sw.status = http.StatusServiceUnavailable
 		http.Error(sw, "No healthy backends available", sw.status)
 	}
-
-	// F. Headers (Response)
-	if activeRoute != nil && activeRoute.Headers != nil {
-		p.applyResponseHeaders(sw, activeRoute.Headers)
-	}
-
-	// G. Caching (Write)
-	if activeRoute != nil && activeRoute.Cache != nil && activeRoute.Cache.Enabled && sw.status == http.StatusOK {
-		p.setCachedResponse(r.URL.String(), sw.body.Bytes(), sw.Header(), activeRoute.Cache.TTL)
-	}
-
-	// Logging
-	p.LogChan <- AccessLog{
-		Timestamp:  start,
-		Method:     r.Method,
-		Path:       r.URL.Path,
-		Status:     sw.status,
-		DurationMs: time.Since(start).Milliseconds(),
-		ClientIP:   r.RemoteAddr,
-		Backend: func() string {
-			if matchedBackend != nil {
-				return matchedBackend.URL.String()
-			}
-			return ""
-		}(),
-	}
 }
 
-
-func (p *Proxy) startHealthCheckWorker() {
-	p.restartHealthChecks()
+// forward proxies one attempt, counting it as in flight so draining can wait for it
+func (p *Proxy) forward(b *Backend, w http.ResponseWriter, r *http.Request) {
+	b.health.inflight.Add(1)
+	defer b.health.inflight.Add(-1)
+	b.Proxy.ServeHTTP(w, r)
 }
 
-func checkBackend(target *url.URL, timeoutSec int) bool {
-	if timeoutSec <= 0 {
-		timeoutSec = 2
-	}
-	client := http.Client{
-		Timeout: time.Duration(timeoutSec) * time.Second,
-	}
-	resp, err := client.Head(target.String())
-	if err != nil {
-		return false
-	}
-	defer resp.Body.Close()
-	return resp.StatusCode >= 200 && resp.StatusCode < 500
-}
+const (
+	// maxRateLimitBuckets is a hard cap on tracked buckets; per-client keys can grow without bound
+	maxRateLimitBuckets = 10000
+	// rateLimitSweepInterval is how often fully refilled buckets are pruned
+	rateLimitSweepInterval = time.Minute
+)
 
 func (p *Proxy) isRateAllowed(path string, config *RateLimitConfig) bool {
 	p.rateLimitMu.Lock()
 	defer p.rateLimitMu.Unlock()
 
+	now := time.Now()
+	if now.Sub(p.rateLimitSwept) >= rateLimitSweepInterval {
+		p.sweepRateLimitBuckets(now)
+	}
+
 	bucket, ok := p.rateLimitBuckets[path]
-	if !ok {
-		bucket = &tokenBucket{tokens: float64(config.Burst), last: time.Now()}
+	if ok {
+		p.rateLimitLRU.MoveToFront(bucket.elem)
+	} else {
+		if len(p.rateLimitBuckets) >= maxRateLimitBuckets {
+			// Still full after the sweep. Only a refilled bucket may make room,
+			// since dropping one that is limiting its client would reset it;
+			// otherwise new keys are refused until space frees up.
+			oldest := p.rateLimitLRU.Back()
+			if !p.rateLimitBuckets[oldest.Value.(string)].refilled(now) {
+				return false
+			}
+			p.removeRateLimitBucket(oldest.Value.(string))
+		}
+		bucket = &tokenBucket{tokens: float64(config.Burst), last: now}
+		bucket.elem = p.rateLimitLRU.PushFront(path)
 		p.rateLimitBuckets[path] = bucket
 	}
+	bucket.rate = config.RequestsPerSecond
+	bucket.burst = float64(config.Burst)
 
-	now := time.Now()
 	elapsed := now.Sub(bucket.last).Seconds()
-	bucket.tokens += elapsed * config.RequestsPerSecond
-	if bucket.tokens > float64(config.Burst) {
-		bucket.tokens = float64(config.Burst)
+	bucket.tokens += elapsed * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
 	}
 	bucket.last = now
 
@@ -946,6 +1319,28 @@ func (p *Proxy) isRateAllowed(path string, config *RateLimitConfig) bool {
 	return false
 }
 
+// sweepRateLimitBuckets drops buckets that have refilled to capacity, since a
+// fresh bucket behaves the same. Caller must hold rateLimitMu.
+func (p *Proxy) sweepRateLimitBuckets(now time.Time) {
+	for k, b := range p.rateLimitBuckets {
+		if b.refilled(now) {
+			p.removeRateLimitBucket(k)
+		}
+	}
+	p.rateLimitSwept = now
+}
+
+// removeRateLimitBucket must be called with rateLimitMu held
+func (p *Proxy) removeRateLimitBucket(key string) {
+	p.rateLimitLRU.Remove(p.rateLimitBuckets[key].elem)
+	delete(p.rateLimitBuckets, key)
+}
+
+// refilled reports whether the bucket is back to capacity at now
+func (b *tokenBucket) refilled(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
 func (p *Proxy) isCircuitClosed(path string, config *CircuitBreakerConfig) bool {
 	p.cbMu.Lock()
 	defer p.cbMu.Unlock()
@@ -979,6 +1374,9 @@ func (p *Proxy) recordFailure(path string, config *CircuitBreakerConfig) {
 	state.failures++
 	state.lastError = time.Now()
 	if state.failures >= config.ErrorThreshold {
+		if state.status != "open" {
+			p.metrics.circuitTrips.counter(path).inc()
+		}
 		state.status = "open"
 		fmt.Printf("🚨 Circuit Breaker TRIPPED for %s\n", path)
 	}
@@ -1002,11 +1400,29 @@ func (p *Proxy) recordSuccess(path string, config *CircuitBreakerConfig) {
 	}
 }
 
-// Shutdown gracefully shuts down the proxy
+// Shutdown gracefully shuts down the proxy. It stops accepting, then waits
+// until ctx is done for in-flight requests, including upgraded connections
+// such as WebSockets, which the HTTP server itself stops tracking.
 func (p *Proxy) Shutdown(ctx context.Context) error {
-	if p.server != nil {
-		fmt.Println("🛑 Shutting down L7 Proxy...")
-		return p.server.Shutdown(ctx)
+	if err := p.shutdownHTTP3(ctx); err != nil {
+		fmt.Printf("⚠️ HTTP/3 shutdown: %v\n", err)
+	}
+	if p.server == nil {
+		return nil
+	}
+	fmt.Println("🛑 Shutting down L7 Proxy...")
+	if err := p.server.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&p.ActiveConnections) > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d connections still open: %w", atomic.LoadInt32(&p.ActiveConnections), ctx.Err())
+		case <-ticker.C:
+		}
 	}
 	return nil
 }
@@ -1,11 +1,15 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -114,6 +118,71 @@ func TestProxy_Lifecycle(t *testing.T) {
 	}
 }
 
+func TestProxy_ShutdownDrainsUpgraded(t *testing.T) {
+	// Backend switches protocols and echoes raw bytes
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{Path: "/ws", Targets: []string{backend.URL}}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go p.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %v (%v)", res, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- p.Shutdown(ctx)
+	}()
+
+	// The upgraded connection keeps working while the proxy drains
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprint(conn, "ping\n")
+	if line, _ := reader.ReadString('\n'); line != "ping\n" {
+		t.Errorf("Expected the upgraded connection to stay open, got %q", line)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned with an upgraded connection open: %v", err)
+	default:
+	}
+
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean drain, got %v", err)
+	}
+
+	// A deadline bounds the wait
+	p2, _ := New([]string{})
+	p2.server = &http.Server{}
+	atomic.AddInt32(&p2.ActiveConnections, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p2.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the drain deadline, got %v", err)
+	}
+}
+
 func TestProxy_AdvancedMatching(t *testing.T) {
 	backend1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "glob")
@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocolConfig enables PROXY protocol (v1 and v2) on the proxy listener
+type ProxyProtocolConfig struct {
+	Enabled        bool     `json:"enabled"`
+	TrustedSources []string `json:"trusted_sources"` // Only these peers may send a PROXY header
+	Required       bool     `json:"required,omitempty"`
+	HeaderTimeout  int      `json:"header_timeout_ms,omitempty"`
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNoProxyHeader = errors.New("proxy protocol header missing")
+
+// proxyProtoListener parses PROXY headers from trusted peers and reports
+// the original client as the connection's remote address
+type proxyProtoListener struct {
+	net.Listener
+	trusted  ipSet
+	required bool
+	timeout  time.Duration
+}
+
+func newProxyProtoListener(ln net.Listener, config ProxyProtocolConfig) (*proxyProtoListener, error) {
+	if len(config.TrustedSources) == 0 {
+		return nil, fmt.Errorf("proxy protocol requires at least one trusted source")
+	}
+	l := &proxyProtoListener{Listener: ln, required: config.Required, timeout: 5 * time.Second}
+	if config.HeaderTimeout > 0 {
+		l.timeout = time.Duration(config.HeaderTimeout) * time.Millisecond
+	}
+	for _, entry := range config.TrustedSources {
+		if err := l.trusted.add(entry); err != nil {
+			return nil, fmt.Errorf("invalid trusted source %q: %w", entry, err)
+		}
+	}
+	return l, nil
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if !l.trusted.contains(peer.Addr().Unmap()) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn, reader: bufio.NewReader(conn), required: l.required, timeout: l.timeout}, nil
+}
+
+// proxyProtoConn lazily reads the PROXY header on first use so a slow
+// sender cannot stall the accept loop
+type proxyProtoConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	required bool
+	timeout  time.Duration
+	once     sync.Once
+	src, dst net.Addr
+	err      error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.src, c.dst, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err == errNoProxyHeader && !c.required {
+			c.err = nil
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.init()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader consumes a v1 or v2 header. LOCAL/UNKNOWN headers return nil addresses.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		if len(peek) >= 6 && string(peek[:6]) == "PROXY " {
+			return readProxyV1(r)
+		}
+		return nil, nil, errNoProxyHeader
+	}
+	if bytes.Equal(peek, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if string(peek[:6]) == "PROXY " {
+		return readProxyV1(r)
+	}
+	return nil, nil, errNoProxyHeader
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The v1 header is at most 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading proxy v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("malformed proxy v1 header")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed proxy v1 header")
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy v1 address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy v1 port %q", port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := readFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("reading proxy v2 header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported proxy protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := readFull(r, payload); err != nil {
+		return nil, nil, fmt.Errorf("reading proxy v2 addresses: %w", err)
+	}
+
+	// LOCAL command: health checks from the proxy itself, keep the real peer
+	if header[12]&0x0F == 0 {
+		return nil, nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, nil, fmt.Errorf("short proxy v2 ipv4 block")
+		}
+		src := netip.AddrFrom4([4]byte(payload[0:4]))
+		dst := netip.AddrFrom4([4]byte(payload[4:8]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload[8:10]))),
+			net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(payload[10:12]))), nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, nil, fmt.Errorf("short proxy v2 ipv6 block")
+		}
+		src := netip.AddrFrom16([16]byte(payload[0:16]))
+		dst := netip.AddrFrom16([16]byte(payload[16:32]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(payload[32:34]))),
+			net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(payload[34:36]))), nil
+	default: // AF_UNSPEC / AF_UNIX carry no usable address
+		return nil, nil, nil
+	}
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// buildProxyHeader encodes a PROXY header for the given addresses
+func buildProxyHeader(version string, src, dst netip.AddrPort) ([]byte, error) {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	if src.Addr().Is4() != dst.Addr().Is4() {
+		// Mixed families cannot be expressed; map both to IPv6
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+
+	switch version {
+	case "v1":
+		family := "TCP4"
+		if !src.Addr().Is4() {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port())), nil
+	case "v2":
+		var buf bytes.Buffer
+		buf.Write(proxyV2Signature)
+		buf.WriteByte(0x21) // version 2, PROXY command
+		if src.Addr().Is4() {
+			buf.WriteByte(0x11) // AF_INET, STREAM
+			binary.Write(&buf, binary.BigEndian, uint16(12))
+		} else {
+			buf.WriteByte(0x21) // AF_INET6, STREAM
+			binary.Write(&buf, binary.BigEndian, uint16(36))
+		}
+		buf.Write(src.Addr().AsSlice())
+		buf.Write(dst.Addr().AsSlice())
+		binary.Write(&buf, binary.BigEndian, src.Port())
+		binary.Write(&buf, binary.BigEndian, dst.Port())
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown proxy protocol version %q", version)
+	}
+}
+
+// proxyProtocolDial wraps dial so every upstream connection starts with a
+// PROXY header describing the original client
+func proxyProtocolDial(dial dialFunc, version string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		header, err := buildProxyHeader(version, proxyHeaderSource(ctx, conn), proxyHeaderDestination(ctx, conn))
+		if err == nil {
+			_, err = conn.Write(header)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// proxyHeaderSource is the resolved client, falling back to our own address for internal requests
+func proxyHeaderSource(ctx context.Context, conn net.Conn) netip.AddrPort {
+	if info, ok := ctx.Value(clientInfoKey{}).(*clientInfo); ok && info.IP.IsValid() {
+		return netip.AddrPortFrom(info.IP, info.Port)
+	}
+	local, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+	return local
+}
+
+// proxyHeaderDestination is the address the client originally connected to
+func proxyHeaderDestination(ctx context.Context, conn net.Conn) netip.AddrPort {
+	if addr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+			return ap
+		}
+	}
+	remote, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	return remote
+}
+
+// SetProxyProtocol configures PROXY protocol parsing for listeners started afterwards
+func (p *Proxy) SetProxyProtocol(config ProxyProtocolConfig) error {
+	if config.Enabled {
+		if _, err := newProxyProtoListener(nil, config); err != nil {
+			return err
+		}
+	}
+	p.listenerMu.Lock()
+	p.proxyProtocol = config
+	p.listenerMu.Unlock()
+	return nil
+}
+
+func (p *Proxy) wrapListener(ln net.Listener) (net.Listener, error) {
+	p.listenerMu.Lock()
+	config := p.proxyProtocol
+	p.listenerMu.Unlock()
+
+	if !config.Enabled {
+		return ln, nil
+	}
+	return newProxyProtoListener(ln, config)
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2, _ := buildProxyHeader("v2", netip.MustParseAddrPort("[2001:db8::1]:4000"), netip.MustParseAddrPort("[2001:db8::2]:443"))
+
+	cases := []struct {
+		name    string
+		input   []byte
+		src     string
+		wantErr bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 198.51.100.1 10.0.0.1 4000 80\r\nGET / HTTP/1.1\r\n"), "198.51.100.1:4000", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n"), "", false},
+		{"v2 tcp6", append(v2, []byte("GET / HTTP/1.1\r\n")...), "[2001:db8::1]:4000", false},
+		{"v1 malformed", []byte("PROXY TCP4 nope\r\nGET / HTTP/1.1\r\n"), "", true},
+	}
+	for _, tc := range cases {
+		src, _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tc.input)))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		got := ""
+		if src != nil {
+			got = src.String()
+		}
+		if got != tc.src {
+			t.Errorf("%s: expected source %q, got %q", tc.name, tc.src, got)
+		}
+	}
+
+	if _, _, err := readProxyHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))); err != errNoProxyHeader {
+		t.Errorf("Expected errNoProxyHeader for plain HTTP, got %v", err)
+	}
+}
+
+func TestProxy_ProxyProtocolListener(t *testing.T) {
+	var seen string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("X-Forwarded-For")
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{backend.URL})
+	if err := p.SetProxyProtocol(ProxyProtocolConfig{Enabled: true}); err == nil {
+		t.Error("Expected error when no trusted sources are configured")
+	}
+	if err := p.SetProxyProtocol(ProxyProtocolConfig{Enabled: true, TrustedSources: []string{"127.0.0.1/32"}}); err != nil {
+		t.Fatalf("SetProxyProtocol failed: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go p.Serve(ln)
+	defer p.Shutdown(t.Context())
+
+	send := func(header []byte) string {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		conn.Write(header)
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %v", err)
+		}
+		resp.Body.Close()
+		return seen
+	}
+
+	if got := send([]byte("PROXY TCP4 198.51.100.7 10.0.0.1 4000 80\r\n")); got != "198.51.100.7" {
+		t.Errorf("Expected v1 client address upstream, got %q", got)
+	}
+	v2, _ := buildProxyHeader("v2", netip.MustParseAddrPort("203.0.113.5:5000"), netip.MustParseAddrPort("10.0.0.1:80"))
+	if got := send(v2); got != "203.0.113.5" {
+		t.Errorf("Expected v2 client address upstream, got %q", got)
+	}
+	if got := send(nil); got != "127.0.0.1" {
+		t.Errorf("Expected peer address without header, got %q", got)
+	}
+}
+
+func TestProxy_ProxyProtocolToBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		src, _, err := readProxyHeader(reader)
+		if err != nil {
+			headers <- "error: " + err.Error()
+			return
+		}
+		headers <- src.String()
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+	}()
+
+	p, _ := New([]string{})
+	if err := p.UpdateRoutes([]ConfigRoute{{Path: "/pp", Targets: []string{"http://" + ln.Addr().String()}, ProxyProtocol: "v2"}}); err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/pp", nil)
+	req.RemoteAddr = "198.51.100.9:6000"
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+
+	if got := <-headers; got != "198.51.100.9:6000" {
+		t.Errorf("Expected client address in PROXY header, got %q", got)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("Unexpected response %d %q", w.Code, w.Body.String())
+	}
+
+	if err := p.UpdateRoutes([]ConfigRoute{{Path: "/pp", Targets: []string{"http://localhost:1"}, ProxyProtocol: "v3"}}); err == nil {
+		t.Error("Expected error for unknown PROXY protocol version")
+	}
+}
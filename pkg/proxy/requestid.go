@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Request ID formats
+const (
+	RequestIDUUID  = "uuid"  // Random RFC 4122 version 4 UUID
+	RequestIDHex   = "hex"   // 32 random hex characters
+	RequestIDTrace = "trace" // The OpenTelemetry trace ID, so logs and traces share one key
+)
+
+// RequestIDConfig controls how request IDs are generated and propagated
+type RequestIDConfig struct {
+	Header         string `json:"header,omitempty"`          // Defaults to X-Request-ID
+	Format         string `json:"format,omitempty"`          // "uuid" (default), "hex" or "trace"
+	IgnoreIncoming bool   `json:"ignore_incoming,omitempty"` // Always generate, even when the client sent an ID
+}
+
+// requestIDPolicy is the compiled form of a RequestIDConfig
+type requestIDPolicy struct {
+	header         string
+	format         string
+	ignoreIncoming bool
+}
+
+var defaultRequestIDPolicy = &requestIDPolicy{header: "X-Request-ID", format: RequestIDUUID}
+
+func newRequestIDPolicy(config RequestIDConfig) (*requestIDPolicy, error) {
+	p := &requestIDPolicy{
+		header:         http.CanonicalHeaderKey(config.Header),
+		format:         strings.ToLower(config.Format),
+		ignoreIncoming: config.IgnoreIncoming,
+	}
+	if p.header == "" {
+		p.header = defaultRequestIDPolicy.header
+	}
+	switch p.format {
+	case "":
+		p.format = RequestIDUUID
+	case RequestIDUUID, RequestIDHex, RequestIDTrace:
+	default:
+		return nil, fmt.Errorf("unknown request id format %q", config.Format)
+	}
+	return p, nil
+}
+
+// resolve accepts a well-formed incoming ID or generates one, and sets it on
+// the request so it is forwarded upstream
+func (p *requestIDPolicy) resolve(r *http.Request) string {
+	id := r.Header.Get(p.header)
+	if p.ignoreIncoming || !validRequestID(id) {
+		id = p.generate(r)
+	}
+	r.Header.Set(p.header, id)
+	// Attach to the span started by the otel handler, if any
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request.id", id))
+	return id
+}
+
+func (p *requestIDPolicy) generate(r *http.Request) string {
+	if p.format == RequestIDTrace {
+		if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+			return sc.TraceID().String()
+		}
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	if p.format == RequestIDUUID {
+		b[6] = b[6]&0x0f | 0x40 // Version 4
+		b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID bounds what a client may inject into our logs and upstream headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:/+=", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SetRequestID configures request ID handling for subsequent requests
+func (p *Proxy) SetRequestID(config RequestIDConfig) error {
+	policy, err := newRequestIDPolicy(config)
+	if err != nil {
+		return err
+	}
+	p.requestID.Store(policy)
+	return nil
+}
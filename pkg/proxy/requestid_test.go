@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestProxy_RequestID(t *testing.T) {
+	var upstreamID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get("X-Request-ID")
+		w.Header().Set("X-Request-ID", "backend-chose-this")
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{Path: "/", Targets: []string{backend.URL}}})
+
+	send := func(incoming string) (*http.Response, AccessLog) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if incoming != "" {
+			req.Header.Set("X-Request-ID", incoming)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w.Result(), <-p.LogChan
+	}
+
+	res, entry := send("")
+	id := res.Header.Get("X-Request-ID")
+	if !uuidPattern.MatchString(id) {
+		t.Fatalf("Expected a generated uuid, got %q", id)
+	}
+	if upstreamID != id || entry.RequestID != id {
+		t.Errorf("Expected one ID across upstream (%q), response (%q) and log (%q)", upstreamID, id, entry.RequestID)
+	}
+
+	if res, _ := send("abc-123"); res.Header.Get("X-Request-ID") != "abc-123" || upstreamID != "abc-123" {
+		t.Errorf("Expected a well-formed incoming ID to be kept, got %q", res.Header.Get("X-Request-ID"))
+	}
+	if res, _ := send("bad id\r\n<script>"); !uuidPattern.MatchString(res.Header.Get("X-Request-ID")) {
+		t.Errorf("Expected a malformed incoming ID to be replaced, got %q", res.Header.Get("X-Request-ID"))
+	}
+
+	// Rejected requests still carry an ID
+	p.UpdateRoutes([]ConfigRoute{{Path: "/", Targets: []string{backend.URL}, Auth: &AuthConfig{Type: "api_key"}}})
+	if res, entry := send(""); res.StatusCode != http.StatusUnauthorized || entry.RequestID == "" || res.Header.Get("X-Request-ID") != entry.RequestID {
+		t.Errorf("Expected an ID on a rejected request, got %q / %q", res.Header.Get("X-Request-ID"), entry.RequestID)
+	}
+}
+
+func TestProxy_RequestIDConfig(t *testing.T) {
+	var upstream http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{Path: "/", Targets: []string{backend.URL}}})
+	if err := p.SetRequestID(RequestIDConfig{Format: "ulid"}); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+	if err := p.SetRequestID(RequestIDConfig{Header: "x-correlation-id", Format: RequestIDTrace, IgnoreIncoming: true}); err != nil {
+		t.Fatalf("SetRequestID failed: %v", err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	ctx, span := tracer.Start(context.Background(), "request")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	req.Header.Set("X-Correlation-ID", "client-supplied")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	span.End()
+	<-p.LogChan
+
+	traceID := span.SpanContext().TraceID().String()
+	if got := w.Header().Get("X-Correlation-ID"); got != traceID {
+		t.Errorf("Expected the trace ID %s as request ID, got %q", traceID, got)
+	}
+	if upstream.Get("X-Correlation-ID") != traceID || upstream.Get("X-Request-ID") != "" {
+		t.Errorf("Expected only the configured header upstream, got %v", upstream)
+	}
+
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("Expected one span, got %d", len(ended))
+	}
+	var found bool
+	for _, attr := range ended[0].Attributes() {
+		if attr.Key == "http.request.id" && attr.Value.AsString() == traceID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the request ID on the span, got %v", ended[0].Attributes())
+	}
+}
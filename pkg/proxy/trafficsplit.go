@@ -0,0 +1,362 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TrafficSplitConfig divides a route's traffic between weighted pools, e.g.
+// stable and canary versions of a service
+type TrafficSplitConfig struct {
+	Splits []TrafficSplit `json:"splits"`
+	// Sticky assignment hashes this cookie or header so a client stays on one split
+	StickyCookie string `json:"sticky_cookie,omitempty"`
+	StickyHeader string `json:"sticky_header,omitempty"`
+	// Testers force a split by sending its name in this header or cookie
+	ForceHeader string `json:"force_header,omitempty"`
+	ForceCookie string `json:"force_cookie,omitempty"`
+}
+
+// TrafficSplit is one weighted destination. A split without targets sends
+// its share to the route's own targets.
+type TrafficSplit struct {
+	Name    string         `json:"name"`
+	Weight  int            `json:"weight"`
+	Targets []string       `json:"targets,omitempty"`
+	Weights map[string]int `json:"weights,omitempty"`
+}
+
+// splitLatencyBuckets are the histogram upper bounds in milliseconds
+var splitLatencyBuckets = []int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// LatencyOverflowMs is reported for percentiles that fall past the largest
+// bucket, so it exceeds any latency threshold
+const LatencyOverflowMs int64 = math.MaxInt64
+
+// TrafficSplitStats compares the versions behind a route
+type TrafficSplitStats struct {
+	Route        string          `json:"route"`
+	Split        string          `json:"split"`
+	Weight       int             `json:"weight"`
+	Requests     uint64          `json:"requests"`
+	Errors       uint64          `json:"errors"` // 5xx responses
+	ErrorRate    float64         `json:"error_rate"`
+	AvgLatencyMs float64         `json:"avg_latency_ms"`
+	P99LatencyMs int64           `json:"p99_latency_ms"` // Upper bound of the bucket holding the 99th percentile, or LatencyOverflowMs
+	Latency      []LatencyBucket `json:"latency_histogram"`
+	latencyMs    uint64
+}
+
+// derive fills the rates and percentiles from the raw counters
+func (s TrafficSplitStats) derive() TrafficSplitStats {
+	s.ErrorRate, s.AvgLatencyMs = 0, 0
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+		s.AvgLatencyMs = float64(s.latencyMs) / float64(s.Requests)
+	}
+	s.P99LatencyMs = s.Percentile(0.99)
+	return s
+}
+
+// Percentile estimates the latency below which a share q of requests completed.
+// Requests in the overflow bucket report LatencyOverflowMs.
+func (s TrafficSplitStats) Percentile(q float64) int64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(s.Requests)))
+	var seen uint64
+	for _, b := range s.Latency {
+		seen += b.Count
+		if seen >= rank && b.LeMs >= 0 {
+			return b.LeMs
+		}
+	}
+	return LatencyOverflowMs
+}
+
+// Since returns the figures for requests served after prev was taken, so a
+// window of traffic can be judged on its own
+func (s TrafficSplitStats) Since(prev TrafficSplitStats) TrafficSplitStats {
+	d := s
+	d.Requests -= min(prev.Requests, s.Requests)
+	d.Errors -= min(prev.Errors, s.Errors)
+	d.latencyMs -= min(prev.latencyMs, s.latencyMs)
+	d.Latency = make([]LatencyBucket, len(s.Latency))
+	for i, b := range s.Latency {
+		d.Latency[i] = b
+		if i < len(prev.Latency) {
+			d.Latency[i].Count -= min(prev.Latency[i].Count, b.Count)
+		}
+	}
+	return d.derive()
+}
+
+// LatencyBucket counts requests that completed within LeMs (-1 for the overflow bucket)
+type LatencyBucket struct {
+	LeMs  int64  `json:"le_ms"`
+	Count uint64 `json:"count"`
+}
+
+// splitStats is kept per route and split name so it survives reloads
+type splitStats struct {
+	requests  atomic.Uint64
+	errors    atomic.Uint64
+	latencyMs atomic.Uint64
+	buckets   [14]atomic.Uint64 // len(splitLatencyBuckets) + overflow
+}
+
+func (s *splitStats) record(status int, d time.Duration) {
+	s.requests.Add(1)
+	if status >= 500 {
+		s.errors.Add(1)
+	}
+	ms := d.Milliseconds()
+	s.latencyMs.Add(uint64(ms))
+	i := sort.Search(len(splitLatencyBuckets), func(i int) bool { return ms <= splitLatencyBuckets[i] })
+	s.buckets[i].Add(1)
+}
+
+type splitTarget struct {
+	name  string
+	pool  *Pool // nil uses the route's active pool
+	stats *splitStats
+}
+
+// splitWeights is swapped as a whole so weights can change without a reload
+type splitWeights struct {
+	weights []int // Parallel to trafficSplit.targets
+	total   int
+}
+
+// trafficSplit is the compiled form of TrafficSplitConfig
+type trafficSplit struct {
+	config  *TrafficSplitConfig
+	targets []*splitTarget
+	weights atomic.Pointer[splitWeights]
+}
+
+// newTrafficSplit builds pools for every split; stats are looked up by the caller
+func newTrafficSplit(cfg *TrafficSplitConfig, opts poolOptions) (*trafficSplit, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if len(cfg.Splits) == 0 {
+		return nil, fmt.Errorf("at least one split is required")
+	}
+	ts := &trafficSplit{config: cfg}
+	w := &splitWeights{}
+	seen := make(map[string]bool)
+	for _, s := range cfg.Splits {
+		if s.Name == "" {
+			return nil, fmt.Errorf("split name is required")
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("duplicate split %q", s.Name)
+		}
+		seen[s.Name] = true
+		if s.Weight < 0 {
+			return nil, fmt.Errorf("split %q has a negative weight", s.Name)
+		}
+		target := &splitTarget{name: s.Name}
+		if len(s.Targets) > 0 {
+			splitOpts := opts
+			splitOpts.weights = s.Weights
+			pool, err := createBackendPoolWithOptions(s.Targets, splitOpts)
+			if err != nil {
+				return nil, err
+			}
+			target.pool = pool
+		}
+		ts.targets = append(ts.targets, target)
+		w.weights = append(w.weights, s.Weight)
+		w.total += s.Weight
+	}
+	ts.weights.Store(w)
+	return ts, nil
+}
+
+// carryState keeps the live weights of the previous generation of the route,
+// e.g. mid-rollout, when its splits are reloaded with unchanged config
+func (ts *trafficSplit) carryState(prev *trafficSplit) {
+	if prev == nil || len(prev.targets) != len(ts.targets) {
+		return
+	}
+	for i, t := range ts.targets {
+		if prev.targets[i].name != t.name || prev.config.Splits[i].Weight != ts.config.Splits[i].Weight {
+			return
+		}
+	}
+	ts.weights.Store(prev.weights.Load())
+}
+
+// choose picks a split: forced by header or cookie, sticky by hash, otherwise at random
+func (ts *trafficSplit) choose(r *http.Request) *splitTarget {
+	cfg := ts.config
+	if name := requestValue(r, cfg.ForceHeader, cfg.ForceCookie); name != "" {
+		for _, t := range ts.targets {
+			if t.name == name {
+				return t
+			}
+		}
+	}
+
+	w := ts.weights.Load()
+	if w.total <= 0 {
+		return ts.targets[0]
+	}
+
+	var roll int
+	if key := requestValue(r, cfg.StickyHeader, cfg.StickyCookie); key != "" {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		roll = int(h.Sum64() % uint64(w.total))
+	} else {
+		roll = rand.IntN(w.total)
+	}
+	for i, t := range ts.targets {
+		if roll < w.weights[i] {
+			return t
+		}
+		roll -= w.weights[i]
+	}
+	return ts.targets[len(ts.targets)-1]
+}
+
+// currentConfig reports the configuration with the weights in effect now
+func (ts *trafficSplit) currentConfig() *TrafficSplitConfig {
+	if ts == nil {
+		return nil
+	}
+	cfg := *ts.config
+	cfg.Splits = append([]TrafficSplit(nil), ts.config.Splits...)
+	w := ts.weights.Load()
+	for i := range cfg.Splits {
+		cfg.Splits[i].Weight = w.weights[i]
+	}
+	return &cfg
+}
+
+// SetTrafficSplitWeights changes the weights of a route's splits in place,
+// keeping their stats. Splits missing from weights keep their current weight.
+func (p *Proxy) SetTrafficSplitWeights(routePath string, weights map[string]int) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, r := range p.routes {
+		if r.Path != routePath {
+			continue
+		}
+		ts := r.trafficSplit
+		if ts == nil {
+			return fmt.Errorf("route %s has no traffic split", routePath)
+		}
+		for name, weight := range weights {
+			if weight < 0 {
+				return fmt.Errorf("split %q has a negative weight", name)
+			}
+			if !slices.ContainsFunc(ts.targets, func(t *splitTarget) bool { return t.name == name }) {
+				return fmt.Errorf("route %s has no split %q", routePath, name)
+			}
+		}
+
+		current := ts.weights.Load()
+		next := &splitWeights{weights: make([]int, len(ts.targets))}
+		for i, t := range ts.targets {
+			next.weights[i] = current.weights[i]
+			if w, ok := weights[t.name]; ok {
+				next.weights[i] = w
+			}
+			next.total += next.weights[i]
+		}
+		ts.weights.Store(next)
+		return nil
+	}
+	return fmt.Errorf("route %s not found", routePath)
+}
+
+// requestValue reads a header, falling back to a cookie
+func requestValue(r *http.Request, header, cookie string) string {
+	if header != "" {
+		if v := r.Header.Get(header); v != "" {
+			return v
+		}
+	}
+	if cookie != "" {
+		if c, err := r.Cookie(cookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// splitStatsRegistry holds stats across reloads, keyed by route and split name
+type splitStatsRegistry struct {
+	mu    sync.Mutex
+	stats map[string]*splitStats
+}
+
+// attach points each split at its stats, creating them on first use and
+// dropping those of splits that no longer exist
+func (reg *splitStatsRegistry) attach(routes []Route) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	next := make(map[string]*splitStats)
+	for _, r := range routes {
+		if r.trafficSplit == nil {
+			continue
+		}
+		for _, t := range r.trafficSplit.targets {
+			key := r.Path + "|" + t.name
+			s, ok := reg.stats[key]
+			if !ok {
+				s = &splitStats{}
+			}
+			t.stats = s
+			next[key] = s
+		}
+	}
+	reg.stats = next
+}
+
+// GetTrafficSplitStats returns per-split request, error and latency figures
+func (p *Proxy) GetTrafficSplitStats() []TrafficSplitStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var out []TrafficSplitStats
+	for _, r := range p.routes {
+		if r.trafficSplit == nil {
+			continue
+		}
+		w := r.trafficSplit.weights.Load()
+		for i, t := range r.trafficSplit.targets {
+			s := TrafficSplitStats{
+				Route:     r.Path,
+				Split:     t.name,
+				Weight:    w.weights[i],
+				Requests:  t.stats.requests.Load(),
+				Errors:    t.stats.errors.Load(),
+				latencyMs: t.stats.latencyMs.Load(),
+			}
+			for i := range t.stats.buckets {
+				le := int64(-1)
+				if i < len(splitLatencyBuckets) {
+					le = splitLatencyBuckets[i]
+				}
+				s.Latency = append(s.Latency, LatencyBucket{LeMs: le, Count: t.stats.buckets[i].Load()})
+			}
+			out = append(out, s.derive())
+		}
+	}
+	return out
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newSplitBackend(body string, status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestProxy_TrafficSplit(t *testing.T) {
+	stable := newSplitBackend("stable", http.StatusOK)
+	defer stable.Close()
+	canary := newSplitBackend("canary", http.StatusInternalServerError)
+	defer canary.Close()
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/app",
+		Targets: []string{stable.URL},
+		TrafficSplit: &TrafficSplitConfig{
+			Splits: []TrafficSplit{
+				{Name: "stable", Weight: 80},
+				{Name: "canary", Weight: 20, Targets: []string{canary.URL}},
+			},
+			StickyCookie: "session",
+			ForceHeader:  "X-Version",
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	serve := func(req *http.Request) string {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// Weighted split without a sticky key
+	counts := map[string]int{}
+	for i := 0; i < 500; i++ {
+		counts[serve(httptest.NewRequest(http.MethodGet, "/app", nil))]++
+	}
+	if counts["canary"] < 50 || counts["canary"] > 150 {
+		t.Errorf("Expected roughly 20%% canary traffic, got %v", counts)
+	}
+
+	// Sticky by cookie
+	for i := 0; i < 20; i++ {
+		session := "user-" + strconv.Itoa(i)
+		first := ""
+		for j := 0; j < 5; j++ {
+			req := httptest.NewRequest(http.MethodGet, "/app", nil)
+			req.AddCookie(&http.Cookie{Name: "session", Value: session})
+			got := serve(req)
+			if first == "" {
+				first = got
+			} else if got != first {
+				t.Fatalf("Session %s moved from %s to %s", session, first, got)
+			}
+		}
+	}
+
+	// Forced by header
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/app", nil)
+		req.Header.Set("X-Version", "canary")
+		if got := serve(req); got != "canary" {
+			t.Fatalf("Expected forced canary, got %s", got)
+		}
+	}
+
+	stats := p.GetTrafficSplitStats()
+	if len(stats) != 2 {
+		t.Fatalf("Expected stats for 2 splits, got %d", len(stats))
+	}
+	for _, s := range stats {
+		switch s.Split {
+		case "stable":
+			if s.Errors != 0 || s.Requests == 0 {
+				t.Errorf("Unexpected stable stats %+v", s)
+			}
+		case "canary":
+			if s.ErrorRate != 1 {
+				t.Errorf("Expected canary error rate 1, got %f", s.ErrorRate)
+			}
+		}
+		var total uint64
+		for _, b := range s.Latency {
+			total += b.Count
+		}
+		if total != s.Requests {
+			t.Errorf("Histogram for %s counts %d of %d requests", s.Split, total, s.Requests)
+		}
+	}
+
+	// Stats survive a reload that keeps the split
+	before := stats[0].Requests
+	p.UpdateRoutes(p.GetRoutes())
+	if after := p.GetTrafficSplitStats()[0].Requests; after != before {
+		t.Errorf("Expected stats to survive reload, got %d want %d", after, before)
+	}
+}
+
+func TestProxy_TrafficSplitValidation(t *testing.T) {
+	p, _ := New([]string{})
+	cases := []*TrafficSplitConfig{
+		{},
+		{Splits: []TrafficSplit{{Weight: 10}}},
+		{Splits: []TrafficSplit{{Name: "a", Weight: 1}, {Name: "a", Weight: 1}}},
+		{Splits: []TrafficSplit{{Name: "a", Weight: -1}}},
+	}
+	for i, cfg := range cases {
+		err := p.UpdateRoutes([]ConfigRoute{{Path: "/app", Targets: []string{"http://10.0.0.1"}, TrafficSplit: cfg}})
+		if err == nil {
+			t.Errorf("Case %d: expected validation error", i)
+		}
+	}
+}
+
+func TestProxy_SetTrafficSplitWeights(t *testing.T) {
+	canary := newSplitBackend("canary", http.StatusOK)
+	defer canary.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/app",
+		Targets: []string{"http://10.0.0.1"},
+		TrafficSplit: &TrafficSplitConfig{Splits: []TrafficSplit{
+			{Name: "stable", Weight: 100},
+			{Name: "canary", Weight: 0, Targets: []string{canary.URL}},
+		}},
+	}})
+
+	if err := p.SetTrafficSplitWeights("/app", map[string]int{"stable": 0, "canary": 100}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/app", nil))
+	if w.Body.String() != "canary" {
+		t.Errorf("Expected all traffic on canary, got %q", w.Body.String())
+	}
+	if split := p.GetRoutes()[0].TrafficSplit; split.Splits[1].Weight != 100 {
+		t.Errorf("Expected GetRoutes to report the new weights, got %+v", split.Splits)
+	}
+
+	// Reloading the same splits keeps the live weights; changed splits take theirs
+	reload := func(stable, canaryWeight int) {
+		p.UpdateRoutes([]ConfigRoute{{
+			Path:    "/app",
+			Targets: []string{"http://10.0.0.1"},
+			TrafficSplit: &TrafficSplitConfig{Splits: []TrafficSplit{
+				{Name: "stable", Weight: stable},
+				{Name: "canary", Weight: canaryWeight, Targets: []string{canary.URL}},
+			}},
+		}})
+	}
+	reload(100, 0)
+	if split := p.GetRoutes()[0].TrafficSplit; split.Splits[1].Weight != 100 {
+		t.Errorf("Expected the weights to survive a reload, got %+v", split.Splits)
+	}
+	reload(90, 10)
+	if split := p.GetRoutes()[0].TrafficSplit; split.Splits[1].Weight != 10 {
+		t.Errorf("Expected the reloaded weights after a config change, got %+v", split.Splits)
+	}
+
+	if err := p.SetTrafficSplitWeights("/app", map[string]int{"unknown": 5}); err == nil {
+		t.Error("Expected error for unknown split")
+	}
+	if err := p.SetTrafficSplitWeights("/missing", nil); err == nil {
+		t.Error("Expected error for unknown route")
+	}
+}
+
+func TestTrafficSplitStats_SinceAndPercentile(t *testing.T) {
+	var s splitStats
+	for i := 0; i < 98; i++ {
+		s.record(http.StatusOK, 3*time.Millisecond)
+	}
+	prevStats := func() TrafficSplitStats {
+		out := TrafficSplitStats{Requests: s.requests.Load(), Errors: s.errors.Load(), latencyMs: s.latencyMs.Load()}
+		for i := range s.buckets {
+			le := int64(-1)
+			if i < len(splitLatencyBuckets) {
+				le = splitLatencyBuckets[i]
+			}
+			out.Latency = append(out.Latency, LatencyBucket{LeMs: le, Count: s.buckets[i].Load()})
+		}
+		return out.derive()
+	}
+	before := prevStats()
+	if before.P99LatencyMs != 5 {
+		t.Errorf("Expected p99 of 5ms, got %d", before.P99LatencyMs)
+	}
+
+	for i := 0; i < 10; i++ {
+		s.record(http.StatusBadGateway, 400*time.Millisecond)
+	}
+	window := prevStats().Since(before)
+	if window.Requests != 10 || window.ErrorRate != 1 || window.P99LatencyMs != 500 {
+		t.Errorf("Unexpected window stats %+v", window)
+	}
+
+	// Requests past the largest bucket never look faster than they were
+	mid := prevStats()
+	for i := 0; i < 10; i++ {
+		s.record(http.StatusOK, 2*time.Minute)
+	}
+	if p99 := prevStats().Since(mid).P99LatencyMs; p99 != LatencyOverflowMs {
+		t.Errorf("Expected the overflow bucket to report LatencyOverflowMs, got %d", p99)
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamConfig tunes the connection pool a route keeps to its backends
+type UpstreamConfig struct {
+	MaxConnsPerHost         int   `json:"max_conns_per_host,omitempty"`      // 0 is unlimited
+	MaxIdleConnsPerHost     int   `json:"max_idle_conns_per_host,omitempty"` // Defaults to 2
+	IdleTimeout             int   `json:"idle_timeout,omitempty"`            // Seconds an idle connection is kept, defaults to 90
+	DialTimeoutMS           int   `json:"dial_timeout_ms,omitempty"`         // Defaults to 30000
+	TLSHandshakeTimeoutMS   int   `json:"tls_handshake_timeout_ms,omitempty"`
+	ResponseHeaderTimeoutMS int   `json:"response_header_timeout_ms,omitempty"`
+	KeepAlive               int   `json:"keepalive,omitempty"` // TCP keepalive period in seconds, -1 disables
+	DisableKeepAlives       bool  `json:"disable_keepalives,omitempty"`
+	HTTP2                   *bool `json:"http2,omitempty"` // HTTP/2 to TLS backends, on by default
+	WriteBufferSize         int   `json:"write_buffer_size,omitempty"`
+	ReadBufferSize          int   `json:"read_buffer_size,omitempty"`
+}
+
+// UpstreamStats reports the utilisation of a backend's connection pool
+type UpstreamStats struct {
+	Route      string `json:"route"`
+	Backend    string `json:"backend"`
+	OpenConns  int64  `json:"open_conns"`
+	InFlight   int64  `json:"in_flight"`
+	MaxConns   int    `json:"max_conns,omitempty"`
+	Dials      uint64 `json:"dials"`
+	DialErrors uint64 `json:"dial_errors"`
+}
+
+type hostConns struct {
+	open       atomic.Int64
+	dials      atomic.Uint64
+	dialErrors atomic.Uint64
+}
+
+// connTracker counts the connections a transport holds to each address
+type connTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*hostConns
+}
+
+func (t *connTracker) host(addr string) *hostConns {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hosts[addr]
+	if !ok {
+		h = &hostConns{}
+		t.hosts[addr] = h
+	}
+	return h
+}
+
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+	host *hostConns
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.host.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// upstreamTransport is a route's own connection pool
+type upstreamTransport struct {
+	*http.Transport
+	config  *UpstreamConfig
+	tracker *connTracker
+}
+
+// newUpstreamTransport builds the transport for a route from its upstream
+// block, optionally prefixing every connection with a PROXY header
+func newUpstreamTransport(cfg *UpstreamConfig, proxyProtocol string) (*upstreamTransport, error) {
+	if proxyProtocol != "" && proxyProtocol != "v1" && proxyProtocol != "v2" {
+		return nil, fmt.Errorf("unknown proxy protocol version %q", proxyProtocol)
+	}
+	c := UpstreamConfig{}
+	if cfg != nil {
+		c = *cfg
+	}
+	for _, v := range []int{c.MaxConnsPerHost, c.MaxIdleConnsPerHost, c.IdleTimeout, c.DialTimeoutMS,
+		c.TLSHandshakeTimeoutMS, c.ResponseHeaderTimeoutMS, c.WriteBufferSize, c.ReadBufferSize} {
+		if v < 0 {
+			return nil, fmt.Errorf("upstream limits and timeouts must not be negative")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if c.DialTimeoutMS > 0 {
+		dialer.Timeout = time.Duration(c.DialTimeoutMS) * time.Millisecond
+	}
+	if c.KeepAlive != 0 {
+		dialer.KeepAlive = time.Duration(c.KeepAlive) * time.Second
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxConnsPerHost = c.MaxConnsPerHost
+	if c.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.IdleTimeout > 0 {
+		t.IdleConnTimeout = time.Duration(c.IdleTimeout) * time.Second
+	}
+	if c.TLSHandshakeTimeoutMS > 0 {
+		t.TLSHandshakeTimeout = time.Duration(c.TLSHandshakeTimeoutMS) * time.Millisecond
+	}
+	t.ResponseHeaderTimeout = time.Duration(c.ResponseHeaderTimeoutMS) * time.Millisecond
+	t.DisableKeepAlives = c.DisableKeepAlives
+	t.WriteBufferSize = c.WriteBufferSize
+	t.ReadBufferSize = c.ReadBufferSize
+	if c.HTTP2 != nil {
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(*c.HTTP2)
+		t.Protocols = protocols
+		t.ForceAttemptHTTP2 = *c.HTTP2
+	}
+
+	dial := dialFunc(dialer.DialContext)
+	if proxyProtocol != "" {
+		// Each connection carries a single client's identity, so none are reused
+		t.DisableKeepAlives = true
+		dial = proxyProtocolDial(dial, proxyProtocol)
+	}
+
+	tracker := &connTracker{hosts: make(map[string]*hostConns)}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host := tracker.host(addr)
+		host.dials.Add(1)
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			host.dialErrors.Add(1)
+			return nil, err
+		}
+		host.open.Add(1)
+		return &trackedConn{Conn: conn, host: host}, nil
+	}
+
+	return &upstreamTransport{Transport: t, config: cfg, tracker: tracker}, nil
+}
+
+// GetUpstreamStats reports connection pool utilisation for the backends of
+// routes with their own pool (an upstream block or PROXY protocol)
+func (p *Proxy) GetUpstreamStats() []UpstreamStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var out []UpstreamStats
+	for _, r := range p.routes {
+		if r.transport == nil {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, pool := range r.pools() {
+			for _, b := range pool.backends() {
+				addr := hostPort(b.URL)
+				if seen[addr] {
+					continue
+				}
+				seen[addr] = true
+				h := r.transport.tracker.host(addr)
+				out = append(out, UpstreamStats{
+					Route:      r.Path,
+					Backend:    b.URL.String(),
+					OpenConns:  h.open.Load(),
+					InFlight:   b.health.inflight.Load(),
+					MaxConns:   r.transport.MaxConnsPerHost,
+					Dials:      h.dials.Load(),
+					DialErrors: h.dialErrors.Load(),
+				})
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxy_UpstreamPoolStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:     "/api",
+		Targets:  []string{backend.URL},
+		Upstream: &UpstreamConfig{MaxConnsPerHost: 4, MaxIdleConnsPerHost: 4, DialTimeoutMS: 500},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+	}
+
+	stats := p.GetUpstreamStats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected stats for 1 backend, got %d", len(stats))
+	}
+	s := stats[0]
+	if s.Dials != 1 || s.OpenConns != 1 || s.MaxConns != 4 || s.InFlight != 0 {
+		t.Errorf("Expected one reused connection, got %+v", s)
+	}
+
+	// A reload drops the idle connections of the old pool
+	old := p.routes[0].transport
+	p.UpdateRoutes(p.GetRoutes())
+	if n := old.tracker.host(hostPort(p.routes[0].Pool.backends()[0].URL)).open.Load(); n != 0 {
+		t.Errorf("Expected old pool to close idle connections, %d still open", n)
+	}
+}
+
+func TestProxy_UpstreamDefaultTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{Path: "/api", Targets: []string{backend.URL}}})
+	if p.routes[0].transport != nil {
+		t.Error("Expected a route without upstream tuning to use the default transport")
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+	if stats := p.GetUpstreamStats(); len(stats) != 0 {
+		t.Errorf("Expected no pool stats without an upstream block, got %+v", stats)
+	}
+}
+
+func TestProxy_UpstreamDisableKeepAlives(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	p.UpdateRoutes([]ConfigRoute{{
+		Path:     "/api",
+		Targets:  []string{backend.URL},
+		Upstream: &UpstreamConfig{DisableKeepAlives: true},
+	}})
+
+	for i := 0; i < 3; i++ {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+	}
+
+	var s UpstreamStats
+	for i := 0; i < 100; i++ {
+		if s = p.GetUpstreamStats()[0]; s.OpenConns == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s.Dials != 3 || s.OpenConns != 0 {
+		t.Errorf("Expected a fresh connection per request, got %+v", s)
+	}
+}
+
+func TestNewUpstreamTransport(t *testing.T) {
+	off := false
+	tr, err := newUpstreamTransport(&UpstreamConfig{
+		IdleTimeout:             10,
+		TLSHandshakeTimeoutMS:   1500,
+		ResponseHeaderTimeoutMS: 2000,
+		HTTP2:                   &off,
+		WriteBufferSize:         8192,
+	}, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tr.IdleConnTimeout != 10*time.Second || tr.TLSHandshakeTimeout != 1500*time.Millisecond ||
+		tr.ResponseHeaderTimeout != 2*time.Second || tr.WriteBufferSize != 8192 {
+		t.Errorf("Transport settings not applied: %+v", tr.Transport)
+	}
+	if tr.ForceAttemptHTTP2 || tr.Protocols.HTTP2() {
+		t.Error("Expected HTTP/2 to be disabled")
+	}
+
+	if _, err := newUpstreamTransport(&UpstreamConfig{MaxConnsPerHost: -1}, ""); err == nil {
+		t.Error("Expected error for negative limit")
+	}
+	if _, err := newUpstreamTransport(nil, "v3"); err == nil {
+		t.Error("Expected error for unknown proxy protocol version")
+	}
+	pp, _ := newUpstreamTransport(nil, "v2")
+	if !pp.DisableKeepAlives {
+		t.Error("PROXY protocol connections must not be reused")
+	}
+}
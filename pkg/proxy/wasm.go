@@ -0,0 +1,550 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WASM plugins are filters compiled to WebAssembly. A module exports its
+// memory and at least one of:
+//
+//	on_request() -> i32            0 continues, anything else stops the request
+//	on_response(status i32) -> i32 runs as the status line is written
+//
+// and may import these functions from the "ghostplane" module. Strings are
+// (pointer, length) pairs in the module's memory. Getters copy at most
+// buf_len bytes and return the full length, or -1 when there is no value,
+// so a module can retry with a larger buffer.
+//
+//	get_header(name_ptr, name_len, buf_ptr, buf_len) -> i32
+//	set_header(name_ptr, name_len, val_ptr, val_len)
+//	add_header(name_ptr, name_len, val_ptr, val_len)
+//	remove_header(name_ptr, name_len)
+//	get_method(buf_ptr, buf_len) -> i32
+//	get_path(buf_ptr, buf_len) -> i32
+//	set_path(ptr, len)                        request phase only
+//	get_body(buf_ptr, buf_len) -> i32         request body, -1 above max_body_bytes
+//	set_body(ptr, len)                        request phase only
+//	get_config(buf_ptr, buf_len) -> i32       the route's per-plugin config
+//	send_response(status, body_ptr, body_len) ends the request with this response
+//	log(ptr, len)
+//
+// Headers are the request's during on_request and the response's during on_response.
+const pluginHostModule = "ghostplane"
+
+// PluginLimits bounds what one plugin may consume
+type PluginLimits struct {
+	MemoryPages  uint32 `json:"memory_pages,omitempty"`   // 64 KiB pages per instance, defaults to 256 (16 MiB)
+	TimeoutMS    int    `json:"timeout_ms,omitempty"`     // Budget per call, defaults to 50
+	MaxBodyBytes int64  `json:"max_body_bytes,omitempty"` // Largest request body get_body will read, defaults to 1 MiB
+	MaxInstances int    `json:"max_instances,omitempty"`  // Idle instances kept for reuse, defaults to 16
+}
+
+// PluginInfo describes a loaded plugin
+type PluginInfo struct {
+	Name     string       `json:"name"`
+	SHA256   string       `json:"sha256"`
+	Size     int          `json:"size"`
+	LoadedAt time.Time    `json:"loaded_at"`
+	Limits   PluginLimits `json:"limits"`
+	Calls    uint64       `json:"calls"`
+	Errors   uint64       `json:"errors"`
+}
+
+var errPluginClosed = errors.New("plugin was unloaded")
+
+// wasmPlugin is one compiled module with its own runtime, so memory limits
+// apply per plugin
+type wasmPlugin struct {
+	info       PluginInfo
+	runtime    wazero.Runtime
+	compiled   wazero.CompiledModule
+	idle       chan api.Module
+	timeout    time.Duration
+	onRequest  bool
+	onResponse bool
+
+	// Calls hold closeMu for reading so a replaced plugin is only closed once idle
+	closeMu sync.RWMutex
+	closed  bool
+	calls   atomic.Uint64
+	errors  atomic.Uint64
+}
+
+// pluginManager holds the loaded plugins by name
+type pluginManager struct {
+	mu      sync.RWMutex
+	plugins map[string]*wasmPlugin
+}
+
+func compilePlugin(name string, module []byte, limits PluginLimits) (*wasmPlugin, error) {
+	if limits.MemoryPages == 0 {
+		limits.MemoryPages = 256
+	}
+	if limits.TimeoutMS <= 0 {
+		limits.TimeoutMS = 50
+	}
+	if limits.MaxBodyBytes <= 0 {
+		limits.MaxBodyBytes = 1 << 20
+	}
+	if limits.MaxInstances <= 0 {
+		limits.MaxInstances = 16
+	}
+
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(limits.MemoryPages).
+		WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+	if _, err := buildPluginHost(rt).Instantiate(ctx); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	compiled, err := rt.CompileModule(ctx, module)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, fmt.Errorf("invalid module: %w", err)
+	}
+
+	sum := sha256.Sum256(module)
+	p := &wasmPlugin{
+		info: PluginInfo{
+			Name:     name,
+			SHA256:   hex.EncodeToString(sum[:]),
+			Size:     len(module),
+			LoadedAt: time.Now(),
+			Limits:   limits,
+		},
+		runtime:  rt,
+		compiled: compiled,
+		idle:     make(chan api.Module, limits.MaxInstances),
+		timeout:  time.Duration(limits.TimeoutMS) * time.Millisecond,
+	}
+	exports := compiled.ExportedFunctions()
+	_, p.onRequest = exports["on_request"]
+	_, p.onResponse = exports["on_response"]
+	if !p.onRequest && !p.onResponse {
+		rt.Close(ctx)
+		return nil, fmt.Errorf("module exports neither on_request nor on_response")
+	}
+
+	// Instantiate once up front so start-up failures surface at load time
+	inst, err := p.instantiate(ctx)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	p.idle <- inst
+	return p, nil
+}
+
+func (p *wasmPlugin) instantiate(ctx context.Context) (api.Module, error) {
+	// Anonymous instances so several can run at once; reactors get their _initialize
+	return p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+}
+
+// call runs an export on a pooled instance. Instances that fail, including
+// by running out of time, are discarded.
+func (p *wasmPlugin) call(state *pluginCall, export string, params ...uint64) (uint64, error) {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		return 0, errPluginClosed
+	}
+	p.calls.Add(1)
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), pluginCallKey{}, state), p.timeout)
+	defer cancel()
+
+	var inst api.Module
+	select {
+	case inst = <-p.idle:
+	default:
+		var err error
+		if inst, err = p.instantiate(ctx); err != nil {
+			p.errors.Add(1)
+			return 0, err
+		}
+	}
+
+	results, err := inst.ExportedFunction(export).Call(ctx, params...)
+	if err != nil {
+		p.errors.Add(1)
+		inst.Close(context.Background())
+		return 0, err
+	}
+	select {
+	case p.idle <- inst:
+	default:
+		inst.Close(context.Background())
+	}
+	if len(results) == 0 {
+		return 0, nil
+	}
+	return results[0], nil
+}
+
+// retire closes the plugin once in-flight calls have finished
+func (p *wasmPlugin) retire() {
+	p.closeMu.Lock()
+	p.closed = true
+	p.closeMu.Unlock()
+	p.runtime.Close(context.Background())
+}
+
+func (p *wasmPlugin) snapshot() PluginInfo {
+	info := p.info
+	info.Calls = p.calls.Load()
+	info.Errors = p.errors.Load()
+	return info
+}
+
+func (m *pluginManager) get(name string) *wasmPlugin {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.plugins[name]
+}
+
+// LoadPlugin compiles a WASM module and makes it available to wasm filters
+// under name. Loading an existing name hot-swaps it: new requests use the
+// new module while running calls finish on the old one.
+func (p *Proxy) LoadPlugin(name string, module []byte, limits PluginLimits) error {
+	if name == "" {
+		return fmt.Errorf("plugin name is required")
+	}
+	plugin, err := compilePlugin(name, module, limits)
+	if err != nil {
+		return err
+	}
+
+	p.plugins.mu.Lock()
+	if p.plugins.plugins == nil {
+		p.plugins.plugins = make(map[string]*wasmPlugin)
+	}
+	old := p.plugins.plugins[name]
+	p.plugins.plugins[name] = plugin
+	p.plugins.mu.Unlock()
+
+	if old != nil {
+		go old.retire()
+	}
+	log.Printf("🧩 Loaded plugin %s (%s)", name, plugin.info.SHA256[:12])
+	return nil
+}
+
+// RemovePlugin unloads a plugin; routes still referencing it fail or skip it per their fail_open setting
+func (p *Proxy) RemovePlugin(name string) error {
+	p.plugins.mu.Lock()
+	old, ok := p.plugins.plugins[name]
+	delete(p.plugins.plugins, name)
+	p.plugins.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("plugin %s not found", name)
+	}
+	go old.retire()
+	return nil
+}
+
+// GetPlugins lists loaded plugins, sorted by name
+func (p *Proxy) GetPlugins() []PluginInfo {
+	p.plugins.mu.RLock()
+	defer p.plugins.mu.RUnlock()
+	infos := make([]PluginInfo, 0, len(p.plugins.plugins))
+	for _, plugin := range p.plugins.plugins {
+		infos = append(infos, plugin.snapshot())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// pluginCall is the state host functions act on during one call
+type pluginCall struct {
+	req      *http.Request
+	header   http.Header // The current phase's headers
+	request  bool        // Request phase: path and body may change
+	config   []byte
+	maxBody  int64
+	body     []byte
+	bodyRead bool
+	response *pluginResponse
+}
+
+type pluginResponse struct {
+	status int
+	body   []byte
+}
+
+type pluginCallKey struct{}
+
+func callState(ctx context.Context) *pluginCall {
+	return ctx.Value(pluginCallKey{}).(*pluginCall)
+}
+
+func readString(m api.Module, ptr, length uint32) (string, bool) {
+	b, ok := m.Memory().Read(ptr, length)
+	return string(b), ok
+}
+
+// writeValue copies as much of v as fits and returns its full length
+func writeValue(m api.Module, v []byte, ptr, capacity uint32) int32 {
+	n := uint32(len(v))
+	if n > capacity {
+		n = capacity
+	}
+	if !m.Memory().Write(ptr, v[:n]) {
+		return -1
+	}
+	return int32(len(v))
+}
+
+// readBody loads the request body once, leaving it readable for the backend
+func (c *pluginCall) readBody() ([]byte, bool) {
+	if c.bodyRead {
+		return c.body, c.body != nil
+	}
+	c.bodyRead = true
+	r := c.req
+	if r.Body == nil || r.Body == http.NoBody {
+		c.body = []byte{}
+		return c.body, true
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, c.maxBody+1))
+	if err != nil || int64(len(data)) > c.maxBody {
+		// Too large (or broken): hand back what was read so the backend still gets it all
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	c.setBody(data)
+	return data, true
+}
+
+func (c *pluginCall) setBody(data []byte) {
+	c.body, c.bodyRead = data, true
+	r := c.req
+	r.ContentLength = int64(len(data))
+	r.TransferEncoding = nil
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	r.Body, _ = r.GetBody()
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func buildPluginHost(rt wazero.Runtime) wazero.HostModuleBuilder {
+	b := rt.NewHostModuleBuilder(pluginHostModule)
+	fn := func(name string, f interface{}) {
+		b.NewFunctionBuilder().WithFunc(f).Export(name)
+	}
+
+	fn("get_header", func(ctx context.Context, m api.Module, namePtr, nameLen, buf, bufLen uint32) int32 {
+		name, ok := readString(m, namePtr, nameLen)
+		values := callState(ctx).header.Values(name)
+		if !ok || len(values) == 0 {
+			return -1
+		}
+		return writeValue(m, []byte(values[0]), buf, bufLen)
+	})
+	fn("set_header", func(ctx context.Context, m api.Module, namePtr, nameLen, valPtr, valLen uint32) {
+		name, ok1 := readString(m, namePtr, nameLen)
+		value, ok2 := readString(m, valPtr, valLen)
+		if ok1 && ok2 {
+			callState(ctx).header.Set(name, value)
+		}
+	})
+	fn("add_header", func(ctx context.Context, m api.Module, namePtr, nameLen, valPtr, valLen uint32) {
+		name, ok1 := readString(m, namePtr, nameLen)
+		value, ok2 := readString(m, valPtr, valLen)
+		if ok1 && ok2 {
+			callState(ctx).header.Add(name, value)
+		}
+	})
+	fn("remove_header", func(ctx context.Context, m api.Module, namePtr, nameLen uint32) {
+		if name, ok := readString(m, namePtr, nameLen); ok {
+			callState(ctx).header.Del(name)
+		}
+	})
+	fn("get_method", func(ctx context.Context, m api.Module, buf, bufLen uint32) int32 {
+		return writeValue(m, []byte(callState(ctx).req.Method), buf, bufLen)
+	})
+	fn("get_path", func(ctx context.Context, m api.Module, buf, bufLen uint32) int32 {
+		return writeValue(m, []byte(callState(ctx).req.URL.Path), buf, bufLen)
+	})
+	fn("set_path", func(ctx context.Context, m api.Module, ptr, length uint32) {
+		c := callState(ctx)
+		if path, ok := readString(m, ptr, length); ok && c.request {
+			c.req.URL.Path = path
+			c.req.URL.RawPath = ""
+		}
+	})
+	fn("get_body", func(ctx context.Context, m api.Module, buf, bufLen uint32) int32 {
+		c := callState(ctx)
+		if !c.request {
+			return -1
+		}
+		body, ok := c.readBody()
+		if !ok {
+			return -1
+		}
+		return writeValue(m, body, buf, bufLen)
+	})
+	fn("set_body", func(ctx context.Context, m api.Module, ptr, length uint32) {
+		c := callState(ctx)
+		if body, ok := m.Memory().Read(ptr, length); ok && c.request {
+			if !c.bodyRead && c.req.Body != nil {
+				c.req.Body.Close()
+			}
+			c.setBody(bytes.Clone(body))
+		}
+	})
+	fn("get_config", func(ctx context.Context, m api.Module, buf, bufLen uint32) int32 {
+		config := callState(ctx).config
+		if config == nil {
+			return -1
+		}
+		return writeValue(m, config, buf, bufLen)
+	})
+	fn("send_response", func(ctx context.Context, m api.Module, status, bodyPtr, bodyLen uint32) {
+		body, ok := m.Memory().Read(bodyPtr, bodyLen)
+		if !ok || status < 100 || status > 599 {
+			return
+		}
+		callState(ctx).response = &pluginResponse{status: int(status), body: bytes.Clone(body)}
+	})
+	fn("log", func(ctx context.Context, m api.Module, ptr, length uint32) {
+		if msg, ok := readString(m, ptr, length); ok {
+			log.Printf("🧩 plugin: %s", msg)
+		}
+	})
+	return b
+}
+
+// wasmFilterConfig is the route config of a "wasm" filter
+type wasmFilterConfig struct {
+	Plugin   string          `json:"plugin"`
+	Config   json.RawMessage `json:"config,omitempty"`    // Handed to the module through get_config
+	FailOpen bool            `json:"fail_open,omitempty"` // Skip the plugin when it errors or is not loaded, instead of a 500
+}
+
+// wasmFilter runs a named plugin. The plugin is looked up per request so
+// hot reloads apply without touching routes.
+type wasmFilter struct {
+	config wasmFilterConfig
+	raw    []byte
+}
+
+func init() {
+	RegisterFilter("wasm", newWASMFilter)
+}
+
+func newWASMFilter(_ *Route, raw json.RawMessage) (Filter, error) {
+	var config wasmFilterConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if config.Plugin == "" {
+		return nil, fmt.Errorf("plugin is required")
+	}
+	f := &wasmFilter{config: config}
+	if len(config.Config) > 0 {
+		f.raw = []byte(config.Config)
+	}
+	return f, nil
+}
+
+func (f *wasmFilter) Name() string { return "wasm" }
+
+func (f *wasmFilter) OnRequest(fc *FilterContext) bool {
+	plugin := fc.proxy.plugins.get(f.config.Plugin)
+	if plugin == nil {
+		return f.failed(fc, errors.New("not loaded"))
+	}
+
+	if plugin.onRequest {
+		state := &pluginCall{req: fc.Request, header: fc.Request.Header, request: true, config: f.raw, maxBody: plugin.info.Limits.MaxBodyBytes}
+		result, err := plugin.call(state, "on_request")
+		if errors.Is(err, errPluginClosed) {
+			// Swapped out between lookup and call: run the replacement
+			if plugin = fc.proxy.plugins.get(f.config.Plugin); plugin == nil {
+				return f.failed(fc, err)
+			}
+			result, err = plugin.call(state, "on_request")
+		}
+		if err != nil {
+			return f.failed(fc, err)
+		}
+		if res := state.response; res != nil {
+			fc.sw.WriteHeader(res.status)
+			fc.sw.Write(res.body)
+			return false
+		}
+		if uint32(result) != 0 {
+			return fc.Reject(http.StatusForbidden, "Forbidden")
+		}
+	}
+
+	if plugin.onResponse {
+		fc.BeforeHeader(func(h http.Header, status int) {
+			if err := f.onResponse(fc, h, status); err != nil {
+				log.Printf("🧩 plugin %s on_response: %v", f.config.Plugin, err)
+				if !f.config.FailOpen {
+					fc.sw.replaceResponse(http.StatusInternalServerError, "Plugin error")
+				}
+			}
+		})
+	}
+	return true
+}
+
+// onResponse runs the plugin loaded now, which a hot reload may have swapped
+// since the request phase
+func (f *wasmFilter) onResponse(fc *FilterContext, h http.Header, status int) error {
+	plugin := fc.proxy.plugins.get(f.config.Plugin)
+	if plugin == nil {
+		return errors.New("not loaded")
+	}
+	if !plugin.onResponse {
+		return nil
+	}
+	state := &pluginCall{req: fc.Request, header: h, config: f.raw}
+	_, err := plugin.call(state, "on_response", uint64(status))
+	if errors.Is(err, errPluginClosed) {
+		// Swapped out between lookup and call: run the replacement
+		if plugin = fc.proxy.plugins.get(f.config.Plugin); plugin == nil {
+			return err
+		}
+		if !plugin.onResponse {
+			return nil
+		}
+		_, err = plugin.call(state, "on_response", uint64(status))
+	}
+	return err
+}
+
+func (f *wasmFilter) failed(fc *FilterContext, err error) bool {
+	log.Printf("🧩 plugin %s: %v", f.config.Plugin, err)
+	if f.config.FailOpen {
+		return true
+	}
+	return fc.Reject(http.StatusInternalServerError, "Plugin error")
+}
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Function types available to test modules
+const (
+	typeStrStr   = iota // (i32 i32 i32 i32) -> ()     set_header
+	typeRequest         // () -> i32                  on_request
+	typeResponse        // (i32) -> i32               on_response
+	typeSend            // (i32 i32 i32) -> ()        send_response
+	typeBuf             // (i32 i32) -> i32           get_config, get_body
+	typeStr             // (i32 i32) -> ()            set_path, set_body
+)
+
+type wasmFunc struct {
+	export string
+	typ    byte
+	body   []byte
+}
+
+// buildWASM assembles a module importing the given host functions (name and
+// type), exporting memory and funcs, with data placed at offset 0
+func buildWASM(imports [][2]interface{}, funcs []wasmFunc, data string) []byte {
+	vec := func(items ...[]byte) []byte {
+		out := uleb(uint32(len(items)))
+		for _, item := range items {
+			out = append(out, item...)
+		}
+		return out
+	}
+	name := func(s string) []byte { return append(uleb(uint32(len(s))), s...) }
+	section := func(id byte, content []byte) []byte {
+		return append(append([]byte{id}, uleb(uint32(len(content)))...), content...)
+	}
+	i32 := byte(0x7f)
+
+	types := vec(
+		[]byte{0x60, 4, i32, i32, i32, i32, 0},
+		[]byte{0x60, 0, 1, i32},
+		[]byte{0x60, 1, i32, 1, i32},
+		[]byte{0x60, 3, i32, i32, i32, 0},
+		[]byte{0x60, 2, i32, i32, 1, i32},
+		[]byte{0x60, 2, i32, i32, 0},
+	)
+	var imps, fns, exps, codes [][]byte
+	for _, imp := range imports {
+		imps = append(imps, append(append(name(pluginHostModule), name(imp[0].(string))...), 0x00, byte(imp[1].(int))))
+	}
+	exps = append(exps, append(name("memory"), 0x02, 0))
+	for i, f := range funcs {
+		fns = append(fns, []byte{f.typ})
+		exps = append(exps, append(name(f.export), 0x00, byte(len(imports)+i)))
+		body := append(append([]byte{0}, f.body...), 0x0b)
+		codes = append(codes, append(uleb(uint32(len(body))), body...))
+	}
+
+	out := []byte("\x00asm\x01\x00\x00\x00")
+	out = append(out, section(1, types)...)
+	out = append(out, section(2, vec(imps...))...)
+	out = append(out, section(3, vec(fns...))...)
+	out = append(out, section(5, []byte{1, 0, 1})...)
+	out = append(out, section(7, vec(exps...))...)
+	out = append(out, section(10, vec(codes...))...)
+	if data != "" {
+		out = append(out, section(11, vec(append([]byte{0, 0x41, 0, 0x0b}, name(data)...)))...)
+	}
+	return out
+}
+
+func uleb(v uint32) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+// i32Const encodes small non-negative constants (below 8192)
+func i32Const(v int) []byte {
+	if v < 64 {
+		return []byte{0x41, byte(v)}
+	}
+	return []byte{0x41, byte(v&0x7f) | 0x80, byte(v >> 7)}
+}
+
+func code(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func callFn(idx int) []byte { return []byte{0x10, byte(idx)} }
+
+// tenantModule copies its config into X-Tenant on requests and tags responses
+func tenantModule() []byte {
+	// "X-Tenant" at 0, "X-Plugin" at 8, "seen" at 16; config is read to 64
+	return buildWASM(
+		[][2]interface{}{{"get_config", typeBuf}, {"set_header", typeStrStr}},
+		[]wasmFunc{
+			{"on_request", typeRequest, code(
+				i32Const(0), i32Const(8), i32Const(64),
+				i32Const(64), i32Const(64), callFn(0), // get_config(64, 64) -> len
+				callFn(1), i32Const(0),
+			)},
+			{"on_response", typeResponse, code(
+				i32Const(8), i32Const(8), i32Const(16), i32Const(4), callFn(1), i32Const(0),
+			)},
+		},
+		"X-TenantX-Pluginseen",
+	)
+}
+
+func TestProxy_WASMPlugin(t *testing.T) {
+	var upstream *http.Request
+	var upstreamBody string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		b, _ := io.ReadAll(r.Body)
+		upstreamBody = string(b)
+	}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	if err := p.LoadPlugin("tenant", tenantModule(), PluginLimits{}); err != nil {
+		t.Fatalf("LoadPlugin failed: %v", err)
+	}
+	err := p.UpdateRoutes([]ConfigRoute{{
+		Path:    "/*",
+		Targets: []string{backend.URL},
+		Filters: []FilterConfig{{Name: "wasm", Config: json.RawMessage(`{"plugin":"tenant","config":"acme"}`)}},
+	}})
+	if err != nil {
+		t.Fatalf("UpdateRoutes failed: %v", err)
+	}
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("original")))
+		return w
+	}
+	w := send()
+	// The JSON string config arrives verbatim
+	if w.Code != http.StatusOK || upstream == nil {
+		t.Fatalf("Expected the request through, got %d %s", w.Code, w.Body.String())
+	}
+	if upstream.Header.Get("X-Tenant") != `"acme"` {
+		t.Fatalf("Expected the plugin to set X-Tenant, got %d, %q", w.Code, upstream.Header.Get("X-Tenant"))
+	}
+	if w.Header().Get("X-Plugin") != "seen" {
+		t.Errorf("Expected the response phase to run, got %v", w.Header())
+	}
+
+	// Hot reload: a module that rewrites the path and body
+	rewrite := buildWASM(
+		[][2]interface{}{{"set_path", typeStr}, {"set_body", typeStr}},
+		[]wasmFunc{{"on_request", typeRequest, code(
+			i32Const(0), i32Const(3), callFn(0),
+			i32Const(3), i32Const(9), callFn(1), i32Const(0),
+		)}},
+		"/v2rewritten",
+	)
+	if err := p.LoadPlugin("tenant", rewrite, PluginLimits{}); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	send()
+	if upstream.URL.Path != "/v2" || upstreamBody != "rewritten" || upstream.Header.Get("X-Tenant") != "" {
+		t.Errorf("Expected the reloaded module to rewrite, got %s %q", upstream.URL.Path, upstreamBody)
+	}
+
+	// Short-circuit with the module's own response
+	deny := buildWASM(
+		[][2]interface{}{{"send_response", typeSend}},
+		[]wasmFunc{{"on_request", typeRequest, code(i32Const(403), i32Const(0), i32Const(6), callFn(0), i32Const(1))}},
+		"denied",
+	)
+	p.LoadPlugin("tenant", deny, PluginLimits{})
+	upstream = nil
+	if w := send(); w.Code != http.StatusForbidden || w.Body.String() != "denied" || upstream != nil {
+		t.Errorf("Expected the plugin's 403, got %d %q", w.Code, w.Body.String())
+	}
+
+	if infos := p.GetPlugins(); len(infos) != 1 || infos[0].Calls == 0 {
+		t.Errorf("Unexpected plugin list %+v", infos)
+	}
+	p.RemovePlugin("tenant")
+	if w := send(); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a missing plugin to fail closed, got %d", w.Code)
+	}
+}
+
+func TestProxy_WASMPluginLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p, _ := New([]string{})
+	if err := p.LoadPlugin("bad", []byte("not wasm"), PluginLimits{}); err == nil {
+		t.Error("Expected an invalid module to be rejected")
+	}
+
+	// on_request spins forever: loop br 0 end
+	spin := buildWASM(nil, []wasmFunc{{"on_request", typeRequest, code([]byte{0x03, 0x40, 0x0c, 0x00, 0x0b}, i32Const(0))}}, "")
+	if err := p.LoadPlugin("spin", spin, PluginLimits{TimeoutMS: 10}); err != nil {
+		t.Fatalf("LoadPlugin failed: %v", err)
+	}
+	p.UpdateRoutes([]ConfigRoute{
+		{Path: "/closed", Targets: []string{backend.URL}, Filters: []FilterConfig{{Name: "wasm", Config: json.RawMessage(`{"plugin":"spin"}`)}}},
+		{Path: "/open", Targets: []string{backend.URL}, Filters: []FilterConfig{{Name: "wasm", Config: json.RawMessage(`{"plugin":"spin","fail_open":true}`)}}},
+	})
+	for path, want := range map[string]int{"/closed": http.StatusInternalServerError, "/open": http.StatusOK} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("%s: expected %d after the plugin timed out, got %d", path, want, w.Code)
+		}
+	}
+	if infos := p.GetPlugins(); infos[0].Errors != 2 {
+		t.Errorf("Expected both timeouts counted, got %+v", infos[0])
+	}
+
+	// A module needing more memory than its limit fails to load
+	big := bytes.Replace(spin, []byte{5, 3, 1, 0, 1}, []byte{5, 3, 1, 0, 4}, 1)
+	if err := p.LoadPlugin("big", big, PluginLimits{MemoryPages: 2}); err == nil {
+		t.Error("Expected the memory limit to reject the module")
+	}
+	if err := p.LoadPlugin("big", big, PluginLimits{MemoryPages: 4}); err != nil {
+		t.Errorf("Expected the module to load within its limit: %v", err)
+	}
+}
+
+func TestProxy_WASMPluginResponsePhase(t *testing.T) {
+	var p *Proxy
+	var swap func()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if swap != nil {
+			swap()
+		}
+		io.WriteString(w, "upstream")
+	}))
+	defer backend.Close()
+
+	p, _ = New([]string{})
+	p.LoadPlugin("tenant", tenantModule(), PluginLimits{})
+	// on_response spins forever: loop br 0 end
+	spin := buildWASM(nil, []wasmFunc{
+		{"on_request", typeRequest, i32Const(0)},
+		{"on_response", typeResponse, code([]byte{0x03, 0x40, 0x0c, 0x00, 0x0b}, i32Const(0))},
+	}, "")
+	p.LoadPlugin("spin", spin, PluginLimits{TimeoutMS: 10})
+	p.UpdateRoutes([]ConfigRoute{
+		{Path: "/tenant", Targets: []string{backend.URL}, Filters: []FilterConfig{{Name: "wasm", Config: json.RawMessage(`{"plugin":"tenant"}`)}}},
+		{Path: "/closed", Targets: []string{backend.URL}, Filters: []FilterConfig{{Name: "wasm", Config: json.RawMessage(`{"plugin":"spin"}`)}}},
+		{Path: "/open", Targets: []string{backend.URL}, Filters: []FilterConfig{{Name: "wasm", Config: json.RawMessage(`{"plugin":"spin","fail_open":true}`)}}},
+	})
+	send := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	// A failing response phase honours fail_open
+	if w := send("/closed"); w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "upstream") {
+		t.Errorf("Expected the failed response phase to fail closed, got %d %q", w.Code, w.Body.String())
+	}
+	if w := send("/open"); w.Code != http.StatusOK || w.Body.String() != "upstream" {
+		t.Errorf("Expected fail_open to pass the response through, got %d %q", w.Code, w.Body.String())
+	}
+
+	// Reloaded while the request is upstream: the new module handles the response
+	v2 := buildWASM(
+		[][2]interface{}{{"set_header", typeStrStr}},
+		[]wasmFunc{
+			{"on_request", typeRequest, i32Const(0)},
+			{"on_response", typeResponse, code(i32Const(0), i32Const(8), i32Const(8), i32Const(2), callFn(0), i32Const(0))},
+		},
+		"X-Pluginv2",
+	)
+	swap = func() { p.LoadPlugin("tenant", v2, PluginLimits{}) }
+	if w := send("/tenant"); w.Code != http.StatusOK || w.Header().Get("X-Plugin") != "v2" {
+		t.Errorf("Expected the reloaded module's response phase, got %d %v", w.Code, w.Header())
+	}
+
+	// Removed while the request is upstream: fails closed like the request phase
+	swap = func() { p.RemovePlugin("tenant") }
+	if w := send("/tenant"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a removed plugin to fail closed, got %d", w.Code)
+	}
+}
@@ -0,0 +1,75 @@
+package templates
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arunsoman/GhostPlane/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlueGreen_TemplateRendersBothColours(t *testing.T) {
+	repo, err := NewRepository("../../templates")
+	require.NoError(t, err)
+	tmpl, err := repo.Get("blue-green-deploy")
+	require.NoError(t, err)
+
+	cfg, err := NewRenderer().Render(tmpl, map[string]interface{}{
+		"active_pool":   "green",
+		"blue_targets":  "http://10.0.0.1",
+		"green_targets": "http://10.0.1.1",
+	})
+	require.NoError(t, err)
+
+	bg := cfg.L7Routes[0].BlueGreen
+	require.NotNil(t, bg)
+	assert.Equal(t, []string{"http://10.0.0.1"}, bg.Blue)
+	assert.Equal(t, []string{"http://10.0.1.1"}, bg.Green)
+	assert.Equal(t, "green", bg.Active)
+	assert.Equal(t, 30, bg.DrainSeconds)
+}
+
+func TestHandler_BlueGreenSwitchWithVerification(t *testing.T) {
+	greenStatus := http.StatusServiceUnavailable
+	blue := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer blue.Close()
+	green := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(greenStatus)
+	}))
+	defer green.Close()
+
+	p, err := proxy.New([]string{})
+	require.NoError(t, err)
+	require.NoError(t, p.UpdateRoutes([]proxy.ConfigRoute{{
+		Path:      "/*",
+		BlueGreen: &proxy.BlueGreenConfig{Blue: []string{blue.URL}, Green: []string{green.URL}},
+	}}))
+
+	repo, err := NewRepository("../../templates")
+	require.NoError(t, err)
+	h := NewHandler(repo, NewRenderer(), NewSimulator(), p, nil, nil, nil, nil)
+
+	post := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"route": "/*", "verify_template": "blue-green-deploy"})
+		w := httptest.NewRecorder()
+		h.HandleBlueGreen(w, httptest.NewRequest(http.MethodPost, "/api/v1/blue-green", bytes.NewBuffer(body)))
+		return w
+	}
+
+	// Green fails verification, so traffic stays on blue
+	w := post()
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, "blue", p.GetBlueGreen()[0].Active)
+
+	greenStatus = http.StatusOK
+	w = post()
+	require.Equal(t, http.StatusOK, w.Code)
+	var status proxy.BlueGreenStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(t, "green", status.Active)
+	assert.Equal(t, "blue", status.Previous)
+}
@@ -1,10 +1,13 @@
 package templates
 
 import (
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/arunsoman/GhostPlane/pkg/l4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -60,3 +63,138 @@ configuration: |
 		assert.Contains(t, err.Error(), "missing required parameter")
 	})
 }
+
+func TestRenderer_RouteFieldNames(t *testing.T) {
+	tmpl := &Template{
+		Metadata:   Metadata{ID: "acl"},
+		Parameters: []Parameter{{Name: "subnets", Type: "ip_list"}},
+		Configuration: `
+l7_routes:
+  - path: "/admin"
+    targets: ["http://10.0.0.1"]
+    ip_filter:
+      allow: {{ .subnets | json }}
+l4_config:
+  listener_port: 5432
+`,
+	}
+
+	cfg, err := NewRenderer().Render(tmpl, map[string]interface{}{"subnets": "10.0.0.0/8, 192.168.0.0/16"})
+	require.NoError(t, err)
+	require.NotNil(t, cfg.L7Routes[0].IPFilter)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.0.0/16"}, cfg.L7Routes[0].IPFilter.Allow)
+	assert.Equal(t, float64(5432), cfg.L4Config["listener_port"])
+}
+
+func TestMultiCloudIngress_Failover(t *testing.T) {
+	repo, err := NewRepository("../../templates")
+	require.NoError(t, err)
+	tmpl, err := repo.Get("global-multi-cloud")
+	require.NoError(t, err)
+
+	cfg, err := NewRenderer().Render(tmpl, map[string]interface{}{
+		"aws_region_targets": "http://10.0.0.1, http://10.0.0.2",
+		"gcp_region_targets": "http://10.1.0.1",
+	})
+	require.NoError(t, err)
+
+	// One route carrying both regions as priority tiers, not two competing routes
+	require.Len(t, cfg.L7Routes, 1)
+	route := cfg.L7Routes[0]
+	assert.Equal(t, []string{"http://10.0.0.1", "http://10.0.0.2"}, route.Targets)
+	assert.Equal(t, "aws", route.Localities["http://10.0.0.2"])
+	require.NotNil(t, route.HealthCheck)
+	assert.Equal(t, 3, route.HealthCheck.UnhealthyThreshold)
+	require.NotNil(t, route.Failover)
+	assert.Equal(t, 50, route.Failover.MinHealthyPercent)
+	require.Len(t, route.Failover.Tiers, 1)
+	assert.Equal(t, []string{"http://10.1.0.1"}, route.Failover.Tiers[0].Targets)
+	assert.Equal(t, "gcp", route.Failover.Tiers[0].Locality)
+}
+
+func TestCanary_TrafficSplit(t *testing.T) {
+	repo, err := NewRepository("../../templates")
+	require.NoError(t, err)
+	tmpl, err := repo.Get("canary-release-10")
+	require.NoError(t, err)
+
+	cfg, err := NewRenderer().Render(tmpl, map[string]interface{}{
+		"stable_targets": "http://10.0.0.1",
+		"canary_targets": "http://10.0.1.1",
+		"canary_weight":  float64(25),
+	})
+	require.NoError(t, err)
+
+	require.Len(t, cfg.L7Routes, 1)
+	split := cfg.L7Routes[0].TrafficSplit
+	require.NotNil(t, split)
+	assert.Equal(t, "session_id", split.StickyCookie)
+	require.Len(t, split.Splits, 2)
+	assert.Equal(t, 75, split.Splits[0].Weight)
+	assert.Equal(t, 25, split.Splits[1].Weight)
+	assert.Equal(t, []string{"http://10.0.1.1"}, split.Splits[1].Targets)
+}
+
+func TestEdgeProxy_CompressedCache(t *testing.T) {
+	repo, err := NewRepository("../../templates")
+	require.NoError(t, err)
+	tmpl, err := repo.Get("edge-asset-proxy")
+	require.NoError(t, err)
+
+	cfg, err := NewRenderer().Render(tmpl, map[string]interface{}{"origin_url": "http://origin.internal"})
+	require.NoError(t, err)
+
+	route := cfg.L7Routes[0]
+	require.NotNil(t, route.Cache)
+	assert.True(t, route.Cache.Enabled)
+	assert.Equal(t, 3600, route.Cache.TTL)
+	require.NotNil(t, route.Compression)
+	assert.True(t, route.Compression.Enabled)
+	assert.Equal(t, []string{"br", "gzip"}, route.Compression.Algorithms)
+}
+
+func TestUDPStreaming_UserSpaceL4(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	repo, err := NewRepository("../../templates")
+	require.NoError(t, err)
+	tmpl, err := repo.Get("udp-streaming")
+	require.NoError(t, err)
+	cfg, err := NewRenderer().Render(tmpl, map[string]interface{}{
+		"udp_port":           0,
+		"streaming_backends": backend.LocalAddr().String(),
+	})
+	require.NoError(t, err)
+
+	// The rendered l4_config drives the user-space proxy as-is
+	l4cfg, err := l4.ParseConfig(cfg.L4Config)
+	require.NoError(t, err)
+	assert.Equal(t, l4.Maglev, l4cfg.Algorithm)
+	l4cfg.ListenAddr = "127.0.0.1"
+	p, err := l4.New(l4cfg)
+	require.NoError(t, err)
+	require.NoError(t, p.Start())
+	defer p.Close()
+
+	client, err := net.Dial("udp", p.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.Write([]byte("rtp"))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "rtp", string(buf[:n]))
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/arunsoman/GhostPlane/pkg/db"
 	"github.com/arunsoman/GhostPlane/pkg/ebpf"
+	"github.com/arunsoman/GhostPlane/pkg/l4"
 	"github.com/arunsoman/GhostPlane/pkg/proxy"
 )
 
@@ -29,20 +30,24 @@ type Handler struct {
 	simulator      *Simulator
 	proxy          *proxy.Proxy
 	ebpfLoader     *ebpf.Loader
+	l4             *l4.Manager // User-space L4 proxies, used when XDP is unavailable
 	store          *db.Store
 	deploymentChan chan<- Deployment
+	rollouts       *RolloutController
 }
 
 // NewHandler creates a new template handler.
-func NewHandler(repo *Repository, renderer *Renderer, simulator *Simulator, p *proxy.Proxy, el *ebpf.Loader, s *db.Store, dChan chan<- Deployment) *Handler {
+func NewHandler(repo *Repository, renderer *Renderer, simulator *Simulator, p *proxy.Proxy, el *ebpf.Loader, l4m *l4.Manager, s *db.Store, dChan chan<- Deployment) *Handler {
 	return &Handler{
 		repo:           repo,
 		renderer:       renderer,
 		simulator:      simulator,
 		proxy:          p,
 		ebpfLoader:     el,
+		l4:             l4m,
 		store:          s,
 		deploymentChan: dChan,
+		rollouts:       NewRolloutController(p, s, dChan),
 	}
 }
 
@@ -122,6 +127,17 @@ func (h *Handler) DeployTemplate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// L4 configs naming a protocol and targets can also run in user space
+	var l4Config *l4.Config
+	if _, ok := finalConfig.L4Config["protocol"]; ok {
+		cfg, err := l4.ParseConfig(finalConfig.L4Config)
+		if err != nil {
+			sendJSONError(w, fmt.Sprintf("invalid l4_config: %v", err), http.StatusBadRequest)
+			return
+		}
+		l4Config = &cfg
+	}
+
 	// Generate ID for the deployment
 	deploymentID := "deploy-" + fmt.Sprintf("%d", time.Now().Unix())
 
@@ -139,7 +155,8 @@ func (h *Handler) DeployTemplate(w http.ResponseWriter, r *http.Request) {
 		status = "active"
 		deployment.Status = status
 
-		// 1. Apply L7 Routes
+		// 1. Apply L7 Routes, remembering the old ones in case the L4 side fails
+		previousRoutes := h.proxy.GetRoutes()
 		if len(finalConfig.L7Routes) > 0 {
 			// Attach Source Metadata
 			for i := range finalConfig.L7Routes {
@@ -156,12 +173,29 @@ func (h *Handler) DeployTemplate(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// 2. Apply L4 Config (if any)
+		// 2. Apply L4 Config (if any): XDP when loaded, otherwise the user-space proxy
 		if listenerPort, ok := finalConfig.L4Config["listener_port"].(float64); ok && h.ebpfLoader != nil {
 			if err := h.ebpfLoader.AddListener(uint16(listenerPort)); err != nil {
 				// Log but don't fail, as it might already exist
 				fmt.Printf("⚠️ Failed to add listener %d: %v\n", int(listenerPort), err)
 			}
+		} else if l4Config != nil && h.ebpfLoader == nil && h.l4 != nil {
+			if _, err := h.l4.Apply(*l4Config); err != nil {
+				// Nothing of a failed deployment stays live
+				if len(finalConfig.L7Routes) > 0 {
+					if rerr := h.proxy.UpdateRoutes(previousRoutes); rerr != nil {
+						fmt.Printf("⚠️ Failed to restore routes: %v\n", rerr)
+					}
+				}
+				sendJSONError(w, fmt.Sprintf("failed to start L4 proxy: %v", err), http.StatusInternalServerError)
+				return
+			}
+			// Persisted so the proxies come back on restart
+			if data, err := json.Marshal(h.l4.Configs()); err == nil {
+				if err := h.store.SetSetting("l4_proxies", string(data)); err != nil {
+					fmt.Printf("⚠️ Failed to persist L4 proxies: %v\n", err)
+				}
+			}
 		}
 
 		// 3. Persist to DB
@@ -265,3 +299,120 @@ func (h *Handler) VerifyTemplate(w http.ResponseWriter, r *http.Request) {
 		"results":     results,
 	})
 }
+
+// HandleRollouts lists (GET), starts (POST) or aborts (DELETE ?id=) progressive canary rollouts.
+func (h *Handler) HandleRollouts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.rollouts.List())
+	case http.MethodPost:
+		var cfg RolloutConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			sendJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		deployment, err := h.rollouts.Start(cfg)
+		if err != nil {
+			sendJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(deployment)
+	case http.MethodDelete:
+		if err := h.rollouts.Abort(r.URL.Query().Get("id")); err != nil {
+			sendJSONError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleBlueGreen lists blue/green routes (GET) or switches one (POST). A switch
+// can first run a template's verification requests against the target colour
+// and is refused if any of them fail.
+func (h *Handler) HandleBlueGreen(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.proxy.GetBlueGreen())
+		return
+	case http.MethodPost:
+	default:
+		sendJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Route          string `json:"route"`
+		Color          string `json:"color"`           // Empty flips to the other colour
+		VerifyTemplate string `json:"verify_template"` // Template whose verification must pass first
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.VerifyTemplate != "" {
+		color := req.Color
+		if color == "" {
+			color = "green"
+			for _, s := range h.proxy.GetBlueGreen() {
+				if s.Route == req.Route && s.Active == "green" {
+					color = "blue"
+				}
+			}
+		}
+		targets, err := h.proxy.BlueGreenPool(req.Route, color)
+		if err != nil {
+			sendJSONError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		tmpl, err := h.repo.Get(req.VerifyTemplate)
+		if err != nil {
+			sendJSONError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		var results []VerificationResult
+		passed := true
+		for _, target := range targets {
+			res, err := h.simulator.VerifyTemplate(r.Context(), tmpl, target)
+			if err != nil {
+				sendJSONError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, v := range res {
+				passed = passed && v.Success
+			}
+			results = append(results, res...)
+		}
+		if !passed {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":   fmt.Sprintf("verification of %s failed, not switching", color),
+				"results": results,
+			})
+			return
+		}
+		req.Color = color
+	}
+
+	status, err := h.proxy.SwitchBlueGreen(req.Route, req.Color)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.store != nil {
+		if err := h.store.SaveRoutes(h.proxy.GetRoutes()); err != nil {
+			fmt.Printf("⚠️ Failed to persist routes: %v\n", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
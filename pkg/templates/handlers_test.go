@@ -0,0 +1,56 @@
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arunsoman/GhostPlane/pkg/l4"
+	"github.com/arunsoman/GhostPlane/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_DeployRestoresRoutesWhenL4Fails(t *testing.T) {
+	// The L4 port is taken, so the deployment cannot start its proxy
+	busy, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "mixed.yaml"), []byte(fmt.Sprintf(`metadata:
+  id: "mixed"
+  name: "Mixed"
+configuration: |
+  l7_routes:
+    - path: "/new"
+      targets: ["http://10.0.0.2:80"]
+  l4_config:
+    protocol: "tcp"
+    listener_port: %d
+    targets: ["127.0.0.1:9"]
+`, busy.Addr().(*net.TCPAddr).Port)), 0644))
+	repo, err := NewRepository(dir)
+	require.NoError(t, err)
+
+	p, err := proxy.New([]string{})
+	require.NoError(t, err)
+	require.NoError(t, p.UpdateRoutes([]proxy.ConfigRoute{{Path: "/old", Targets: []string{"http://10.0.0.1:80"}}}))
+	m := l4.NewManager()
+	defer m.Close()
+	h := NewHandler(repo, NewRenderer(), NewSimulator(), p, nil, m, nil, nil)
+
+	w := httptest.NewRecorder()
+	h.DeployTemplate(w, httptest.NewRequest(http.MethodPost, "/api/v1/templates/mixed/deploy", bytes.NewBufferString(`{"parameters": {}}`)))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	routes := p.GetRoutes()
+	require.Len(t, routes, 1)
+	assert.Equal(t, "/old", routes[0].Path, "a failed deployment must not leave its L7 routes live")
+	assert.Empty(t, m.Stats())
+}
@@ -16,7 +16,7 @@ func TestHandler_ListTemplates_Integration(t *testing.T) {
 
 	renderer := NewRenderer()
 	simulator := NewSimulator()
-	handler := NewHandler(repo, renderer, simulator, nil, nil, nil, nil)
+	handler := NewHandler(repo, renderer, simulator, nil, nil, nil, nil, nil)
 
 	// Create a request to /api/v1/templates
 	req, err := http.NewRequest("GET", "/api/v1/templates", nil)
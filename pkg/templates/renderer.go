@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -39,10 +40,30 @@ func NewRenderer() *Renderer {
 				b, err := json.Marshal(v)
 				return string(b), err
 			},
+			// sub works on numeric parameters whether they arrive as numbers or strings
+			"sub": func(a, b interface{}) (int, error) {
+				x, err := toInt(a)
+				if err != nil {
+					return 0, err
+				}
+				y, err := toInt(b)
+				if err != nil {
+					return 0, err
+				}
+				return x - y, nil
+			},
 		},
 	}
 }
 
+func toInt(v interface{}) (int, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(fmt.Sprint(v)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("not a number: %v", v)
+	}
+	return int(f), nil
+}
+
 // Render processes a template with the provided parameters and returns a system-compatible configuration.
 func (r *Renderer) Render(tmpl *Template, params map[string]interface{}) (*RenderedConfig, error) {
 	// 1. Normalize and Validate parameters
@@ -80,9 +101,18 @@ func (r *Renderer) Render(tmpl *Template, params map[string]interface{}) (*Rende
 		return nil, fmt.Errorf("failed to execute template: %w", err)
 	}
 
-	// 3. Convert to final RenderedConfig object
+	// 3. Convert to final RenderedConfig object. Routes are decoded through their
+	// JSON tags so templates use the same field names as the config API.
+	var generic interface{}
+	if err := yaml.Unmarshal(buf.Bytes(), &generic); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal into RenderedConfig: %w. Buf: %s", err, buf.String())
+	}
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert rendered config: %w", err)
+	}
 	var finalConfig RenderedConfig
-	if err := yaml.Unmarshal(buf.Bytes(), &finalConfig); err != nil {
+	if err := json.Unmarshal(data, &finalConfig); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal into RenderedConfig: %w. Buf: %s", err, buf.String())
 	}
 
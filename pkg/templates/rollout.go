@@ -0,0 +1,258 @@
+package templates
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/arunsoman/GhostPlane/pkg/db"
+	"github.com/arunsoman/GhostPlane/pkg/proxy"
+)
+
+// RolloutConfig describes a progressive canary run over a route's traffic split.
+type RolloutConfig struct {
+	Route           string  `json:"route"`
+	StableSplit     string  `json:"stable_split,omitempty"` // Defaults to "stable"
+	CanarySplit     string  `json:"canary_split,omitempty"` // Defaults to "canary"
+	Steps           []int   `json:"steps"`                  // Canary weight per step, e.g. [5, 25, 50, 100]
+	StepDuration    int     `json:"step_duration"`          // Seconds of traffic analysed per step
+	MaxErrorRate    float64 `json:"max_error_rate"`         // Canary 5xx share that triggers a rollback, e.g. 0.05
+	MaxP99LatencyMs int64   `json:"max_p99_latency_ms,omitempty"`
+	MinRequests     int     `json:"min_requests,omitempty"`      // Canary requests needed for a verdict, defaults to 20
+	MaxStepDuration int     `json:"max_step_duration,omitempty"` // Seconds a step may wait for min_requests before rolling back, defaults to 10x step_duration
+}
+
+// RolloutController shifts traffic to a canary step by step, judging each step
+// on the proxy's per-split metrics, and promotes or rolls back on its own.
+type RolloutController struct {
+	proxy          *proxy.Proxy
+	store          *db.Store // Optional; the final weights are saved with the routes
+	deploymentChan chan<- Deployment
+	stepUnit       time.Duration
+
+	mu       sync.Mutex
+	rollouts map[string]*rollout
+}
+
+type rollout struct {
+	config     RolloutConfig
+	deployment Deployment
+	cancel     context.CancelFunc
+}
+
+// NewRolloutController creates a controller that reports progress on dChan.
+func NewRolloutController(p *proxy.Proxy, s *db.Store, dChan chan<- Deployment) *RolloutController {
+	return &RolloutController{
+		proxy:          p,
+		store:          s,
+		deploymentChan: dChan,
+		stepUnit:       time.Second,
+		rollouts:       make(map[string]*rollout),
+	}
+}
+
+// Start validates the config and runs the rollout in the background.
+func (c *RolloutController) Start(cfg RolloutConfig) (Deployment, error) {
+	if cfg.StableSplit == "" {
+		cfg.StableSplit = "stable"
+	}
+	if cfg.CanarySplit == "" {
+		cfg.CanarySplit = "canary"
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if len(cfg.Steps) == 0 {
+		return Deployment{}, fmt.Errorf("at least one step is required")
+	}
+	for i, w := range cfg.Steps {
+		// A 0% step sends the canary no traffic, so it could never reach a verdict
+		if w <= 0 || w > 100 || (i > 0 && w < cfg.Steps[i-1]) {
+			return Deployment{}, fmt.Errorf("steps must be non-decreasing weights between 1 and 100")
+		}
+	}
+	if cfg.StepDuration <= 0 {
+		return Deployment{}, fmt.Errorf("step_duration must be positive")
+	}
+	if cfg.MaxStepDuration <= 0 {
+		cfg.MaxStepDuration = 10 * cfg.StepDuration
+	}
+	if cfg.MaxStepDuration < cfg.StepDuration {
+		return Deployment{}, fmt.Errorf("max_step_duration must be at least step_duration")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ro := range c.rollouts {
+		if ro.config.Route == cfg.Route && ro.deployment.Status == "deploying" {
+			return Deployment{}, fmt.Errorf("a rollout is already running on route %s", cfg.Route)
+		}
+	}
+
+	// Begin with all traffic on stable; this also checks both splits exist
+	if err := c.proxy.SetTrafficSplitWeights(cfg.Route, map[string]int{cfg.StableSplit: 100, cfg.CanarySplit: 0}); err != nil {
+		return Deployment{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ro := &rollout{
+		config: cfg,
+		deployment: Deployment{
+			ID:         "rollout-" + fmt.Sprintf("%d", time.Now().UnixNano()),
+			TemplateID: "canary-rollout",
+			Status:     "deploying",
+			Parameters: map[string]interface{}{"route": cfg.Route, "steps": cfg.Steps},
+			CreatedAt:  time.Now(),
+		},
+		cancel: cancel,
+	}
+	c.rollouts[ro.deployment.ID] = ro
+	go c.run(ctx, ro)
+
+	return ro.deployment, nil
+}
+
+// Abort stops a running rollout and sends all traffic back to stable.
+func (c *RolloutController) Abort(id string) error {
+	c.mu.Lock()
+	ro, ok := c.rollouts[id]
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("rollout %s not found", id)
+	}
+	ro.cancel()
+	return nil
+}
+
+// List returns every rollout started since the controller was created.
+func (c *RolloutController) List() []Deployment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]Deployment, 0, len(c.rollouts))
+	for _, ro := range c.rollouts {
+		out = append(out, ro.deployment)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+func (c *RolloutController) run(ctx context.Context, ro *rollout) {
+	cfg := ro.config
+	window := time.Duration(cfg.StepDuration) * c.stepUnit
+	maxWait := time.Duration(cfg.MaxStepDuration) * c.stepUnit
+
+	for i, weight := range cfg.Steps {
+		if err := c.proxy.SetTrafficSplitWeights(cfg.Route, map[string]int{cfg.StableSplit: 100 - weight, cfg.CanarySplit: weight}); err != nil {
+			c.finish(ro, "failed", err.Error())
+			return
+		}
+		c.report(ro, "deploying", i*100/len(cfg.Steps), "")
+
+		// Hold the step until the canary has served enough traffic for a verdict
+		before := c.canaryStats(cfg)
+		deadline := time.Now().Add(maxWait)
+		for {
+			select {
+			case <-ctx.Done():
+				c.rollback(ro, "rollout aborted")
+				return
+			case <-time.After(window):
+			}
+
+			stats := c.canaryStats(cfg).Since(before)
+			if stats.Requests < uint64(cfg.MinRequests) {
+				// Too little traffic to judge; don't hold the canary at this weight forever
+				if !time.Now().Before(deadline) {
+					c.rollback(ro, fmt.Sprintf("step %d (%d%%): only %d of %d canary requests within %ds", i+1, weight, stats.Requests, cfg.MinRequests, cfg.MaxStepDuration))
+					return
+				}
+				continue
+			}
+			if reason := analyse(cfg, stats); reason != "" {
+				c.rollback(ro, fmt.Sprintf("step %d (%d%%): %s", i+1, weight, reason))
+				return
+			}
+			break
+		}
+	}
+
+	// Promote: the canary takes all traffic
+	if err := c.proxy.SetTrafficSplitWeights(cfg.Route, map[string]int{cfg.StableSplit: 0, cfg.CanarySplit: 100}); err != nil {
+		c.finish(ro, "failed", err.Error())
+		return
+	}
+	c.finish(ro, "active", "")
+}
+
+// analyse returns why the canary failed a step, or "" if it passed
+func analyse(cfg RolloutConfig, stats proxy.TrafficSplitStats) string {
+	if cfg.MaxErrorRate > 0 && stats.ErrorRate > cfg.MaxErrorRate {
+		return fmt.Sprintf("error rate %.2f%% exceeds %.2f%%", stats.ErrorRate*100, cfg.MaxErrorRate*100)
+	}
+	if cfg.MaxP99LatencyMs > 0 && stats.P99LatencyMs > cfg.MaxP99LatencyMs {
+		if stats.P99LatencyMs == proxy.LatencyOverflowMs {
+			return fmt.Sprintf("p99 latency is past the largest histogram bucket, exceeding %dms", cfg.MaxP99LatencyMs)
+		}
+		return fmt.Sprintf("p99 latency %dms exceeds %dms", stats.P99LatencyMs, cfg.MaxP99LatencyMs)
+	}
+	return ""
+}
+
+func (c *RolloutController) canaryStats(cfg RolloutConfig) proxy.TrafficSplitStats {
+	for _, s := range c.proxy.GetTrafficSplitStats() {
+		if s.Route == cfg.Route && s.Split == cfg.CanarySplit {
+			return s
+		}
+	}
+	return proxy.TrafficSplitStats{}
+}
+
+func (c *RolloutController) rollback(ro *rollout, reason string) {
+	cfg := ro.config
+	if err := c.proxy.SetTrafficSplitWeights(cfg.Route, map[string]int{cfg.StableSplit: 100, cfg.CanarySplit: 0}); err != nil {
+		reason += "; rollback failed: " + err.Error()
+	}
+	c.finish(ro, "failed", "rolled back: "+reason)
+}
+
+func (c *RolloutController) finish(ro *rollout, status, reason string) {
+	// Promoted or rolled back, the weights must survive a restart
+	if c.store != nil {
+		if err := c.store.SaveRoutes(c.proxy.GetRoutes()); err != nil {
+			fmt.Printf("⚠️ Failed to persist routes: %v\n", err)
+		}
+	}
+	progress := 100
+	if status != "active" {
+		c.mu.Lock()
+		progress = ro.deployment.Progress
+		c.mu.Unlock()
+	}
+	c.report(ro, status, progress, reason)
+	ro.cancel()
+}
+
+// report records progress and broadcasts it over the deployment channel
+func (c *RolloutController) report(ro *rollout, status string, progress int, reason string) {
+	c.mu.Lock()
+	ro.deployment.Status = status
+	ro.deployment.Progress = progress
+	if reason != "" {
+		ro.deployment.Errors = append(ro.deployment.Errors, reason)
+	}
+	d := ro.deployment
+	d.Errors = append([]string(nil), ro.deployment.Errors...)
+	c.mu.Unlock()
+
+	if c.deploymentChan != nil {
+		select {
+		case c.deploymentChan <- d:
+		default:
+			// Channel full, drop event
+		}
+	}
+}
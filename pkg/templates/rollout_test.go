@@ -0,0 +1,158 @@
+package templates
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arunsoman/GhostPlane/pkg/db"
+	"github.com/arunsoman/GhostPlane/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRolloutProxy routes /app to a stable and a canary server split 100/0
+func newRolloutProxy(t *testing.T, canaryStatus int) *proxy.Proxy {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(stable.Close)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(canaryStatus)
+	}))
+	t.Cleanup(canary.Close)
+
+	p, err := proxy.New([]string{})
+	require.NoError(t, err)
+	require.NoError(t, p.UpdateRoutes([]proxy.ConfigRoute{{
+		Path:    "/app",
+		Targets: []string{stable.URL},
+		TrafficSplit: &proxy.TrafficSplitConfig{Splits: []proxy.TrafficSplit{
+			{Name: "stable", Weight: 100},
+			{Name: "canary", Weight: 0, Targets: []string{canary.URL}},
+		}},
+	}}))
+	return p
+}
+
+// driveTraffic sends requests through the proxy until ctx is done
+func driveTraffic(ctx context.Context, p *proxy.Proxy) {
+	for ctx.Err() == nil {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/app", nil))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// awaitFinal collects progress events until the rollout leaves "deploying"
+func awaitFinal(t *testing.T, events <-chan Deployment) (Deployment, []int) {
+	var progress []int
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case d := <-events:
+			progress = append(progress, d.Progress)
+			if d.Status != "deploying" {
+				return d, progress
+			}
+		case <-timeout:
+			t.Fatal("rollout did not finish")
+		}
+	}
+}
+
+func TestRollout_Promotes(t *testing.T) {
+	p := newRolloutProxy(t, http.StatusOK)
+	store, err := db.NewStore(filepath.Join(t.TempDir(), "nlb.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	events := make(chan Deployment, 20)
+	c := NewRolloutController(p, store, events)
+	c.stepUnit = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go driveTraffic(ctx, p)
+
+	_, err = c.Start(RolloutConfig{Route: "/app", Steps: []int{25, 50, 100}, StepDuration: 2, MaxErrorRate: 0.05, MinRequests: 5})
+	require.NoError(t, err)
+
+	final, progress := awaitFinal(t, events)
+	assert.Equal(t, "active", final.Status)
+	assert.Equal(t, 100, final.Progress)
+	assert.Equal(t, []int{0, 33, 66, 100}, progress)
+
+	split := p.GetRoutes()[0].TrafficSplit
+	assert.Equal(t, 0, split.Splits[0].Weight)
+	assert.Equal(t, 100, split.Splits[1].Weight)
+
+	// The promoted weights are what a restart loads
+	saved, err := store.LoadRoutes()
+	require.NoError(t, err)
+	var routes []proxy.ConfigRoute
+	require.NoError(t, json.Unmarshal([]byte(saved), &routes))
+	require.Len(t, routes, 1)
+	assert.Equal(t, 100, routes[0].TrafficSplit.Splits[1].Weight)
+}
+
+func TestRollout_RollsBackOnErrors(t *testing.T) {
+	p := newRolloutProxy(t, http.StatusInternalServerError)
+	events := make(chan Deployment, 20)
+	c := NewRolloutController(p, nil, events)
+	c.stepUnit = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go driveTraffic(ctx, p)
+
+	_, err := c.Start(RolloutConfig{Route: "/app", Steps: []int{50, 100}, StepDuration: 2, MaxErrorRate: 0.05, MinRequests: 5})
+	require.NoError(t, err)
+
+	final, _ := awaitFinal(t, events)
+	assert.Equal(t, "failed", final.Status)
+	require.Len(t, final.Errors, 1)
+	assert.Contains(t, final.Errors[0], "error rate")
+
+	split := p.GetRoutes()[0].TrafficSplit
+	assert.Equal(t, 100, split.Splits[0].Weight)
+	assert.Equal(t, 0, split.Splits[1].Weight)
+}
+
+func TestRollout_RollsBackWithoutTraffic(t *testing.T) {
+	p := newRolloutProxy(t, http.StatusOK)
+	events := make(chan Deployment, 20)
+	c := NewRolloutController(p, nil, events)
+	c.stepUnit = 50 * time.Millisecond
+
+	_, err := c.Start(RolloutConfig{Route: "/app", Steps: []int{50, 100}, StepDuration: 1, MaxStepDuration: 3, MinRequests: 5})
+	require.NoError(t, err)
+
+	final, _ := awaitFinal(t, events)
+	assert.Equal(t, "failed", final.Status)
+	require.Len(t, final.Errors, 1)
+	assert.Contains(t, final.Errors[0], "canary requests")
+	assert.Equal(t, 100, p.GetRoutes()[0].TrafficSplit.Splits[0].Weight)
+}
+
+func TestRollout_Validation(t *testing.T) {
+	p := newRolloutProxy(t, http.StatusOK)
+	c := NewRolloutController(p, nil, nil)
+
+	_, err := c.Start(RolloutConfig{Route: "/app", StepDuration: 1})
+	assert.Error(t, err, "steps are required")
+	_, err = c.Start(RolloutConfig{Route: "/app", Steps: []int{50, 25}, StepDuration: 1})
+	assert.Error(t, err, "steps must increase")
+	_, err = c.Start(RolloutConfig{Route: "/app", Steps: []int{0, 50}, StepDuration: 1})
+	assert.Error(t, err, "a 0% step can never be judged")
+	_, err = c.Start(RolloutConfig{Route: "/app", Steps: []int{50}, StepDuration: 2, MaxStepDuration: 1})
+	assert.Error(t, err, "max_step_duration must cover a step")
+	_, err = c.Start(RolloutConfig{Route: "/missing", Steps: []int{50}, StepDuration: 1})
+	assert.Error(t, err, "route must have a traffic split")
+
+	d, err := c.Start(RolloutConfig{Route: "/app", Steps: []int{50}, StepDuration: 60})
+	require.NoError(t, err)
+	_, err = c.Start(RolloutConfig{Route: "/app", Steps: []int{50}, StepDuration: 60})
+	assert.Error(t, err, "only one rollout per route")
+	require.NoError(t, c.Abort(d.ID))
+}
@@ -0,0 +1,248 @@
+// Package upgrade hands listening sockets to a newly exec'd copy of the
+// process, so the binary can be replaced without refusing connections.
+//
+// The running process calls Upgrade, which starts the successor with every
+// listener as an inherited file descriptor. The successor rebuilds its
+// listeners from them with Listen and calls Ready once it is serving; only
+// then does Upgrade return and the old process drain and exit. If the
+// successor fails to start, the old process keeps serving.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment variables describing inherited descriptors
+const (
+	envListeners = "GHOSTPLANE_LISTEN_FDS" // name=fd pairs, comma separated
+	envReady     = "GHOSTPLANE_READY_FD"
+)
+
+// dupFile duplicates a socket for a child. Unlike the listeners' File
+// method, the copy stays non-blocking when exec reads its descriptor, which
+// would otherwise stall the accept loop we keep running until the handoff.
+func dupFile(name string, conn syscall.Conn) (*os.File, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var fd int
+	var dupErr error
+	if err := raw.Control(func(s uintptr) { fd, dupErr = syscall.Dup(int(s)) }); err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, dupErr
+	}
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// Upgrader tracks the process's listeners and performs upgrades
+type Upgrader struct {
+	// Path and Args start the successor; they default to this binary and its arguments
+	Path string
+	Args []string
+	// ReadyTimeout bounds how long the successor may take to call Ready, 30s by default
+	ReadyTimeout time.Duration
+
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	listeners map[string]syscall.Conn
+	ready     *os.File
+}
+
+// New picks up descriptors passed by a predecessor, if any
+func New() *Upgrader {
+	u := &Upgrader{
+		inherited: make(map[string]*os.File),
+		listeners: make(map[string]syscall.Conn),
+	}
+	for _, pair := range strings.Split(os.Getenv(envListeners), ",") {
+		name, fd, ok := strings.Cut(pair, "=")
+		if n, err := strconv.Atoi(fd); ok && err == nil {
+			u.inherited[name] = os.NewFile(uintptr(n), name)
+		}
+	}
+	if n, err := strconv.Atoi(os.Getenv(envReady)); err == nil {
+		u.ready = os.NewFile(uintptr(n), "ready")
+	}
+	// Not for our own children
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReady)
+	return u
+}
+
+// Inherited reports whether this process was started by an upgrade
+func (u *Upgrader) Inherited() bool {
+	return u.ready != nil
+}
+
+// Listen returns the inherited listener called name, or opens a new one
+func (u *Upgrader) Listen(name, network, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var ln net.Listener
+	var err error
+	if f, ok := u.inherited[name]; ok {
+		delete(u.inherited, name)
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := ln.(syscall.Conn); ok {
+		u.listeners[name] = f
+	}
+	return ln, nil
+}
+
+// ListenPacket is Listen for datagram sockets such as the HTTP/3 listener
+func (u *Upgrader) ListenPacket(name, network, addr string) (net.PacketConn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var conn net.PacketConn
+	var err error
+	if f, ok := u.inherited[name]; ok {
+		delete(u.inherited, name)
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := conn.(syscall.Conn); ok {
+		u.listeners[name] = f
+	}
+	return conn, nil
+}
+
+// Ready tells the predecessor this process is serving, so it can drain and exit
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// Descriptors the new configuration no longer listens on
+	for name, f := range u.inherited {
+		f.Close()
+		delete(u.inherited, name)
+	}
+	if u.ready == nil {
+		return nil
+	}
+	_, err := u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+	return err
+}
+
+// Upgrade starts the successor with this process's listeners and waits for
+// it to become ready. On error the successor has been stopped and this
+// process should carry on serving.
+func (u *Upgrader) Upgrade() (*os.Process, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	path, args := u.Path, u.Args
+	if path == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("locating executable: %w", err)
+		}
+		path, args = exe, os.Args
+	}
+	timeout := u.ReadyTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	names := make([]string, 0, len(u.listeners))
+	for name := range u.listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// ExtraFiles become descriptors 3, 4, ... in the child
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var pairs []string
+	for _, name := range names {
+		f, err := dupFile(name, u.listeners[name])
+		if errors.Is(err, net.ErrClosed) {
+			// Closed since, e.g. a proxy that was removed or rebound
+			delete(u.listeners, name)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("duplicating listener %s: %w", name, err)
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, 3+len(files)))
+		files = append(files, f)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	readyFD := 3 + len(files)
+	files = append(files, readyW)
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envListeners+"=") && !strings.HasPrefix(kv, envReady+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, envListeners+"="+strings.Join(pairs, ","), envReady+"="+strconv.Itoa(readyFD))
+
+	cmd := exec.Command(path)
+	if len(args) > 0 {
+		cmd.Args = append([]string{path}, args[1:]...)
+	}
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting successor: %w", err)
+	}
+	// Only the child holds the write end now, so its exit shows up as EOF
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err == nil {
+			return cmd.Process, nil
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("successor exited before becoming ready")
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("successor not ready after %s", timeout)
+	}
+}
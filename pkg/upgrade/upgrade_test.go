@@ -0,0 +1,106 @@
+package upgrade
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestHelperSuccessor is the process started by TestUpgrade, not a test itself
+func TestHelperSuccessor(t *testing.T) {
+	if os.Getenv("GHOSTPLANE_TEST_SUCCESSOR") != "1" {
+		t.Skip("helper process")
+	}
+	u := New()
+	if !u.Inherited() {
+		os.Exit(2)
+	}
+	ln, err := u.Listen("http", "tcp", "127.0.0.1:0")
+	if err != nil {
+		os.Exit(3)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "successor")
+	}))
+	u.Ready()
+	time.Sleep(10 * time.Second)
+	os.Exit(0)
+}
+
+func get(t *testing.T, addr string) string {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 2 * time.Second}
+	res, err := client.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestUpgrade(t *testing.T) {
+	u := New()
+	if u.Inherited() {
+		t.Fatal("Expected a fresh process")
+	}
+	ln, err := u.Listen("http", "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "predecessor")
+	})}
+	go server.Serve(ln)
+	addr := ln.Addr().String()
+	if got := get(t, addr); got != "predecessor" {
+		t.Fatalf("Unexpected response %q", got)
+	}
+
+	// A successor that exits without calling Ready aborts the upgrade
+	u.Path, u.Args = os.Args[0], []string{os.Args[0], "-test.run=^$"}
+	if _, err := u.Upgrade(); err == nil {
+		t.Fatal("Expected the upgrade to fail")
+	}
+	if got := get(t, addr); got != "predecessor" {
+		t.Fatalf("Expected to keep serving after a failed upgrade, got %q", got)
+	}
+
+	t.Setenv("GHOSTPLANE_TEST_SUCCESSOR", "1")
+	u.Args = []string{os.Args[0], "-test.run=^TestHelperSuccessor$"}
+	u.ReadyTimeout = 10 * time.Second
+	proc, err := u.Upgrade()
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	defer proc.Kill()
+
+	// Once the old process stops accepting, the same address is served by the successor
+	server.Close()
+	if got := get(t, addr); got != "successor" {
+		t.Errorf("Expected the successor on the inherited socket, got %q", got)
+	}
+}
+
+func TestListenFallback(t *testing.T) {
+	u := New()
+	ln, err := u.Listen("unknown", "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	conn, err := u.ListenPacket("udp", "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := ln.(*net.TCPListener); !ok {
+		t.Errorf("Expected a fresh TCP listener, got %T", ln)
+	}
+	if err := u.Ready(); err != nil {
+		t.Errorf("Ready without a predecessor should be a no-op: %v", err)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,7 +15,7 @@ import (
 
 var (
 	targetURL   = flag.String("url", "http://localhost:8080/api/v1/test", "Proxy URL to test")
-	metricsURL  = flag.String("metrics", "http://localhost:8081/api/v1/metrics", "Metrics API URL")
+	metricsURL  = flag.String("metrics", "http://localhost:8081/metrics", "Prometheus metrics URL")
 	duration    = flag.Duration("duration", 6*time.Minute, "Duration of the test")
 	concurrency = flag.Int("c", 10, "Number of concurrent workers")
 	adminToken  = flag.String("token", "", "Bearer token for metrics API")
@@ -122,11 +124,37 @@ func fetchMetrics(url, token string) {
 		return
 	}
 
-	var data map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		fmt.Printf("Metrics JSON Error: %v\n", err)
-		return
+	// Sum the families we report from the text exposition
+	var active, total float64
+	byClass := map[string]float64{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.LastIndexByte(line, ' ')
+		if sep < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[sep+1:], 64)
+		if err != nil {
+			continue
+		}
+		name := line[:sep]
+		switch {
+		case name == "ghostplane_active_connections":
+			active = value
+		case name == "ghostplane_requests_total":
+			total = value
+		case strings.HasPrefix(name, "ghostplane_http_requests_total{"):
+			if i := strings.Index(name, `code_class="`); i >= 0 {
+				class := name[i+len(`code_class="`):]
+				byClass[class[:strings.IndexByte(class, '"')]] += value
+			}
+		}
 	}
 
-	fmt.Printf("System Metrics: Active Conns: %v, Total Reqs: %v\n", data["active_connections"], data["total_requests"])
+	fmt.Printf("System Metrics: Active Conns: %v, Total Reqs: %v, By Status: 2xx=%v 4xx=%v 5xx=%v\n",
+		active, total, byClass["2xx"], byClass["4xx"], byClass["5xx"])
 }